@@ -0,0 +1,134 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package copyist
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"strings"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// Transformer types a function that replaces a value returned by the database
+// with another value, such as a fake value that does not reveal the original.
+type Transformer func(val driver.Value) driver.Value
+
+// transformers maps the names of result columns to the transformers set by
+// SetTransformer.
+var transformers map[string]Transformer
+
+// SetTransformer sets the transformer that replaces the values of result
+// columns having the given name when they are recorded, in order to remove
+// real data from recordings. Values are returned to the application as-is when
+// recording, but the recording stores the transformed values, which are
+// returned instead during playback. For example:
+//
+//	copyist.SetTransformer("name", copyist.FakeName)
+//	copyist.SetTransformer("email", copyist.FakeEmail)
+//
+// The built-in FakeName, FakeEmail and FakeToken transformers are
+// deterministic: they replace equal values with equal fake values, keyed by a
+// hash of the original value. This preserves referential consistency across
+// rows and tables, so that joins and lookups made by the application during
+// playback behave as they did when recording. Calling SetTransformer with a
+// nil transformer stops transforming the column.
+func SetTransformer(column string, transformer Transformer) {
+	if transformer == nil {
+		delete(transformers, column)
+		return
+	}
+	if transformers == nil {
+		transformers = make(map[string]Transformer)
+	}
+	transformers[column] = transformer
+}
+
+// columnTransformers returns the transformer of each of the given columns, or
+// nil if none of the columns are transformed.
+func columnTransformers(cols []string) []Transformer {
+	var result []Transformer
+	for i, col := range cols {
+		if transformer, ok := transformers[col]; ok {
+			if result == nil {
+				result = make([]Transformer, len(cols))
+			}
+			result[i] = transformer
+		}
+	}
+	return result
+}
+
+// firstNames and lastNames are the names from which fake names are made.
+var firstNames = []string{
+	"Alice", "Bob", "Carol", "David", "Erin", "Frank", "Grace", "Heidi",
+	"Ivan", "Judy", "Karl", "Laura", "Mallory", "Nina", "Oscar", "Peggy",
+	"Quinn", "Rupert", "Sybil", "Trent", "Uma", "Victor", "Wendy", "Xavier",
+	"Yvonne", "Zach",
+}
+var lastNames = []string{
+	"Adams", "Baker", "Clark", "Davis", "Evans", "Fisher", "Garcia", "Harris",
+	"Irwin", "Jones", "King", "Lewis", "Moore", "Nelson", "Owens", "Parker",
+	"Quincy", "Roberts", "Smith", "Turner", "Underwood", "Vance", "Walker",
+	"Young", "Zimmerman",
+}
+
+// FakeName is a Transformer that replaces string values with fake names, like
+// "Grace Parker". Equal values are always replaced by equal names, although
+// different values may also be replaced by the same name.
+func FakeName(val driver.Value) driver.Value {
+	return fakeValue(val, func(hash uint64) string {
+		first := firstNames[hash%uint64(len(firstNames))]
+		last := lastNames[(hash>>32)%uint64(len(lastNames))]
+		return first + " " + last
+	})
+}
+
+// FakeEmail is a Transformer that replaces string values with fake email
+// addresses in the example.com domain, like "grace.parker.42@example.com".
+// Equal values are always replaced by equal addresses, and different values
+// are replaced by different addresses, except in the rare event of a hash
+// collision.
+func FakeEmail(val driver.Value) driver.Value {
+	return fakeValue(val, func(hash uint64) string {
+		first := firstNames[hash%uint64(len(firstNames))]
+		last := lastNames[(hash>>32)%uint64(len(lastNames))]
+		return fmt.Sprintf("%s.%s.%d@example.com",
+			strings.ToLower(first), strings.ToLower(last), hash>>48)
+	})
+}
+
+// FakeToken is a Transformer that replaces string values, like passwords or
+// API tokens, with fake tokens, like "anon-1f2e3d4c5b6a7980". Equal values are
+// always replaced by equal tokens, and different values are replaced by
+// different tokens, except in the rare event of a hash collision.
+func FakeToken(val driver.Value) driver.Value {
+	return fakeValue(val, func(hash uint64) string {
+		return fmt.Sprintf("anon-%016x", hash)
+	})
+}
+
+// fakeValue replaces the given string or byte slice value with the fake value
+// that the given function returns for its hash. Values of other types,
+// including nil, are returned as-is.
+func fakeValue(val driver.Value, fake func(hash uint64) string) driver.Value {
+	switch t := val.(type) {
+	case string:
+		return fake(xxhash.Sum64String(t))
+	case []byte:
+		return []byte(fake(xxhash.Sum64(t)))
+	}
+	return val
+}
@@ -0,0 +1,70 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package copyist
+
+import (
+	"database/sql/driver"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestFakeTransformers tests that the built-in transformers replace equal
+// values with equal fake values.
+func TestFakeTransformers(t *testing.T) {
+	for _, transform := range []Transformer{FakeName, FakeEmail, FakeToken} {
+		fake := transform("andy@cockroachlabs.com")
+		require.IsType(t, "", fake)
+		require.NotEqual(t, "andy@cockroachlabs.com", fake)
+		require.Equal(t, fake, transform("andy@cockroachlabs.com"))
+		require.Equal(t, []byte(fake.(string)), transform([]byte("andy@cockroachlabs.com")))
+		require.NotEqual(t, fake, transform("bob@cockroachlabs.com"))
+
+		require.Nil(t, transform(nil))
+		require.Equal(t, int64(1), transform(int64(1)))
+	}
+
+	require.True(t, strings.HasSuffix(FakeEmail("andy").(string), "@example.com"))
+	require.True(t, strings.HasPrefix(FakeToken("hunter2").(string), "anon-"))
+	require.Len(t, strings.Fields(FakeName("Andy Kimball").(string)), 2)
+}
+
+// TestSetTransformer tests that the values of transformed columns are returned
+// as-is when recording, but are transformed in the recording.
+func TestSetTransformer(t *testing.T) {
+	SetTransformer("email", FakeEmail)
+	defer SetTransformer("email", nil)
+
+	s := newSession(&memorySource{}, "TestSetTransformer")
+	c := &proxyConn{driver: &proxyDriver{driverName: "fake"}, session: s}
+
+	*recordFlag = true
+	visitedRecording = true
+	defer func() { *recordFlag = false }()
+
+	rows := &proxyRows{conn: c, rows: &fakeRows{
+		cols: []string{"id", "email"},
+		rows: [][]driver.Value{{int64(1), "andy@cockroachlabs.com"}, {int64(2), nil}},
+	}}
+	dest := make([]driver.Value, 2)
+	require.NoError(t, rows.Next(dest))
+	require.Equal(t, []driver.Value{int64(1), "andy@cockroachlabs.com"}, dest)
+	require.NoError(t, rows.Next(dest))
+
+	require.Len(t, s.recording, 2)
+	require.Equal(t, []driver.Value{int64(1), FakeEmail("andy@cockroachlabs.com")}, s.recording[0].Args[0])
+	require.Equal(t, []driver.Value{int64(2), nil}, s.recording[1].Args[0])
+}
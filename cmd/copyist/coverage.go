@@ -0,0 +1,261 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var coverageCommand = &command{
+	name:  "coverage",
+	usage: "[-recordings paths] [source directories]",
+	short: "report SQL statements in source code that no recording executes",
+	run:   runCoverage,
+}
+
+// sourceQuery is a SQL statement that appears as a string literal in source
+// code.
+type sourceQuery struct {
+	pos   token.Position
+	query string
+}
+
+// runCoverage extracts the SQL statements that appear as string literals in the
+// Go source files in the given directories, and reports those that are not
+// executed by any recording, in the same way that code coverage reports lines
+// that are not executed by any test. This includes the queries generated by
+// sqlc. Directories are searched recursively if they end in "/...". Test files
+// are ignored. The recordings are searched for in the source directories,
+// unless the -recordings flag gives other paths to search. It fails if any
+// statement is not covered, so that it can be used as a CI gate.
+func runCoverage(cmd *command, args []string) error {
+	fs := newFlagSet(cmd)
+	recordingPaths := fs.String("recordings", "",
+		"comma-separated list of recording files or directories (default: the source directories)")
+	fs.Parse(args)
+
+	dirs := fs.Args()
+	if len(dirs) == 0 {
+		dirs = []string{"."}
+	}
+	queries, err := findSourceQueries(dirs)
+	if err != nil {
+		return err
+	}
+
+	paths := dirs
+	if *recordingPaths != "" {
+		paths = strings.Split(*recordingPaths, ",")
+	}
+	files, err := findRecordingFiles(paths)
+	if err != nil {
+		return err
+	}
+	recorded, err := recordedQueries(files)
+	if err != nil {
+		return err
+	}
+
+	uncovered := writeUncoveredQueries(os.Stdout, queries, recorded)
+	if uncovered != 0 {
+		return fmt.Errorf("%d of %d statement(s) have no recorded coverage", uncovered, len(queries))
+	}
+	return nil
+}
+
+// writeUncoveredQueries writes each of the given source queries that is not in
+// the given set of recorded queries, and returns the number written.
+func writeUncoveredQueries(w io.Writer, queries []sourceQuery, recorded map[string]bool) int {
+	uncovered := 0
+	for _, q := range queries {
+		key := coverageKey(q.query)
+		if recorded[key] {
+			continue
+		}
+		fmt.Fprintf(w, "%s:%d: %s\n", q.pos.Filename, q.pos.Line, key)
+		uncovered++
+	}
+	return uncovered
+}
+
+// recordedQueries returns the set of SQL statements that are executed or
+// prepared by the recordings in the given files, normalized by coverageKey.
+func recordedQueries(files []string) (map[string]bool, error) {
+	queries := make(map[string]bool)
+	for _, fileName := range files {
+		file, err := readRecordingFile(fileName)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", fileName, err)
+		}
+		for _, name := range file.RecordingNames() {
+			records, err := file.Recording(name)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", fileName, err)
+			}
+			for _, rec := range records {
+				if query, ok := queryText(rec); ok {
+					queries[coverageKey(query)] = true
+				}
+			}
+		}
+	}
+	return queries, nil
+}
+
+// findSourceQueries returns the SQL statements in the non-test Go source files
+// in the given directories, in order of their position.
+func findSourceQueries(dirs []string) ([]sourceQuery, error) {
+	var queries []sourceQuery
+	fset := token.NewFileSet()
+	for _, dir := range dirs {
+		recursive := dir == "..." || strings.HasSuffix(dir, "/...")
+		if dir == "..." {
+			dir = "."
+		}
+		dir = strings.TrimSuffix(dir, "/...")
+
+		err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				if path != dir && (!recursive || d.Name() == "testdata" || d.Name() == "vendor") {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !strings.HasSuffix(path, ".go") || strings.HasSuffix(path, "_test.go") {
+				return nil
+			}
+
+			file, err := parser.ParseFile(fset, path, nil, 0)
+			if err != nil {
+				return err
+			}
+			queries = append(queries, fileQueries(fset, file)...)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.SliceStable(queries, func(i, j int) bool {
+		if queries[i].pos.Filename != queries[j].pos.Filename {
+			return queries[i].pos.Filename < queries[j].pos.Filename
+		}
+		return queries[i].pos.Offset < queries[j].pos.Offset
+	})
+	return queries, nil
+}
+
+// fileQueries returns the SQL statements in the given parsed Go source file.
+// Concatenations of string literals are treated as a single string, and
+// concatenations with other expressions are ignored.
+func fileQueries(fset *token.FileSet, file *ast.File) []sourceQuery {
+	var queries []sourceQuery
+	ast.Inspect(file, func(n ast.Node) bool {
+		switch n.(type) {
+		case *ast.BasicLit, *ast.BinaryExpr:
+			s, ok := constantString(n.(ast.Expr))
+			if !ok {
+				// Statements that are concatenated with variables are built
+				// dynamically, so they cannot be compared with recordings.
+				return false
+			}
+			if query, ok := sqlStatement(s); ok {
+				queries = append(queries, sourceQuery{pos: fset.Position(n.Pos()), query: query})
+			}
+			return false
+		}
+		return true
+	})
+	return queries
+}
+
+// constantString returns the value of the given expression, if it is a string
+// literal or a concatenation of string literals.
+func constantString(expr ast.Expr) (string, bool) {
+	switch t := expr.(type) {
+	case *ast.BasicLit:
+		if t.Kind != token.STRING {
+			return "", false
+		}
+		s, err := strconv.Unquote(t.Value)
+		return s, err == nil
+	case *ast.ParenExpr:
+		return constantString(t.X)
+	case *ast.BinaryExpr:
+		if t.Op != token.ADD {
+			return "", false
+		}
+		x, ok := constantString(t.X)
+		if !ok {
+			return "", false
+		}
+		y, ok := constantString(t.Y)
+		return x + y, ok
+	}
+	return "", false
+}
+
+// sqlVerbs are the first words of the SQL statements that are extracted from
+// source code.
+var sqlVerbs = map[string]bool{
+	"SELECT": true, "INSERT": true, "UPDATE": true, "DELETE": true, "UPSERT": true,
+	"WITH": true, "CREATE": true, "ALTER": true, "DROP": true, "TRUNCATE": true,
+}
+
+// sqlStatement returns the given string, if it is a SQL statement.
+func sqlStatement(s string) (string, bool) {
+	fields := strings.Fields(stripComments(s))
+	if len(fields) < 2 || !sqlVerbs[strings.ToUpper(fields[0])] {
+		return "", false
+	}
+	return s, true
+}
+
+// coverageKey returns the form of the given SQL statement that is compared
+// between source code and recordings. Leading SQL comment lines are removed,
+// like the "-- name: GetAuthor :one" comments that sqlc adds to the queries
+// that it generates, and whitespace is normalized.
+func coverageKey(query string) string {
+	return normalizeQuery(stripComments(query))
+}
+
+// stripComments returns the given SQL text without any leading comment lines.
+func stripComments(s string) string {
+	for {
+		s = strings.TrimSpace(s)
+		if !strings.HasPrefix(s, "--") {
+			return s
+		}
+		end := strings.IndexByte(s, '\n')
+		if end == -1 {
+			return ""
+		}
+		s = s[end+1:]
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCoverage(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "testdata"), 0777))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "store.go"), []byte(`package store
+
+const getAuthor = `+"`"+`-- name: GetAuthor :one
+SELECT id, name FROM authors
+WHERE id = $1 LIMIT 1
+`+"`"+`
+
+func queries(table string) []string {
+	return []string{
+		"DELETE FROM customers",
+		"UPDATE customers " +
+			"SET name=$1",
+		"SELECT name FROM " + table,
+		"selected: %d",
+		"INSERT INTO orders VALUES ($1)",
+	}
+}
+`), 0666))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "store_test.go"), []byte(`package store
+
+const testQuery = "SELECT 1 FROM tests"
+`), 0666))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "testdata", "store_test.copyist"), []byte(`
+1=DriverOpen	1:nil
+2=ConnQuery	2:"-- name: GetAuthor :one\nSELECT id, name FROM authors\nWHERE id = $1 LIMIT 1\n"	1:nil
+3=ConnExec	2:"UPDATE customers SET name=$1"	1:nil
+4=ConnPrepare	2:"DELETE FROM customers;"	1:nil
+
+"TestStore"=1,2,3,4
+`), 0666))
+
+	queries, err := findSourceQueries([]string{dir})
+	require.NoError(t, err)
+	require.Len(t, queries, 4)
+
+	files, err := findRecordingFiles([]string{dir})
+	require.NoError(t, err)
+	recorded, err := recordedQueries(files)
+	require.NoError(t, err)
+
+	var buf strings.Builder
+	require.Equal(t, 1, writeUncoveredQueries(&buf, queries, recorded))
+	require.Equal(t, filepath.Join(dir, "store.go")+":15: INSERT INTO orders VALUES ($1)\n", buf.String())
+}
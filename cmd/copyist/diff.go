@@ -0,0 +1,164 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"github.com/cockroachdb/copyist"
+	"github.com/cockroachdb/copyist/internal/linediff"
+)
+
+var diffCommand = &command{
+	name:  "diff",
+	usage: "[-r recording] old new",
+	short: "show added, removed and changed driver calls between recording files",
+	run:   runDiff,
+}
+
+// errRecordingsDiffer is returned by the diff command when there are
+// differences, so that it exits with a non-zero status like diff(1).
+var errRecordingsDiffer = errors.New("recordings differ")
+
+// runDiff compares two recording files at the record level. Either file can
+// be given as "<revision>:<path>", in which case it is read from git.
+func runDiff(cmd *command, args []string) error {
+	fs := newFlagSet(cmd)
+	only := fs.String("r", "", "only compare the recording with this name")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	oldFile, err := readRecordingFileOrRevision(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("%s: %v", fs.Arg(0), err)
+	}
+	newFile, err := readRecordingFileOrRevision(fs.Arg(1))
+	if err != nil {
+		return fmt.Errorf("%s: %v", fs.Arg(1), err)
+	}
+
+	differ, err := diffRecordingFiles(oldFile, newFile, *only, os.Stdout)
+	if err != nil {
+		return err
+	}
+	if differ {
+		return errRecordingsDiffer
+	}
+	return nil
+}
+
+// readRecordingFileOrRevision reads the recording file at the given path. If
+// the path does not exist and is of the form "<revision>:<path>", then the file
+// is read from that git revision instead.
+func readRecordingFileOrRevision(pathName string) (*copyist.RecordingFile, error) {
+	if _, err := os.Stat(pathName); err == nil || !strings.Contains(pathName, ":") {
+		return readRecordingFile(pathName)
+	}
+
+	data, err := exec.Command("git", "show", pathName).Output()
+	if err != nil {
+		return nil, fmt.Errorf("git show failed: %v", err)
+	}
+	return copyist.ReadRecordingFile(copyist.NewMemorySource(data))
+}
+
+// diffRecordingFiles writes the differences between the recordings in the old
+// and new files to the given writer, and returns true if there are any. If
+// only is not empty, then only the recording with that name is compared.
+func diffRecordingFiles(
+	oldFile, newFile *copyist.RecordingFile, only string, w io.Writer,
+) (bool, error) {
+	oldNames := make(map[string]bool)
+	for _, name := range oldFile.RecordingNames() {
+		oldNames[name] = true
+	}
+	newNames := make(map[string]bool)
+	for _, name := range newFile.RecordingNames() {
+		newNames[name] = true
+	}
+
+	// Merge the sorted recording names from both files.
+	var names []string
+	for _, name := range oldFile.RecordingNames() {
+		if only == "" || name == only {
+			names = append(names, name)
+		}
+	}
+	for _, name := range newFile.RecordingNames() {
+		if !oldNames[name] && (only == "" || name == only) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	differ := false
+	for _, name := range names {
+		var oldRecords, newRecords []string
+		if oldNames[name] {
+			var err error
+			if oldRecords, err = oldFile.RecordingLines(name); err != nil {
+				return false, err
+			}
+		}
+		if newNames[name] {
+			var err error
+			if newRecords, err = newFile.RecordingLines(name); err != nil {
+				return false, err
+			}
+		}
+
+		switch {
+		case !oldNames[name]:
+			fmt.Fprintf(w, "added %q (%d records)\n", name, len(newRecords))
+		case !newNames[name]:
+			fmt.Fprintf(w, "removed %q (%d records)\n", name, len(oldRecords))
+		default:
+			lines := linediff.Lines(oldRecords, newRecords)
+			changed := false
+			for _, line := range lines {
+				if line.Op != linediff.Equal {
+					changed = true
+					break
+				}
+			}
+			if !changed {
+				continue
+			}
+			fmt.Fprintf(w, "changed %q\n", name)
+			for i, line := range lines {
+				// Only print unchanged lines that are next to a change.
+				if line.Op == linediff.Equal {
+					nearChange := (i > 0 && lines[i-1].Op != linediff.Equal) ||
+						(i < len(lines)-1 && lines[i+1].Op != linediff.Equal)
+					if !nearChange {
+						continue
+					}
+				}
+				fmt.Fprintf(w, "  %c %s\n", line.Op, line.Text)
+			}
+		}
+		differ = true
+	}
+	return differ, nil
+}
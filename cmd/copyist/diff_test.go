@@ -0,0 +1,62 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/cockroachdb/copyist"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiff(t *testing.T) {
+	oldFile, err := readRecordingFile(writeTestRecording(t))
+	require.NoError(t, err)
+
+	// Renumber the records, change a row, and add/remove recordings.
+	newFile, err := copyist.ReadRecordingFile(copyist.NewMemorySource([]byte(`
+1=RowsNext	11:[]	7:"EOF"
+2=RowsColumns	9:["name"]
+3=ConnQuery	2:"SELECT name FROM customers WHERE id=$1"	1:nil
+4=DriverOpen	1:nil
+5=RowsNext	11:[2:"Jay"]	1:nil
+
+"TestQuery"=4,3,2,5,1
+"TestQuery/subtest"=4,3,2,1
+"TestAdded"=4
+`)))
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	differ, err := diffRecordingFiles(oldFile, newFile, "", &out)
+	require.NoError(t, err)
+	require.True(t, differ)
+	require.Equal(t, `added "TestAdded" (1 records)
+changed "TestQuery"
+    RowsColumns	9:["name"]
+  - RowsNext	11:[2:"Andy"]	1:nil
+  + RowsNext	11:[2:"Jay"]	1:nil
+    RowsNext	11:[]	7:"EOF"
+removed "TestRenamed" (2 records)
+`, out.String())
+
+	// Only compare one recording.
+	out.Reset()
+	differ, err = diffRecordingFiles(oldFile, newFile, "TestQuery/subtest", &out)
+	require.NoError(t, err)
+	require.False(t, differ)
+	require.Equal(t, "", out.String())
+}
@@ -0,0 +1,111 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+var expireCommand = &command{
+	name:  "expire",
+	usage: "[-max-age duration] [-strict] [files or directories]",
+	short: "list recordings that are older than their maximum age",
+	run:   runExpire,
+}
+
+// expirePolicy determines when recordings are considered to have expired.
+type expirePolicy struct {
+	// maxAge is the maximum age of recordings that do not have their own
+	// maximum age. Zero means that such recordings never expire.
+	maxAge time.Duration
+
+	// strict reports recordings with an unknown creation time as expired.
+	strict bool
+}
+
+// runExpire lists recordings that are older than their maximum age, so that
+// teams can periodically refresh recordings against real databases. It fails
+// if any expired recordings are found, so that it can be used as a CI gate.
+func runExpire(cmd *command, args []string) error {
+	fs := newFlagSet(cmd)
+	var policy expirePolicy
+	fs.DurationVar(&policy.maxAge, "max-age", 0,
+		"maximum age of recordings that were not recorded with their own maximum age")
+	fs.BoolVar(&policy.strict, "strict", false,
+		"report recordings with an unknown creation time as expired")
+	fs.Parse(args)
+
+	files, err := findRecordingFiles(fs.Args())
+	if err != nil {
+		return err
+	}
+
+	expired := 0
+	now := time.Now()
+	for _, fileName := range files {
+		n, err := expireRecordingFile(fileName, policy, now, os.Stdout)
+		if err != nil {
+			return fmt.Errorf("%s: %v", fileName, err)
+		}
+		expired += n
+	}
+	if expired != 0 {
+		return fmt.Errorf("found %d expired recording(s)", expired)
+	}
+	return nil
+}
+
+// expireRecordingFile writes the recordings in the given file that have expired
+// as of the given time to the given writer, and returns the number of expired
+// recordings.
+func expireRecordingFile(
+	fileName string, policy expirePolicy, now time.Time, w io.Writer,
+) (int, error) {
+	file, err := readRecordingFile(fileName)
+	if err != nil {
+		return 0, err
+	}
+
+	expired := 0
+	for _, name := range file.RecordingNames() {
+		created := file.CreatedAt(name)
+		if created.IsZero() {
+			if policy.strict {
+				fmt.Fprintf(w, "%s: recording %q has an unknown creation time\n", fileName, name)
+				expired++
+			}
+			continue
+		}
+
+		maxAge := file.MaxAge(name)
+		if maxAge == 0 {
+			maxAge = policy.maxAge
+		}
+		if maxAge == 0 {
+			continue
+		}
+
+		age := now.Sub(created)
+		if age > maxAge {
+			fmt.Fprintf(w, "%s: recording %q was created %s, %s ago, exceeding %s\n",
+				fileName, name, created.Format(time.RFC3339), age.Round(time.Hour), maxAge)
+			expired++
+		}
+	}
+	return expired, nil
+}
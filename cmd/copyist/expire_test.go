@@ -0,0 +1,60 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpire(t *testing.T) {
+	pathName := filepath.Join(t.TempDir(), "expire.copyist")
+	require.NoError(t, os.WriteFile(pathName, []byte(`1=DriverOpen	1:nil
+
+"TestNew"=1
+"TestNew"@created=2021-06-20T00:00:00Z
+"TestOld"=1
+"TestOld"@created=2021-01-01T00:00:00Z
+"TestOwnMaxAge"=1
+"TestOwnMaxAge"@created=2021-06-20T00:00:00Z
+"TestOwnMaxAge"@max-age=24h0m0s
+"TestUnknown"=1
+`), 0666))
+	now := time.Date(2021, 7, 1, 0, 0, 0, 0, time.UTC)
+
+	// Only recordings with their own maximum age can expire.
+	var out bytes.Buffer
+	expired, err := expireRecordingFile(pathName, expirePolicy{}, now, &out)
+	require.NoError(t, err)
+	require.Equal(t, 1, expired)
+	require.Equal(t, pathName+`: recording "TestOwnMaxAge" was created 2021-06-20T00:00:00Z, 264h0m0s ago, exceeding 24h0m0s
+`, out.String())
+
+	// Apply a policy to the remaining recordings.
+	out.Reset()
+	policy := expirePolicy{maxAge: 30 * 24 * time.Hour, strict: true}
+	expired, err = expireRecordingFile(pathName, policy, now, &out)
+	require.NoError(t, err)
+	require.Equal(t, 3, expired)
+	require.Equal(t, pathName+`: recording "TestOld" was created 2021-01-01T00:00:00Z, 4344h0m0s ago, exceeding 720h0m0s
+`+pathName+`: recording "TestOwnMaxAge" was created 2021-06-20T00:00:00Z, 264h0m0s ago, exceeding 24h0m0s
+`+pathName+`: recording "TestUnknown" has an unknown creation time
+`, out.String())
+}
@@ -0,0 +1,100 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/cockroachdb/copyist"
+)
+
+// recordingExt is the file extension of copyist recording files.
+const recordingExt = ".copyist"
+
+// findRecordingFiles returns the paths of all copyist recording files in the
+// given list of paths. Files are returned as-is, and directories are searched
+// recursively for files with the ".copyist" extension. Go package patterns
+// like "./..." are treated as the directory they are rooted at. If no paths
+// are given, the current directory is searched.
+func findRecordingFiles(paths []string) ([]string, error) {
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+
+	var files []string
+	for _, root := range paths {
+		if root == "..." {
+			root = "."
+		}
+		root = strings.TrimSuffix(root, "/...")
+
+		info, err := os.Stat(root)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, root)
+			continue
+		}
+
+		err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.IsDir() && strings.HasSuffix(path, recordingExt) {
+				files = append(files, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// readRecordingFile reads and parses the copyist recording file at the given
+// path.
+func readRecordingFile(pathName string) (*copyist.RecordingFile, error) {
+	source, err := recordingFileSource(pathName)
+	if err != nil {
+		return nil, err
+	}
+	return copyist.ReadRecordingFile(source)
+}
+
+// recordingFileSource returns the source of the copyist recording file at the
+// given path. If the COPYIST_ENCRYPTION_KEY environment variable is defined,
+// then the file is decrypted when read and encrypted when written, with the
+// base64-encoded key that it contains.
+func recordingFileSource(pathName string) (copyist.Source, error) {
+	source := copyist.NewFileSource(pathName)
+	env := os.Getenv("COPYIST_ENCRYPTION_KEY")
+	if env == "" {
+		return source, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(env)
+	if err != nil {
+		return nil, fmt.Errorf("COPYIST_ENCRYPTION_KEY is not valid base64: %v", err)
+	}
+	return copyist.NewEncryptedSource(source, key)
+}
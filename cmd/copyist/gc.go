@@ -0,0 +1,117 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+
+	"github.com/cockroachdb/copyist"
+)
+
+var gcCommand = &command{
+	name:  "gc",
+	usage: "[-n] [files or directories]",
+	short: "compact recording files by dropping unused and duplicate records",
+	run:   runGC,
+}
+
+// runGC rewrites each recording file in its compact, normalized form.
+func runGC(cmd *command, args []string) error {
+	fs := newFlagSet(cmd)
+	dryRun := fs.Bool("n", false, "report files that would change without rewriting them")
+	fs.Parse(args)
+
+	files, err := findRecordingFiles(fs.Args())
+	if err != nil {
+		return err
+	}
+	for _, fileName := range files {
+		if err := compactRecordingFile(fileName, *dryRun, os.Stdout); err != nil {
+			return fmt.Errorf("%s: %v", fileName, err)
+		}
+	}
+	return nil
+}
+
+// compactRecordingFile rewrites the given recording file so that every record
+// is re-formatted, duplicate records are merged, records that are not used by
+// any recording are dropped, and recordings are written in sorted order. The
+// recordings in the file are verified to be unchanged before it is rewritten.
+func compactRecordingFile(fileName string, dryRun bool, w io.Writer) error {
+	fileSource, err := recordingFileSource(fileName)
+	if err != nil {
+		return err
+	}
+	data, err := fileSource.ReadAll()
+	if err != nil {
+		return err
+	}
+
+	source := copyist.NewMemorySource(data)
+	file, err := copyist.ReadRecordingFile(source)
+	if err != nil {
+		return err
+	}
+	before, err := formatRecordingFile(file)
+	if err != nil {
+		return err
+	}
+
+	// Re-format every record, so that records whose values are formatted
+	// differently but are otherwise equal are merged.
+	for _, name := range file.RecordingNames() {
+		records, err := file.Recording(name)
+		if err != nil {
+			return err
+		}
+		if err := file.SetRecording(name, records); err != nil {
+			return err
+		}
+	}
+	if err := file.Write(); err != nil {
+		return err
+	}
+
+	compacted, err := source.ReadAll()
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(data, compacted) {
+		return nil
+	}
+
+	// Ensure that playback semantics have not changed.
+	file, err = copyist.ReadRecordingFile(copyist.NewMemorySource(compacted))
+	if err != nil {
+		return err
+	}
+	after, err := formatRecordingFile(file)
+	if err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(before, after) {
+		return fmt.Errorf("compaction changed recordings, so file was not rewritten")
+	}
+
+	fmt.Fprintf(w, "%s: %d -> %d bytes\n", fileName, len(data), len(compacted))
+	if dryRun {
+		return nil
+	}
+	return fileSource.WriteAll(compacted)
+}
@@ -0,0 +1,59 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGC(t *testing.T) {
+	// Record 3 is unused, record 4 duplicates record 1 and record 5 formats
+	// the same value as record 2 differently.
+	pathName := filepath.Join(t.TempDir(), "gc.copyist")
+	require.NoError(t, os.WriteFile(pathName, []byte(`1=DriverOpen	1:nil
+2=ConnQuery	2:"SELECT 1"	1:nil
+3=ConnExec	2:"unused"	1:nil
+4=DriverOpen	1:nil
+5=ConnQuery	2:"SELECT \x31"	1:nil
+
+"TestB"=4,5
+"TestA"=1,2
+`), 0666))
+
+	var out bytes.Buffer
+	require.NoError(t, compactRecordingFile(pathName, true /* dryRun */, &out))
+	require.Equal(t, pathName+": 156 -> 75 bytes\n", out.String())
+
+	out.Reset()
+	require.NoError(t, compactRecordingFile(pathName, false /* dryRun */, &out))
+	data, err := os.ReadFile(pathName)
+	require.NoError(t, err)
+	require.Equal(t, `1=DriverOpen	1:nil
+2=ConnQuery	2:"SELECT 1"	1:nil
+
+"TestA"=1,2
+"TestB"=1,2
+`, string(data))
+
+	// Compacting again is a no-op.
+	out.Reset()
+	require.NoError(t, compactRecordingFile(pathName, false /* dryRun */, &out))
+	require.Equal(t, "", out.String())
+}
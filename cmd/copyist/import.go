@@ -0,0 +1,290 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/cockroachdb/copyist"
+)
+
+var importCommand = &command{
+	name:  "import",
+	usage: "-dsn dsn [-driver name] [-name prefix] log output",
+	short: "create recordings by running the statements in a Postgres statement log",
+	run:   runImport,
+}
+
+// loggedStatement is a statement that was executed by a Postgres backend, as
+// captured in its statement log.
+type loggedStatement struct {
+	// query is the SQL text of the statement.
+	query string
+
+	// args are the values of the statement's parameters, if it was executed
+	// using the extended query protocol. NULL values are nil.
+	args []interface{}
+}
+
+// runImport reads a Postgres statement log, as written with
+// log_statement=all (or log_min_duration_statement=0), and runs the
+// statements executed by each backend against the given database in recording
+// mode, in order to fetch their results. The statements of each backend are
+// saved as a separate recording in the output recording file, named by the
+// backend's process ID. Since the statements are run again, the database
+// should be a scratch copy of the one that was logged.
+func runImport(cmd *command, args []string) error {
+	fs := newFlagSet(cmd)
+	driverName := fs.String("driver", "postgres", "name of the SQL driver used to run the statements")
+	dataSourceName := fs.String("dsn", "", "data source name of the database used to run the statements")
+	prefix := fs.String("name", "Imported", "prefix of the names of the imported recordings")
+	fs.Parse(args)
+	if fs.NArg() != 2 || *dataSourceName == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sessions, err := parseStatementLog(f)
+	if err != nil {
+		return fmt.Errorf("%s: %v", fs.Arg(0), err)
+	}
+
+	// Run the statements in recording mode.
+	os.Setenv("COPYIST_RECORD", "1")
+	copyist.Register(*driverName)
+	source := copyist.NewFileSource(fs.Arg(1))
+
+	pids := make([]string, 0, len(sessions))
+	for pid := range sessions {
+		pids = append(pids, pid)
+	}
+	sort.Strings(pids)
+	for _, pid := range pids {
+		name := *prefix + "/" + pid
+		if err := importSession(source, name, *driverName, *dataSourceName, sessions[pid]); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		fmt.Printf("%s: imported %q (%d statements)\n", fs.Arg(1), name, len(sessions[pid]))
+	}
+	return nil
+}
+
+// importSession runs the given statements using a single connection, and saves
+// the calls made to the driver as the recording of the given name. Statements
+// that fail are recorded along with their errors, just as they would be by a
+// test.
+func importSession(
+	source copyist.Source, name, driverName, dataSourceName string, stmts []loggedStatement,
+) (err error) {
+	t := &importT{name: name}
+	closer := copyist.OpenSource(t, source, name)
+	defer func() {
+		closer.Close()
+		if err == nil {
+			err = t.err
+		}
+	}()
+
+	db, err := sql.Open("copyist_"+driverName, dataSourceName)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	// Run the statements in order on the same connection, since they may
+	// depend on session state (e.g. an open transaction).
+	db.SetMaxOpenConns(1)
+	for _, stmt := range stmts {
+		if !returnsRows(stmt.query) {
+			db.Exec(stmt.query, stmt.args...)
+			continue
+		}
+
+		rows, err := db.Query(stmt.query, stmt.args...)
+		if err != nil {
+			continue
+		}
+		for rows.Next() {
+		}
+		rows.Close()
+	}
+	return nil
+}
+
+// importT is passed to copyist.OpenSource in place of a test, in order to
+// capture session errors.
+type importT struct {
+	name string
+	err  error
+}
+
+// Fatalf stores the error.
+func (t *importT) Fatalf(format string, args ...interface{}) {
+	t.err = fmt.Errorf(format, args...)
+}
+
+// Name returns the name of the recording.
+func (t *importT) Name() string {
+	return t.name
+}
+
+// returnsRowsRegex matches statements that may return rows, and therefore must
+// be run as queries rather than executed.
+var returnsRowsRegex = regexp.MustCompile(`(?is)^\s*(SELECT|WITH|SHOW|VALUES|TABLE|EXPLAIN)\b|\bRETURNING\b`)
+
+// returnsRows returns true if the given statement may return rows.
+func returnsRows(query string) bool {
+	return returnsRowsRegex.MatchString(query)
+}
+
+// logLineRegex matches a line of a Postgres statement log, capturing the
+// backend's process ID from the default log_line_prefix (e.g. "[1234]"), the
+// severity of the message, and the message.
+var logLineRegex = regexp.MustCompile(
+	`^(?:.*?\[(\d+)\])?.*?\b(LOG|DETAIL|ERROR|STATEMENT|HINT|CONTEXT|WARNING|NOTICE|FATAL|PANIC|INFO|DEBUG\d?):\s+(.*)$`)
+
+// statementRegex matches the message of a logged statement, capturing the SQL
+// text. Statements are logged with a "statement:" prefix by the simple query
+// protocol, and with an "execute <name>:" prefix by the extended query
+// protocol. log_min_duration_statement adds a "duration:" prefix.
+var statementRegex = regexp.MustCompile(
+	`^(?:duration: \S+ ms\s+)?(?:statement|execute [^:]*):\s(?s)(.*)$`)
+
+// parseStatementLog parses a Postgres statement log, written to stderr with a
+// log_line_prefix that includes the process ID as "[%p]" (the default), and
+// returns the statements executed by each backend, indexed by process ID.
+// Statements whose process ID is not known are returned with an empty one.
+func parseStatementLog(r io.Reader) (map[string][]loggedStatement, error) {
+	sessions := make(map[string][]loggedStatement)
+
+	// Messages can span multiple lines, so only handle each message once all
+	// of its continuation lines have been read.
+	var pid, severity string
+	var msg strings.Builder
+	var last *loggedStatement
+	handle := func() error {
+		if severity == "" {
+			return nil
+		}
+		text := msg.String()
+		switch severity {
+		case "LOG":
+			m := statementRegex.FindStringSubmatch(text)
+			if m == nil {
+				last = nil
+				return nil
+			}
+			stmts := append(sessions[pid], loggedStatement{query: m[1]})
+			sessions[pid] = stmts
+			last = &stmts[len(stmts)-1]
+		case "DETAIL":
+			if last != nil && strings.HasPrefix(text, "parameters: ") {
+				args, err := parseParameters(strings.TrimPrefix(text, "parameters: "))
+				if err != nil {
+					return err
+				}
+				last.args = args
+			}
+		}
+		return nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 64*1024*1024)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "\t") {
+			msg.WriteByte('\n')
+			msg.WriteString(line[1:])
+			continue
+		}
+		if err := handle(); err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNum-1, err)
+		}
+
+		severity = ""
+		msg.Reset()
+		m := logLineRegex.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		pid, severity = m[1], m[2]
+		msg.WriteString(m[3])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if err := handle(); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// parseParameters parses the parameters of a statement that was executed using
+// the extended query protocol, as logged in a DETAIL message, like:
+//
+//	$1 = '1', $2 = NULL, $3 = 'it''s'
+func parseParameters(s string) ([]interface{}, error) {
+	var args []interface{}
+	for len(s) > 0 {
+		eq := strings.Index(s, " = ")
+		if !strings.HasPrefix(s, "$") || eq == -1 {
+			return nil, fmt.Errorf("malformed parameters: %s", s)
+		}
+		s = s[eq+3:]
+
+		if strings.HasPrefix(s, "NULL") {
+			args = append(args, nil)
+			s = s[4:]
+		} else if strings.HasPrefix(s, "'") {
+			var val strings.Builder
+			i := 1
+			for {
+				if i >= len(s) {
+					return nil, errors.New("unterminated parameter value")
+				}
+				if s[i] == '\'' {
+					if i+1 < len(s) && s[i+1] == '\'' {
+						val.WriteByte('\'')
+						i += 2
+						continue
+					}
+					break
+				}
+				val.WriteByte(s[i])
+				i++
+			}
+			args = append(args, val.String())
+			s = s[i+1:]
+		} else {
+			return nil, fmt.Errorf("malformed parameter value: %s", s)
+		}
+		s = strings.TrimPrefix(s, ", ")
+	}
+	return args, nil
+}
@@ -0,0 +1,67 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseStatementLog(t *testing.T) {
+	sessions, err := parseStatementLog(strings.NewReader(`
+2021-08-01 12:00:00.001 UTC [101] LOG:  statement: BEGIN
+2021-08-01 12:00:00.002 UTC [102] LOG:  execute <unnamed>: SELECT name
+	FROM customers WHERE id=$1 AND name<>$2
+2021-08-01 12:00:00.002 UTC [102] DETAIL:  parameters: $1 = '1', $2 = 'it''s, ok'
+2021-08-01 12:00:00.003 UTC [101] LOG:  duration: 0.105 ms  statement: DELETE FROM customers
+2021-08-01 12:00:00.004 UTC [101] ERROR:  relation "orders" does not exist
+2021-08-01 12:00:00.004 UTC [101] STATEMENT:  DELETE FROM orders
+2021-08-01 12:00:00.005 UTC [102] LOG:  execute S_1: UPDATE customers SET name=$1
+2021-08-01 12:00:00.005 UTC [102] DETAIL:  parameters: $1 = NULL
+2021-08-01 12:00:00.006 UTC [101] LOG:  connection authorized: user=root
+LOG:  statement: SELECT 1
+`))
+	require.NoError(t, err)
+	require.Equal(t, map[string][]loggedStatement{
+		"101": {
+			{query: "BEGIN"},
+			{query: "DELETE FROM customers"},
+		},
+		"102": {
+			{
+				query: "SELECT name\nFROM customers WHERE id=$1 AND name<>$2",
+				args:  []interface{}{"1", "it's, ok"},
+			},
+			{query: "UPDATE customers SET name=$1", args: []interface{}{nil}},
+		},
+		"": {
+			{query: "SELECT 1"},
+		},
+	}, sessions)
+
+	_, err = parseStatementLog(strings.NewReader(
+		"[1] LOG:  execute <unnamed>: SELECT $1\n[1] DETAIL:  parameters: $1 = 'abc\n"))
+	require.EqualError(t, err, "unterminated parameter value")
+}
+
+func TestReturnsRows(t *testing.T) {
+	require.True(t, returnsRows("SELECT 1"))
+	require.True(t, returnsRows("  with x AS (SELECT 1) SELECT * FROM x"))
+	require.True(t, returnsRows("INSERT INTO customers VALUES (1) RETURNING id"))
+	require.False(t, returnsRows("DELETE FROM customers"))
+	require.False(t, returnsRows("BEGIN"))
+}
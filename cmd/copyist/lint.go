@@ -0,0 +1,129 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/cockroachdb/copyist"
+)
+
+var lintCommand = &command{
+	name:  "lint",
+	usage: "[-disable rules] [-rule name=pattern]... [files or directories]",
+	short: "flag recorded queries that match bad SQL patterns",
+	run:   runLint,
+}
+
+// runLint checks the queries in the given recording files against the default
+// lint rules, along with any custom rules, and fails if any query violates a
+// rule, so that it can be used as a CI gate.
+func runLint(cmd *command, args []string) error {
+	fs := newFlagSet(cmd)
+	disable := fs.String("disable", "", "comma-separated list of default rules to disable "+
+		"(select-star, missing-limit, cross-join)")
+	var custom stringList
+	fs.Var(&custom, "rule", "flag queries that match this regular expression, as name=pattern "+
+		"(can be repeated)")
+	fs.Parse(args)
+
+	rules, err := lintRules(*disable, custom)
+	if err != nil {
+		return err
+	}
+	files, err := findRecordingFiles(fs.Args())
+	if err != nil {
+		return err
+	}
+
+	violations := 0
+	for _, fileName := range files {
+		n, err := lintRecordingFile(fileName, rules, os.Stdout)
+		if err != nil {
+			return fmt.Errorf("%s: %v", fileName, err)
+		}
+		violations += n
+	}
+	if violations != 0 {
+		return fmt.Errorf("%d queries violate lint rules", violations)
+	}
+	return nil
+}
+
+// lintRules returns the default lint rules, except for the disabled ones, along
+// with the given custom rules, each of which is formatted as name=pattern.
+func lintRules(disable string, custom []string) ([]copyist.LintRule, error) {
+	disabled := make(map[string]bool)
+	for _, name := range strings.Split(disable, ",") {
+		if name != "" {
+			disabled[name] = true
+		}
+	}
+
+	var rules []copyist.LintRule
+	for _, rule := range copyist.DefaultLintRules() {
+		if !disabled[rule.Name] {
+			rules = append(rules, rule)
+		}
+	}
+	for _, s := range custom {
+		i := strings.IndexByte(s, '=')
+		if i <= 0 {
+			return nil, fmt.Errorf("rule %q is not formatted as name=pattern", s)
+		}
+		name, pattern := s[:i], s[i+1:]
+		rule, err := copyist.NewLintRule(name, "matches "+pattern, pattern)
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: %v", name, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// lintRecordingFile writes the queries in the given recording file that violate
+// the given rules to the given writer, and returns how many there are. Each
+// query is only checked once per recording.
+func lintRecordingFile(fileName string, rules []copyist.LintRule, w io.Writer) (int, error) {
+	file, err := readRecordingFile(fileName)
+	if err != nil {
+		return 0, err
+	}
+
+	violations := 0
+	for _, name := range file.RecordingNames() {
+		records, err := file.Recording(name)
+		if err != nil {
+			return 0, err
+		}
+		seen := make(map[string]bool)
+		for _, rec := range records {
+			query, ok := queryText(rec)
+			if !ok || seen[query] {
+				continue
+			}
+			seen[query] = true
+			for _, rule := range copyist.LintQuery(query, rules) {
+				fmt.Fprintf(w, "%s: %s: %s: %s\n", fileName, name, rule.Name,
+					strings.Join(strings.Fields(query), " "))
+				violations++
+			}
+		}
+	}
+	return violations, nil
+}
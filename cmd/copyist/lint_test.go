@@ -0,0 +1,56 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLint(t *testing.T) {
+	pathName := filepath.Join(t.TempDir(), "lint.copyist")
+	require.NoError(t, os.WriteFile(pathName, []byte(`
+1=DriverOpen	1:nil
+2=ConnQuery	2:"SELECT * FROM customers"	1:nil
+3=ConnExec	2:"DELETE FROM customers WHERE id = 1"	1:nil
+
+"TestLint"=1,2,2,3
+`), 0666))
+
+	rules, err := lintRules("", nil)
+	require.NoError(t, err)
+	var out bytes.Buffer
+	n, err := lintRecordingFile(pathName, rules, &out)
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	require.Equal(t, pathName+": TestLint: select-star: SELECT * FROM customers\n"+
+		pathName+": TestLint: missing-limit: SELECT * FROM customers\n", out.String())
+
+	// Disable default rules and add a custom rule.
+	rules, err = lintRules("select-star,missing-limit", []string{"no-delete=^DELETE"})
+	require.NoError(t, err)
+	out.Reset()
+	n, err = lintRecordingFile(pathName, rules, &out)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	require.Equal(t, pathName+": TestLint: no-delete: DELETE FROM customers WHERE id = 1\n", out.String())
+
+	_, err = lintRules("", []string{"no-name"})
+	require.EqualError(t, err, `rule "no-name" is not formatted as name=pattern`)
+}
@@ -0,0 +1,120 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/cockroachdb/copyist"
+)
+
+var listCommand = &command{
+	name:  "list",
+	usage: "[-s] [files or directories]",
+	short: "list recordings with their record counts, sizes and query counts",
+	run:   runList,
+}
+
+// recordingInfo summarizes one recording in a recording file.
+type recordingInfo struct {
+	fileName string
+	name     string
+	records  int
+	bytes    int
+	queries  int
+}
+
+// runList prints a table of the recordings in the given recording files.
+func runList(cmd *command, args []string) error {
+	fs := newFlagSet(cmd)
+	sortBySize := fs.Bool("s", false, "sort recordings by size, largest first")
+	fs.Parse(args)
+
+	files, err := findRecordingFiles(fs.Args())
+	if err != nil {
+		return err
+	}
+
+	var infos []recordingInfo
+	for _, fileName := range files {
+		fileInfos, err := listRecordingFile(fileName)
+		if err != nil {
+			return fmt.Errorf("%s: %v", fileName, err)
+		}
+		infos = append(infos, fileInfos...)
+	}
+
+	if *sortBySize {
+		sort.SliceStable(infos, func(i, j int) bool {
+			return infos[i].bytes > infos[j].bytes
+		})
+	}
+
+	printRecordingInfos(os.Stdout, infos)
+	return nil
+}
+
+// listRecordingFile returns information about each recording in the given
+// recording file.
+func listRecordingFile(fileName string) ([]recordingInfo, error) {
+	file, err := readRecordingFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	var infos []recordingInfo
+	for _, name := range file.RecordingNames() {
+		records, err := file.Recording(name)
+		if err != nil {
+			return nil, err
+		}
+
+		info := recordingInfo{fileName: fileName, name: name, records: len(records)}
+		for _, rec := range records {
+			// Account for the record's line in the recording file, even though
+			// the line may be shared with other recordings.
+			info.bytes += len(rec.String()) + 1
+			if isQuery(rec) {
+				info.queries++
+			}
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// printRecordingInfos prints the given recording information as a table.
+func printRecordingInfos(w io.Writer, infos []recordingInfo) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "RECORDS\tBYTES\tQUERIES\tFILE\tRECORDING\n")
+	for _, info := range infos {
+		fmt.Fprintf(tw, "%d\t%d\t%d\t%s\t%s\n",
+			info.records, info.bytes, info.queries, info.fileName, info.name)
+	}
+	tw.Flush()
+}
+
+// isQuery returns true if the given record executes a SQL statement.
+func isQuery(rec copyist.Record) bool {
+	switch rec.Type {
+	case "ConnExec", "ConnQuery", "StmtExec", "StmtQuery":
+		return true
+	}
+	return false
+}
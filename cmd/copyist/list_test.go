@@ -0,0 +1,32 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestList(t *testing.T) {
+	pathName := writeTestRecording(t)
+	infos, err := listRecordingFile(pathName)
+	require.NoError(t, err)
+	require.Equal(t, []recordingInfo{
+		{fileName: pathName, name: "TestQuery", records: 5, bytes: 151, queries: 1},
+		{fileName: pathName, name: "TestQuery/subtest", records: 4, bytes: 122, queries: 1},
+		{fileName: pathName, name: "TestRenamed", records: 2, bytes: 58, queries: 1},
+	}, infos)
+}
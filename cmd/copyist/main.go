@@ -0,0 +1,128 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Command copyist provides tools for inspecting and maintaining copyist
+// recording files. Usage:
+//
+//	copyist <command> [arguments]
+//
+// Run "copyist help" for the list of commands.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	// Record and play back the errors of the lib/pq and pgx drivers with all
+	// of their fields.
+	_ "github.com/cockroachdb/copyist/copyistpgx"
+	_ "github.com/cockroachdb/copyist/copyistpq"
+)
+
+// command is a copyist sub-command, like "prune".
+type command struct {
+	// name is the name of the command, as typed on the command line.
+	name string
+
+	// usage is a one-line description of the command's arguments.
+	usage string
+
+	// short is a one-line description of what the command does.
+	short string
+
+	// run executes the command with the arguments that follow its name on the
+	// command line. It returns an error if the command failed.
+	run func(cmd *command, args []string) error
+}
+
+// commands is the list of all copyist sub-commands.
+var commands = []*command{
+	pruneCommand,
+	renameCommand,
+	listCommand,
+	diffCommand,
+	verifyCommand,
+	statsCommand,
+	recordCommand,
+	redactCommand,
+	migrateCommand,
+	mergeCommand,
+	gcCommand,
+	reportCommand,
+	expireCommand,
+	sqlmockCommand,
+	importCommand,
+	serveCommand,
+	proxyCommand,
+	seedCommand,
+	coverageCommand,
+	timingCommand,
+	lintCommand,
+	retryCommand,
+	schemaCommand,
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() < 1 || flag.Arg(0) == "help" {
+		usage()
+		os.Exit(2)
+	}
+
+	cmd := findCommand(flag.Arg(0))
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "copyist: unknown command %q\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+
+	if err := cmd.run(cmd, flag.Args()[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "copyist %s: %v\n", cmd.name, err)
+		os.Exit(1)
+	}
+}
+
+// findCommand returns the command having the given name, or nil if there is no
+// such command.
+func findCommand(name string) *command {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+// usage prints the list of commands to stderr.
+func usage() {
+	fmt.Fprintf(os.Stderr, "copyist is a tool for maintaining copyist recording files.\n\n")
+	fmt.Fprintf(os.Stderr, "Usage:\n\n\tcopyist <command> [arguments]\n\nThe commands are:\n\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "\t%-10s %s\n", cmd.name, cmd.short)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun \"copyist <command> -h\" for more information about a command.\n")
+}
+
+// newFlagSet returns a flag set for the given command, which prints the
+// command's usage and flags on error.
+func newFlagSet(cmd *command) *flag.FlagSet {
+	fs := flag.NewFlagSet(cmd.name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: copyist %s %s\n\n", cmd.name, cmd.usage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
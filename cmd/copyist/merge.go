@@ -0,0 +1,167 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/cockroachdb/copyist"
+)
+
+var mergeCommand = &command{
+	name:  "merge",
+	usage: "[-prefer ours|theirs] base ours theirs",
+	short: "three-way merge recording files, for use as a git merge driver",
+	run:   runMerge,
+}
+
+// runMerge merges the changes between base and theirs into ours, writing the
+// result to ours. It can be registered as a git merge driver:
+//
+//	git config merge.copyist.driver "copyist merge %O %A %B"
+//	echo '*.copyist merge=copyist' >> .gitattributes
+//
+// Recordings are independent of one another, so they are merged individually.
+// A recording only conflicts if both sides changed it in different ways. In
+// that case, the merge fails (unless -prefer is given), leaving ours' version
+// of the recording in place.
+func runMerge(cmd *command, args []string) error {
+	fs := newFlagSet(cmd)
+	prefer := fs.String("prefer", "",
+		`resolve conflicting recordings using "ours" or "theirs" instead of failing`)
+	fs.Parse(args)
+	if fs.NArg() != 3 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *prefer != "" && *prefer != "ours" && *prefer != "theirs" {
+		return fmt.Errorf(`-prefer must be "ours" or "theirs"`)
+	}
+
+	var files [3]*copyist.RecordingFile
+	for i := range files {
+		var err error
+		files[i], err = readRecordingFile(fs.Arg(i))
+		if err != nil {
+			return fmt.Errorf("%s: %v", fs.Arg(i), err)
+		}
+	}
+
+	conflicts, err := mergeRecordingFiles(files[0], files[1], files[2], *prefer, os.Stderr)
+	if err != nil {
+		return err
+	}
+	if err := files[1].Write(); err != nil {
+		return err
+	}
+	if conflicts != 0 {
+		return fmt.Errorf("%d conflicting recording(s) in %s", conflicts, fs.Arg(1))
+	}
+	return nil
+}
+
+// mergeRecordingFiles merges the changes between base and theirs into ours, in
+// memory. It returns the number of conflicting recordings, which are resolved
+// according to prefer ("ours", "theirs", or empty to keep ours and count the
+// conflict).
+func mergeRecordingFiles(
+	base, ours, theirs *copyist.RecordingFile, prefer string, w io.Writer,
+) (conflicts int, err error) {
+	baseRecs, err := formatRecordingFile(base)
+	if err != nil {
+		return 0, err
+	}
+	ourRecs, err := formatRecordingFile(ours)
+	if err != nil {
+		return 0, err
+	}
+	theirRecs, err := formatRecordingFile(theirs)
+	if err != nil {
+		return 0, err
+	}
+
+	names := make(map[string]bool)
+	for _, recs := range []map[string]string{baseRecs, ourRecs, theirRecs} {
+		for name := range recs {
+			names[name] = true
+		}
+	}
+	sortedNames := make([]string, 0, len(names))
+	for name := range names {
+		sortedNames = append(sortedNames, name)
+	}
+	sort.Strings(sortedNames)
+
+	for _, name := range sortedNames {
+		baseRec, inBase := baseRecs[name]
+		ourRec, inOurs := ourRecs[name]
+		theirRec, inTheirs := theirRecs[name]
+
+		takeTheirs := false
+		switch {
+		case inOurs == inTheirs && ourRec == theirRec:
+			// Both sides agree.
+		case inOurs == inBase && ourRec == baseRec:
+			// Only theirs changed.
+			takeTheirs = true
+		case inTheirs == inBase && theirRec == baseRec:
+			// Only ours changed.
+		default:
+			fmt.Fprintf(w, "conflicting changes to recording %q\n", name)
+			switch prefer {
+			case "theirs":
+				takeTheirs = true
+			case "":
+				conflicts++
+			}
+		}
+
+		if !takeTheirs {
+			continue
+		}
+		if !inTheirs {
+			ours.DeleteRecording(name)
+			continue
+		}
+		records, err := theirs.Recording(name)
+		if err != nil {
+			return 0, err
+		}
+		if err := ours.SetRecording(name, records); err != nil {
+			return 0, err
+		}
+		ours.SetMetadata(name, theirs.Metadata(name))
+	}
+	return conflicts, nil
+}
+
+// formatRecordingFile returns each recording in the given file formatted as a
+// string, keyed by recording name, so that recordings can be compared
+// regardless of how their records are numbered.
+func formatRecordingFile(file *copyist.RecordingFile) (map[string]string, error) {
+	recs := make(map[string]string)
+	for _, name := range file.RecordingNames() {
+		lines, err := file.RecordingLines(name)
+		if err != nil {
+			return nil, err
+		}
+		recs[name] = strings.Join(lines, "\n")
+	}
+	return recs, nil
+}
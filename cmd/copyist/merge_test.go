@@ -0,0 +1,93 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/cockroachdb/copyist"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMerge(t *testing.T) {
+	readFile := func(data string) *copyist.RecordingFile {
+		file, err := copyist.ReadRecordingFile(copyist.NewMemorySource([]byte(data)))
+		require.NoError(t, err)
+		return file
+	}
+
+	const base = `1=DriverOpen	1:nil
+2=ConnExec	2:"SELECT 1"	1:nil
+3=ConnExec	2:"SELECT 2"	1:nil
+
+"TestUnchanged"=1
+"TestOurs"=1
+"TestTheirs"=1
+"TestDeleted"=1
+"TestConflict"=1
+`
+	// Ours: change TestOurs and TestConflict, add TestAddedOurs.
+	const ours = `1=DriverOpen	1:nil
+2=ConnExec	2:"SELECT 1"	1:nil
+3=ConnExec	2:"SELECT 2"	1:nil
+
+"TestUnchanged"=1
+"TestOurs"=1,2
+"TestTheirs"=1
+"TestDeleted"=1
+"TestConflict"=1,2
+"TestAddedOurs"=1
+`
+	// Theirs: renumber records, change TestTheirs and TestConflict, delete
+	// TestDeleted, and add TestAddedTheirs.
+	const theirs = `1=ConnExec	2:"SELECT 2"	1:nil
+2=DriverOpen	1:nil
+
+"TestUnchanged"=2
+"TestOurs"=2
+"TestTheirs"=2,1
+"TestConflict"=2,1
+"TestAddedTheirs"=2,1
+`
+
+	var out bytes.Buffer
+	oursFile := readFile(ours)
+	conflicts, err := mergeRecordingFiles(readFile(base), oursFile, readFile(theirs), "", &out)
+	require.NoError(t, err)
+	require.Equal(t, 1, conflicts)
+	require.Equal(t, "conflicting changes to recording \"TestConflict\"\n", out.String())
+
+	merged, err := formatRecordingFile(oursFile)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		"TestUnchanged":   "DriverOpen\t1:nil",
+		"TestOurs":        "DriverOpen\t1:nil\nConnExec\t2:\"SELECT 1\"\t1:nil",
+		"TestTheirs":      "DriverOpen\t1:nil\nConnExec\t2:\"SELECT 2\"\t1:nil",
+		"TestConflict":    "DriverOpen\t1:nil\nConnExec\t2:\"SELECT 1\"\t1:nil",
+		"TestAddedOurs":   "DriverOpen\t1:nil",
+		"TestAddedTheirs": "DriverOpen\t1:nil\nConnExec\t2:\"SELECT 2\"\t1:nil",
+	}, merged)
+
+	// Prefer theirs when there's a conflict.
+	out.Reset()
+	oursFile = readFile(ours)
+	conflicts, err = mergeRecordingFiles(readFile(base), oursFile, readFile(theirs), "theirs", &out)
+	require.NoError(t, err)
+	require.Equal(t, 0, conflicts)
+	merged, err = formatRecordingFile(oursFile)
+	require.NoError(t, err)
+	require.Equal(t, "DriverOpen\t1:nil\nConnExec\t2:\"SELECT 2\"\t1:nil", merged["TestConflict"])
+}
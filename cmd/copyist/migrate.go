@@ -0,0 +1,149 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/cockroachdb/copyist"
+)
+
+var migrateCommand = &command{
+	name: "migrate",
+	usage: "[-old-query sql -new-query sql] [-query pattern] [-rename-column old=new]... " +
+		"[-add-column name=value]... [-n] [files or directories]",
+	short: "apply schema changes to recordings without re-recording",
+	run:   runMigrate,
+}
+
+// runMigrate rewrites recording files so that they reflect small changes to the
+// database schema, like renamed or added columns, so that the tests that use
+// them do not need to be re-recorded. See RecordingFile.Migrate.
+func runMigrate(cmd *command, args []string) error {
+	fs := newFlagSet(cmd)
+	var renames, adds stringList
+	oldQuery := fs.String("old-query", "", "replace the SQL text of queries that are exactly "+
+		"equal to this with -new-query")
+	newQuery := fs.String("new-query", "", "the SQL text that replaces -old-query")
+	query := fs.String("query", "", "only change the results of queries that match this regular "+
+		"expression (defaults to -new-query, if given, or else to all queries)")
+	fs.Var(&renames, "rename-column", "rename result columns, given as old=new (can be repeated)")
+	fs.Var(&adds, "add-column", "add a result column after the existing columns, given as "+
+		"name=value, where value is in the recording file format, like 2:\"text\" or 1:nil "+
+		"(can be repeated)")
+	dryRun := fs.Bool("n", false, "report recordings that would change without rewriting them")
+	fs.Parse(args)
+
+	migrations, err := parseMigrations(*oldQuery, *newQuery, *query, renames, adds)
+	if err != nil {
+		return err
+	}
+
+	files, err := findRecordingFiles(fs.Args())
+	if err != nil {
+		return err
+	}
+	for _, fileName := range files {
+		if err := migrateFile(fileName, migrations, *dryRun, os.Stdout); err != nil {
+			return fmt.Errorf("%s: %v", fileName, err)
+		}
+	}
+	return nil
+}
+
+// parseMigrations returns the migrations specified by the migrate command's
+// flags, in the order that they are applied: the query is replaced first, then
+// columns are renamed, and then columns are added.
+func parseMigrations(
+	oldQuery, newQuery, query string, renames, adds []string,
+) ([]copyist.Migration, error) {
+	if (oldQuery == "") != (newQuery == "") {
+		return nil, fmt.Errorf("-old-query and -new-query must be specified together")
+	}
+
+	var migrations []copyist.Migration
+	if oldQuery != "" {
+		migrations = append(migrations, copyist.ReplaceQuery(oldQuery, newQuery))
+	}
+
+	// By default, columns are only changed in the results of the new query.
+	var queryRE *regexp.Regexp
+	if query == "" && newQuery != "" {
+		query = "^" + regexp.QuoteMeta(newQuery) + "$"
+	}
+	if query != "" {
+		var err error
+		queryRE, err = regexp.Compile(query)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, rename := range renames {
+		i := strings.IndexByte(rename, '=')
+		if i <= 0 || i == len(rename)-1 {
+			return nil, fmt.Errorf("expected -rename-column old=new, got %q", rename)
+		}
+		migrations = append(migrations, copyist.RenameColumn(queryRE, rename[:i], rename[i+1:]))
+	}
+
+	for _, add := range adds {
+		i := strings.IndexByte(add, '=')
+		if i <= 0 {
+			return nil, fmt.Errorf("expected -add-column name=value, got %q", add)
+		}
+		val, err := copyist.ParseValue(add[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of column %q: %v", add[:i], err)
+		}
+		migrations = append(migrations, copyist.AddColumn(queryRE, add[:i], val))
+	}
+
+	if len(migrations) == 0 {
+		return nil, fmt.Errorf("at least one -old-query, -rename-column or -add-column " +
+			"migration must be specified")
+	}
+	return migrations, nil
+}
+
+// migrateFile applies the given migrations to every recording in the given
+// file, and rewrites it if any recordings changed (unless dryRun is true).
+func migrateFile(fileName string, migrations []copyist.Migration, dryRun bool, w io.Writer) error {
+	file, err := readRecordingFile(fileName)
+	if err != nil {
+		return err
+	}
+
+	changed := false
+	for _, name := range file.RecordingNames() {
+		migrated, err := file.Migrate(name, migrations...)
+		if err != nil {
+			return err
+		}
+		if migrated {
+			fmt.Fprintf(w, "%s: migrated %q\n", fileName, name)
+			changed = true
+		}
+	}
+
+	if !changed || dryRun {
+		return nil
+	}
+	return file.Write()
+}
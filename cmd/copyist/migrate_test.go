@@ -0,0 +1,73 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrate(t *testing.T) {
+	pathName := filepath.Join(t.TempDir(), "migrate.copyist")
+	require.NoError(t, os.WriteFile(pathName, []byte(`1=DriverOpen	1:nil
+2=ConnQuery	2:"SELECT id, name FROM users"	1:nil
+3=RowsColumns	9:["id","name"]
+4=RowsNext	11:[4:1,2:"Andy"]	1:nil
+5=RowsNext	11:[]	7:"EOF"
+6=ConnQuery	2:"SELECT name FROM pets"	1:nil
+7=RowsColumns	9:["name"]
+
+"TestMigrate"=1,2,3,4,5
+"TestUnchanged"=1,6,7
+`), 0666))
+
+	migrations, err := parseMigrations("SELECT id, name FROM users",
+		"SELECT id, full_name, active FROM users", "",
+		[]string{"name=full_name"}, []string{"active=6:true"})
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	require.NoError(t, migrateFile(pathName, migrations, true /* dryRun */, &out))
+	require.Equal(t, pathName+": migrated \"TestMigrate\"\n", out.String())
+
+	out.Reset()
+	require.NoError(t, migrateFile(pathName, migrations, false /* dryRun */, &out))
+	file, err := readRecordingFile(pathName)
+	require.NoError(t, err)
+	records, err := file.Recording("TestMigrate")
+	require.NoError(t, err)
+	require.Equal(t, "SELECT id, full_name, active FROM users", records[1].Args[0])
+	require.Equal(t, []string{"id", "full_name", "active"}, records[2].Args[0])
+	require.Equal(t, []driver.Value{int64(1), "Andy", true}, records[3].Args[0])
+	require.Equal(t, []driver.Value{}, records[4].Args[0])
+
+	// Columns are only changed in the results of the new query by default.
+	records, err = file.Recording("TestUnchanged")
+	require.NoError(t, err)
+	require.Equal(t, []string{"name"}, records[2].Args[0])
+
+	_, err = parseMigrations("", "", "", nil, nil)
+	require.EqualError(t, err,
+		"at least one -old-query, -rename-column or -add-column migration must be specified")
+	_, err = parseMigrations("SELECT 1", "", "", nil, nil)
+	require.EqualError(t, err, "-old-query and -new-query must be specified together")
+	_, err = parseMigrations("", "", "", []string{"name"}, nil)
+	require.EqualError(t, err, `expected -rename-column old=new, got "name"`)
+}
@@ -0,0 +1,274 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgproto3/v2"
+	"github.com/lib/pq"
+)
+
+// These are the OIDs of the Postgres types that recorded values are sent as
+// over the wire protocol.
+const (
+	boolOID        = 16
+	byteaOID       = 17
+	nameOID        = 19
+	int8OID        = 20
+	int2OID        = 21
+	int4OID        = 23
+	textOID        = 25
+	float4OID      = 700
+	float8OID      = 701
+	bpcharOID      = 1042
+	varcharOID     = 1043
+	timestampOID   = 1114
+	timestamptzOID = 1184
+)
+
+// postgresEpoch is the zero time of Postgres binary timestamps.
+var postgresEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// valueOID returns the OID of the Postgres type that the given recorded value
+// is sent as. Values of unknown type, including nil, are sent as text.
+func valueOID(val driver.Value) uint32 {
+	switch val.(type) {
+	case bool:
+		return boolOID
+	case []byte:
+		return byteaOID
+	case int64:
+		return int8OID
+	case float64:
+		return float8OID
+	case time.Time:
+		return timestamptzOID
+	}
+	return textOID
+}
+
+// columnOIDs returns the OID of each of the given columns, derived from the
+// first non-nil value in that column of the given rows.
+func columnOIDs(columns []string, rows [][]driver.Value) []uint32 {
+	oids := make([]uint32, len(columns))
+	for i := range columns {
+		oids[i] = textOID
+		for _, row := range rows {
+			if i < len(row) && row[i] != nil {
+				oids[i] = valueOID(row[i])
+				break
+			}
+		}
+	}
+	return oids
+}
+
+// encodeValue encodes the given recorded value in the Postgres text format, or
+// the binary format if binaryFormat is true. Nil values are encoded as nil,
+// which the wire protocol sends as NULL.
+func encodeValue(val driver.Value, binaryFormat bool) []byte {
+	if val == nil {
+		return nil
+	}
+
+	if binaryFormat {
+		switch t := val.(type) {
+		case bool:
+			if t {
+				return []byte{1}
+			}
+			return []byte{0}
+		case int64:
+			return uint64Bytes(uint64(t))
+		case float64:
+			return uint64Bytes(math.Float64bits(t))
+		case time.Time:
+			micros := t.Sub(postgresEpoch).Microseconds()
+			return uint64Bytes(uint64(micros))
+		case []byte:
+			return t
+		}
+		return []byte(fmt.Sprint(val))
+	}
+
+	switch t := val.(type) {
+	case bool:
+		if t {
+			return []byte("t")
+		}
+		return []byte("f")
+	case int64:
+		return strconv.AppendInt(nil, t, 10)
+	case float64:
+		return strconv.AppendFloat(nil, t, 'g', -1, 64)
+	case time.Time:
+		return []byte(t.Format("2006-01-02 15:04:05.999999999Z07:00"))
+	case []byte:
+		return []byte(`\x` + hex.EncodeToString(t))
+	case string:
+		return []byte(t)
+	}
+	return []byte(fmt.Sprint(val))
+}
+
+// decodeValue decodes a value of the Postgres type having the given OID, which
+// was sent in the text format, or the binary format if binaryFormat is true.
+// Values are decoded to the same Go types that the pq driver returns. Values of
+// types that copyist does not know are returned as strings if they are in the
+// text format, or as bytes otherwise.
+func decodeValue(oid uint32, src []byte, binaryFormat bool) (driver.Value, error) {
+	if src == nil {
+		return nil, nil
+	}
+
+	if binaryFormat {
+		switch oid {
+		case boolOID:
+			return len(src) == 1 && src[0] != 0, nil
+		case int2OID:
+			if len(src) != 2 {
+				return nil, fmt.Errorf("invalid int2 of length %d", len(src))
+			}
+			return int64(int16(binary.BigEndian.Uint16(src))), nil
+		case int4OID:
+			if len(src) != 4 {
+				return nil, fmt.Errorf("invalid int4 of length %d", len(src))
+			}
+			return int64(int32(binary.BigEndian.Uint32(src))), nil
+		case int8OID:
+			if len(src) != 8 {
+				return nil, fmt.Errorf("invalid int8 of length %d", len(src))
+			}
+			return int64(binary.BigEndian.Uint64(src)), nil
+		case float4OID:
+			if len(src) != 4 {
+				return nil, fmt.Errorf("invalid float4 of length %d", len(src))
+			}
+			return float64(math.Float32frombits(binary.BigEndian.Uint32(src))), nil
+		case float8OID:
+			if len(src) != 8 {
+				return nil, fmt.Errorf("invalid float8 of length %d", len(src))
+			}
+			return math.Float64frombits(binary.BigEndian.Uint64(src)), nil
+		case timestampOID, timestamptzOID:
+			if len(src) != 8 {
+				return nil, fmt.Errorf("invalid timestamp of length %d", len(src))
+			}
+			micros := int64(binary.BigEndian.Uint64(src))
+			return postgresEpoch.Add(time.Duration(micros) * time.Microsecond), nil
+		case textOID, nameOID, bpcharOID, varcharOID:
+			return string(src), nil
+		}
+		return append([]byte(nil), src...), nil
+	}
+
+	s := string(src)
+	switch oid {
+	case boolOID:
+		return s == "t", nil
+	case int2OID, int4OID, int8OID:
+		return strconv.ParseInt(s, 10, 64)
+	case float4OID, float8OID:
+		return strconv.ParseFloat(s, 64)
+	case byteaOID:
+		return hex.DecodeString(strings.TrimPrefix(s, `\x`))
+	case timestampOID:
+		return time.Parse("2006-01-02 15:04:05.999999999", s)
+	case timestamptzOID:
+		// Postgres abbreviates whole-hour offsets, like "+02".
+		if t, err := time.Parse("2006-01-02 15:04:05.999999999Z07:00", s); err == nil {
+			return t, nil
+		}
+		return time.Parse("2006-01-02 15:04:05.999999999Z07", s)
+	}
+	return s, nil
+}
+
+// uint64Bytes returns the big-endian encoding of the given integer.
+func uint64Bytes(n uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, n)
+	return b
+}
+
+// errorResponse returns the ErrorResponse message that reports the given
+// recorded error. Postgres errors recorded by the pq and pgx drivers keep
+// their code and details. Other errors are reported as internal errors.
+func errorResponse(err error) *pgproto3.ErrorResponse {
+	switch t := err.(type) {
+	case *pq.Error:
+		return &pgproto3.ErrorResponse{
+			Severity:       t.Severity,
+			Code:           string(t.Code),
+			Message:        t.Message,
+			Detail:         t.Detail,
+			Hint:           t.Hint,
+			SchemaName:     t.Schema,
+			TableName:      t.Table,
+			ColumnName:     t.Column,
+			DataTypeName:   t.DataTypeName,
+			ConstraintName: t.Constraint,
+		}
+	case *pgconn.PgError:
+		return &pgproto3.ErrorResponse{
+			Severity:       t.Severity,
+			Code:           t.Code,
+			Message:        t.Message,
+			Detail:         t.Detail,
+			Hint:           t.Hint,
+			SchemaName:     t.SchemaName,
+			TableName:      t.TableName,
+			ColumnName:     t.ColumnName,
+			DataTypeName:   t.DataTypeName,
+			ConstraintName: t.ConstraintName,
+		}
+	}
+	return &pgproto3.ErrorResponse{Severity: "ERROR", Code: "XX000", Message: err.Error()}
+}
+
+// commandTag returns the tag of the CommandComplete message that Postgres
+// sends after executing the given statement, which affected or returned the
+// given number of rows.
+func commandTag(query string, rows int64) string {
+	fields := strings.Fields(query)
+	if len(fields) == 0 {
+		return ""
+	}
+	verb := strings.ToUpper(strings.TrimSuffix(fields[0], ";"))
+	switch verb {
+	case "INSERT":
+		return fmt.Sprintf("INSERT 0 %d", rows)
+	case "SELECT", "UPDATE", "DELETE", "MERGE", "FETCH", "MOVE", "COPY":
+		return fmt.Sprintf("%s %d", verb, rows)
+	case "WITH", "VALUES", "SHOW", "TABLE":
+		return fmt.Sprintf("SELECT %d", rows)
+	case "START":
+		return "BEGIN"
+	case "CREATE", "DROP", "ALTER":
+		if len(fields) > 1 {
+			return verb + " " + strings.ToUpper(fields[1])
+		}
+	}
+	return verb
+}
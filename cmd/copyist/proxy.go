@@ -0,0 +1,586 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"database/sql/driver"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/cockroachdb/copyist"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgproto3/v2"
+)
+
+var proxyCommand = &command{
+	name:  "proxy",
+	usage: "[-addr address] [-name prefix] server output",
+	short: "record the traffic between Postgres clients and a server",
+	run:   runProxy,
+}
+
+// These are the codes that identify the untyped messages that a client can
+// send at the start of a connection, other than the startup message.
+const (
+	cancelRequestCode  = 80877102
+	sslRequestCode     = 80877103
+	gssEncRequestCode  = 80877104
+	maxStartupMsgBytes = 10000
+)
+
+// runProxy listens for Postgres clients on the given address, and relays their
+// traffic to the Postgres server at the given address. The statements sent by
+// each client connection and the server's responses are saved in the output
+// recording file when the connection is closed, as a recording named by the
+// given prefix and the number of the connection (e.g. "Proxied/1"). This allows
+// recordings to be made for programs that do not use database/sql, or that are
+// not written in Go.
+func runProxy(cmd *command, args []string) error {
+	fs := newFlagSet(cmd)
+	addr := fs.String("addr", "localhost:5433", "address on which to listen for clients")
+	prefix := fs.String("name", "Proxied", "prefix of the names of the recordings")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	server, output := fs.Arg(0), fs.Arg(1)
+
+	// Create the output file if it does not yet exist.
+	if _, err := os.Stat(output); os.IsNotExist(err) {
+		if err := os.WriteFile(output, nil, 0666); err != nil {
+			return err
+		}
+	}
+
+	ln, err := net.Listen("tcp", *addr)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "proxying %s to %s\n", ln.Addr(), server)
+
+	var mu sync.Mutex
+	for connNum := 1; ; connNum++ {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+
+		name := fmt.Sprintf("%s/%d", *prefix, connNum)
+		go func() {
+			records, err := proxyConn(conn, server)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "copyist proxy: %s: %v\n", name, err)
+			}
+			if len(records) == 0 {
+				return
+			}
+
+			// Connections can be closed concurrently, so serialize updates to
+			// the recording file.
+			mu.Lock()
+			defer mu.Unlock()
+			if err := saveRecording(output, name, records); err != nil {
+				fmt.Fprintf(os.Stderr, "copyist proxy: %s: %v\n", name, err)
+				return
+			}
+			fmt.Printf("%s: recorded %q (%d records)\n", output, name, len(records))
+		}()
+	}
+}
+
+// saveRecording adds or replaces the recording of the given name in the given
+// recording file.
+func saveRecording(pathName, name string, records []copyist.Record) error {
+	file, err := readRecordingFile(pathName)
+	if err != nil {
+		return err
+	}
+	if err := file.SetRecording(name, records); err != nil {
+		return err
+	}
+	return file.Write()
+}
+
+// proxyConn relays the traffic of the given client connection to a new
+// connection to the given server, until either connection is closed. It
+// returns the records of the statements that were executed by the client, in
+// the same form as they would have been recorded by copyist's database/sql
+// driver. Requests for SSL or GSS encryption are refused, so that the traffic
+// can be read.
+func proxyConn(client net.Conn, server string) ([]copyist.Record, error) {
+	defer client.Close()
+	clientReader := bufio.NewReader(client)
+
+	startup, err := readStartupMessage(client, clientReader)
+	if err != nil || startup == nil {
+		return nil, err
+	}
+
+	serverConn, err := net.Dial("tcp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer serverConn.Close()
+	if _, err := serverConn.Write(startup); err != nil {
+		return nil, err
+	}
+	if binary.BigEndian.Uint32(startup[4:]) == cancelRequestCode {
+		return nil, nil
+	}
+
+	c := &capturedConn{
+		stmts:   make(map[string]*capturedStmt),
+		portals: make(map[string]*capturedStmt),
+		records: []copyist.Record{{Type: "DriverOpen", Args: []interface{}{nil}}},
+	}
+
+	// Relay the server's messages to the client in the background. When either
+	// side closes its connection, close both, so that the other relay stops.
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- relayMessages(client, bufio.NewReader(serverConn), c.serverMessage)
+		client.Close()
+	}()
+	clientErr := relayMessages(serverConn, clientReader, c.clientMessage)
+	serverConn.Close()
+	if err := <-serverErr; clientErr == nil {
+		clientErr = err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.records, clientErr
+}
+
+// readStartupMessage reads the startup message that begins a client
+// connection, and returns it. Requests for SSL or GSS encryption are refused.
+// readStartupMessage returns nil if the client closes its connection before
+// sending a startup message.
+func readStartupMessage(client net.Conn, r *bufio.Reader) ([]byte, error) {
+	for {
+		header := make([]byte, 8)
+		if _, err := io.ReadFull(r, header); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil, nil
+			}
+			return nil, err
+		}
+
+		size := binary.BigEndian.Uint32(header)
+		if size < 8 || size > maxStartupMsgBytes {
+			return nil, fmt.Errorf("invalid startup message length %d", size)
+		}
+		msg := make([]byte, size)
+		copy(msg, header)
+		if _, err := io.ReadFull(r, msg[8:]); err != nil {
+			return nil, err
+		}
+
+		switch binary.BigEndian.Uint32(header[4:]) {
+		case sslRequestCode, gssEncRequestCode:
+			if _, err := client.Write([]byte("N")); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		return msg, nil
+	}
+}
+
+// relayMessages reads the messages from the given reader and writes each of
+// them to the given writer, after passing its type and body to the given
+// capture function. It returns nil when the reader reaches the end of its
+// stream, or a Terminate message is relayed.
+func relayMessages(w io.Writer, r *bufio.Reader, capture func(typ byte, body []byte)) error {
+	for {
+		header := make([]byte, 5)
+		if _, err := io.ReadFull(r, header); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		size := binary.BigEndian.Uint32(header[1:])
+		if size < 4 {
+			return fmt.Errorf("invalid message length %d", size)
+		}
+		msg := make([]byte, 1+size)
+		copy(msg, header)
+		if _, err := io.ReadFull(r, msg[5:]); err != nil {
+			return err
+		}
+
+		capture(msg[0], msg[5:])
+		if _, err := w.Write(msg); err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		if msg[0] == 'X' {
+			return nil
+		}
+	}
+}
+
+// capturedStmt is a statement that was prepared or bound to a portal by a
+// client.
+type capturedStmt struct {
+	query string
+
+	// stmt is the prepared statement that was bound to this portal, or nil if
+	// this is a prepared statement.
+	stmt *capturedStmt
+
+	// fields describe the result columns of the statement, or are nil if it
+	// has not been described.
+	fields []pgproto3.FieldDescription
+
+	// formats are the result column format codes requested when the statement
+	// was bound to this portal.
+	formats []int16
+}
+
+// resultFields returns the description of the result columns of the given
+// portal, or nil if neither the portal nor its statement have been described.
+func (s *capturedStmt) resultFields() []pgproto3.FieldDescription {
+	if s.fields == nil && s.stmt != nil {
+		return s.stmt.fields
+	}
+	return s.fields
+}
+
+// pendingMessage is a message sent by a client, whose response from the server
+// has not yet been fully received.
+type pendingMessage struct {
+	// typ is the type of the message, like 'Q' for Query.
+	typ byte
+
+	// stmt is the statement that is the subject of the message, if any.
+	stmt *capturedStmt
+
+	// fields and rows are the result columns and rows of the statement, as
+	// they are received.
+	fields []pgproto3.FieldDescription
+	rows   [][]driver.Value
+
+	// done is true if the result of a Query message has been recorded, in
+	// which case the results of any further statements in the same query
+	// string are ignored.
+	done bool
+}
+
+// capturedConn builds the records of the statements executed on a proxied
+// connection, from the messages exchanged by the client and the server.
+type capturedConn struct {
+	mu sync.Mutex
+
+	// pending is the queue of messages sent by the client, which are answered
+	// by the server in order.
+	pending []*pendingMessage
+
+	// stmts and portals are the prepared statements and portals created by
+	// the client, by name.
+	stmts   map[string]*capturedStmt
+	portals map[string]*capturedStmt
+
+	records []copyist.Record
+}
+
+// clientMessage captures a message sent by the client.
+func (c *capturedConn) clientMessage(typ byte, body []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch typ {
+	case 'Q':
+		var msg pgproto3.Query
+		if msg.Decode(body) == nil {
+			c.push(&pendingMessage{typ: typ, stmt: &capturedStmt{query: msg.String}})
+		}
+
+	case 'P':
+		var msg pgproto3.Parse
+		if msg.Decode(body) == nil {
+			stmt := &capturedStmt{query: msg.Query}
+			c.stmts[msg.Name] = stmt
+			c.push(&pendingMessage{typ: typ, stmt: stmt})
+		}
+
+	case 'B':
+		var msg pgproto3.Bind
+		if msg.Decode(body) == nil {
+			stmt := c.stmts[msg.PreparedStatement]
+			if stmt == nil {
+				stmt = &capturedStmt{}
+			}
+			c.portals[msg.DestinationPortal] = &capturedStmt{
+				query:   stmt.query,
+				stmt:    stmt,
+				formats: msg.ResultFormatCodes,
+			}
+			c.push(&pendingMessage{typ: typ})
+		}
+
+	case 'D':
+		var msg pgproto3.Describe
+		if msg.Decode(body) == nil {
+			stmt := c.portals[msg.Name]
+			if msg.ObjectType == 'S' {
+				stmt = c.stmts[msg.Name]
+			}
+			c.push(&pendingMessage{typ: typ, stmt: stmt})
+		}
+
+	case 'E':
+		var msg pgproto3.Execute
+		if msg.Decode(body) == nil {
+			c.push(&pendingMessage{typ: typ, stmt: c.portals[msg.Portal]})
+		}
+
+	case 'C', 'S':
+		c.push(&pendingMessage{typ: typ})
+	}
+}
+
+// serverMessage captures a message sent by the server, which answers the
+// oldest pending client message.
+func (c *capturedConn) serverMessage(typ byte, body []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.pending) == 0 {
+		return
+	}
+	head := c.pending[0]
+
+	switch typ {
+	case '1', '2', '3', 'n':
+		// ParseComplete, BindComplete, CloseComplete and NoData complete the
+		// Parse, Bind, Close and Describe messages.
+		c.pop()
+
+	case 'T':
+		var msg pgproto3.RowDescription
+		if msg.Decode(body) != nil {
+			return
+		}
+		fields := append([]pgproto3.FieldDescription(nil), msg.Fields...)
+		switch head.typ {
+		case 'D':
+			if head.stmt != nil {
+				head.stmt.fields = fields
+			}
+			c.pop()
+		case 'Q':
+			head.fields, head.rows = fields, nil
+		}
+
+	case 'D':
+		var msg pgproto3.DataRow
+		if msg.Decode(body) != nil || head.done {
+			return
+		}
+		fields, formats := head.fields, []int16(nil)
+		if head.typ == 'E' && head.stmt != nil {
+			fields, formats = head.stmt.resultFields(), head.stmt.formats
+		}
+		row := make([]driver.Value, len(msg.Values))
+		for i, src := range msg.Values {
+			var oid uint32 = textOID
+			if i < len(fields) {
+				oid = fields[i].DataTypeOID
+			}
+			val, err := decodeValue(oid, src, resultFormat(formats, i) == 1)
+			if err != nil {
+				val = string(src)
+			}
+			row[i] = val
+		}
+		head.rows = append(head.rows, row)
+
+	case 'C', 's':
+		// CommandComplete and PortalSuspended complete the execution of a
+		// statement.
+		var tag string
+		if typ == 'C' {
+			var msg pgproto3.CommandComplete
+			if msg.Decode(body) == nil {
+				tag = string(msg.CommandTag)
+			}
+		}
+		switch head.typ {
+		case 'Q':
+			if !head.done {
+				c.recordStatement(head, tag, nil)
+				head.done = true
+			}
+		case 'E':
+			c.recordStatement(head, tag, nil)
+			c.pop()
+		}
+
+	case 'I':
+		// EmptyQueryResponse answers an empty query string.
+		if head.typ == 'E' {
+			c.pop()
+		}
+
+	case 'E':
+		var msg pgproto3.ErrorResponse
+		if msg.Decode(body) != nil {
+			return
+		}
+		err := &pgconn.PgError{
+			Severity:         msg.Severity,
+			Code:             msg.Code,
+			Message:          msg.Message,
+			Detail:           msg.Detail,
+			Hint:             msg.Hint,
+			Position:         msg.Position,
+			InternalPosition: msg.InternalPosition,
+			InternalQuery:    msg.InternalQuery,
+			Where:            msg.Where,
+			SchemaName:       msg.SchemaName,
+			TableName:        msg.TableName,
+			ColumnName:       msg.ColumnName,
+			DataTypeName:     msg.DataTypeName,
+			ConstraintName:   msg.ConstraintName,
+			File:             msg.File,
+			Line:             msg.Line,
+			Routine:          msg.Routine,
+		}
+		switch head.typ {
+		case 'Q':
+			if !head.done {
+				c.recordStatement(head, "", err)
+				head.done = true
+			}
+			return
+		case 'P':
+			c.records = append(c.records,
+				copyist.Record{Type: "ConnPrepare", Args: []interface{}{head.stmt.query, err}})
+		case 'E':
+			c.recordStatement(head, "", err)
+		}
+
+		// After an error, the server ignores the client's messages until the
+		// next Sync message.
+		for len(c.pending) > 0 && c.pending[0].typ != 'S' {
+			c.pop()
+		}
+
+	case 'Z':
+		// ReadyForQuery completes the Sync or Query message.
+		for len(c.pending) > 0 {
+			typ := c.pop().typ
+			if typ == 'S' || typ == 'Q' {
+				break
+			}
+		}
+	}
+}
+
+// recordStatement appends the records of a statement that was executed by the
+// given message, and completed with the given command tag or error.
+func (c *capturedConn) recordStatement(msg *pendingMessage, tag string, err error) {
+	if msg.stmt == nil {
+		return
+	}
+	query := msg.stmt.query
+
+	switch strings.ToUpper(commandTag(query, 0)) {
+	case "BEGIN":
+		c.records = append(c.records, copyist.Record{Type: "ConnBegin", Args: []interface{}{err}})
+		return
+	case "COMMIT", "END":
+		c.records = append(c.records, copyist.Record{Type: "TxCommit", Args: []interface{}{err}})
+		return
+	case "ROLLBACK", "ABORT":
+		c.records = append(c.records, copyist.Record{Type: "TxRollback", Args: []interface{}{err}})
+		return
+	}
+
+	fields := msg.fields
+	if msg.typ == 'E' {
+		fields = msg.stmt.resultFields()
+	}
+
+	if err != nil {
+		typ := "ConnExec"
+		if fields != nil || returnsRows(query) {
+			typ = "ConnQuery"
+		}
+		c.records = append(c.records, copyist.Record{Type: typ, Args: []interface{}{query, err}})
+		return
+	}
+
+	if fields == nil {
+		c.records = append(c.records,
+			copyist.Record{Type: "ConnExec", Args: []interface{}{query, nil}},
+			copyist.Record{Type: "ResultRowsAffected", Args: []interface{}{tagRowsAffected(tag), nil}})
+		return
+	}
+
+	columns := make([]string, len(fields))
+	for i := range fields {
+		columns[i] = string(fields[i].Name)
+	}
+	c.records = append(c.records,
+		copyist.Record{Type: "ConnQuery", Args: []interface{}{query, nil}},
+		copyist.Record{Type: "RowsColumns", Args: []interface{}{columns}})
+	for _, row := range msg.rows {
+		c.records = append(c.records, copyist.Record{Type: "RowsNext", Args: []interface{}{row, nil}})
+	}
+	c.records = append(c.records,
+		copyist.Record{Type: "RowsNext", Args: []interface{}{[]driver.Value{}, io.EOF}})
+}
+
+// push adds the given client message to the end of the pending queue.
+func (c *capturedConn) push(msg *pendingMessage) {
+	c.pending = append(c.pending, msg)
+}
+
+// pop removes and returns the oldest client message in the pending queue.
+func (c *capturedConn) pop() *pendingMessage {
+	msg := c.pending[0]
+	c.pending = c.pending[1:]
+	return msg
+}
+
+// tagRowsAffected returns the number of rows affected by a statement, as given
+// by the last field of its command tag (e.g. "INSERT 0 3"), or zero if the tag
+// does not have a row count.
+func tagRowsAffected(tag string) int64 {
+	fields := strings.Fields(tag)
+	if len(fields) < 2 {
+		return 0
+	}
+	n, err := strconv.ParseInt(fields[len(fields)-1], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return n
+}
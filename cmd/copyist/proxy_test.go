@@ -0,0 +1,134 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/cockroachdb/copyist"
+	"github.com/jackc/pgconn"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy(t *testing.T) {
+	// Proxy a server that answers from the records that are expected to be
+	// captured by the proxy.
+	expected := []copyist.Record{
+		{Type: "DriverOpen", Args: []interface{}{nil}},
+		{Type: "ConnBegin", Args: []interface{}{nil}},
+		{Type: "ConnExec", Args: []interface{}{"DELETE FROM customers", nil}},
+		{Type: "ResultRowsAffected", Args: []interface{}{int64(3), nil}},
+		{Type: "ConnQuery", Args: []interface{}{"SELECT id, name FROM customers WHERE id=$1", nil}},
+		{Type: "RowsColumns", Args: []interface{}{[]string{"id", "name"}}},
+		{Type: "RowsNext", Args: []interface{}{[]driver.Value{int64(1), "Andy"}, nil}},
+		{Type: "RowsNext", Args: []interface{}{[]driver.Value{}, io.EOF}},
+		{Type: "TxCommit", Args: []interface{}{nil}},
+		{Type: "ConnExec", Args: []interface{}{
+			"INSERT INTO customers VALUES (1)",
+			&pgconn.PgError{Severity: "ERROR", Code: "23505", Message: "duplicate key value"},
+		}},
+	}
+	responses, err := recordedResponses(expected)
+	require.NoError(t, err)
+
+	serverLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer serverLn.Close()
+	go serve(serverLn, responses)
+
+	proxyLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer proxyLn.Close()
+	recorded := make(chan []copyist.Record, 1)
+	go func() {
+		conn, err := proxyLn.Accept()
+		if err != nil {
+			close(recorded)
+			return
+		}
+		records, _ := proxyConn(conn, serverLn.Addr().String())
+		recorded <- records
+	}()
+
+	db, err := sql.Open("postgres", fmt.Sprintf("postgres://root@%s/db?sslmode=disable", proxyLn.Addr()))
+	require.NoError(t, err)
+	db.SetMaxOpenConns(1)
+
+	tx, err := db.Begin()
+	require.NoError(t, err)
+	_, err = tx.Exec("DELETE FROM customers")
+	require.NoError(t, err)
+	var id int
+	var name string
+	err = tx.QueryRow("SELECT id, name FROM customers WHERE id=$1", 1).Scan(&id, &name)
+	require.NoError(t, err)
+	require.Equal(t, "Andy", name)
+	require.NoError(t, tx.Commit())
+
+	_, err = db.Exec("INSERT INTO customers VALUES (1)")
+	require.Error(t, err)
+	require.Equal(t, pq.ErrorCode("23505"), err.(*pq.Error).Code)
+	require.NoError(t, db.Close())
+
+	records := <-recorded
+	require.Len(t, records, len(expected))
+	for i := range expected {
+		if pgErr, ok := records[i].Args[len(records[i].Args)-1].(*pgconn.PgError); ok {
+			require.Equal(t, "23505", pgErr.Code)
+			require.Equal(t, "duplicate key value", pgErr.Message)
+			continue
+		}
+		require.Equal(t, expected[i], records[i])
+	}
+}
+
+func TestDecodeValue(t *testing.T) {
+	for _, val := range []driver.Value{
+		int64(-42), float64(1.5), true, false, "abc", []byte{1, 2}, postgresEpoch.Add(1e9),
+	} {
+		for _, binaryFormat := range []bool{false, true} {
+			decoded, err := decodeValue(valueOID(val), encodeValue(val, binaryFormat), binaryFormat)
+			require.NoError(t, err)
+			require.EqualValues(t, val, decoded)
+		}
+	}
+
+	val, err := decodeValue(int4OID, []byte{0xff, 0xff, 0xff, 0xfe}, true)
+	require.NoError(t, err)
+	require.Equal(t, int64(-2), val)
+	val, err = decodeValue(int2OID, []byte{0x80, 0x00}, true)
+	require.NoError(t, err)
+	require.Equal(t, int64(-32768), val)
+
+	// Binary integers must have the length of their type.
+	_, err = decodeValue(int4OID, []byte{0xff, 0xfe}, true)
+	require.EqualError(t, err, "invalid int4 of length 2")
+	_, err = decodeValue(int8OID, make([]byte, 9), true)
+	require.EqualError(t, err, "invalid int8 of length 9")
+	_, err = decodeValue(int2OID, []byte{}, true)
+	require.EqualError(t, err, "invalid int2 of length 0")
+}
+
+func TestTagRowsAffected(t *testing.T) {
+	require.Equal(t, int64(3), tagRowsAffected("INSERT 0 3"))
+	require.Equal(t, int64(5), tagRowsAffected("UPDATE 5"))
+	require.Equal(t, int64(0), tagRowsAffected("CREATE TABLE"))
+}
@@ -0,0 +1,158 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/cockroachdb/copyist/internal/recdir"
+)
+
+var pruneCommand = &command{
+	name:  "prune",
+	usage: "[-n] [-force] [-dir dir] [packages]",
+	short: "delete recordings that have no corresponding test",
+	run:   runPrune,
+}
+
+// testNameRegex matches the names of tests printed by "go test -list".
+var testNameRegex = regexp.MustCompile(`^(Test|Benchmark|Example|Fuzz)\w*$`)
+
+// runPrune lists the tests in each package using "go test -list", and then
+// deletes the package's recordings whose top-level test name is not in that
+// list. Packages default to "./...".
+func runPrune(cmd *command, args []string) error {
+	fs := newFlagSet(cmd)
+	dryRun := fs.Bool("n", false, "report orphaned recordings without deleting them")
+	force := fs.Bool("force", false,
+		"also delete recordings that are not named after a test, such as those made by "+
+			"copyist.OpenNamed")
+	recordingDir := fs.String("dir", os.Getenv("COPYIST_RECORDING_DIR"),
+		"directory that recordings are stored in instead of testdata directories, as set by "+
+			"copyist.SetRecordingDir (defaults to COPYIST_RECORDING_DIR)")
+	fs.Parse(args)
+
+	packages := fs.Args()
+	if len(packages) == 0 {
+		packages = []string{"./..."}
+	}
+
+	// Get the import path and directory of each package.
+	listArgs := append([]string{"list", "-f", "{{.ImportPath}}\t{{.Dir}}"}, packages...)
+	out, err := exec.Command("go", listArgs...).Output()
+	if err != nil {
+		return fmt.Errorf("go list failed: %v", err)
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), "\t", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		importPath, dirName := fields[0], fields[1]
+
+		files, err := filepath.Glob(
+			filepath.Join(recdir.PackageDir(dirName, *recordingDir), "*"+recordingExt))
+		if err != nil {
+			return err
+		}
+		if len(files) == 0 {
+			continue
+		}
+
+		tests, err := listTests(importPath)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			if err := pruneRecordingFile(file, tests, *dryRun, *force, os.Stdout); err != nil {
+				return fmt.Errorf("%s: %v", file, err)
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// listTests returns the set of top-level test names in the given package, as
+// reported by "go test -list".
+func listTests(importPath string) (map[string]bool, error) {
+	out, err := exec.Command("go", "test", "-list", ".", importPath).Output()
+	if err != nil {
+		return nil, fmt.Errorf("go test -list %s failed: %v", importPath, err)
+	}
+
+	tests := make(map[string]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		if line := scanner.Text(); testNameRegex.MatchString(line) {
+			tests[line] = true
+		}
+	}
+	return tests, scanner.Err()
+}
+
+// pruneRecordingFile reports recordings in the given recording file whose
+// top-level test name is not in the given set of tests. Unless dryRun is true,
+// it also deletes them. If no recordings remain, the file is deleted.
+// Recordings that are not named after a test, such as those made by
+// copyist.OpenNamed, cannot be matched with a test, so they are skipped unless
+// force is true.
+func pruneRecordingFile(
+	pathName string, tests map[string]bool, dryRun, force bool, w io.Writer,
+) error {
+	file, err := readRecordingFile(pathName)
+	if err != nil {
+		return err
+	}
+
+	var pruned int
+	names := file.RecordingNames()
+	for _, name := range names {
+		// Sub-test recordings are named like "TestFoo/bar", and recordings of
+		// variants are named like "TestFoo@v21.1".
+		testName := name
+		if index := strings.IndexAny(testName, "/@"); index != -1 {
+			testName = testName[:index]
+		}
+		if tests[testName] {
+			continue
+		}
+		if !force && !testNameRegex.MatchString(testName) {
+			fmt.Fprintf(w, "%s: %s (skipped, not named after a test)\n", pathName, name)
+			continue
+		}
+
+		fmt.Fprintf(w, "%s: %s\n", pathName, name)
+		file.DeleteRecording(name)
+		pruned++
+	}
+
+	if dryRun || pruned == 0 {
+		return nil
+	}
+	if pruned == len(names) {
+		return os.Remove(pathName)
+	}
+	return file.Write()
+}
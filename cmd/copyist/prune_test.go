@@ -0,0 +1,118 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testRecording = `1=DriverOpen	1:nil
+2=ConnQuery	2:"SELECT name FROM customers WHERE id=$1"	1:nil
+3=RowsColumns	9:["name"]
+4=RowsNext	11:[2:"Andy"]	1:nil
+5=RowsNext	11:[]	7:"EOF"
+6=ConnExec	2:"DELETE FROM customers"	1:nil
+
+"TestQuery"=1,2,3,4,5
+"TestQuery/subtest"=1,2,3,5
+"TestRenamed"=1,6
+`
+
+// writeTestRecording writes the test recording to a temporary file and returns
+// its path.
+func writeTestRecording(t *testing.T) string {
+	pathName := filepath.Join(t.TempDir(), "test.copyist")
+	require.NoError(t, os.WriteFile(pathName, []byte(testRecording), 0666))
+	return pathName
+}
+
+func TestPrune(t *testing.T) {
+	pathName := writeTestRecording(t)
+	tests := map[string]bool{"TestQuery": true}
+
+	// Dry run.
+	var out bytes.Buffer
+	require.NoError(t, pruneRecordingFile(pathName, tests, true /* dryRun */, false /* force */, &out))
+	require.Equal(t, pathName+": TestRenamed\n", out.String())
+	file, err := readRecordingFile(pathName)
+	require.NoError(t, err)
+	require.Equal(t, []string{"TestQuery", "TestQuery/subtest", "TestRenamed"}, file.RecordingNames())
+
+	// Delete orphaned recordings.
+	out.Reset()
+	require.NoError(t, pruneRecordingFile(pathName, tests, false /* dryRun */, false /* force */, &out))
+	require.Equal(t, pathName+": TestRenamed\n", out.String())
+	file, err = readRecordingFile(pathName)
+	require.NoError(t, err)
+	require.Equal(t, []string{"TestQuery", "TestQuery/subtest"}, file.RecordingNames())
+
+	// Delete the file once no recordings remain.
+	require.NoError(t, pruneRecordingFile(pathName, nil, false /* dryRun */, false /* force */, &out))
+	_, err = os.Stat(pathName)
+	require.True(t, os.IsNotExist(err))
+
+	// Recordings of variants belong to their unqualified test.
+	require.NoError(t, os.WriteFile(pathName, []byte(`1=DriverOpen	1:nil
+
+"TestQuery@v21.1"=1
+"TestQuery/subtest@v21.1"=1
+"TestRenamed@v21.1"=1
+`), 0666))
+	out.Reset()
+	require.NoError(t, pruneRecordingFile(pathName, tests, true /* dryRun */, false /* force */, &out))
+	require.Equal(t, pathName+": TestRenamed@v21.1\n", out.String())
+}
+
+// TestPruneUnnamed tests that recordings that are not named after a test, such
+// as those made by copyist.OpenNamed, are only deleted if forced.
+func TestPruneUnnamed(t *testing.T) {
+	pathName := filepath.Join(t.TempDir(), "test.copyist")
+	require.NoError(t, os.WriteFile(pathName, []byte(`1=DriverOpen	1:nil
+
+"TestQuery"=1
+"TestRenamed"=1
+"login flow"=1
+`), 0666))
+	tests := map[string]bool{"TestQuery": true}
+
+	var out bytes.Buffer
+	require.NoError(t, pruneRecordingFile(pathName, tests, false /* dryRun */, false /* force */, &out))
+	require.Equal(t, pathName+": TestRenamed\n"+
+		pathName+": login flow (skipped, not named after a test)\n", out.String())
+	file, err := readRecordingFile(pathName)
+	require.NoError(t, err)
+	require.Equal(t, []string{"TestQuery", "login flow"}, file.RecordingNames())
+
+	// The file is kept while it has skipped recordings.
+	out.Reset()
+	require.NoError(t, pruneRecordingFile(pathName, nil, false /* dryRun */, false /* force */, &out))
+	require.Equal(t, pathName+": TestQuery\n"+
+		pathName+": login flow (skipped, not named after a test)\n", out.String())
+	file, err = readRecordingFile(pathName)
+	require.NoError(t, err)
+	require.Equal(t, []string{"login flow"}, file.RecordingNames())
+
+	// Forced.
+	out.Reset()
+	require.NoError(t, pruneRecordingFile(pathName, nil, false /* dryRun */, true /* force */, &out))
+	require.Equal(t, pathName+": login flow\n", out.String())
+	_, err = os.Stat(pathName)
+	require.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,272 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/cockroachdb/copyist/drivertest/dockerdb"
+	"github.com/cockroachdb/copyist/internal/recdir"
+)
+
+var recordCommand = &command{
+	name: "record",
+	usage: "[-image name -dsn dsn [-tag tag] [-port host:container]... [-env name=value]... " +
+		"[-cmd command] [-driver name]] [-versions v1,v2] [-clean] [-dir dir] [-p n] " +
+		"[packages] [-- go test flags]",
+	short: "re-record tests, running a database in docker while they run",
+	run:   runRecord,
+}
+
+// recordOptions configures a run of the record command.
+type recordOptions struct {
+	image          string
+	tag            string
+	ports          stringList
+	env            stringList
+	command        string
+	driverName     string
+	dataSourceName string
+	versions       []string
+	clean          bool
+	recordingDir   string
+	parallel       int
+	packages       []string
+	testArgs       []string
+}
+
+// runRecord starts a database in docker (if configured), runs "go test" in
+// recording mode for the given packages, and then tears down the database. If
+// a list of versions is given, then this is repeated for each version, with
+// recordings qualified by the version (see copyist.SetVariant).
+func runRecord(cmd *command, args []string) error {
+	opts, err := parseRecordArgs(cmd, args)
+	if err != nil {
+		return err
+	}
+
+	if opts.clean {
+		dirNames, err := packageDirs(opts.packages)
+		if err != nil {
+			return err
+		}
+		if err := deleteRecordingFiles(dirNames, opts.recordingDir, os.Stdout); err != nil {
+			return err
+		}
+	}
+
+	if len(opts.versions) == 0 {
+		return recordVersion(opts, "")
+	}
+	for _, version := range opts.versions {
+		fmt.Printf("recording against version %s\n", version)
+		if err := recordVersion(opts, version); err != nil {
+			return fmt.Errorf("version %s: %v", version, err)
+		}
+	}
+	return nil
+}
+
+// parseRecordArgs parses the arguments of the record command. Arguments after
+// "--" are passed through to "go test".
+func parseRecordArgs(cmd *command, args []string) (recordOptions, error) {
+	fs := newFlagSet(cmd)
+	var opts recordOptions
+	fs.StringVar(&opts.image, "image", "",
+		`docker image that runs the database (e.g. "cockroachdb/cockroach"), if any`)
+	fs.StringVar(&opts.tag, "tag", "",
+		"tag of the docker image; overridden by -versions and COPYIST_DOCKER_TAG")
+	fs.Var(&opts.ports, "port", "publish a container port on the host, given as host:container "+
+		"(can be repeated)")
+	fs.Var(&opts.env, "env", "set an environment variable in the container, given as "+
+		"name=value (can be repeated)")
+	fs.StringVar(&opts.command, "cmd", "",
+		"command and arguments to run in the container, instead of the image's default")
+	fs.StringVar(&opts.driverName, "driver", "postgres",
+		"name of the SQL driver used to check that the database is ready")
+	fs.StringVar(&opts.dataSourceName, "dsn", "",
+		"data source name used to check that the database is ready")
+	versions := fs.String("versions", "",
+		"comma-separated list of database versions to record against, used as the tag "+
+			"of the docker image")
+	fs.BoolVar(&opts.clean, "clean", false,
+		"delete existing recording files of the packages first")
+	fs.StringVar(&opts.recordingDir, "dir", os.Getenv("COPYIST_RECORDING_DIR"),
+		"directory that recordings are stored in instead of testdata directories, as set by "+
+			"copyist.SetRecordingDir (defaults to COPYIST_RECORDING_DIR)")
+	fs.IntVar(&opts.parallel, "p", 1, "number of packages to record in parallel")
+	fs.Parse(args)
+
+	// The flag package consumes the "--" if it comes before any packages.
+	opts.packages = fs.Args()
+	if n := len(args) - len(opts.packages); n > 0 && args[n-1] == "--" {
+		opts.packages, opts.testArgs = nil, opts.packages
+	}
+	for i, arg := range opts.packages {
+		if arg == "--" {
+			opts.packages, opts.testArgs = opts.packages[:i], opts.packages[i+1:]
+			break
+		}
+	}
+	if len(opts.packages) == 0 {
+		opts.packages = []string{"./..."}
+	}
+	if *versions != "" {
+		opts.versions = strings.Split(*versions, ",")
+	}
+
+	if opts.image != "" && opts.dataSourceName == "" {
+		return recordOptions{}, fmt.Errorf("-dsn must be specified with -image")
+	}
+	return opts, nil
+}
+
+// containerConfig returns the configuration of the docker container that runs
+// the given version of the database, or the configured tag if the version is
+// empty.
+func (opts recordOptions) containerConfig(version string) (dockerdb.Config, error) {
+	cfg := dockerdb.Config{
+		DriverName:     opts.driverName,
+		DataSourceName: opts.dataSourceName,
+		Image:          opts.image,
+		Tag:            opts.tag,
+		Command:        strings.Fields(opts.command),
+	}
+	if version != "" {
+		cfg.Tag = version
+	}
+
+	for _, port := range opts.ports {
+		hostPort, containerPort := port, port
+		if index := strings.Index(port, ":"); index != -1 {
+			hostPort, containerPort = port[:index], port[index+1:]
+		}
+		host, err := strconv.Atoi(hostPort)
+		if err != nil {
+			return dockerdb.Config{}, fmt.Errorf("invalid port %q", port)
+		}
+		container, err := strconv.Atoi(containerPort)
+		if err != nil {
+			return dockerdb.Config{}, fmt.Errorf("invalid port %q", port)
+		}
+		cfg.Ports = append(cfg.Ports, dockerdb.Port{Host: host, Container: container})
+	}
+
+	for _, env := range opts.env {
+		index := strings.Index(env, "=")
+		if index == -1 {
+			return dockerdb.Config{}, fmt.Errorf("expected name=value: %s", env)
+		}
+		if cfg.Env == nil {
+			cfg.Env = make(map[string]string)
+		}
+		cfg.Env[env[:index]] = env[index+1:]
+	}
+	return cfg, nil
+}
+
+// recordVersion records the tests against the given version of the database,
+// or against the configured database if the version is empty.
+func recordVersion(opts recordOptions, version string) error {
+	if opts.image != "" {
+		cfg, err := opts.containerConfig(version)
+		if err != nil {
+			return err
+		}
+		c, err := dockerdb.StartContainer(cfg)
+		if err != nil {
+			return fmt.Errorf("could not start database: %v", err)
+		}
+		defer c.Close()
+	}
+
+	goTest := exec.Command("go", goTestArgs(opts)...)
+	goTest.Env = append(os.Environ(), "COPYIST_RECORD=1")
+	goTest.Stdout = os.Stdout
+	goTest.Stderr = os.Stderr
+	if opts.recordingDir != "" {
+		goTest.Env = append(goTest.Env, "COPYIST_RECORDING_DIR="+opts.recordingDir)
+	}
+
+	// Qualify recordings with the version, and have test packages that start
+	// their own database containers using dockerdb run that version.
+	if version != "" {
+		goTest.Env = append(goTest.Env, "COPYIST_VARIANT="+version, "COPYIST_DOCKER_TAG="+version)
+	}
+
+	// Test packages that start their own database containers using dockerdb
+	// share them, rather than each starting a new one. The shared containers
+	// are removed once all packages have been recorded.
+	if os.Getenv("COPYIST_DOCKER_REUSE") == "" {
+		goTest.Env = append(goTest.Env, "COPYIST_DOCKER_REUSE=1")
+		defer dockerdb.RemoveReusedContainers()
+	}
+	return goTest.Run()
+}
+
+// goTestArgs returns the arguments passed to "go" in order to run the tests of
+// the configured packages.
+func goTestArgs(opts recordOptions) []string {
+	args := []string{"test", "-count=1", "-p=" + strconv.Itoa(opts.parallel)}
+	args = append(args, opts.packages...)
+	return append(args, opts.testArgs...)
+}
+
+// packageDirs returns the directories of the given packages, as reported by
+// "go list".
+func packageDirs(packages []string) ([]string, error) {
+	listArgs := append([]string{"list", "-f", "{{.Dir}}"}, packages...)
+	out, err := exec.Command("go", listArgs...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("go list failed: %v", err)
+	}
+
+	var dirNames []string
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		if dirName := scanner.Text(); dirName != "" {
+			dirNames = append(dirNames, dirName)
+		}
+	}
+	return dirNames, scanner.Err()
+}
+
+// deleteRecordingFiles deletes the recording files of the packages in the given
+// directories, so that they can be recorded from a clean slate. See
+// recdir.PackageDir for where the recording files are located.
+func deleteRecordingFiles(dirNames []string, recordingDir string, w io.Writer) error {
+	for _, dirName := range dirNames {
+		files, err := filepath.Glob(
+			filepath.Join(recdir.PackageDir(dirName, recordingDir), "*"+recordingExt))
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			fmt.Fprintf(w, "deleting %s\n", file)
+			if err := os.Remove(file); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cockroachdb/copyist/drivertest/dockerdb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRecordArgs(t *testing.T) {
+	// Defaults.
+	opts, err := parseRecordArgs(recordCommand, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"./..."}, opts.packages)
+	require.Nil(t, opts.testArgs)
+	require.Equal(t, "postgres", opts.driverName)
+	require.False(t, opts.clean)
+	require.Equal(t, []string{"test", "-count=1", "-p=1", "./..."}, goTestArgs(opts))
+
+	// Arguments after "--" are passed through to "go test".
+	opts, err = parseRecordArgs(recordCommand, []string{
+		"-clean", "-p", "4", "-dir", "recordings", "./store", "./api/...",
+		"--", "-run", "TestQuery", "-v",
+	})
+	require.NoError(t, err)
+	require.True(t, opts.clean)
+	require.Equal(t, "recordings", opts.recordingDir)
+	require.Equal(t, []string{"./store", "./api/..."}, opts.packages)
+	require.Equal(t, []string{"-run", "TestQuery", "-v"}, opts.testArgs)
+	require.Equal(t, []string{"test", "-count=1", "-p=4", "./store", "./api/...", "-run",
+		"TestQuery", "-v"}, goTestArgs(opts))
+
+	// Packages default to "./..." even if there are go test flags.
+	opts, err = parseRecordArgs(recordCommand, []string{"--", "-short"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"./..."}, opts.packages)
+	require.Equal(t, []string{"-short"}, opts.testArgs)
+
+	// A data source name is needed to check that the database is ready.
+	_, err = parseRecordArgs(recordCommand, []string{"-image", "cockroachdb/cockroach"})
+	require.EqualError(t, err, "-dsn must be specified with -image")
+}
+
+func TestRecordContainerConfig(t *testing.T) {
+	opts, err := parseRecordArgs(recordCommand, []string{
+		"-image", "cockroachdb/cockroach", "-tag", "v20.2.4",
+		"-port", "26257:26257", "-port", "8080",
+		"-env", "COCKROACH_USER=root", "-cmd", "start-single-node --insecure",
+		"-dsn", "postgresql://root@localhost:26257?sslmode=disable",
+		"-versions", "v21.1.0,v21.2.0",
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"v21.1.0", "v21.2.0"}, opts.versions)
+
+	expected := dockerdb.Config{
+		DriverName:     "postgres",
+		DataSourceName: "postgresql://root@localhost:26257?sslmode=disable",
+		Image:          "cockroachdb/cockroach",
+		Tag:            "v20.2.4",
+		Env:            map[string]string{"COCKROACH_USER": "root"},
+		Ports:          []dockerdb.Port{{Host: 26257, Container: 26257}, {Host: 8080, Container: 8080}},
+		Command:        []string{"start-single-node", "--insecure"},
+	}
+	cfg, err := opts.containerConfig("")
+	require.NoError(t, err)
+	require.Equal(t, expected, cfg)
+
+	// Versions are used as the tag of the docker image.
+	expected.Tag = "v21.1.0"
+	cfg, err = opts.containerConfig("v21.1.0")
+	require.NoError(t, err)
+	require.Equal(t, expected, cfg)
+
+	opts.ports = stringList{"abc"}
+	_, err = opts.containerConfig("")
+	require.EqualError(t, err, `invalid port "abc"`)
+
+	opts.ports = nil
+	opts.env = stringList{"COCKROACH_USER"}
+	_, err = opts.containerConfig("")
+	require.EqualError(t, err, "expected name=value: COCKROACH_USER")
+}
+
+func TestDeleteRecordingFiles(t *testing.T) {
+	dirName := t.TempDir()
+	pkgDir := filepath.Join(dirName, "store")
+	recordingDir := filepath.Join(dirName, "recordings")
+	for _, path := range []string{
+		filepath.Join(pkgDir, "testdata", "store_test.copyist"),
+		filepath.Join(pkgDir, "testdata", "golden.json"),
+		filepath.Join(recordingDir, "store", "store_test.copyist"),
+	} {
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0777))
+		require.NoError(t, os.WriteFile(path, nil, 0666))
+	}
+
+	// Only recording files in the testdata directory are deleted.
+	var out bytes.Buffer
+	require.NoError(t, deleteRecordingFiles([]string{pkgDir}, "", &out))
+	require.Equal(t, "deleting "+filepath.Join(pkgDir, "testdata", "store_test.copyist")+"\n",
+		out.String())
+	_, err := os.Stat(filepath.Join(pkgDir, "testdata", "golden.json"))
+	require.NoError(t, err)
+	_, err = os.Stat(filepath.Join(recordingDir, "store", "store_test.copyist"))
+	require.NoError(t, err)
+
+	// Recording files in a custom recording directory are deleted.
+	out.Reset()
+	require.NoError(t, deleteRecordingFiles([]string{pkgDir}, recordingDir, &out))
+	require.Equal(t, "deleting "+filepath.Join(recordingDir, "store", "store_test.copyist")+"\n",
+		out.String())
+	_, err = os.Stat(filepath.Join(recordingDir, "store", "store_test.copyist"))
+	require.True(t, os.IsNotExist(err))
+}
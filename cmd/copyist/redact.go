@@ -0,0 +1,232 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/cockroachdb/copyist"
+)
+
+var redactCommand = &command{
+	name:  "redact",
+	usage: "[-column name]... [-regex pattern]... [-with replacement] [-n] [files or directories]",
+	short: "scrub sensitive values from recordings without re-recording",
+	run:   runRedact,
+}
+
+// stringList is a flag.Value that accumulates the values of a flag that can be
+// specified multiple times.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// redactor applies redaction rules to the records in a recording.
+type redactor struct {
+	// columns is the set of column names whose row values are redacted.
+	columns map[string]bool
+
+	// regexes match substrings of string values that are redacted.
+	regexes []*regexp.Regexp
+
+	// replacement is the string that replaces redacted strings.
+	replacement string
+}
+
+// runRedact rewrites recording files, redacting row values in the given columns
+// and substrings of values that match the given regular expressions.
+func runRedact(cmd *command, args []string) error {
+	fs := newFlagSet(cmd)
+	var columns, regexes stringList
+	fs.Var(&columns, "column", "redact row values in columns with this name (can be repeated)")
+	fs.Var(&regexes, "regex", "redact substrings of values that match this regular expression "+
+		"(can be repeated)")
+	replacement := fs.String("with", "REDACTED", "replacement for redacted strings")
+	dryRun := fs.Bool("n", false, "report recordings that would change without rewriting them")
+	fs.Parse(args)
+
+	if len(columns) == 0 && len(regexes) == 0 {
+		return fmt.Errorf("at least one -column or -regex rule must be specified")
+	}
+
+	r := &redactor{columns: make(map[string]bool), replacement: *replacement}
+	for _, column := range columns {
+		r.columns[column] = true
+	}
+	for _, pattern := range regexes {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return err
+		}
+		r.regexes = append(r.regexes, re)
+	}
+
+	files, err := findRecordingFiles(fs.Args())
+	if err != nil {
+		return err
+	}
+	for _, fileName := range files {
+		if err := r.redactFile(fileName, *dryRun, os.Stdout); err != nil {
+			return fmt.Errorf("%s: %v", fileName, err)
+		}
+	}
+	return nil
+}
+
+// redactFile applies the redaction rules to every recording in the given file,
+// and rewrites it if any recordings changed (unless dryRun is true).
+func (r *redactor) redactFile(fileName string, dryRun bool, w io.Writer) error {
+	file, err := readRecordingFile(fileName)
+	if err != nil {
+		return err
+	}
+
+	changed := false
+	for _, name := range file.RecordingNames() {
+		records, err := file.Recording(name)
+		if err != nil {
+			return err
+		}
+		if !r.redactRecording(records) {
+			continue
+		}
+
+		fmt.Fprintf(w, "%s: redacted %q\n", fileName, name)
+		if err := file.SetRecording(name, records); err != nil {
+			return err
+		}
+		changed = true
+	}
+
+	if !changed || dryRun {
+		return nil
+	}
+	return file.Write()
+}
+
+// redactRecording applies the redaction rules to the given records in place,
+// and returns true if any values were changed.
+func (r *redactor) redactRecording(records []copyist.Record) bool {
+	changed := false
+	var columns []string
+	for i := range records {
+		rec := &records[i]
+		switch rec.Type {
+		case "RowsColumns":
+			columns, _ = rec.Args[0].([]string)
+			continue
+
+		case "ConnExec", "ConnQuery", "ConnPrepare", "PgConnSend":
+			// Don't redact the SQL text, since playback compares it to the
+			// SQL text the application sends.
+			for j := 1; j < len(rec.Args); j++ {
+				changed = r.redactArg(&rec.Args[j]) || changed
+			}
+			continue
+
+		case "RowsNext":
+			if row, ok := rec.Args[0].([]driver.Value); ok {
+				for j := range row {
+					if j < len(columns) && r.columns[columns[j]] {
+						redacted := r.redactColumnValue(row[j])
+						if !reflect.DeepEqual(redacted, row[j]) {
+							row[j] = redacted
+							changed = true
+						}
+						continue
+					}
+					changed = r.redactValue(&row[j]) || changed
+				}
+			}
+			continue
+		}
+
+		for j := range rec.Args {
+			changed = r.redactArg(&rec.Args[j]) || changed
+		}
+	}
+	return changed
+}
+
+// redactArg applies the regular expression rules to the given record argument.
+func (r *redactor) redactArg(arg *interface{}) bool {
+	if row, ok := (*arg).([]driver.Value); ok {
+		changed := false
+		for i := range row {
+			changed = r.redactValue(&row[i]) || changed
+		}
+		return changed
+	}
+	val := driver.Value(*arg)
+	changed := r.redactValue(&val)
+	*arg = val
+	return changed
+}
+
+// redactValue applies the regular expression rules to the given value, if it
+// is a string or byte slice.
+func (r *redactor) redactValue(val *driver.Value) bool {
+	switch t := (*val).(type) {
+	case string:
+		if redacted := r.redactString(t); redacted != t {
+			*val = redacted
+			return true
+		}
+	case []byte:
+		if redacted := r.redactString(string(t)); redacted != string(t) {
+			*val = []byte(redacted)
+			return true
+		}
+	}
+	return false
+}
+
+// redactString replaces substrings of the given string that match any of the
+// regular expressions.
+func (r *redactor) redactString(s string) string {
+	for _, re := range r.regexes {
+		s = re.ReplaceAllLiteralString(s, r.replacement)
+	}
+	return s
+}
+
+// redactColumnValue returns the redacted form of a value in a redacted column.
+// Strings and byte slices are replaced, and other types are replaced with the
+// zero value of their type, so that the application sees the same column type.
+func (r *redactor) redactColumnValue(val driver.Value) driver.Value {
+	switch t := val.(type) {
+	case nil:
+		return nil
+	case string:
+		return r.replacement
+	case []byte:
+		return []byte(r.replacement)
+	default:
+		return reflect.Zero(reflect.TypeOf(t)).Interface()
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedact(t *testing.T) {
+	pathName := filepath.Join(t.TempDir(), "redact.copyist")
+	require.NoError(t, os.WriteFile(pathName, []byte(`1=DriverOpen	1:nil
+2=ConnQuery	2:"SELECT name, email, born FROM users WHERE email='andy@example.com'"	1:nil
+3=RowsColumns	9:["name","email","born"]
+4=RowsNext	11:[2:"Andy",10:YW5keUBleGFtcGxlLmNvbQ,8:2000-01-01T10:00:00Z]	1:nil
+5=RowsNext	11:[]	7:"EOF"
+
+"TestRedact"=1,2,3,4,5
+"TestUnchanged"=1
+`), 0666))
+
+	r := &redactor{
+		columns:     map[string]bool{"name": true, "born": true},
+		regexes:     []*regexp.Regexp{regexp.MustCompile(`\w+@example\.com`)},
+		replacement: "XXX",
+	}
+
+	var out bytes.Buffer
+	require.NoError(t, r.redactFile(pathName, false /* dryRun */, &out))
+	require.Equal(t, pathName+": redacted \"TestRedact\"\n", out.String())
+
+	file, err := readRecordingFile(pathName)
+	require.NoError(t, err)
+	records, err := file.Recording("TestRedact")
+	require.NoError(t, err)
+
+	// SQL text is never redacted.
+	require.Equal(t,
+		"SELECT name, email, born FROM users WHERE email='andy@example.com'", records[1].Args[0])
+	require.Equal(t,
+		[]driver.Value{"XXX", []byte("XXX"), time.Time{}}, records[3].Args[0])
+}
@@ -0,0 +1,96 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+)
+
+var renameCommand = &command{
+	name:  "rename",
+	usage: "[-n] pattern replacement [files or directories]",
+	short: "rename recordings after their tests are renamed",
+	run:   runRename,
+}
+
+// runRename renames the recordings whose names match a regular expression, so
+// that they are not orphaned when their tests are renamed. The pattern must
+// match the entire recording name, and the replacement can refer to its
+// submatches, like $1. See RecordingFile.RenameRecordings.
+func runRename(cmd *command, args []string) error {
+	fs := newFlagSet(cmd)
+	dryRun := fs.Bool("n", false, "report recordings that would be renamed without renaming them")
+	fs.Parse(args)
+	if fs.NArg() < 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	re, err := regexp.Compile("^(?:" + fs.Arg(0) + ")$")
+	if err != nil {
+		return err
+	}
+	files, err := findRecordingFiles(fs.Args()[2:])
+	if err != nil {
+		return err
+	}
+	for _, fileName := range files {
+		if err := renameFile(fileName, re, fs.Arg(1), *dryRun, os.Stdout); err != nil {
+			return fmt.Errorf("%s: %v", fileName, err)
+		}
+	}
+	return nil
+}
+
+// renameFile renames the recordings in the given file whose names match the
+// given regular expression, replacing their names with the given replacement.
+// The file is rewritten if any recordings were renamed (unless dryRun is true).
+func renameFile(
+	fileName string, re *regexp.Regexp, replacement string, dryRun bool, w io.Writer,
+) error {
+	file, err := readRecordingFile(fileName)
+	if err != nil {
+		return err
+	}
+
+	var oldNames []string
+	renames := make(map[string]string)
+	for _, name := range file.RecordingNames() {
+		if !re.MatchString(name) {
+			continue
+		}
+		if newName := re.ReplaceAllString(name, replacement); newName != name {
+			oldNames = append(oldNames, name)
+			renames[name] = newName
+		}
+	}
+
+	if len(renames) == 0 {
+		return nil
+	}
+	if err := file.RenameRecordings(renames); err != nil {
+		return err
+	}
+	for _, name := range oldNames {
+		fmt.Fprintf(w, "%s: renamed %q to %q\n", fileName, name, renames[name])
+	}
+	if dryRun {
+		return nil
+	}
+	return file.Write()
+}
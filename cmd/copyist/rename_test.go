@@ -0,0 +1,65 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRename(t *testing.T) {
+	pathName := filepath.Join(t.TempDir(), "rename.copyist")
+	require.NoError(t, os.WriteFile(pathName, []byte(`1=DriverOpen	1:nil
+2=ConnQuery	2:"SELECT 1"	1:nil
+
+"TestOld"=1,2
+"TestOld/case"=1,2
+"TestOld@v21.1.0"=1
+"TestOldest"=1
+"TestOld"@created=2021-01-01T00:00:00Z
+`), 0666))
+
+	re := regexp.MustCompile(`^(?:TestOld(/.*|@.*)?)$`)
+	var out bytes.Buffer
+	require.NoError(t, renameFile(pathName, re, "TestNew$1", true /* dryRun */, &out))
+	require.Equal(t, pathName+": renamed \"TestOld\" to \"TestNew\"\n"+
+		pathName+": renamed \"TestOld/case\" to \"TestNew/case\"\n"+
+		pathName+": renamed \"TestOld@v21.1.0\" to \"TestNew@v21.1.0\"\n", out.String())
+
+	out.Reset()
+	require.NoError(t, renameFile(pathName, re, "TestNew$1", false /* dryRun */, &out))
+	data, err := os.ReadFile(pathName)
+	require.NoError(t, err)
+	require.Equal(t, `1=DriverOpen	1:nil
+2=ConnQuery	2:"SELECT 1"	1:nil
+
+"TestNew"=1,2
+"TestNew"@created=2021-01-01T00:00:00Z
+"TestNew/case"=1,2
+"TestNew@v21.1.0"=1
+"TestOldest"=1
+`, string(data))
+
+	// Recordings cannot be renamed over existing recordings.
+	re = regexp.MustCompile(`^(?:TestOldest)$`)
+	err = renameFile(pathName, re, "TestNew", false /* dryRun */, &out)
+	require.EqualError(t, err, `cannot rename "TestOldest" to "TestNew", `+
+		`since a recording with that name already exists`)
+}
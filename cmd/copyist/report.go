@@ -0,0 +1,233 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+var reportCommand = &command{
+	name:  "report",
+	usage: "[-format markdown|html] [-o file] [files or directories]",
+	short: "generate a report of the SQL statements executed by each test",
+	run:   runReport,
+}
+
+// accessReport describes the SQL statements executed by each recording.
+type accessReport struct {
+	Files []fileReport
+
+	// Statements lists every distinct statement, with the recordings that
+	// execute it, in sorted order.
+	Statements []statementUsage
+}
+
+// fileReport describes the recordings in one recording file.
+type fileReport struct {
+	Name       string
+	Recordings []recordingReport
+}
+
+// recordingReport describes the SQL statements executed by one recording, in
+// the order in which they are first executed.
+type recordingReport struct {
+	Name       string
+	Statements []statementReport
+}
+
+// statementReport describes one distinct SQL statement in a recording.
+type statementReport struct {
+	SQL string
+
+	// Calls is the number of times that the statement was executed (or
+	// prepared, for prepared statements).
+	Calls int
+
+	// Prepared is true if the statement was executed as a prepared statement.
+	Prepared bool
+}
+
+// statementUsage lists the recordings that execute a SQL statement.
+type statementUsage struct {
+	SQL        string
+	Recordings []string
+}
+
+// runReport writes a report of the SQL statements executed by each recording.
+func runReport(cmd *command, args []string) error {
+	fs := newFlagSet(cmd)
+	format := fs.String("format", "markdown", `report format, either "markdown" or "html"`)
+	outName := fs.String("o", "", "write the report to this file rather than stdout")
+	fs.Parse(args)
+	if *format != "markdown" && *format != "html" {
+		return fmt.Errorf(`-format must be "markdown" or "html"`)
+	}
+
+	files, err := findRecordingFiles(fs.Args())
+	if err != nil {
+		return err
+	}
+	report, err := buildAccessReport(files)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *outName != "" {
+		out, err := os.Create(*outName)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+		w = out
+	}
+
+	if *format == "html" {
+		return htmlReportTemplate.Execute(w, report)
+	}
+	writeMarkdownReport(w, report)
+	return nil
+}
+
+// buildAccessReport reads the given recording files and builds a report of the
+// SQL statements executed by each of their recordings.
+func buildAccessReport(files []string) (*accessReport, error) {
+	report := &accessReport{}
+	usages := make(map[string][]string)
+	for _, fileName := range files {
+		file, err := readRecordingFile(fileName)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", fileName, err)
+		}
+
+		fr := fileReport{Name: fileName}
+		for _, name := range file.RecordingNames() {
+			records, err := file.Recording(name)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", fileName, err)
+			}
+
+			rr := recordingReport{Name: name}
+			indexes := make(map[string]int)
+			for _, rec := range records {
+				query, ok := queryText(rec)
+				if !ok {
+					continue
+				}
+				index, ok := indexes[query]
+				if !ok {
+					index = len(rr.Statements)
+					indexes[query] = index
+					rr.Statements = append(rr.Statements, statementReport{SQL: query})
+					usages[query] = append(usages[query], name)
+				}
+				rr.Statements[index].Calls++
+				if rec.Type == "ConnPrepare" {
+					rr.Statements[index].Prepared = true
+				}
+			}
+			fr.Recordings = append(fr.Recordings, rr)
+		}
+		report.Files = append(report.Files, fr)
+	}
+
+	for query, names := range usages {
+		report.Statements = append(report.Statements, statementUsage{SQL: query, Recordings: names})
+	}
+	sort.Slice(report.Statements, func(i, j int) bool {
+		return report.Statements[i].SQL < report.Statements[j].SQL
+	})
+	return report, nil
+}
+
+// writeMarkdownReport writes the report in markdown format.
+func writeMarkdownReport(w io.Writer, report *accessReport) {
+	fmt.Fprintf(w, "# SQL statements executed by tests\n")
+	for _, fr := range report.Files {
+		fmt.Fprintf(w, "\n## %s\n", fr.Name)
+		for _, rr := range fr.Recordings {
+			fmt.Fprintf(w, "\n### %s\n\n", rr.Name)
+			if len(rr.Statements) == 0 {
+				fmt.Fprintf(w, "No SQL statements.\n")
+				continue
+			}
+			fmt.Fprintf(w, "| Calls | Prepared | Statement |\n|---:|:---:|---|\n")
+			for _, stmt := range rr.Statements {
+				prepared := ""
+				if stmt.Prepared {
+					prepared = "yes"
+				}
+				fmt.Fprintf(w, "| %d | %s | `%s` |\n", stmt.Calls, prepared, markdownCode(stmt.SQL))
+			}
+		}
+	}
+
+	fmt.Fprintf(w, "\n## All statements\n\n| Statement | Tests |\n|---|---|\n")
+	for _, usage := range report.Statements {
+		fmt.Fprintf(w, "| `%s` | %s |\n",
+			markdownCode(usage.SQL), strings.Join(usage.Recordings, ", "))
+	}
+}
+
+// markdownCode makes the given SQL text safe for inclusion in an inline code
+// span within a markdown table cell.
+func markdownCode(sql string) string {
+	sql = strings.Join(strings.Fields(sql), " ")
+	sql = strings.ReplaceAll(sql, "`", "'")
+	return strings.ReplaceAll(sql, "|", "\\|")
+}
+
+// htmlReportTemplate renders the report in HTML format.
+var htmlReportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>SQL statements executed by tests</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+td, th { border: 1px solid #ccc; padding: 4px 8px; text-align: left; vertical-align: top; }
+pre { margin: 0; white-space: pre-wrap; }
+</style>
+</head>
+<body>
+<h1>SQL statements executed by tests</h1>
+{{range .Files}}
+<h2>{{.Name}}</h2>
+{{range .Recordings}}
+<h3>{{.Name}}</h3>
+{{if .Statements}}
+<table>
+<tr><th>Calls</th><th>Prepared</th><th>Statement</th></tr>
+{{range .Statements}}<tr><td>{{.Calls}}</td><td>{{if .Prepared}}yes{{end}}</td><td><pre>{{.SQL}}</pre></td></tr>
+{{end}}</table>
+{{else}}
+<p>No SQL statements.</p>
+{{end}}
+{{end}}
+{{end}}
+<h2>All statements</h2>
+<table>
+<tr><th>Statement</th><th>Tests</th></tr>
+{{range .Statements}}<tr><td><pre>{{.SQL}}</pre></td><td>{{range $i, $name := .Recordings}}{{if $i}}, {{end}}{{$name}}{{end}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
@@ -0,0 +1,66 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReport(t *testing.T) {
+	pathName := writeTestRecording(t)
+	report, err := buildAccessReport([]string{pathName})
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	writeMarkdownReport(&out, report)
+	require.Equal(t, strings.ReplaceAll(`# SQL statements executed by tests
+
+## PATH
+
+### TestQuery
+
+| Calls | Prepared | Statement |
+|---:|:---:|---|
+| 1 |  | `+"`SELECT name FROM customers WHERE id=$1`"+` |
+
+### TestQuery/subtest
+
+| Calls | Prepared | Statement |
+|---:|:---:|---|
+| 1 |  | `+"`SELECT name FROM customers WHERE id=$1`"+` |
+
+### TestRenamed
+
+| Calls | Prepared | Statement |
+|---:|:---:|---|
+| 1 |  | `+"`DELETE FROM customers`"+` |
+
+## All statements
+
+| Statement | Tests |
+|---|---|
+| `+"`DELETE FROM customers`"+` | TestRenamed |
+| `+"`SELECT name FROM customers WHERE id=$1`"+` | TestQuery, TestQuery/subtest |
+`, "PATH", pathName), out.String())
+
+	out.Reset()
+	require.NoError(t, htmlReportTemplate.Execute(&out, report))
+	require.Contains(t, out.String(), "<h3>TestQuery/subtest</h3>")
+	require.Contains(t, out.String(), "<td>TestQuery, TestQuery/subtest</td>")
+}
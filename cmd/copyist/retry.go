@@ -0,0 +1,106 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/jackc/pgconn"
+	"github.com/lib/pq"
+)
+
+var retryCommand = &command{
+	name:  "retry",
+	usage: "[-tx n] [-driver pq|pgx] [-as name] file recording",
+	short: "make a transaction in a recording fail once with a retryable error",
+	run:   runRetry,
+}
+
+// retryMessage is the message of the simulated retryable error, which mimics
+// the errors returned by CockroachDB.
+const retryMessage = "restart transaction: TransactionRetryWithProtoRefreshError: " +
+	"simulated by copyist"
+
+// runRetry rewrites a recording so that one of its transactions fails once with
+// a retryable (40001) error when its savepoint is released, and then succeeds
+// when it is retried. This allows the retry loop of crdb.ExecuteTx to be
+// covered in playback. See RecordingFile.SimulateRetry.
+func runRetry(cmd *command, args []string) error {
+	fs := newFlagSet(cmd)
+	tx := fs.Int("tx", 1, "the transaction to retry, numbered from 1 in the order it was begun")
+	driverName := fs.String("driver", "pq", "the driver whose error type to use (pq or pgx)")
+	as := fs.String("as", "", "write the rewritten recording under this name, "+
+		"leaving the original recording unchanged")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	retryErr, err := retryError(*driverName)
+	if err != nil {
+		return err
+	}
+	fileName, name := fs.Arg(0), fs.Arg(1)
+	if err := retryRecording(fileName, name, *as, *tx, retryErr); err != nil {
+		return fmt.Errorf("%s: %v", fileName, err)
+	}
+	return nil
+}
+
+// retryError returns a retryable error of the type returned by the given
+// driver.
+func retryError(driverName string) (error, error) {
+	switch driverName {
+	case "pq", "postgres":
+		return &pq.Error{Severity: "ERROR", Code: "40001", Message: retryMessage}, nil
+	case "pgx":
+		return &pgconn.PgError{Severity: "ERROR", Code: "40001", Message: retryMessage}, nil
+	}
+	return nil, fmt.Errorf("driver %q is not supported (must be pq or pgx)", driverName)
+}
+
+// retryRecording rewrites the recording having the given name in the given
+// file so that the given transaction fails once with the given error. If
+// newName is not empty, then the rewritten recording is added under that name,
+// and the original recording is left unchanged.
+func retryRecording(fileName, name, newName string, tx int, retryErr error) error {
+	file, err := readRecordingFile(fileName)
+	if err != nil {
+		return err
+	}
+
+	if newName != "" {
+		records, err := file.Recording(name)
+		if err != nil {
+			return err
+		}
+		if err := file.SetRecording(newName, records); err != nil {
+			return err
+		}
+		metadata := make(map[string]string)
+		for k, v := range file.Metadata(name) {
+			metadata[k] = v
+		}
+		file.SetMetadata(newName, metadata)
+		name = newName
+	}
+
+	if err := file.SimulateRetry(name, tx, retryErr); err != nil {
+		return err
+	}
+	return file.Write()
+}
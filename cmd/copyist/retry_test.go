@@ -0,0 +1,60 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetry(t *testing.T) {
+	pathName := filepath.Join(t.TempDir(), "test.copyist")
+	require.NoError(t, os.WriteFile(pathName, []byte(`1=DriverOpen	1:nil
+2=ConnBegin	1:nil
+3=ConnExec	2:"SAVEPOINT cockroach_restart"	1:nil
+4=ConnExec	2:"DELETE FROM customers"	1:nil
+5=ConnExec	2:"RELEASE SAVEPOINT cockroach_restart"	1:nil
+6=TxCommit	1:nil
+
+"TestTx"=1,2,3,4,5,6
+`), 0666))
+
+	retryErr, err := retryError("pq")
+	require.NoError(t, err)
+	require.NoError(t, retryRecording(pathName, "TestTx", "TestTxRetry", 1, retryErr))
+
+	file, err := readRecordingFile(pathName)
+	require.NoError(t, err)
+	require.Equal(t, []string{"TestTx", "TestTxRetry"}, file.RecordingNames())
+	records, err := file.Recording("TestTx")
+	require.NoError(t, err)
+	require.Len(t, records, 6)
+
+	records, err = file.Recording("TestTxRetry")
+	require.NoError(t, err)
+	require.Len(t, records, 9)
+	require.Equal(t, pq.ErrorCode("40001"), records[4].Args[1].(*pq.Error).Code)
+	require.Equal(t, "ROLLBACK TO SAVEPOINT cockroach_restart", records[5].Args[0])
+	require.Equal(t, "DELETE FROM customers", records[6].Args[0])
+
+	_, err = retryError("mysql")
+	require.EqualError(t, err, `driver "mysql" is not supported (must be pq or pgx)`)
+	require.EqualError(t, retryRecording(pathName, "TestMissing", "", 1, retryErr),
+		"no recording exists with this name: TestMissing")
+}
@@ -0,0 +1,114 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/cockroachdb/copyist"
+)
+
+var schemaCommand = &command{
+	name:  "schema",
+	usage: "-dsn dsn -query sql [-driver name] [files or directories]",
+	short: "list recordings that were made against a different schema than a database",
+	run:   runSchema,
+}
+
+// runSchema fingerprints the schema of a live database, using the same query
+// that was given to copyist.SetSchemaQuery when recording, and lists the
+// recordings that were made against a different schema, since they may no
+// longer reflect reality. It fails if any such recordings are found, so that it
+// can be used as a CI gate.
+func runSchema(cmd *command, args []string) error {
+	fs := newFlagSet(cmd)
+	driverName := fs.String("driver", "postgres", "name of the SQL driver used to connect")
+	dataSourceName := fs.String("dsn", "", "data source name of the database to compare with")
+	query := fs.String("query", "", "query that describes the schema, as given to SetSchemaQuery")
+	fs.Parse(args)
+	if *dataSourceName == "" || *query == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	schema, err := liveSchema(*driverName, *dataSourceName, *query)
+	if err != nil {
+		return err
+	}
+	files, err := findRecordingFiles(fs.Args())
+	if err != nil {
+		return err
+	}
+
+	stale := 0
+	for _, fileName := range files {
+		n, err := schemaRecordingFile(fileName, schema, os.Stdout)
+		if err != nil {
+			return fmt.Errorf("%s: %v", fileName, err)
+		}
+		stale += n
+	}
+	if stale != 0 {
+		return fmt.Errorf("found %d recording(s) made against a different schema", stale)
+	}
+	return nil
+}
+
+// liveSchema returns the schema fingerprint of the given database. See
+// copyist.SchemaFingerprint.
+func liveSchema(driverName, dataSourceName, query string) (schema string, err error) {
+	db, err := sql.Open(driverName, dataSourceName)
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	err = conn.Raw(func(driverConn interface{}) error {
+		schema, err = copyist.SchemaFingerprint(driverConn.(driver.Conn), query)
+		return err
+	})
+	return schema, err
+}
+
+// schemaRecordingFile writes the recordings in the given file that were made
+// against a different schema than the given one to the given writer, and
+// returns the number of such recordings. Recordings made without a schema
+// fingerprint are skipped.
+func schemaRecordingFile(fileName, schema string, w io.Writer) (int, error) {
+	file, err := readRecordingFile(fileName)
+	if err != nil {
+		return 0, err
+	}
+
+	stale := 0
+	for _, name := range file.RecordingNames() {
+		if recorded := file.Schema(name); recorded != "" && recorded != schema {
+			fmt.Fprintf(w, "%s: recording %q was made against a different schema\n", fileName, name)
+			stale++
+		}
+	}
+	return stale, nil
+}
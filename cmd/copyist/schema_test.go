@@ -0,0 +1,43 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSchema(t *testing.T) {
+	pathName := filepath.Join(t.TempDir(), "test.copyist")
+	require.NoError(t, os.WriteFile(pathName, []byte(`1=DriverOpen	1:nil
+
+"TestCurrent"=1
+"TestStale"=1
+"TestUnknown"=1
+"TestCurrent"@schema=abc
+"TestStale"@schema=def
+`), 0666))
+
+	var out bytes.Buffer
+	n, err := schemaRecordingFile(pathName, "abc", &out)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	require.Equal(t, pathName+`: recording "TestStale" was made against a different schema`+"\n",
+		out.String())
+}
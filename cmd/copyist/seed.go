@@ -0,0 +1,219 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var seedCommand = &command{
+	name:  "seed",
+	usage: "[-o output] file [recordings]",
+	short: "generate a SQL script that inserts the rows returned in recordings",
+	run:   runSeed,
+}
+
+// seedTable accumulates the rows of one table that were returned by the
+// queries in recordings.
+type seedTable struct {
+	name    string
+	columns []string
+	rows    [][]driver.Value
+
+	// seen is the set of rows that have already been added, formatted as SQL.
+	seen map[string]bool
+}
+
+// runSeed writes a SQL script of INSERT statements that insert the rows that
+// were returned by the queries in the given recordings into the tables that
+// they were queried from. If no recordings are given, then the rows returned
+// in every recording in the file are inserted. Only rows returned by queries of
+// a single table can be inserted, since otherwise it is not known where they
+// came from. This allows local databases or fixtures to be seeded with
+// realistic data.
+func runSeed(cmd *command, args []string) error {
+	fs := newFlagSet(cmd)
+	output := fs.String("o", "", "write the script to this file rather than stdout")
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	file, err := readRecordingFile(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("%s: %v", fs.Arg(0), err)
+	}
+	names := fs.Args()[1:]
+	if len(names) == 0 {
+		names = file.RecordingNames()
+	}
+
+	var tables []*seedTable
+	byName := make(map[string]*seedTable)
+	for _, name := range names {
+		records, err := file.Recording(name)
+		if err != nil {
+			return fmt.Errorf("%s: %v", fs.Arg(0), err)
+		}
+		responses, err := recordedResponses(records)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: skipping %q: %v\n", fs.Arg(0), name, err)
+			continue
+		}
+
+		for _, resp := range responses {
+			if !resp.returnsRows || len(resp.rows) == 0 {
+				continue
+			}
+			tableName, ok := queriedTable(resp.query, resp.columns)
+			if !ok {
+				fmt.Fprintf(os.Stderr, "%s: skipping rows of %q: table cannot be derived\n",
+					fs.Arg(0), strings.Join(strings.Fields(resp.query), " "))
+				continue
+			}
+
+			// Tables that are queried for different columns are kept apart.
+			key := tableName + "\x00" + strings.Join(resp.columns, "\x00")
+			table, ok := byName[key]
+			if !ok {
+				table = &seedTable{name: tableName, columns: resp.columns, seen: make(map[string]bool)}
+				byName[key] = table
+				tables = append(tables, table)
+			}
+			for _, row := range resp.rows {
+				table.addRow(row)
+			}
+		}
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		out, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+		w = out
+	}
+	writeSeedScript(w, fs.Arg(0), tables)
+	return nil
+}
+
+// addRow adds the given row to the table, unless an identical row has already
+// been added.
+func (t *seedTable) addRow(row []driver.Value) {
+	key := formatSeedRow(row)
+	if t.seen[key] {
+		return
+	}
+	t.seen[key] = true
+	t.rows = append(t.rows, row)
+}
+
+// writeSeedScript writes a SQL script that inserts the rows of the given
+// tables.
+func writeSeedScript(w io.Writer, fileName string, tables []*seedTable) {
+	fmt.Fprintf(w, "-- Rows returned by the queries in %s, as recorded by copyist.\n", fileName)
+	for _, table := range tables {
+		fmt.Fprintf(w, "\nINSERT INTO %s (%s) VALUES\n", table.name, strings.Join(table.columns, ", "))
+		for i, row := range table.rows {
+			sep := ","
+			if i == len(table.rows)-1 {
+				sep = ";"
+			}
+			fmt.Fprintf(w, "\t%s%s\n", formatSeedRow(row), sep)
+		}
+	}
+}
+
+// formatSeedRow formats the given row as a parenthesized list of SQL literals.
+func formatSeedRow(row []driver.Value) string {
+	literals := make([]string, len(row))
+	for i, val := range row {
+		literals[i] = sqlLiteral(val)
+	}
+	return "(" + strings.Join(literals, ", ") + ")"
+}
+
+// sqlLiteral formats the given value returned by a driver as a Postgres SQL
+// literal.
+func sqlLiteral(val driver.Value) string {
+	switch t := val.(type) {
+	case nil:
+		return "NULL"
+	case int64:
+		return strconv.FormatInt(t, 10)
+	case float64:
+		return strconv.FormatFloat(t, 'g', -1, 64)
+	case bool:
+		if t {
+			return "TRUE"
+		}
+		return "FALSE"
+	case []byte:
+		return `'\x` + hex.EncodeToString(t) + `'`
+	case time.Time:
+		return "'" + t.Format(time.RFC3339Nano) + "'"
+	}
+	return "'" + strings.ReplaceAll(fmt.Sprint(val), "'", "''") + "'"
+}
+
+// selectRegexp matches queries that select from a single table, capturing the
+// select list and the name of the table.
+var selectRegexp = regexp.MustCompile(
+	`(?is)^\s*SELECT\s+(.+?)\s+FROM\s+([\w."]+)(?:\s+(?:AS\s+)?\w+)?\s*(?:WHERE\b.*|ORDER\b.*|LIMIT\b.*|FOR\b.*|;)?\s*$`)
+
+// identRegexp matches a column name in a select list, optionally qualified by
+// the name of its table.
+var identRegexp = regexp.MustCompile(`^(?:[\w"]+\.)?([\w"]+)$`)
+
+// queriedTable returns the name of the table that the given query selects the
+// given columns from. It returns false if the query does not select from a
+// single table, or if any of the columns is an expression rather than a column
+// of the table, since their values could not be inserted into it.
+func queriedTable(query string, columns []string) (string, bool) {
+	match := selectRegexp.FindStringSubmatch(query)
+	if match == nil {
+		return "", false
+	}
+	selectList, tableName := strings.TrimSpace(match[1]), match[2]
+	if strings.EqualFold(tableName, "SELECT") || strings.Contains(strings.ToUpper(match[0]), " JOIN ") {
+		return "", false
+	}
+	if selectList == "*" {
+		return tableName, true
+	}
+
+	exprs := strings.Split(selectList, ",")
+	if len(exprs) != len(columns) {
+		return "", false
+	}
+	for i, expr := range exprs {
+		ident := identRegexp.FindStringSubmatch(strings.TrimSpace(expr))
+		if ident == nil || strings.Trim(ident[1], `"`) != columns[i] {
+			return "", false
+		}
+	}
+	return tableName, true
+}
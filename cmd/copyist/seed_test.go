@@ -0,0 +1,63 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueriedTable(t *testing.T) {
+	testCases := []struct {
+		query   string
+		columns []string
+		table   string
+	}{
+		{query: "SELECT * FROM customers", columns: []string{"id"}, table: "customers"},
+		{query: "SELECT id, c.name FROM public.customers AS c WHERE id=$1", columns: []string{"id", "name"}, table: "public.customers"},
+		{query: "select id from orders order by id limit 10;", columns: []string{"id"}, table: "orders"},
+		{query: "SELECT count(*) FROM customers", columns: []string{"count"}},
+		{query: "SELECT id FROM customers JOIN orders ON true", columns: []string{"id"}},
+		{query: "SELECT id FROM customers, orders", columns: []string{"id"}},
+		{query: "SELECT id AS key FROM customers", columns: []string{"key"}},
+		{query: "SELECT 1", columns: []string{"?column?"}},
+	}
+	for _, tc := range testCases {
+		table, ok := queriedTable(tc.query, tc.columns)
+		require.Equal(t, tc.table != "", ok, tc.query)
+		require.Equal(t, tc.table, table, tc.query)
+	}
+}
+
+func TestWriteSeedScript(t *testing.T) {
+	table := &seedTable{name: "customers", columns: []string{"id", "name", "data", "created"}, seen: map[string]bool{}}
+	created := time.Date(2021, 8, 1, 12, 0, 0, 0, time.UTC)
+	table.addRow([]driver.Value{int64(1), "Andy", []byte{0xab}, created})
+	table.addRow([]driver.Value{int64(2), "O'Brien", nil, created})
+	table.addRow([]driver.Value{int64(1), "Andy", []byte{0xab}, created})
+
+	var buf bytes.Buffer
+	writeSeedScript(&buf, "store_test.copyist", []*seedTable{table})
+	require.Equal(t, `-- Rows returned by the queries in store_test.copyist, as recorded by copyist.
+
+INSERT INTO customers (id, name, data, created) VALUES
+	(1, 'Andy', '\xab', '2021-08-01T12:00:00Z'),
+	(2, 'O''Brien', NULL, '2021-08-01T12:00:00Z');
+`, buf.String())
+}
@@ -0,0 +1,656 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/cockroachdb/copyist"
+	"github.com/jackc/pgproto3/v2"
+)
+
+var serveCommand = &command{
+	name:  "serve",
+	usage: "[-addr address] file recording",
+	short: "answer Postgres wire protocol queries from a recording",
+	run:   runServe,
+}
+
+// runServe listens for Postgres clients on the given address, and answers
+// their queries from the given recording, so that programs that are not
+// written in Go (e.g. psql) can replay the same interactions as the test that
+// made the recording. Each client connection replays the recording from its
+// beginning.
+func runServe(cmd *command, args []string) error {
+	fs := newFlagSet(cmd)
+	addr := fs.String("addr", "localhost:5432", "address on which to listen for clients")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	file, err := readRecordingFile(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("%s: %v", fs.Arg(0), err)
+	}
+	records, err := file.Recording(fs.Arg(1))
+	if err != nil {
+		return fmt.Errorf("%s: %v", fs.Arg(0), err)
+	}
+	responses, err := recordedResponses(records)
+	if err != nil {
+		return fmt.Errorf("%s: %v", fs.Arg(1), err)
+	}
+
+	ln, err := net.Listen("tcp", *addr)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "serving %q on %s\n", fs.Arg(1), ln.Addr())
+	return serve(ln, responses)
+}
+
+// serve accepts client connections from the given listener until it is
+// closed, and serves each of them from the given responses.
+func serve(ln net.Listener, responses []*response) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			c := &serverConn{
+				conn:      conn,
+				backend:   pgproto3.NewBackend(pgproto3.NewChunkReader(conn), conn),
+				responses: responses,
+				stmts:     make(map[string]string),
+				portals:   make(map[string]*portal),
+				txStatus:  'I',
+			}
+			if err := c.serve(); err != nil {
+				fmt.Fprintf(os.Stderr, "copyist serve: %s: %v\n", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// response is the recorded response of the database to one statement.
+type response struct {
+	// query is the SQL text of the statement. Transaction statements have the
+	// query "BEGIN", "COMMIT" or "ROLLBACK".
+	query string
+
+	// prepareErr is true if the statement failed to be prepared, in which case
+	// err is the error.
+	prepareErr bool
+
+	// returnsRows is true if the statement was a query, in which case columns
+	// and rows are the result of the query, and rowErr is the error, if any,
+	// that was returned when iterating over its rows.
+	returnsRows bool
+	columns     []string
+	rows        [][]driver.Value
+	rowErr      error
+
+	// rowsAffected is the number of rows affected by the statement, if the
+	// statement was not a query.
+	rowsAffected int64
+
+	// err is the error returned by the statement, if it failed.
+	err error
+}
+
+// recordedResponses returns the responses of the database to each of the
+// statements in the given recording.
+func recordedResponses(records []copyist.Record) ([]*response, error) {
+	var responses []*response
+	var lastExec, lastQuery *response
+	stmtQueries := make(map[int]string)
+	lastStmtQuery := ""
+
+	for _, rec := range records {
+		switch rec.Type {
+		case "DriverOpen", "StmtNumInput", "ResultLastInsertId":
+			// These calls do not send statements to the database.
+
+		case "ConnPrepare":
+			query := rec.Args[0].(string)
+			if len(rec.Args) > 2 {
+				stmtQueries[rec.Args[2].(int)] = query
+			}
+			lastStmtQuery = query
+			if err := argErr(rec.Args[1]); err != nil {
+				responses = append(responses, &response{query: query, prepareErr: true, err: err})
+			}
+
+		case "ConnExec", "ConnQuery", "StmtExec", "StmtQuery":
+			resp := &response{}
+			switch rec.Type {
+			case "ConnExec", "ConnQuery":
+				resp.query = rec.Args[0].(string)
+				resp.err = argErr(rec.Args[1])
+			default:
+				// Statements made before copyist recorded statement IDs always
+				// belong to the last prepared statement.
+				resp.query = lastStmtQuery
+				if len(rec.Args) > 2 {
+					resp.query = stmtQueries[rec.Args[2].(int)]
+				}
+				resp.err = argErr(rec.Args[0])
+			}
+			if rec.Type == "ConnQuery" || rec.Type == "StmtQuery" {
+				resp.returnsRows = true
+				lastQuery = resp
+			} else {
+				lastExec = resp
+			}
+			responses = append(responses, resp)
+
+		case "ConnBegin", "TxCommit", "TxRollback":
+			query := map[string]string{
+				"ConnBegin":  "BEGIN",
+				"TxCommit":   "COMMIT",
+				"TxRollback": "ROLLBACK",
+			}[rec.Type]
+			responses = append(responses, &response{query: query, err: argErr(rec.Args[0])})
+
+		case "ResultRowsAffected":
+			if lastExec != nil {
+				lastExec.rowsAffected = rec.Args[0].(int64)
+			}
+
+		case "RowsColumns":
+			if lastQuery != nil {
+				lastQuery.columns = rec.Args[0].([]string)
+			}
+
+		case "RowsNext":
+			if lastQuery == nil {
+				continue
+			}
+			err := argErr(rec.Args[1])
+			if err == io.EOF {
+				continue
+			}
+			if err != nil {
+				lastQuery.rowErr = err
+				continue
+			}
+			lastQuery.rows = append(lastQuery.rows, rec.Args[0].([]driver.Value))
+
+		case "ConnNotice":
+			// Notices don't affect the responses to queries.
+			continue
+
+		default:
+			return nil, fmt.Errorf("%s records cannot be served", rec.Type)
+		}
+	}
+	return responses, nil
+}
+
+// portal is a statement that has been bound by a client, ready for execution.
+type portal struct {
+	query string
+
+	// formats are the result column format codes requested by the client.
+	formats []int16
+}
+
+// serverConn serves one client connection from the recorded responses.
+type serverConn struct {
+	conn      net.Conn
+	backend   *pgproto3.Backend
+	responses []*response
+
+	// next is the index of the next response to be returned.
+	next int
+
+	// stmts maps the name of each prepared statement to its SQL text.
+	stmts map[string]string
+
+	// portals maps the name of each portal to the statement it will execute.
+	portals map[string]*portal
+
+	// txStatus is the transaction status that is reported to the client when
+	// it is ready for the next query ('I', 'T' or 'E').
+	txStatus byte
+
+	// skipToSync is true if an extended query has failed, in which case
+	// messages are ignored until the client sends a Sync message.
+	skipToSync bool
+}
+
+// serve performs the startup handshake with the client, and then answers its
+// queries until it terminates the connection.
+func (c *serverConn) serve() error {
+	if err := c.startup(); err != nil {
+		return err
+	}
+
+	for {
+		msg, err := c.backend.Receive()
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil
+			}
+			return err
+		}
+
+		if c.skipToSync {
+			if _, ok := msg.(*pgproto3.Sync); !ok {
+				continue
+			}
+		}
+
+		switch msg := msg.(type) {
+		case *pgproto3.Query:
+			err = c.handleQuery(msg.String)
+
+		case *pgproto3.Parse:
+			err = c.handleParse(msg)
+
+		case *pgproto3.Bind:
+			err = c.handleBind(msg)
+
+		case *pgproto3.Describe:
+			err = c.handleDescribe(msg)
+
+		case *pgproto3.Execute:
+			err = c.handleExecute(msg)
+
+		case *pgproto3.Close:
+			if msg.ObjectType == 'S' {
+				delete(c.stmts, msg.Name)
+			} else {
+				delete(c.portals, msg.Name)
+			}
+			err = c.backend.Send(&pgproto3.CloseComplete{})
+
+		case *pgproto3.Sync:
+			c.skipToSync = false
+			err = c.backend.Send(&pgproto3.ReadyForQuery{TxStatus: c.txStatus})
+
+		case *pgproto3.Flush:
+
+		case *pgproto3.Terminate:
+			return nil
+
+		default:
+			err = c.sendError(&pgproto3.ErrorResponse{
+				Severity: "ERROR",
+				Code:     "0A000",
+				Message:  fmt.Sprintf("copyist serve does not support %T messages", msg),
+			})
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// startup answers the client's startup message. The client is not asked to
+// authenticate, and requests for encryption are refused.
+func (c *serverConn) startup() error {
+	for {
+		msg, err := c.backend.ReceiveStartupMessage()
+		if err != nil {
+			return err
+		}
+
+		switch msg.(type) {
+		case *pgproto3.SSLRequest, *pgproto3.GSSEncRequest:
+			if _, err := c.conn.Write([]byte("N")); err != nil {
+				return err
+			}
+			continue
+
+		case *pgproto3.CancelRequest:
+			return nil
+		}
+		break
+	}
+
+	messages := []pgproto3.BackendMessage{&pgproto3.AuthenticationOk{}}
+	for _, param := range [][2]string{
+		{"server_version", "13.0"},
+		{"server_encoding", "UTF8"},
+		{"client_encoding", "UTF8"},
+		{"DateStyle", "ISO, MDY"},
+		{"TimeZone", "UTC"},
+		{"integer_datetimes", "on"},
+		{"standard_conforming_strings", "on"},
+	} {
+		messages = append(messages, &pgproto3.ParameterStatus{Name: param[0], Value: param[1]})
+	}
+	messages = append(messages,
+		&pgproto3.BackendKeyData{ProcessID: 1},
+		&pgproto3.ReadyForQuery{TxStatus: c.txStatus})
+	return c.send(messages...)
+}
+
+// handleQuery answers a query sent using the simple query protocol.
+func (c *serverConn) handleQuery(query string) error {
+	if strings.TrimSpace(query) == "" {
+		return c.send(&pgproto3.EmptyQueryResponse{}, &pgproto3.ReadyForQuery{TxStatus: c.txStatus})
+	}
+
+	resp, err := c.nextResponse(query)
+	if err == nil && resp.returnsRows && resp.err == nil {
+		err = c.backend.Send(rowDescription(resp, nil))
+	}
+	if err == nil {
+		err = c.sendResult(query, resp, nil)
+	}
+	if err != nil {
+		if err := c.sendError(errorResponseFor(err)); err != nil {
+			return err
+		}
+	}
+
+	// Unlike an extended query, a failed simple query does not cause later
+	// messages to be ignored.
+	c.skipToSync = false
+	return c.backend.Send(&pgproto3.ReadyForQuery{TxStatus: c.txStatus})
+}
+
+// handleParse prepares a statement. Statements whose preparation failed when
+// they were recorded fail in the same way.
+func (c *serverConn) handleParse(msg *pgproto3.Parse) error {
+	if c.next < len(c.responses) {
+		resp := c.responses[c.next]
+		if resp.prepareErr && queryMatches(resp.query, msg.Query) {
+			c.next++
+			return c.sendError(errorResponse(resp.err))
+		}
+	}
+	c.stmts[msg.Name] = msg.Query
+	return c.backend.Send(&pgproto3.ParseComplete{})
+}
+
+// handleBind binds a prepared statement to a portal.
+func (c *serverConn) handleBind(msg *pgproto3.Bind) error {
+	query, ok := c.stmts[msg.PreparedStatement]
+	if !ok {
+		return c.sendError(&pgproto3.ErrorResponse{
+			Severity: "ERROR",
+			Code:     "26000",
+			Message:  fmt.Sprintf("prepared statement %q does not exist", msg.PreparedStatement),
+		})
+	}
+	c.portals[msg.DestinationPortal] = &portal{query: query, formats: msg.ResultFormatCodes}
+	return c.backend.Send(&pgproto3.BindComplete{})
+}
+
+// handleDescribe describes the parameters and/or result columns of a prepared
+// statement or portal. The result columns are taken from the next response,
+// which must be for the described statement.
+func (c *serverConn) handleDescribe(msg *pgproto3.Describe) error {
+	var query string
+	var formats []int16
+	if msg.ObjectType == 'S' {
+		var ok bool
+		if query, ok = c.stmts[msg.Name]; !ok {
+			return c.sendError(&pgproto3.ErrorResponse{
+				Severity: "ERROR",
+				Code:     "26000",
+				Message:  fmt.Sprintf("prepared statement %q does not exist", msg.Name),
+			})
+		}
+
+		// Recordings do not store the types of parameters, so they are
+		// described as text.
+		params := make([]uint32, numParams(query))
+		for i := range params {
+			params[i] = textOID
+		}
+		if err := c.backend.Send(&pgproto3.ParameterDescription{ParameterOIDs: params}); err != nil {
+			return err
+		}
+	} else {
+		p, ok := c.portals[msg.Name]
+		if !ok {
+			return c.sendError(&pgproto3.ErrorResponse{
+				Severity: "ERROR",
+				Code:     "34000",
+				Message:  fmt.Sprintf("portal %q does not exist", msg.Name),
+			})
+		}
+		query, formats = p.query, p.formats
+	}
+
+	resp, err := c.peekResponse(query)
+	if err != nil {
+		return c.sendError(errorResponseFor(err))
+	}
+	if !resp.returnsRows || resp.err != nil {
+		return c.backend.Send(&pgproto3.NoData{})
+	}
+	return c.backend.Send(rowDescription(resp, formats))
+}
+
+// handleExecute executes a portal, answering with the next response, which
+// must be for the portal's statement.
+func (c *serverConn) handleExecute(msg *pgproto3.Execute) error {
+	p, ok := c.portals[msg.Portal]
+	if !ok {
+		return c.sendError(&pgproto3.ErrorResponse{
+			Severity: "ERROR",
+			Code:     "34000",
+			Message:  fmt.Sprintf("portal %q does not exist", msg.Portal),
+		})
+	}
+
+	resp, err := c.nextResponse(p.query)
+	if err == nil {
+		err = c.sendResult(p.query, resp, p.formats)
+	}
+	if err != nil {
+		return c.sendError(errorResponseFor(err))
+	}
+	return nil
+}
+
+// sendResult sends the rows and completion of the given response. It returns
+// a responseError if the response is a recorded error.
+func (c *serverConn) sendResult(query string, resp *response, formats []int16) error {
+	if resp.err != nil {
+		return responseError{resp.err}
+	}
+
+	switch resp.query {
+	case "BEGIN":
+		c.txStatus = 'T'
+	case "COMMIT", "ROLLBACK":
+		c.txStatus = 'I'
+	}
+
+	if !resp.returnsRows {
+		return c.backend.Send(&pgproto3.CommandComplete{
+			CommandTag: []byte(commandTag(query, resp.rowsAffected)),
+		})
+	}
+
+	for _, row := range resp.rows {
+		values := make([][]byte, len(row))
+		for i, val := range row {
+			values[i] = encodeValue(val, resultFormat(formats, i) == 1)
+		}
+		if err := c.backend.Send(&pgproto3.DataRow{Values: values}); err != nil {
+			return err
+		}
+	}
+	if resp.rowErr != nil {
+		return responseError{resp.rowErr}
+	}
+	return c.backend.Send(&pgproto3.CommandComplete{
+		CommandTag: []byte(commandTag(query, int64(len(resp.rows)))),
+	})
+}
+
+// peekResponse returns the next response, without consuming it. It returns an
+// error if the next response is not for the given query.
+func (c *serverConn) peekResponse(query string) (*response, error) {
+	if c.next >= len(c.responses) {
+		return nil, fmt.Errorf("recording has no more statements, but got %q", query)
+	}
+	resp := c.responses[c.next]
+	if !queryMatches(resp.query, query) {
+		return nil, fmt.Errorf("recording expected %q, but got %q", resp.query, query)
+	}
+	return resp, nil
+}
+
+// nextResponse consumes and returns the next response. It returns an error if
+// the next response is not for the given query.
+func (c *serverConn) nextResponse(query string) (*response, error) {
+	resp, err := c.peekResponse(query)
+	if err != nil {
+		return nil, err
+	}
+	c.next++
+	return resp, nil
+}
+
+// sendError sends the given error to the client. If the client is using the
+// extended query protocol, then the rest of its messages are ignored until it
+// sends a Sync message.
+func (c *serverConn) sendError(msg *pgproto3.ErrorResponse) error {
+	c.skipToSync = true
+	if c.txStatus == 'T' {
+		c.txStatus = 'E'
+	}
+	return c.backend.Send(msg)
+}
+
+// send sends the given messages to the client.
+func (c *serverConn) send(messages ...pgproto3.BackendMessage) error {
+	for _, msg := range messages {
+		if err := c.backend.Send(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// responseError wraps an error that was recorded as the response to a
+// statement, as opposed to an error in replaying the recording.
+type responseError struct {
+	err error
+}
+
+func (e responseError) Error() string {
+	return e.err.Error()
+}
+
+// errorResponseFor returns the ErrorResponse message that reports the given
+// error. Recorded errors are reported as they were recorded. Statements that
+// do not match the recording are reported as protocol violations.
+func errorResponseFor(err error) *pgproto3.ErrorResponse {
+	if respErr, ok := err.(responseError); ok {
+		return errorResponse(respErr.err)
+	}
+	return &pgproto3.ErrorResponse{Severity: "ERROR", Code: "08P01", Message: err.Error()}
+}
+
+// rowDescription returns the RowDescription message that describes the result
+// columns of the given response, in the given format codes.
+func rowDescription(resp *response, formats []int16) *pgproto3.RowDescription {
+	oids := columnOIDs(resp.columns, resp.rows)
+	fields := make([]pgproto3.FieldDescription, len(resp.columns))
+	for i, name := range resp.columns {
+		fields[i] = pgproto3.FieldDescription{
+			Name:         []byte(name),
+			DataTypeOID:  oids[i],
+			DataTypeSize: -1,
+			TypeModifier: -1,
+			Format:       resultFormat(formats, i),
+		}
+	}
+	return &pgproto3.RowDescription{Fields: fields}
+}
+
+// resultFormat returns the format code of the given result column, given the
+// format codes that were requested by the client. No codes means that all
+// columns use the text format, and one code applies to all columns.
+func resultFormat(formats []int16, col int) int16 {
+	switch {
+	case len(formats) == 0:
+		return 0
+	case len(formats) == 1:
+		return formats[0]
+	case col < len(formats):
+		return formats[col]
+	}
+	return 0
+}
+
+// queryMatches returns true if the given statement received from a client is
+// the same as the given recorded statement, ignoring differences in whitespace
+// and trailing semicolons. Transaction statements match their synonyms, like
+// "START TRANSACTION" for "BEGIN".
+func queryMatches(recorded, query string) bool {
+	switch recorded {
+	case "BEGIN", "COMMIT", "ROLLBACK":
+		switch strings.ToUpper(strings.TrimSuffix(commandTag(query, 0), ";")) {
+		case "BEGIN":
+			return recorded == "BEGIN"
+		case "COMMIT", "END":
+			return recorded == "COMMIT"
+		case "ROLLBACK", "ABORT":
+			return recorded == "ROLLBACK"
+		}
+	}
+	return normalizeQuery(recorded) == normalizeQuery(query)
+}
+
+// normalizeQuery collapses runs of whitespace in the given query and removes
+// any trailing semicolon.
+func normalizeQuery(query string) string {
+	query = strings.Join(strings.Fields(query), " ")
+	return strings.TrimSpace(strings.TrimSuffix(query, ";"))
+}
+
+// paramRegexp matches the $1, $2, ... placeholders of statement parameters.
+var paramRegexp = regexp.MustCompile(`\$(\d+)`)
+
+// numParams returns the number of parameters of the given statement, as given
+// by its highest-numbered placeholder.
+func numParams(query string) int {
+	n := 0
+	for _, match := range paramRegexp.FindAllStringSubmatch(query, -1) {
+		if i, err := strconv.Atoi(match[1]); err == nil && i > n {
+			n = i
+		}
+	}
+	return n
+}
+
+// argErr returns the given record argument as an error, or nil if it is not an
+// error.
+func argErr(arg interface{}) error {
+	err, _ := arg.(error)
+	return err
+}
@@ -0,0 +1,92 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/cockroachdb/copyist"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServe(t *testing.T) {
+	responses, err := recordedResponses([]copyist.Record{
+		{Type: "DriverOpen", Args: []interface{}{nil}},
+		{Type: "ConnExec", Args: []interface{}{"DELETE FROM customers", nil}},
+		{Type: "ResultRowsAffected", Args: []interface{}{int64(3), nil}},
+		{Type: "ConnPrepare", Args: []interface{}{"SELECT id, name FROM customers WHERE id=$1", nil}},
+		{Type: "StmtNumInput", Args: []interface{}{1}},
+		{Type: "StmtQuery", Args: []interface{}{nil}},
+		{Type: "RowsColumns", Args: []interface{}{[]string{"id", "name"}}},
+		{Type: "RowsNext", Args: []interface{}{[]driver.Value{int64(1), "Andy"}, nil}},
+		{Type: "RowsNext", Args: []interface{}{[]driver.Value{}, io.EOF}},
+		{Type: "ConnExec", Args: []interface{}{
+			"INSERT INTO customers VALUES (1)",
+			&pq.Error{Severity: "ERROR", Code: "23505", Message: "duplicate key value"},
+		}},
+	})
+	require.NoError(t, err)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	go serve(ln, responses)
+
+	db, err := sql.Open("postgres", fmt.Sprintf("postgres://root@%s/db?sslmode=disable", ln.Addr()))
+	require.NoError(t, err)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	res, err := db.Exec("DELETE FROM customers")
+	require.NoError(t, err)
+	affected, err := res.RowsAffected()
+	require.NoError(t, err)
+	require.Equal(t, int64(3), affected)
+
+	var id int
+	var name string
+	err = db.QueryRow("SELECT id, name FROM customers WHERE id=$1", 1).Scan(&id, &name)
+	require.NoError(t, err)
+	require.Equal(t, 1, id)
+	require.Equal(t, "Andy", name)
+
+	_, err = db.Exec("INSERT INTO customers VALUES (1)")
+	var pqErr *pq.Error
+	require.True(t, errors.As(err, &pqErr))
+	require.Equal(t, pq.ErrorCode("23505"), pqErr.Code)
+
+	_, err = db.Exec("DROP TABLE customers")
+	require.EqualError(t, err, `pq: recording has no more statements, but got "DROP TABLE customers"`)
+}
+
+func TestRecordedResponses(t *testing.T) {
+	_, err := recordedResponses([]copyist.Record{{Type: "ConnRaw", Args: []interface{}{nil}}})
+	require.EqualError(t, err, "ConnRaw records cannot be served")
+}
+
+func TestQueryMatches(t *testing.T) {
+	require.True(t, queryMatches("SELECT  1\n FROM t", "SELECT 1 FROM t;"))
+	require.False(t, queryMatches("SELECT 1", "SELECT 2"))
+	require.True(t, queryMatches("BEGIN", "start transaction"))
+	require.True(t, queryMatches("COMMIT", "END"))
+	require.False(t, queryMatches("COMMIT", "ROLLBACK"))
+}
@@ -0,0 +1,59 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/cockroachdb/copyist/sqlmockgen"
+)
+
+var sqlmockCommand = &command{
+	name:  "sqlmock",
+	usage: "[-p package] [-o output] file [recordings]",
+	short: "generate go-sqlmock expectations from recordings",
+	run:   runSqlmock,
+}
+
+// runSqlmock generates Go code that sets the recorded calls of the given
+// recordings as the expectations of a go-sqlmock mock. If no recordings are
+// given, then code is generated for every recording in the file.
+func runSqlmock(cmd *command, args []string) error {
+	fs := newFlagSet(cmd)
+	pkgName := fs.String("p", "main", "name of the package of the generated code")
+	output := fs.String("o", "", "write the generated code to this file rather than stdout")
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	file, err := readRecordingFile(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("%s: %v", fs.Arg(0), err)
+	}
+
+	src, err := sqlmockgen.Generate(file, *pkgName, fs.Args()[1:]...)
+	if err != nil {
+		return fmt.Errorf("%s: %v", fs.Arg(0), err)
+	}
+
+	if *output == "" {
+		_, err = os.Stdout.Write(src)
+		return err
+	}
+	return os.WriteFile(*output, src, 0666)
+}
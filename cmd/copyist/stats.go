@@ -0,0 +1,268 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/cockroachdb/copyist"
+)
+
+var statsCommand = &command{
+	name:  "stats",
+	usage: "[-n count] [files or directories]",
+	short: "report aggregate statistics across recording files",
+	run:   runStats,
+}
+
+// noStreamsDriverName is the label under which connections are counted when
+// the driver that opened them cannot be determined, because the recording has
+// no streams metadata and no errors that identify the driver.
+const noStreamsDriverName = "(no streams metadata)"
+
+// recordingStats accumulates statistics across a set of recordings.
+type recordingStats struct {
+	files      int
+	recordings int
+	records    int
+
+	// queries is the total number of SQL statements executed, and
+	// uniqueQueries is the set of distinct SQL statements.
+	queries       int
+	uniqueQueries map[string]bool
+
+	// errors is the number of records that returned an error other than
+	// io.EOF, keyed by the type of the record.
+	errors map[string]int
+
+	// drivers is the number of connections opened, keyed by the name of the
+	// driver that opened them. Driver names are taken from the streams
+	// metadata of recordings made by more than one connection. Other
+	// recordings don't store driver names, so the driver is inferred from the
+	// type of any errors in the recording, and if there are none, the
+	// connections are counted under noStreamsDriverName.
+	drivers map[string]int
+
+	// resultSets is the size of each result set, in rows.
+	resultSets []resultSet
+}
+
+// resultSet describes one result set that was returned by a query.
+type resultSet struct {
+	fileName      string
+	recordingName string
+	query         string
+	rows          int
+}
+
+// runStats prints aggregate statistics for the given recording files.
+func runStats(cmd *command, args []string) error {
+	fs := newFlagSet(cmd)
+	top := fs.Int("n", 5, "number of largest result sets to print")
+	fs.Parse(args)
+
+	files, err := findRecordingFiles(fs.Args())
+	if err != nil {
+		return err
+	}
+
+	stats := newRecordingStats()
+	for _, fileName := range files {
+		if err := stats.addFile(fileName); err != nil {
+			return fmt.Errorf("%s: %v", fileName, err)
+		}
+	}
+	stats.print(os.Stdout, *top)
+	return nil
+}
+
+func newRecordingStats() *recordingStats {
+	return &recordingStats{
+		uniqueQueries: make(map[string]bool),
+		errors:        make(map[string]int),
+		drivers:       make(map[string]int),
+	}
+}
+
+// addFile adds the recordings in the given recording file to the statistics.
+func (s *recordingStats) addFile(fileName string) error {
+	file, err := readRecordingFile(fileName)
+	if err != nil {
+		return err
+	}
+	s.files++
+
+	for _, name := range file.RecordingNames() {
+		records, err := file.Recording(name)
+		if err != nil {
+			return err
+		}
+		s.recordings++
+		s.records += len(records)
+
+		// Recordings made by more than one connection name the driver that
+		// made each record in their streams metadata. Otherwise, the driver
+		// can only be guessed from the types of the errors that it returned.
+		recordDrivers := file.RecordDrivers(name)
+		driverOpens := 0
+		driverName := ""
+
+		var current *resultSet
+		for i, rec := range records {
+			if isQuery(rec) {
+				s.queries++
+				if query, ok := queryText(rec); ok {
+					s.uniqueQueries[query] = true
+				}
+			}
+
+			switch rec.Type {
+			case "DriverOpen":
+				if recordDrivers != nil {
+					s.drivers[recordDrivers[i]]++
+				} else {
+					driverOpens++
+				}
+			case "ConnQuery", "StmtQuery":
+				// Start counting rows in a new result set.
+				query, _ := queryText(rec)
+				s.resultSets = append(s.resultSets,
+					resultSet{fileName: fileName, recordingName: name, query: query})
+				current = &s.resultSets[len(s.resultSets)-1]
+			case "RowsNext":
+				if current != nil && recordErr(rec) == nil {
+					current.rows++
+				}
+			}
+
+			if err := recordErr(rec); err != nil && err != io.EOF && err != driver.ErrSkip {
+				s.errors[rec.Type]++
+				if name := errorDriverName(err); name != "" {
+					driverName = name
+				}
+			}
+		}
+
+		if driverOpens != 0 {
+			if driverName == "" {
+				driverName = noStreamsDriverName
+			}
+			s.drivers[driverName] += driverOpens
+		}
+	}
+	return nil
+}
+
+// print writes the statistics to the given writer, including the given number
+// of largest result sets.
+func (s *recordingStats) print(w io.Writer, top int) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "files:\t%d\n", s.files)
+	fmt.Fprintf(tw, "recordings:\t%d\n", s.recordings)
+	fmt.Fprintf(tw, "records:\t%d\n", s.records)
+	fmt.Fprintf(tw, "queries:\t%d\n", s.queries)
+	fmt.Fprintf(tw, "unique queries:\t%d\n", len(s.uniqueQueries))
+
+	totalErrors := 0
+	for _, n := range s.errors {
+		totalErrors += n
+	}
+	fmt.Fprintf(tw, "error records:\t%d\n", totalErrors)
+	for _, typ := range sortedKeys(s.errors) {
+		fmt.Fprintf(tw, "  %s:\t%d\n", typ, s.errors[typ])
+	}
+
+	fmt.Fprintf(tw, "connections by driver:\t\n")
+	for _, name := range sortedKeys(s.drivers) {
+		fmt.Fprintf(tw, "  %s:\t%d\n", name, s.drivers[name])
+	}
+	tw.Flush()
+
+	sort.SliceStable(s.resultSets, func(i, j int) bool {
+		return s.resultSets[i].rows > s.resultSets[j].rows
+	})
+	if top > len(s.resultSets) {
+		top = len(s.resultSets)
+	}
+	if top > 0 {
+		fmt.Fprintf(w, "\nlargest result sets:\n")
+		tw = tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintf(tw, "ROWS\tRECORDING\tQUERY\n")
+		for _, rs := range s.resultSets[:top] {
+			fmt.Fprintf(tw, "%d\t%s\t%s\n", rs.rows, rs.recordingName, truncate(rs.query, 60))
+		}
+		tw.Flush()
+	}
+}
+
+// queryText returns the SQL text of the given record, if it has one. Records
+// for prepared statements don't include their SQL text.
+func queryText(rec copyist.Record) (string, bool) {
+	switch rec.Type {
+	case "ConnExec", "ConnQuery", "ConnPrepare":
+		query, ok := rec.Args[0].(string)
+		return query, ok
+	}
+	return "", false
+}
+
+// recordErr returns the error returned by the driver method call in the given
+// record, or nil if there was no error. By convention, the error is the last
+// argument of the record.
+func recordErr(rec copyist.Record) error {
+	if len(rec.Args) == 0 {
+		return nil
+	}
+	err, _ := rec.Args[len(rec.Args)-1].(error)
+	return err
+}
+
+// errorDriverName returns the name of the driver that returned the given error,
+// based on its type, or the empty string if that cannot be determined.
+func errorDriverName(err error) string {
+	typeName := fmt.Sprintf("%T", err)
+	switch {
+	case strings.HasPrefix(typeName, "*pq."):
+		return "postgres"
+	case strings.HasPrefix(typeName, "*pgconn."):
+		return "pgx"
+	}
+	return ""
+}
+
+// truncate shortens the given string to at most n characters, adding an
+// ellipsis if it was shortened.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n-3] + "..."
+}
+
+// sortedKeys returns the keys of the given map in sorted order.
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,62 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStats(t *testing.T) {
+	stats := newRecordingStats()
+	require.NoError(t, stats.addFile(writeTestRecording(t)))
+
+	var out bytes.Buffer
+	stats.print(&out, 2)
+	require.Equal(t, `files:                    1
+recordings:               3
+records:                  11
+queries:                  3
+unique queries:           2
+error records:            0
+connections by driver:    
+  (no streams metadata):  3
+
+largest result sets:
+ROWS  RECORDING          QUERY
+1     TestQuery          SELECT name FROM customers WHERE id=$1
+0     TestQuery/subtest  SELECT name FROM customers WHERE id=$1
+`, out.String())
+}
+
+// TestStatsStreams tests that connections are counted by the driver named in
+// the streams metadata of recordings made by more than one connection.
+func TestStatsStreams(t *testing.T) {
+	pathName := filepath.Join(t.TempDir(), "test.copyist")
+	require.NoError(t, os.WriteFile(pathName, []byte(`1=DriverOpen	1:nil
+2=ConnExec	2:"DELETE FROM customers"	1:nil
+
+"TestStreams"=1,1,2,1,2
+"TestStreams"@streams="postgres"*1 "postgres"#1*1 "pgx"*1 "pgx"#2*2
+`), 0666))
+
+	stats := newRecordingStats()
+	require.NoError(t, stats.addFile(pathName))
+	require.Equal(t, map[string]int{"postgres": 2, "pgx": 1}, stats.drivers)
+}
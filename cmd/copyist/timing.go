@@ -0,0 +1,175 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+var timingCommand = &command{
+	name:  "timing",
+	usage: "[-n count] [files or directories]",
+	short: "report the database time spent by each test and query",
+	run:   runTiming,
+}
+
+// dbTiming accumulates the recorded durations of driver calls across a set of
+// recordings. Only recordings made with copyist.SetRecordDurations enabled
+// have durations.
+type dbTiming struct {
+	// recordings is the total time spent by each recording.
+	recordings []recordingTime
+
+	// queries is the total time spent by each distinct SQL statement, keyed by
+	// its text.
+	queries map[string]*queryTime
+
+	// untimed is the number of recordings that have no durations.
+	untimed int
+}
+
+// recordingTime is the total time spent in driver calls by one recording.
+type recordingTime struct {
+	fileName      string
+	recordingName string
+	total         time.Duration
+}
+
+// queryTime is the total time spent in driver calls by one SQL statement.
+type queryTime struct {
+	query string
+	calls int
+	total time.Duration
+}
+
+// runTiming prints the slowest recordings and queries in the given recording
+// files.
+func runTiming(cmd *command, args []string) error {
+	fs := newFlagSet(cmd)
+	top := fs.Int("n", 10, "number of slowest tests and queries to print")
+	fs.Parse(args)
+
+	files, err := findRecordingFiles(fs.Args())
+	if err != nil {
+		return err
+	}
+
+	timing := &dbTiming{queries: make(map[string]*queryTime)}
+	for _, fileName := range files {
+		if err := timing.addFile(fileName); err != nil {
+			return fmt.Errorf("%s: %v", fileName, err)
+		}
+	}
+	timing.print(os.Stdout, *top)
+	return nil
+}
+
+// addFile adds the durations of the recordings in the given recording file.
+// The time spent by each call is attributed to the most recent SQL statement
+// in its recording, so that the time spent reading a query's rows counts
+// towards the query, as does the time spent executing a prepared statement.
+func (t *dbTiming) addFile(fileName string) error {
+	file, err := readRecordingFile(fileName)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range file.RecordingNames() {
+		records, err := file.Recording(name)
+		if err != nil {
+			return err
+		}
+		durations := file.Durations(name)
+		if len(durations) != len(records) {
+			t.untimed++
+			continue
+		}
+
+		rt := recordingTime{fileName: fileName, recordingName: name}
+		var current *queryTime
+		for i, rec := range records {
+			if query, ok := queryText(rec); ok {
+				current = t.queries[query]
+				if current == nil {
+					current = &queryTime{query: query}
+					t.queries[query] = current
+				}
+				current.calls++
+			}
+			rt.total += durations[i]
+			if current != nil {
+				current.total += durations[i]
+			}
+		}
+		t.recordings = append(t.recordings, rt)
+	}
+	return nil
+}
+
+// print writes the given number of slowest recordings and queries to the given
+// writer.
+func (t *dbTiming) print(w io.Writer, top int) {
+	if t.untimed != 0 {
+		fmt.Fprintf(w, "%d recordings have no durations; "+
+			"regenerate them with copyist.SetRecordDurations(true)\n\n", t.untimed)
+	}
+
+	sort.SliceStable(t.recordings, func(i, j int) bool {
+		return t.recordings[i].total > t.recordings[j].total
+	})
+	recordings := t.recordings
+	if top < len(recordings) {
+		recordings = recordings[:top]
+	}
+	fmt.Fprintf(w, "slowest tests:\n")
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "TIME\tRECORDING\tFILE\n")
+	for _, rt := range recordings {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", formatTime(rt.total), rt.recordingName, rt.fileName)
+	}
+	tw.Flush()
+
+	queries := make([]*queryTime, 0, len(t.queries))
+	for _, qt := range t.queries {
+		queries = append(queries, qt)
+	}
+	sort.Slice(queries, func(i, j int) bool {
+		if queries[i].total != queries[j].total {
+			return queries[i].total > queries[j].total
+		}
+		return queries[i].query < queries[j].query
+	})
+	if top < len(queries) {
+		queries = queries[:top]
+	}
+	fmt.Fprintf(w, "\nslowest queries:\n")
+	tw = tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "TIME\tCALLS\tAVERAGE\tQUERY\n")
+	for _, qt := range queries {
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\n", formatTime(qt.total), qt.calls,
+			formatTime(qt.total/time.Duration(qt.calls)), truncate(qt.query, 60))
+	}
+	tw.Flush()
+}
+
+// formatTime formats the given duration, rounded to the nearest microsecond.
+func formatTime(d time.Duration) string {
+	return d.Round(time.Microsecond).String()
+}
@@ -0,0 +1,59 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTiming(t *testing.T) {
+	pathName := filepath.Join(t.TempDir(), "timing.copyist")
+	require.NoError(t, os.WriteFile(pathName, []byte(`
+1=DriverOpen	1:nil
+2=ConnQuery	2:"SELECT name FROM customers"	1:nil
+3=RowsColumns	9:["name"]
+4=RowsNext	11:[]	7:"EOF"
+5=ConnExec	2:"DELETE FROM customers"	1:nil
+
+"TestQuery"=1,2,3,4,5
+"TestQuery"@durations=1000 2500 0 500 1200
+"TestDelete"=1,5,5
+"TestDelete"@durations=800 3000 1000
+"TestUntimed"=1,5
+`), 0666))
+
+	timing := &dbTiming{queries: make(map[string]*queryTime)}
+	require.NoError(t, timing.addFile(pathName))
+
+	var out bytes.Buffer
+	timing.print(&out, 2)
+	require.Equal(t, `1 recordings have no durations; regenerate them with copyist.SetRecordDurations(true)
+
+slowest tests:
+TIME   RECORDING   FILE
+5.2ms  TestQuery   `+pathName+`
+4.8ms  TestDelete  `+pathName+`
+
+slowest queries:
+TIME   CALLS  AVERAGE  QUERY
+5.2ms  3      1.733ms  DELETE FROM customers
+3ms    1      3ms      SELECT name FROM customers
+`, out.String())
+}
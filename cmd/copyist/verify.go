@@ -0,0 +1,115 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+var verifyCommand = &command{
+	name:  "verify",
+	usage: "[-max-record-size bytes] [-max-recording-size bytes] [files or directories]",
+	short: "check that recording files are well-formed and not too large",
+	run:   runVerify,
+}
+
+// verifyLimits are the size thresholds checked by the verify command. A limit
+// of zero means there is no limit.
+type verifyLimits struct {
+	maxRecordSize    int
+	maxRecordingSize int
+}
+
+// runVerify checks each recording file for problems, printing each problem that
+// is found. It fails if any problems are found, so that it can be used as a CI
+// gate.
+func runVerify(cmd *command, args []string) error {
+	fs := newFlagSet(cmd)
+	var limits verifyLimits
+	fs.IntVar(&limits.maxRecordSize, "max-record-size", 0,
+		"maximum size of a single record, in bytes (0 means no limit)")
+	fs.IntVar(&limits.maxRecordingSize, "max-recording-size", 0,
+		"maximum total size of the records in a recording, in bytes (0 means no limit)")
+	fs.Parse(args)
+
+	files, err := findRecordingFiles(fs.Args())
+	if err != nil {
+		return err
+	}
+
+	problems := 0
+	for _, fileName := range files {
+		problems += verifyRecordingFile(fileName, limits, os.Stdout)
+	}
+	if problems != 0 {
+		return fmt.Errorf("found %d problem(s) in %d file(s)", problems, len(files))
+	}
+	return nil
+}
+
+// verifyRecordingFile checks the given recording file for problems, writes them
+// to the given writer, and returns the number of problems found.
+func verifyRecordingFile(fileName string, limits verifyLimits, w io.Writer) int {
+	file, err := readRecordingFile(fileName)
+	if err != nil {
+		fmt.Fprintf(w, "%s: %v\n", fileName, err)
+		return 1
+	}
+
+	errs := file.Validate()
+	for _, err := range errs {
+		fmt.Fprintf(w, "%s: %v\n", fileName, err)
+	}
+	if len(errs) != 0 {
+		// Skip size checks, since some recordings can't be parsed.
+		return len(errs)
+	}
+
+	problems := 0
+	for _, name := range file.RecordingNames() {
+		records, err := file.Recording(name)
+		if err != nil {
+			fmt.Fprintf(w, "%s: recording %q: %v\n", fileName, name, err)
+			problems++
+			continue
+		}
+
+		recordingSize := 0
+		for i, rec := range records {
+			size := len(rec.String())
+			if limits.maxRecordSize != 0 && size > limits.maxRecordSize {
+				fmt.Fprintf(w, "%s: recording %q: record %d (%s) is %d bytes, exceeding %d bytes\n",
+					fileName, name, i+1, rec.Type, size, limits.maxRecordSize)
+				problems++
+			}
+			recordingSize += size
+		}
+		if limits.maxRecordingSize != 0 && recordingSize > limits.maxRecordingSize {
+			fmt.Fprintf(w, "%s: recording %q is %d bytes, exceeding %d bytes\n",
+				fileName, name, recordingSize, limits.maxRecordingSize)
+			problems++
+		}
+
+		// Nondeterministic queries are only warnings, since they don't make
+		// the recording invalid.
+		for _, query := range file.NondeterministicQueries(name) {
+			fmt.Fprintf(w, "%s: recording %q: warning: query may return rows in a "+
+				"nondeterministic order: %s\n", fileName, name, query)
+		}
+	}
+	return problems
+}
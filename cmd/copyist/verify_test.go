@@ -0,0 +1,78 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerify(t *testing.T) {
+	writeFile := func(data string) string {
+		pathName := filepath.Join(t.TempDir(), "verify.copyist")
+		require.NoError(t, os.WriteFile(pathName, []byte(data), 0666))
+		return pathName
+	}
+
+	var out bytes.Buffer
+	pathName := writeTestRecording(t)
+	require.Equal(t, 0, verifyRecordingFile(pathName, verifyLimits{}, &out))
+	require.Equal(t, "", out.String())
+
+	// Size limits.
+	out.Reset()
+	limits := verifyLimits{maxRecordSize: 50, maxRecordingSize: 140}
+	require.Equal(t, 3, verifyRecordingFile(pathName, limits, &out))
+	require.Equal(t, pathName+`: recording "TestQuery": record 2 (ConnQuery) is 58 bytes, exceeding 50 bytes
+`+pathName+`: recording "TestQuery" is 146 bytes, exceeding 140 bytes
+`+pathName+`: recording "TestQuery/subtest": record 2 (ConnQuery) is 58 bytes, exceeding 50 bytes
+`, out.String())
+
+	// Nondeterministic queries are warnings, not problems.
+	out.Reset()
+	pathName = writeFile(`1=DriverOpen	1:nil
+
+"TestFoo"=1
+"TestFoo"@nondeterministic=["SELECT * FROM customers"]
+`)
+	require.Equal(t, 0, verifyRecordingFile(pathName, verifyLimits{}, &out))
+	require.Equal(t, pathName+`: recording "TestFoo": warning: query may return rows in a `+
+		`nondeterministic order: SELECT * FROM customers
+`, out.String())
+
+	// Syntax error.
+	out.Reset()
+	pathName = writeFile("1 DriverOpen\n")
+	require.Equal(t, 1, verifyRecordingFile(pathName, verifyLimits{}, &out))
+	require.Equal(t, pathName+": expected equals: 1 DriverOpen\n", out.String())
+
+	// Unknown record and value types, and dangling record references.
+	out.Reset()
+	pathName = writeFile(`1=DriverOpen	1:nil
+2=DriverClose	1:nil
+3=ConnExec	99:"foo"	1:nil
+
+"TestFoo"=1,2,3,4
+`)
+	require.Equal(t, 3, verifyRecordingFile(pathName, verifyLimits{}, &out))
+	require.Equal(t, pathName+`: record 2: record type DriverClose is not recognized
+`+pathName+`: record 3: error parsing 99:"foo": unsupported type: 99
+`+pathName+`: recording "TestFoo": record with number 4 does not exist
+`, out.String())
+}
@@ -16,7 +16,12 @@ package copyist
 
 import (
 	"context"
+	"database/sql"
 	"database/sql/driver"
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
 )
 
 // proxyConn records and plays back calls to driver.Conn methods.
@@ -46,6 +51,35 @@ type proxyConn struct {
 	// session is the copyist session in which this connection was created. This
 	// connection can only be reused within that session.
 	session *session
+
+	// id uniquely identifies this connection among the connections opened by
+	// the session. It is used only during recording mode.
+	id int
+
+	// stream is the stream of records that this connection plays back. It is
+	// nil until the connection's first call is played back. See
+	// session.stream.
+	stream *recordStream
+
+	// callStart is the time at which this connection's current call to the
+	// wrapped driver began. It is used only during recording mode, to record
+	// the duration of the call. See session.SerializeCall.
+	callStart time.Time
+
+	// bad is true if a call to this connection returned driver.ErrBadConn, in
+	// which case it must be closed rather than pooled, just as the `sql`
+	// package would do. That way, the `sql` package retries the call on a new
+	// connection during playback, exactly as it did during recording.
+	bad bool
+}
+
+// markBad marks this connection as bad if the given error is driver.ErrBadConn.
+// It returns the given error.
+func (c *proxyConn) markBad(err error) error {
+	if errors.Is(err, driver.ErrBadConn) {
+		c.bad = true
+	}
+	return err
 }
 
 // ResetSession is called while a connection is in the connection
@@ -74,6 +108,7 @@ func (c *proxyConn) ExecContext(
 	ctx context.Context, query string, args []driver.NamedValue,
 ) (driver.Result, error) {
 	if IsRecording() {
+		defer c.session.SerializeCall(c)()
 		var res driver.Result
 		var err error
 		switch t := c.conn.(type) {
@@ -87,25 +122,40 @@ func (c *proxyConn) ExecContext(
 			}
 			res, err = t.Exec(query, vals)
 		default:
-			return nil, driver.ErrSkip
+			// The driver does not support executing queries directly, so the
+			// sql package falls back to preparing a statement. Record that,
+			// so that playback falls back in the same way.
+			err = driver.ErrSkip
 		}
 
-		currentSession.AddRecord(&record{Typ: ConnExec, Args: recordArgs{query, err}})
+		recArgs := recordArgs{query, err}
+		sentinel := sentinelResult(res)
+		if sentinel != nil {
+			recArgs = append(recArgs, sentinel)
+		}
+		c.session.AddRecord(c, &record{Typ: ConnExec, Args: recArgs})
 		if err != nil {
-			return nil, err
+			return nil, c.markBad(err)
+		}
+		c.session.explain(c, query, args)
+		if sentinel != nil {
+			return sentinel, nil
 		}
-		return &proxyResult{res: res}, nil
+		return &proxyResult{conn: c, res: res}, nil
 	}
 
-	rec, err := currentSession.VerifyRecordWithStringArg(ConnExec, query)
+	rec, err := c.session.VerifyRecordWithStringArg(c, ConnExec, query)
 	if err != nil {
 		return nil, err
 	}
 	err, _ = rec.Args[1].(error)
 	if err != nil {
-		return nil, err
+		return nil, c.markBad(err)
+	}
+	if sentinel := recordedResult(rec, 2); sentinel != nil {
+		return sentinel, nil
 	}
-	return &proxyResult{}, nil
+	return &proxyResult{conn: c}, nil
 }
 
 // Prepare returns a prepared statement, bound to this connection.
@@ -118,6 +168,7 @@ func (c *proxyConn) Prepare(query string) (driver.Stmt, error) {
 // it must not store the context within the statement itself.
 func (c *proxyConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
 	if IsRecording() {
+		defer c.session.SerializeCall(c)()
 		var stmt driver.Stmt
 		var err error
 		if prepCtx, ok := c.conn.(driver.ConnPrepareContext); ok {
@@ -126,22 +177,31 @@ func (c *proxyConn) PrepareContext(ctx context.Context, query string) (driver.St
 			stmt, err = c.conn.Prepare(query)
 		}
 
-		currentSession.AddRecord(&record{Typ: ConnPrepare, Args: recordArgs{query, err}})
+		// Assign each prepared statement an ID, so that playback can verify
+		// that calls are made to the same statement as when recording.
+		id := c.session.nextStmtID()
+		c.session.AddRecord(c,
+			&record{Typ: ConnPrepare, Args: recordArgs{query, err, id}})
 		if err != nil {
-			return nil, err
+			return nil, c.markBad(err)
 		}
-		return &proxyStmt{stmt: stmt}, nil
+		return &proxyStmt{conn: c, stmt: stmt, id: id, query: query}, nil
 	}
 
-	rec, err := currentSession.VerifyRecordWithStringArg(ConnPrepare, query)
+	rec, err := c.session.VerifyRecordWithStringArg(c, ConnPrepare, query)
 	if err != nil {
 		return nil, err
 	}
 	err, _ = rec.Args[1].(error)
 	if err != nil {
-		return nil, err
+		return nil, c.markBad(err)
 	}
-	return &proxyStmt{}, nil
+	// Recordings made before statements had IDs are not checked.
+	id := 0
+	if len(rec.Args) > 2 {
+		id = rec.Args[2].(int)
+	}
+	return &proxyStmt{conn: c, id: id, query: query}, nil
 }
 
 // QueryContext executes a query that may return rows, such as a
@@ -152,6 +212,7 @@ func (c *proxyConn) QueryContext(
 	ctx context.Context, query string, args []driver.NamedValue,
 ) (driver.Rows, error) {
 	if IsRecording() {
+		defer c.session.SerializeCall(c)()
 		var rows driver.Rows
 		var err error
 		switch t := c.conn.(type) {
@@ -165,25 +226,29 @@ func (c *proxyConn) QueryContext(
 			}
 			rows, err = t.Query(query, vals)
 		default:
-			return nil, driver.ErrSkip
+			// The driver does not support executing queries directly, so the
+			// sql package falls back to preparing a statement. Record that,
+			// so that playback falls back in the same way.
+			err = driver.ErrSkip
 		}
 
-		currentSession.AddRecord(&record{Typ: ConnQuery, Args: recordArgs{query, err}})
+		c.session.AddRecord(c,
+			&record{Typ: ConnQuery, Args: recordArgs{query, err}})
 		if err != nil {
-			return nil, err
+			return nil, c.markBad(err)
 		}
-		return &proxyRows{rows: rows}, nil
+		return &proxyRows{conn: c, rows: rows, query: query, args: args}, nil
 	}
 
-	rec, err := currentSession.VerifyRecordWithStringArg(ConnQuery, query)
+	rec, err := c.session.VerifyRecordWithStringArg(c, ConnQuery, query)
 	if err != nil {
 		return nil, err
 	}
 	err, _ = rec.Args[1].(error)
 	if err != nil {
-		return nil, err
+		return nil, c.markBad(err)
 	}
-	return &proxyRows{}, nil
+	return &proxyRows{conn: c}, nil
 }
 
 // Close invalidates and potentially stops any current
@@ -195,8 +260,9 @@ func (c *proxyConn) QueryContext(
 // idle connections, it shouldn't be necessary for drivers to
 // do their own connection caching.
 func (c *proxyConn) Close() error {
-	// Try to return the connection to the pool rather than closing it.
-	if !c.driver.tryPoolConnection(c) {
+	// Try to return the connection to the pool rather than closing it, unless
+	// it is bad.
+	if c.bad || !c.driver.tryPoolConnection(c) {
 		// Not successful, so close the connection.
 		if IsRecording() {
 			return c.conn.Close()
@@ -226,6 +292,7 @@ func (c *proxyConn) Begin() (driver.Tx, error) {
 // or return an error if it is not supported.
 func (c *proxyConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
 	if IsRecording() {
+		defer c.session.SerializeCall(c)()
 		var tx driver.Tx
 		var err error
 		if beginTx, ok := c.conn.(driver.ConnBeginTx); ok {
@@ -234,32 +301,103 @@ func (c *proxyConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.
 			tx, err = c.conn.Begin()
 		}
 
-		currentSession.AddRecord(&record{Typ: ConnBegin, Args: recordArgs{err}})
+		c.session.AddRecord(c,
+			&record{Typ: ConnBegin, Args: recordArgs{err}})
 		if err != nil {
-			return nil, err
+			return nil, c.markBad(err)
 		}
-		return &proxyTx{tx: tx}, nil
+		return &proxyTx{conn: c, tx: tx}, nil
 	}
 
-	rec, err := currentSession.VerifyRecord(ConnBegin)
+	rec, err := c.session.VerifyRecord(c, ConnBegin)
 	if err != nil {
 		return nil, err
 	}
 	err, _ = rec.Args[0].(error)
 	if err != nil {
-		return nil, err
+		return nil, c.markBad(err)
 	}
-	return &proxyTx{}, nil
+	return &proxyTx{conn: c}, nil
 }
 
 // CheckNamedValue implements driver.NamedValueChecker. If the underlying
 // connection implements this interface, this method is delegated to it.
 // Otherwise, driver.ErrSkip is returned as per the driver.NamedValueChecker
 // documentation.
+//
+// During playback, there is no underlying connection. However, drivers like
+// go-sql-driver/mysql accept uint64 values having their high bit set, and
+// drivers like ClickHouse's accept slices as array values, both of which the
+// default converter rejects, so accept them here as well. In both modes, slices
+// are only accepted if copyist can record them, so that a value that cannot be
+// recorded is rejected during playback just as it is during recording, rather
+// than being accepted by one mode and not the other.
 func (c *proxyConn) CheckNamedValue(nv *driver.NamedValue) (err error) {
 	if nvc, ok := c.conn.(driver.NamedValueChecker); ok {
-		return nvc.CheckNamedValue(nv)
+		if err = nvc.CheckNamedValue(nv); err != nil {
+			return err
+		}
+		return checkRecordableValue(nv.Value)
 	}
 
+	if c.conn == nil {
+		if _, ok := nv.Value.(uint64); ok {
+			return nil
+		}
+		if reflect.ValueOf(nv.Value).Kind() == reflect.Slice {
+			return checkRecordableValue(nv.Value)
+		}
+	}
 	return driver.ErrSkip
 }
+
+// checkRecordableValue returns an error if the given value, accepted by
+// CheckNamedValue, is a slice that copyist cannot record.
+func checkRecordableValue(val interface{}) error {
+	if reflect.ValueOf(val).Kind() == reflect.Slice && !isRecordableSlice(val) {
+		return fmt.Errorf("copyist cannot record or play back a value of type %T", val)
+	}
+	return nil
+}
+
+// Raw executes f on the driver connection underlying the given dedicated
+// connection, in the same way as sql.Conn.Raw. Unlike sql.Conn.Raw, it does not
+// pass the copyist connection to f, but rather the wrapped "real" connection,
+// so that f can use extensions of the underlying driver that are not part of
+// the database/sql interface (e.g. bulk copy). For example:
+//
+//	conn, _ := db.Conn(ctx)
+//	err := copyist.Raw(conn, func(driverConn interface{}) error {
+//	  return driverConn.(*stdlib.Conn).Conn().Ping(ctx)
+//	})
+//
+// Calls that f makes to the wrapped connection bypass copyist, so they cannot
+// be recorded. Instead, the error returned by f is recorded on the dedicated
+// connection's stream of records. During playback, f is not called at all, and
+// the recorded error is returned instead. Therefore, f should not produce any
+// other results that the test depends upon.
+//
+// If conn is not a copyist connection, then f is called with its driver
+// connection as usual.
+func Raw(conn *sql.Conn, f func(driverConn interface{}) error) error {
+	return conn.Raw(func(driverConn interface{}) error {
+		c, ok := driverConn.(*proxyConn)
+		if !ok {
+			return f(driverConn)
+		}
+
+		if IsRecording() {
+			defer c.session.SerializeCall(c)()
+			err := f(c.conn)
+			c.session.AddRecord(c, &record{Typ: ConnRaw, Args: recordArgs{err}})
+			return c.markBad(err)
+		}
+
+		rec, err := c.session.VerifyRecord(c, ConnRaw)
+		if err != nil {
+			return err
+		}
+		err, _ = rec.Args[0].(error)
+		return c.markBad(err)
+	})
+}
@@ -0,0 +1,182 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package copyist
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// prepareDriver is a fake driver whose connections do not execute queries
+// directly, like go-mssqldb, so that the sql package must prepare statements.
+type prepareDriver struct{}
+
+func (prepareDriver) Open(name string) (driver.Conn, error) {
+	return &prepareConn{}, nil
+}
+
+// prepareConn is a fake driver connection that only prepares statements.
+type prepareConn struct {
+	driver.Conn
+}
+
+func (c *prepareConn) Prepare(query string) (driver.Stmt, error) {
+	return &prepareStmt{}, nil
+}
+
+func (c *prepareConn) Close() error {
+	return nil
+}
+
+// prepareStmt is a fake statement that returns the names of its arguments.
+type prepareStmt struct {
+	driver.Stmt
+}
+
+func (s *prepareStmt) NumInput() int {
+	return -1
+}
+
+func (s *prepareStmt) QueryContext(
+	ctx context.Context, args []driver.NamedValue,
+) (driver.Rows, error) {
+	rows := &fakeRows{cols: []string{"name"}}
+	for _, arg := range args {
+		rows.rows = append(rows.rows, []driver.Value{arg.Name})
+	}
+	return rows, nil
+}
+
+func (s *prepareStmt) ExecContext(
+	ctx context.Context, args []driver.NamedValue,
+) (driver.Result, error) {
+	return driver.RowsAffected(len(args)), nil
+}
+
+func (s *prepareStmt) Close() error {
+	return nil
+}
+
+// TestPrepareFallback tests recording and playing back queries and statements
+// with named arguments, using a driver that does not support executing them
+// without first preparing them. copyist records the driver.ErrSkip error that
+// makes the sql package fall back to preparing a statement, so that playback
+// falls back in the same way.
+func TestPrepareFallback(t *testing.T) {
+	sql.Register("postgres19", prepareDriver{})
+	registered = nil
+	defer func() { registered = nil }()
+	Register("postgres19")
+
+	source := &memorySource{}
+	run := func() {
+		m := &mockTestingT{T: t}
+		closer := OpenSource(m, source, "TestPrepareFallback")
+		db, err := sql.Open("copyist_postgres19", "")
+		require.NoError(t, err)
+		rows, err := db.Query("SELECT @id, @name", sql.Named("id", 1), sql.Named("name", "Andy"))
+		require.NoError(t, err)
+		var names []string
+		for rows.Next() {
+			var name string
+			require.NoError(t, rows.Scan(&name))
+			names = append(names, name)
+		}
+		require.NoError(t, rows.Err())
+		require.Equal(t, []string{"id", "name"}, names)
+		res, err := db.Exec("DELETE FROM customers WHERE id=@id", sql.Named("id", 1))
+		require.NoError(t, err)
+		affected, err := res.RowsAffected()
+		require.NoError(t, err)
+		require.Equal(t, int64(1), affected)
+		require.NoError(t, db.Close())
+		require.NoError(t, closer.Close())
+		require.Equal(t, "", m.buf.String())
+	}
+
+	// Record.
+	*recordFlag = true
+	visitedRecording = true
+	run()
+	*recordFlag = false
+	require.Contains(t, string(source.data),
+		`ConnQuery	2:"SELECT @id, @name"	7:"driver: skip fast-path; continue as if unimplemented"`)
+	require.Contains(t, string(source.data),
+		`ConnExec	2:"DELETE FROM customers WHERE id=@id"	7:"driver: skip fast-path; continue as if unimplemented"`)
+
+	// Play back.
+	run()
+}
+
+// TestCheckNamedValue tests that values which drivers accept, but which the
+// default converter rejects, are accepted during playback, unless they cannot
+// be recorded, in which case they are rejected in both modes.
+func TestCheckNamedValue(t *testing.T) {
+	c := &proxyConn{}
+	require.NoError(t, c.CheckNamedValue(&driver.NamedValue{Value: uint64(math.MaxUint64)}))
+	require.NoError(t, c.CheckNamedValue(&driver.NamedValue{Value: []int32{1, 2, 3}}))
+	require.Equal(t, driver.ErrSkip, c.CheckNamedValue(&driver.NamedValue{Value: 1}))
+
+	// Slices of structs cannot be recorded, so they are rejected in playback.
+	type point struct{ x, y int }
+	err := c.CheckNamedValue(&driver.NamedValue{Value: []point{{1, 2}}})
+	require.EqualError(t, err, "copyist cannot record or play back a value of type []copyist.point")
+
+	// The same rule applies in recording, after the driver accepts the value.
+	c = &proxyConn{conn: checkerConn{}}
+	require.NoError(t, c.CheckNamedValue(&driver.NamedValue{Value: []int32{1, 2, 3}}))
+	err = c.CheckNamedValue(&driver.NamedValue{Value: []point{{1, 2}}})
+	require.EqualError(t, err, "copyist cannot record or play back a value of type []copyist.point")
+}
+
+// checkerConn is a driver.Conn that accepts any value passed to it.
+type checkerConn struct {
+	driver.Conn
+}
+
+// CheckNamedValue implements driver.NamedValueChecker.
+func (checkerConn) CheckNamedValue(*driver.NamedValue) error {
+	return nil
+}
+
+// TestNoPrepareFallback tests that driver.ErrSkip is not recorded for drivers
+// that support executing statements without first preparing them.
+func TestNoPrepareFallback(t *testing.T) {
+	sql.Register("postgres21", execDriver{})
+	registered = nil
+	defer func() { registered = nil }()
+	Register("postgres21")
+
+	source := &memorySource{}
+	m := &mockTestingT{T: t}
+	*recordFlag = true
+	visitedRecording = true
+	defer func() { *recordFlag = false }()
+	closer := OpenSource(m, source, "TestNoPrepareFallback")
+	db, err := sql.Open("copyist_postgres21", "")
+	require.NoError(t, err)
+	_, err = db.Exec("DELETE FROM customers WHERE id=@id", sql.Named("id", 1))
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+	require.NoError(t, closer.Close())
+
+	require.Contains(t, string(source.data), `ConnExec	2:"DELETE FROM customers WHERE id=@id"	1:nil`)
+	require.NotContains(t, string(source.data), "ConnPrepare")
+}
@@ -0,0 +1,84 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package copyist
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+)
+
+// proxyConnector is a driver.Connector that opens connections using a proxy
+// driver constructed by RegisterWithConnector.
+type proxyConnector struct {
+	driver *proxyDriver
+}
+
+var _ driver.Connector = proxyConnector{}
+
+// RegisterWithConnector constructs a proxy driver that wraps the given
+// connector, and returns a connector that opens its connections. It is like
+// Register, but for applications that open their database by passing a
+// connector to sql.OpenDB, rather than by passing a data source name to
+// sql.Open. The given driver name identifies the proxy driver in recordings, so
+// the same name must be used with playback as was used during recording. Here
+// is an example:
+//
+//	var connector driver.Connector
+//
+//	func init() {
+//	  pqConnector, _ := pq.NewConnector("postgresql://root@localhost")
+//	  connector = copyist.RegisterWithConnector("postgres", pqConnector)
+//	}
+//
+//	func TestMyStuff(t *testing.T) {
+//	  defer copyist.Open(t).Close()
+//
+//	  db := sql.OpenDB(connector)
+//	  defer db.Close()
+//	  ...
+//	}
+//
+// The wrapped connector is only used in recording mode, but it must still be
+// given during playback. Connections opened by the returned connector always
+// belong to the current session, so it cannot be used with OpenParallel. Like
+// Register, RegisterWithConnector can only be called once for a given driver
+// name; subsequent attempts will fail with an error.
+func RegisterWithConnector(driverName string, connector driver.Connector) driver.Connector {
+	if noopMode {
+		return connector
+	}
+
+	if registered == nil {
+		registered = make(map[string]*proxyDriver)
+	} else if _, ok := registered[driverName]; ok {
+		panic(fmt.Errorf("RegisterWithConnector called twice for driver %s", driverName))
+	}
+
+	copyistDriver := &proxyDriver{driverName: driverName, connector: connector}
+	registered[driverName] = copyistDriver
+	return proxyConnector{driver: copyistDriver}
+}
+
+// Connect returns a connection to the database, which is recorded or played
+// back by the current copyist session.
+func (c proxyConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	return c.driver.open(ctx, "")
+}
+
+// Driver returns the proxy driver.
+func (c proxyConnector) Driver() driver.Driver {
+	return c.driver
+}
@@ -0,0 +1,94 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package copyist
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// execConnector is a fake driver.Connector that opens connections which count
+// the statements that they execute.
+type execConnector struct {
+	connects int
+}
+
+func (c *execConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	c.connects++
+	return &execConn{}, nil
+}
+
+func (c *execConnector) Driver() driver.Driver {
+	return nil
+}
+
+// execConn is a fake driver connection that executes statements without doing
+// anything.
+type execConn struct {
+	driver.Conn
+}
+
+func (c *execConn) ExecContext(
+	ctx context.Context, query string, args []driver.NamedValue,
+) (driver.Result, error) {
+	return driver.RowsAffected(1), nil
+}
+
+func (c *execConn) Close() error {
+	return nil
+}
+
+// TestRegisterWithConnector tests recording and playing back the connections
+// opened by a connector passed to sql.OpenDB.
+func TestRegisterWithConnector(t *testing.T) {
+	registered = nil
+	defer func() { registered = nil }()
+	fake := &execConnector{}
+	connector := RegisterWithConnector("connector", fake)
+	require.PanicsWithError(t, "RegisterWithConnector called twice for driver connector", func() {
+		RegisterWithConnector("connector", fake)
+	})
+
+	source := &memorySource{}
+	run := func() {
+		m := &mockTestingT{T: t}
+		closer := OpenSource(m, source, "TestRegisterWithConnector")
+		db := sql.OpenDB(connector)
+		res, err := db.Exec("DELETE FROM customers")
+		require.NoError(t, err)
+		affected, err := res.RowsAffected()
+		require.NoError(t, err)
+		require.Equal(t, int64(1), affected)
+		require.NoError(t, db.Close())
+		require.NoError(t, closer.Close())
+		require.Equal(t, "", m.buf.String())
+	}
+
+	// Record.
+	*recordFlag = true
+	visitedRecording = true
+	run()
+	*recordFlag = false
+	require.Equal(t, 1, fake.connects)
+	require.Contains(t, string(source.data), `"TestRegisterWithConnector"=1,2`)
+
+	// Play back, without using the wrapped connector.
+	run()
+	require.Equal(t, 1, fake.connects)
+}
@@ -15,17 +15,25 @@
 package copyist
 
 import (
+	"bytes"
+	"crypto/md5"
 	"database/sql"
 	"errors"
 	"flag"
 	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/printer"
+	"go/token"
 	"io"
 	"os"
-	"path"
+	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
+	"time"
 
-	"github.com/jmoiron/sqlx"
+	"github.com/cockroachdb/copyist/internal/recdir"
 )
 
 // testingT is a subset of the testing.T methods that are used by copyist. The
@@ -35,14 +43,90 @@ type testingT interface {
 	Name() string
 }
 
+// testingLogger is implemented by testingT implementations that can log
+// non-fatal messages, like testing.T.
+type testingLogger interface {
+	Logf(format string, args ...interface{})
+}
+
+// testingSkipper is implemented by testingT implementations that can skip the
+// test, like testing.T.
+type testingSkipper interface {
+	Skipf(format string, args ...interface{})
+}
+
 // recordFlag instructs copyist to record all calls to the registered driver, if
 // true. Otherwise, it plays back previously recorded calls.
-var recordFlag = flag.Bool("record", true, "record sql database accesses")
+var recordFlag = new(bool)
+
+// diffFlag instructs copyist to compare new recordings with the existing
+// recordings rather than saving them, if true. It is set by "-record=diff", and
+// implies recordFlag.
+var diffFlag = new(bool)
+
+// verifyFlag instructs copyist to check new records against the existing
+// recordings as they are made, rather than saving them, if true. It is set by
+// "-record=verify", and implies recordFlag.
+var verifyFlag = new(bool)
+
+func init() {
+	if noopMode {
+		return
+	}
+	*recordFlag = true
+	flag.Var(recordFlagValue{}, "record",
+		"record sql database accesses, or \"diff\" or \"verify\" to compare them with "+
+			"existing recordings")
+}
+
+// recordFlagValue is the value of the "record" command-line flag. It is a
+// boolean flag, so "-record" alone is the same as "-record=true", but it also
+// accepts "diff", which records calls without saving them, and instead
+// reports how they differ from the existing recordings, and "verify", which
+// records calls without saving them, and fails as soon as they differ from the
+// existing recordings.
+type recordFlagValue struct{}
+
+// IsBoolFlag implements the flag package's boolFlag interface.
+func (recordFlagValue) IsBoolFlag() bool { return true }
+
+// String implements flag.Value.
+func (recordFlagValue) String() string {
+	if *diffFlag {
+		return "diff"
+	}
+	if *verifyFlag {
+		return "verify"
+	}
+	return strconv.FormatBool(*recordFlag)
+}
+
+// Set implements flag.Value.
+func (recordFlagValue) Set(value string) error {
+	switch value {
+	case "diff":
+		*recordFlag, *diffFlag, *verifyFlag = true, true, false
+		return nil
+	case "verify":
+		*recordFlag, *diffFlag, *verifyFlag = true, false, true
+		return nil
+	}
+	record, err := strconv.ParseBool(value)
+	if err != nil {
+		return err
+	}
+	*recordFlag, *diffFlag, *verifyFlag = record, false, false
+	return nil
+}
 
 var visitedRecording bool
 
 // IsRecording returns true if copyist is currently in recording mode.
 func IsRecording() bool {
+	if noopMode {
+		return false
+	}
+
 	// Determine whether the "record" flag was explicitly passed rather than
 	// defaulted. This is painful and slow in Go, so do it just once.
 	if !visitedRecording {
@@ -55,8 +139,10 @@ func IsRecording() bool {
 		if !found {
 			// If the record flag was not explicitly specified, then next check
 			// the value of the COPYIST_RECORD environment variable.
-			if os.Getenv("COPYIST_RECORD") != "" {
+			if env := os.Getenv("COPYIST_RECORD"); env != "" {
 				*recordFlag = true
+				*diffFlag = env == "diff"
+				*verifyFlag = env == "verify"
 			} else {
 				*recordFlag = false
 			}
@@ -66,8 +152,11 @@ func IsRecording() bool {
 	return *recordFlag
 }
 
-// MaxRecordingSize is the maximum size, in bytes, of a single recording in its
+// MaxRecordingSize was the maximum size, in bytes, of a single recording in its
 // text format.
+//
+// Deprecated: There is no longer any limit on the size of recordings, so this
+// has no effect.
 var MaxRecordingSize = 1024 * 1024
 
 // SessionInitCallback types a function that is invoked once per session for
@@ -78,6 +167,54 @@ type SessionInitCallback func()
 // sessionInit is called at the beginning of each new session, if not nil.
 var sessionInit SessionInitCallback
 
+// recordingDir is the directory set by SetRecordingDir, or empty if it has not
+// been set.
+var recordingDir string
+
+// RecordingPathCallback types a function that returns the path of the copyist
+// recording file that Open should use for a test, given the name of the test
+// file that called Open (e.g. "/src/pkg/store/store_test.go") and the name of
+// the test (e.g. "TestStore/subtest").
+type RecordingPathCallback func(testFileName, testName string) string
+
+// recordingPath is called by Open to derive the recording file path, if not
+// nil.
+var recordingPath RecordingPathCallback
+
+// variant is the variant set by SetVariant, or empty if it has not been set.
+var variant string
+
+// maxAge is the maximum age set by SetMaxAge, or zero if it has not been set.
+var maxAge time.Duration
+
+// failOnStaleRecording is set by SetFailOnStaleRecording.
+var failOnStaleRecording bool
+
+// failOnUnconsumedRecords is set by SetFailOnUnconsumedRecords.
+var failOnUnconsumedRecords bool
+
+// skipMissingRecordings is set by SetSkipMissingRecordings.
+var skipMissingRecordings bool
+
+// sidecarThreshold is the threshold set by SetSidecarThreshold, or zero if it
+// has not been set.
+var sidecarThreshold int
+
+// serializeCalls is set by SetSerializeCalls.
+var serializeCalls bool
+
+// volatileColumns is the set of column names set by SetVolatileColumns.
+var volatileColumns map[string]bool
+
+// RedactorCallback types a function that redacts sensitive values from a record
+// before it is written to a recording file. It is given the name of the driver
+// method that the record describes (e.g. "RowsNext") and the arguments and/or
+// return values of the call, and returns the values to record in their place.
+type RedactorCallback func(recordType string, args []interface{}) []interface{}
+
+// redactor is called on every record when recording, if not nil.
+var redactor RedactorCallback
+
 // registered is the set of proxy drivers created via calls to Register, indexed
 // by driver name.
 var registered map[string]*proxyDriver
@@ -96,30 +233,115 @@ var registered map[string]*proxyDriver
 //
 //	copyist.Register("postgres")
 //
+// The copyist driver is registered with the `sql` package with the name
+// "copyist_<driverName>", unless a different name is given with the WithName
+// option.
+//
 // Note that Register can only be called once for a given driver; subsequent
-// attempts will fail with an error. In addition, the same copyist driver must
-// be used with playback as was was used during recording.
-func Register(driverName string) {
+// attempts will fail with an error. However, the same driver can be registered
+// again under a different name, using the WithName option. For example, a
+// primary database and an analytics database that both use the "postgres"
+// driver can be registered separately, with their own session initialization:
+//
+//	copyist.Register("postgres",
+//	  copyist.WithName("copyist_primary"), copyist.WithSessionInit(resetPrimary))
+//	copyist.Register("postgres",
+//	  copyist.WithName("copyist_analytics"), copyist.WithSessionInit(resetAnalytics))
+//
+// The calls made via each registration are recorded and played back as their
+// own stream of records. In addition, the same copyist driver must be used with
+// playback as was was used during recording.
+//
+// Register does not tell the sqlx package how to represent query parameters
+// for the copyist driver, so that projects that do not use sqlx do not depend on
+// it. Projects that use sqlx should call copyistsqlx.Register instead, which
+// also binds the copyist driver with sqlx.
+func Register(driverName string, opts ...RegisterOption) {
+	if noopMode {
+		sql.Register(DriverName(driverName, opts...), &noopDriver{driverName: driverName})
+		return
+	}
+
+	// Drivers registered with a custom name are identified by that name, so
+	// that the same driver can be registered more than once.
+	options := newRegisterOptions(opts)
+	key := driverName
+	if options.name != "" {
+		key = options.name
+	}
+
 	if registered == nil {
 		registered = make(map[string]*proxyDriver)
-	} else if _, ok := registered[driverName]; ok {
-		panic(fmt.Errorf("Register called twice for driver %s", driverName))
+	} else if _, ok := registered[key]; ok {
+		panic(fmt.Errorf("Register called twice for driver %s", key))
 	}
 
-	copyistDriver := &proxyDriver{driverName: driverName}
-	registered[driverName] = copyistDriver
-
-	// sqlx uses a default list of driver names to determine how to represent
-	// parameters in prepared queries. For example, postgres uses $1, mysql
-	// uses ?, sqlserver uses @, and so on.  But since copyist defines a custom
-	// driver name, sqlx falls back to the default ?, which won't work with some
-	// databases. Register the copyist driver name with sqlx and tell it to use
-	// the bind type of the underlying driver rather than the default ?.
-	copyistDriverName := copyistDriverName(driverName)
-	sqlx.BindDriver(copyistDriverName, sqlx.BindType(driverName))
+	copyistDriver := &proxyDriver{driverName: key, sessionInit: options.sessionInit}
+	if key != driverName {
+		copyistDriver.wrappedName = driverName
+	}
+	registered[key] = copyistDriver
 
 	// Register the copyist driver with the `sql` package.
-	sql.Register(copyistDriverName, copyistDriver)
+	sql.Register(DriverName(driverName, opts...), copyistDriver)
+}
+
+// registerOptions are the options that are passed to Register.
+type registerOptions struct {
+	// name is the name with which the copyist driver is registered with the
+	// `sql` package, or "" to use the default name.
+	name string
+
+	// sessionInit is called at the beginning of each new session that uses
+	// the copyist driver, if not nil.
+	sessionInit SessionInitCallback
+}
+
+// newRegisterOptions returns the options set by the given list of options.
+func newRegisterOptions(opts []RegisterOption) registerOptions {
+	var options registerOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+	return options
+}
+
+// RegisterOption customizes the copyist driver constructed by Register.
+type RegisterOption func(opts *registerOptions)
+
+// WithName sets the name with which Register registers the copyist driver with
+// the `sql` package, rather than "copyist_<driverName>". This avoids conflicts
+// with other packages that register a driver of the default name, such as a
+// library that also wraps drivers. Here is an example:
+//
+//	copyist.Register("postgres", copyist.WithName("recorded_postgres"))
+//	...
+//	db, _ := sql.Open("recorded_postgres", "postgresql://root@localhost")
+func WithName(name string) RegisterOption {
+	return func(opts *registerOptions) {
+		opts.name = name
+	}
+}
+
+// WithSessionInit sets a callback function that will be invoked at the beginning
+// of each copyist session that uses the copyist driver, in addition to the
+// callback set by SetSessionInit. Like that callback, it is only invoked in
+// "recording" mode. It is useful when several drivers are registered, each
+// with its own database to initialize.
+func WithSessionInit(callback SessionInitCallback) RegisterOption {
+	return func(opts *registerOptions) {
+		opts.sessionInit = callback
+	}
+}
+
+// DriverName returns the name with which Register registers the copyist driver
+// that wraps the driver of the given name, when it is passed the given options.
+// This is the name to pass to sql.Open.
+func DriverName(driverName string, opts ...RegisterOption) string {
+	if options := newRegisterOptions(opts); options.name != "" {
+		return options.name
+	}
+	return "copyist_" + driverName
 }
 
 // SetSessionInit sets the callback function that will be invoked at the
@@ -133,6 +355,214 @@ func SetSessionInit(callback SessionInitCallback) {
 	sessionInit = callback
 }
 
+// SetRecordingPath sets the callback function that Open uses to derive the
+// path of the copyist recording file for each test, replacing the default
+// testdata/<testfile>.copyist convention. This allows projects with central
+// recording trees or unconventional layouts to use Open rather than calling
+// OpenNamed in every test. For example:
+//
+//	copyist.SetRecordingPath(func(testFileName, testName string) string {
+//	  rel, _ := filepath.Rel(repoRoot, filepath.Dir(testFileName))
+//	  return filepath.Join(repoRoot, "recordings", rel+".copyist")
+//	})
+//
+// Calling SetRecordingPath with nil restores the default behavior.
+func SetRecordingPath(callback RecordingPathCallback) {
+	recordingPath = callback
+}
+
+// SetVariant qualifies the names of recordings made or played back from now on
+// with the given variant, such as the version of the database server that they
+// are recorded against. Recording names are qualified like "TestFoo@v21.1".
+// This allows the same tests to be recorded against multiple database versions
+// and stored alongside one another, in order to verify behavior differences
+// between them. If SetVariant is not called, then the COPYIST_VARIANT
+// environment variable is used instead, if it is defined. Calling SetVariant
+// with an empty string restores the default behavior. See the "-versions" flag
+// of the "copyist record" command for an easy way to record a version matrix.
+func SetVariant(name string) {
+	variant = name
+}
+
+// getVariant returns the variant set by SetVariant, or else the value of the
+// COPYIST_VARIANT environment variable.
+func getVariant() string {
+	if variant != "" {
+		return variant
+	}
+	return os.Getenv("COPYIST_VARIANT")
+}
+
+// qualifyRecordingName qualifies the given recording name with the current
+// variant, if there is one.
+func qualifyRecordingName(recordingName string) string {
+	if v := getVariant(); v != "" {
+		return recordingName + "@" + v
+	}
+	return recordingName
+}
+
+// SetMaxAge sets the maximum age of recordings made from now on, after which
+// they should be regenerated against a real database. The maximum age is saved
+// in the recording file alongside each recording, together with the time at
+// which the recording was made. It does not affect playback; instead, the
+// "copyist expire" command reports recordings that have outlived their maximum
+// age, so that they can be periodically refreshed. Calling SetMaxAge with zero
+// means that recordings never expire, unless a policy is given to the
+// "copyist expire" command.
+func SetMaxAge(d time.Duration) {
+	maxAge = d
+}
+
+// SetFingerprint sets the fingerprint of the test that is using the currently
+// open session, overriding the fingerprint that Open derives from the source of
+// the test function. When recording, the fingerprint is saved alongside the
+// recording. When playing back, the fingerprint is compared to the saved
+// fingerprint, in order to detect recordings that were not regenerated after
+// the test changed. This is useful when the test depends on code outside of the
+// test function, such as a schema or fixture file:
+//
+//	defer copyist.Open(t).Close()
+//	copyist.SetFingerprint(fmt.Sprintf("%x", md5.Sum(schema)))
+//
+// Calling SetFingerprint with an empty string disables the check for the
+// session.
+func SetFingerprint(fingerprint string) {
+	if currentSession == nil {
+		panic(errors.New("SetFingerprint called without an open session"))
+	}
+	currentSession.fingerprint = fingerprint
+}
+
+// SetFailOnStaleRecording determines what happens when playing back a
+// recording whose fingerprint does not match the test, meaning that the test
+// has changed since the recording was made. By default, a warning is logged
+// via testing.T.Logf. If fail is true, then the test fails instead.
+func SetFailOnStaleRecording(fail bool) {
+	failOnStaleRecording = fail
+}
+
+// SetFailOnUnconsumedRecords determines what happens when a playback session is
+// closed before all of the records in its recording have been played back,
+// meaning that the recording is longer than the test that it backs (e.g.
+// because the test was changed to make fewer calls, but was not re-recorded).
+// By default, a warning is logged via testing.T.Logf. If fail is true, then the
+// test fails instead.
+func SetFailOnUnconsumedRecords(fail bool) {
+	failOnUnconsumedRecords = fail
+}
+
+// SetSkipMissingRecordings determines what happens when a test is played back,
+// but its recording does not exist (e.g. because the test was just added, and
+// recordings are made on a separate cadence). By default, the test fails when
+// it first calls the database. If skip is true, then the test is skipped
+// instead, via testing.T.Skipf, with a message that explains why.
+func SetSkipMissingRecordings(skip bool) {
+	skipMissingRecordings = skip
+}
+
+// SetSidecarThreshold sets the size, in bytes, above which byte slice values
+// (e.g. bytea or blob columns) are stored in sidecar files rather than inline in
+// recording files made from now on. Multi-megabyte values make recording files
+// slow to read and impossible to review. Sidecar files are named after the
+// SHA-256 hash of their contents, and are stored in a directory alongside the
+// recording file, named after it. For example, values recorded in
+// "testdata/store_test.copyist" are stored in:
+//
+//	testdata/store_test.sidecar/<hash>
+//
+// Sidecar files are loaded transparently when recordings are played back, so
+// they need to be committed along with the recording file. Calling
+// SetSidecarThreshold with zero stores all values inline, which is the default.
+func SetSidecarThreshold(size int) {
+	sidecarThreshold = size
+}
+
+// SetSerializeCalls determines whether driver calls are serialized while
+// recording. Each connection plays back its own stream of records, so the order
+// in which concurrent connections make calls usually doesn't matter. However,
+// if an application depends on the order of calls across connections (e.g. one
+// goroutine polls for rows inserted by another), then the recorded order may
+// not be reproduced on playback. If serialize is true, then each driver call is
+// made behind a mutex while recording, so that no two calls overlap, and each
+// record is annotated with the goroutine that made it. When such a recording is
+// played back, each call waits until all calls recorded before it have been
+// made, or until a timeout expires.
+//
+// Since only one call is made at a time, calls that block until another
+// connection makes progress (e.g. waiting for a lock held by another
+// transaction) deadlock while recording.
+func SetSerializeCalls(serialize bool) {
+	serializeCalls = serialize
+}
+
+// SetVolatileColumns declares the names of result columns whose values differ
+// each time they are queried, like the result of "SELECT now()" or "SHOW
+// session_id". Such values can never match a recording made at another time,
+// and they cause every regenerated recording to differ from the last. When
+// recording, the values of volatile columns are returned to the application
+// as-is, but the recording only stores a placeholder that records their type.
+// During playback, the zero value of that type is returned instead, so tests
+// must not depend on the values of volatile columns. Calling
+// SetVolatileColumns with no names clears the set.
+func SetVolatileColumns(names ...string) {
+	volatileColumns = make(map[string]bool, len(names))
+	for _, name := range names {
+		volatileColumns[name] = true
+	}
+}
+
+// SetRedactor sets the callback function that is invoked on every record made
+// while recording, before it is written to a recording file. This keeps
+// passwords, tokens and personal data returned by the database out of
+// version-controlled recordings. For example, to redact the rows returned by
+// queries of a users table:
+//
+//	copyist.SetRedactor(func(recordType string, args []interface{}) []interface{} {
+//	  if recordType == "RowsNext" && args[0] != nil {
+//	    row := args[0].([]driver.Value)
+//	    ...
+//	  }
+//	  return args
+//	})
+//
+// The callback may modify the given args in place, since they are a copy of
+// the values returned to the application. Replacement values must be of the
+// same types as the values that they replace. Redacting the SQL text of
+// statements will cause playback to fail, since the application will still
+// execute the original statements. Calling SetRedactor with nil disables
+// redaction.
+func SetRedactor(callback RedactorCallback) {
+	redactor = callback
+}
+
+// SetRecordingDir redirects the recording files read and written by Open to
+// the given directory, rather than the testdata directory alongside each test
+// file. Each test file's recording file is located in a subdirectory having
+// the path of the test file's package relative to the root of its module, so
+// that packages with the same name do not collide. For example, recordings for
+// "pkg/store/store_test.go" would be read and written from:
+//
+//	<dirName>/pkg/store/store_test.copyist
+//
+// This is useful for recording into a CI artifacts directory, or for
+// experimenting without touching committed recordings. If SetRecordingDir is
+// not called, then the COPYIST_RECORDING_DIR environment variable is used
+// instead, if it is defined. Calling SetRecordingDir with an empty string
+// restores the default behavior.
+func SetRecordingDir(dirName string) {
+	recordingDir = dirName
+}
+
+// getRecordingDir returns the directory set by SetRecordingDir, or else the
+// value of the COPYIST_RECORDING_DIR environment variable.
+func getRecordingDir() string {
+	if recordingDir != "" {
+		return recordingDir
+	}
+	return os.Getenv("COPYIST_RECORDING_DIR")
+}
+
 // Open begins a recording or playback session, depending on the value of the
 // "record" command-line flag. If recording, then all calls to registered
 // drivers will be recorded and then saved in a copyist recording file that sits
@@ -157,25 +587,136 @@ func SetSessionInit(callback SessionInitCallback) {
 //	  mystuff_test.copyist
 //
 // Each test or sub-test that needs to be executed independently needs to record
-// its own session.
+// its own session. The location of the recording file can be customized by
+// calling SetRecordingPath or SetRecordingDir.
 func Open(t testingT) io.Closer {
+	if noopMode {
+		return noopCloser{}
+	}
 	if registered == nil {
 		panic(errors.New("Register was not called"))
 	}
 
 	// Get name of calling test file.
-	fileName := findTestFile()
+	return OpenForFile(t, findTestFile())
+}
 
-	// Construct the recording pathName name by locating the copyist recording
-	// file in the testdata directory with the ".copyist" extension.
-	dirName := path.Join(path.Dir(fileName), "testdata")
-	fileName = path.Base(fileName[:len(fileName)-3]) + ".copyist"
-	pathName := path.Join(dirName, fileName)
+// OpenForFile is a variant of Open which accepts the name of the test file
+// (e.g. "/src/pkg/store/store_test.go") rather than searching the call stack
+// for it. This is useful when the test file is not on the call stack, such as
+// when a test framework opens a session in a separate goroutine on behalf of
+// the test. The recording file and recording name are derived in the same way
+// as by Open.
+func OpenForFile(t testingT, fileName string) io.Closer {
+	if noopMode {
+		return noopCloser{}
+	}
+	if registered == nil {
+		panic(errors.New("Register was not called"))
+	}
 
 	// The recording name is the name of the test.
 	recordingName := t.Name()
 
-	return OpenNamed(t, pathName, recordingName)
+	c := OpenNamed(t, recordingPathName(fileName, recordingName), recordingName)
+	currentSession.fingerprint = testFingerprint(fileName, recordingName)
+	currentSession.rerun = rerunCommand(fileName, t.Name())
+	return c
+}
+
+// OpenFuzz is a variant of Open for use in fuzz targets. The fuzzing engine
+// calls the target many times with differing inputs, each time under a new
+// sub-test name (e.g. "FuzzParse/seed#0" or "FuzzParse/5a3b..."). Rather than
+// expecting a recording per input, OpenFuzz names the recording after the fuzz
+// test itself (e.g. "FuzzParse"), and every execution plays back that same
+// recording from its beginning. Here is a typical calling pattern:
+//
+//	func FuzzParse(f *testing.F) {
+//	  f.Add("SELECT 1")
+//	  f.Fuzz(func(t *testing.T, s string) {
+//	    defer copyist.OpenFuzz(t).Close()
+//	    ...
+//	  })
+//	}
+//
+// The database calls made by the target must therefore not depend on its
+// inputs. The recording is made by running the seed corpus in recording mode
+// (i.e. without the -fuzz flag). Recording while fuzzing is not supported, as
+// it would make a new recording for every one of the generated inputs, so
+// OpenFuzz panics if it is called in recording mode under -fuzz.
+func OpenFuzz(t testingT) io.Closer {
+	if noopMode {
+		return noopCloser{}
+	}
+	if registered == nil {
+		panic(errors.New("Register was not called"))
+	}
+
+	if IsRecording() && isFuzzing() {
+		panic(errors.New("copyist cannot record while fuzzing; " +
+			"record the seed corpus without -fuzz instead"))
+	}
+
+	// The recording name is the name of the fuzz test, without the name of
+	// the input.
+	fileName := findTestFile()
+	recordingName := strings.SplitN(t.Name(), "/", 2)[0]
+
+	c := OpenNamed(t, recordingPathName(fileName, recordingName), recordingName)
+	currentSession.fingerprint = testFingerprint(fileName, recordingName)
+	currentSession.rerun = rerunCommand(fileName, recordingName)
+	return c
+}
+
+// OpenWithVars is a variant of Open for table-driven tests whose cases make the
+// same database calls, differing only in identifiers like user IDs or names.
+// Every case records and plays back the same recording, having the given name,
+// in the calling test file's recording file. The given template variables
+// are bound to the values used by the current case. While recording, each
+// value is replaced by a named placeholder, like "{{.UserID}}", and during
+// playback, each placeholder is replaced by the value bound to its variable:
+//
+//	for _, tc := range cases {
+//	  t.Run(tc.name, func(t *testing.T) {
+//	    defer copyist.OpenWithVars(t, "TestLookup", map[string]interface{}{
+//	      "UserID": tc.userID,
+//	    }).Close()
+//	    ...
+//	  })
+//	}
+//
+// String values are replaced wherever they occur, including within query text,
+// while other values (integers, floats and booleans) are replaced only where
+// they are returned as whole values in rows. Values should therefore be
+// distinctive enough that they do not occur by coincidence.
+func OpenWithVars(t testingT, recordingName string, vars map[string]interface{}) io.Closer {
+	if noopMode {
+		return noopCloser{}
+	}
+	if registered == nil {
+		panic(errors.New("Register was not called"))
+	}
+
+	templateVars := newTemplateVars(vars)
+	fileName := findTestFile()
+	c := OpenNamed(t, recordingPathName(fileName, recordingName), recordingName)
+	currentSession.fingerprint = testFingerprint(fileName, recordingName)
+	currentSession.rerun = rerunCommand(fileName, t.Name())
+	currentSession.vars = templateVars
+	return c
+}
+
+// isFuzzing returns true if the test binary was started by "go test -fuzz",
+// either as the coordinating process or as one of its fuzzing workers.
+func isFuzzing() bool {
+	for _, name := range []string{"test.fuzz", "test.fuzzworker"} {
+		if f := flag.Lookup(name); f != nil {
+			if val := f.Value.String(); val != "" && val != "false" {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 // OpenNamed is a variant of Open which accepts a caller-specified pathName and
@@ -185,11 +726,14 @@ func Open(t testingT) io.Closer {
 // directory. The given recordingName will be used as the recording name in that
 // file rather than using the testing.T.Name() value.
 func OpenNamed(t testingT, pathName, recordingName string) io.Closer {
+	if noopMode {
+		return noopCloser{}
+	}
 	if registered == nil {
 		panic(errors.New("Register was not called"))
 	}
 
-	return OpenSource(t, fileSource{PathName: pathName}, recordingName)
+	return OpenSource(t, NewFileSource(pathName), recordingName)
 }
 
 // OpenSource is a variant of Open which accepts a caller-specified source and
@@ -199,42 +743,60 @@ func OpenNamed(t testingT, pathName, recordingName string) io.Closer {
 // be used as the recording name in that file rather than using the
 // testing.T.Name() value.
 func OpenSource(t testingT, source Source, recordingName string) io.Closer {
+	if noopMode {
+		return noopCloser{}
+	}
 	if registered == nil {
 		panic(errors.New("Register was not called"))
 	}
 
 	// Start a new recording or playback session.
-	currentSession = newSession(source, recordingName)
+	s := newSession(source, qualifyRecordingName(recordingName))
+	skipIfMissing(t, s)
+	currentSession = s
 
 	// Return a closer that will close the session when called.
 	return closer(func(r interface{}) error {
-		// Convert sessionError panics into fatal test errors.
-		if _, ok := r.(*sessionError); ok {
-			t.Fatalf("%v\n", r)
-		} else if r != nil {
-			panic(r)
-		}
-
-		if currentSession.verificationErr != nil {
-			t.Fatalf("%+v\n", currentSession.verificationErr.error)
-		}
-
-		currentSession.Close()
+		currentSession.Finish(t, r)
 		currentSession = nil
 		return nil
 	})
 }
 
+// skipIfMissing skips the test if the given session would play back a
+// recording that does not exist, and SetSkipMissingRecordings is enabled.
+func skipIfMissing(t testingT, s *session) {
+	if !skipMissingRecordings || IsRecording() {
+		return
+	}
+	skipper, ok := t.(testingSkipper)
+	if !ok {
+		return
+	}
+	err := s.recordingSource.ParseCached()
+	if _, ok := s.recordingSource.recordingDecls[s.recordingName]; err == nil && ok {
+		return
+	}
+	if err != nil && !os.IsNotExist(err) {
+		// Let playback report the parse error.
+		return
+	}
+	skipper.Skipf("copyist: skipping test, since recording %s does not exist\n\n"+
+		"Do you need to generate the recording with the -record flag?", s.recordingName)
+}
+
 // findTestFile searches the call stack, looking for the test that called
 // copyist.Open. It searches up to N levels, looking for the last file that
-// ends in "_test.go" and returns that filename.
+// ends in "_test.go" and returns that filename. runtime.Caller always uses
+// forward slashes, so the filename is converted to use the separator of the
+// current platform (e.g. backslashes on Windows).
 func findTestFile() string {
 	const levels = 10
 	var lastTestFilename string
 	for i := 0; i < levels; i++ {
 		_, fileName, _, _ := runtime.Caller(2 + i)
 		if strings.HasSuffix(fileName, "_test.go") {
-			lastTestFilename = fileName
+			lastTestFilename = filepath.FromSlash(fileName)
 		}
 	}
 	if lastTestFilename != "" {
@@ -243,10 +805,49 @@ func findTestFile() string {
 	panic(fmt.Errorf("Open was not called directly or indirectly from a test file"))
 }
 
-// copyistDriverName constructs the copyist wrapper driver's name as a function
-// of the wrapped driver's name.
-func copyistDriverName(driverName string) string {
-	return "copyist_" + driverName
+// testFingerprint returns a hash of the source of the test function that made
+// the recording of the given name, or the empty string if the source cannot be
+// found. Sub-tests use the fingerprint of their top-level test function. The
+// function is parsed and printed without comments before hashing, so that only
+// changes to its code change the fingerprint.
+func testFingerprint(testFileName, recordingName string) string {
+	funcName := strings.SplitN(recordingName, "/", 2)[0]
+
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, testFileName, nil, 0)
+	if err != nil {
+		return ""
+	}
+
+	for _, decl := range file.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok || fn.Recv != nil || fn.Name.Name != funcName {
+			continue
+		}
+
+		var buf bytes.Buffer
+		if err := printer.Fprint(&buf, fset, fn); err != nil {
+			return ""
+		}
+		return fmt.Sprintf("%x", md5.Sum(buf.Bytes()))
+	}
+	return ""
+}
+
+// recordingPathName returns the path of the copyist recording file that holds
+// the recording having the given name, made by a test in the given test file.
+// If SetRecordingPath has been called, then its callback decides the path. By
+// default, the recording file is in the testdata directory alongside the test
+// file, with the ".copyist" extension. If a recording directory has been set,
+// then the recording file is instead located in a subdirectory of it having
+// the test package's path relative to its module root (e.g. "a/store").
+func recordingPathName(testFileName, recordingName string) string {
+	if recordingPath != nil {
+		return recordingPath(testFileName, recordingName)
+	}
+	dirName := recdir.PackageDir(filepath.Dir(testFileName), getRecordingDir())
+	fileName := filepath.Base(testFileName[:len(testFileName)-3]) + ".copyist"
+	return filepath.Join(dirName, fileName)
 }
 
 // clearPooledConnections clears any pooled connection on all registered
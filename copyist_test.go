@@ -16,11 +16,18 @@ package copyist
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
+	"database/sql/driver"
+	"flag"
 	"fmt"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -47,6 +54,119 @@ func TestMultipleRegisterCalls(t *testing.T) {
 	Register("multiple-register-driver-2")
 }
 
+// TestRegisterWithName tests registering the copyist driver with a custom name.
+func TestRegisterWithName(t *testing.T) {
+	registered = nil
+	Register("postgres17", WithName("custom_postgres17"))
+	require.Contains(t, sql.Drivers(), "custom_postgres17")
+	require.NotContains(t, sql.Drivers(), "copyist_postgres17")
+
+	require.Equal(t, "copyist_postgres", DriverName("postgres"))
+	require.Equal(t, "custom_postgres17", DriverName("postgres17", WithName("custom_postgres17")))
+}
+
+// execDriver is a fake driver that opens execConn connections.
+type execDriver struct{}
+
+func (execDriver) Open(name string) (driver.Conn, error) {
+	return &execConn{}, nil
+}
+
+// TestRegisterTwiceWithNames tests registering the same driver more than once,
+// with different names and session initialization.
+func TestRegisterTwiceWithNames(t *testing.T) {
+	sql.Register("postgres18", execDriver{})
+	registered = nil
+	defer func() { registered = nil }()
+
+	inits := make(map[string]int)
+	Register("postgres18", WithName("copyist_primary"),
+		WithSessionInit(func() { inits["primary"]++ }))
+	Register("postgres18", WithName("copyist_analytics"),
+		WithSessionInit(func() { inits["analytics"]++ }))
+	require.PanicsWithError(t, "Register called twice for driver copyist_primary", func() {
+		Register("postgres18", WithName("copyist_primary"))
+	})
+
+	source := &memorySource{}
+	run := func(names ...string) {
+		m := &mockTestingT{T: t}
+		closer := OpenSource(m, source, "TestRegisterTwiceWithNames")
+		for _, name := range names {
+			db, err := sql.Open(name, "")
+			require.NoError(t, err)
+			_, err = db.Exec("DELETE FROM " + name)
+			require.NoError(t, err)
+			require.NoError(t, db.Close())
+		}
+		require.NoError(t, closer.Close())
+		require.Equal(t, "", m.buf.String())
+	}
+
+	// Record, initializing each database once.
+	*recordFlag = true
+	visitedRecording = true
+	run("copyist_primary", "copyist_analytics")
+	*recordFlag = false
+	require.Equal(t, map[string]int{"primary": 1, "analytics": 1}, inits)
+	require.Contains(t, string(source.data), `"TestRegisterTwiceWithNames"@streams=`+
+		`"copyist_primary"*1 "copyist_primary"#1*1 "copyist_analytics"*1 "copyist_analytics"#2*1`)
+
+	// Play back in a different order, since each registration has its own
+	// stream of records.
+	run("copyist_analytics", "copyist_primary")
+	require.Equal(t, map[string]int{"primary": 1, "analytics": 1}, inits)
+}
+
+// TestSessionInitQuery tests that session initialization callbacks can run
+// queries using copyist drivers, which open connections with the same session.
+func TestSessionInitQuery(t *testing.T) {
+	sql.Register("postgres22", execDriver{})
+	registered = nil
+	defer func() { registered = nil }()
+
+	initQuery := func(query string) func() {
+		return func() {
+			db, err := sql.Open("copyist_postgres22", "")
+			require.NoError(t, err)
+			defer db.Close()
+			_, err = db.Exec(query)
+			require.NoError(t, err)
+		}
+	}
+	Register("postgres22", WithSessionInit(initQuery("DELETE FROM orders")))
+	SetSessionInit(initQuery("DELETE FROM customers"))
+	defer SetSessionInit(nil)
+
+	*recordFlag = true
+	visitedRecording = true
+	defer func() { *recordFlag = false }()
+
+	source := &memorySource{}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		m := &mockTestingT{T: t}
+		closer := OpenSource(m, source, "TestSessionInitQuery")
+		db, err := sql.Open("copyist_postgres22", "")
+		require.NoError(t, err)
+		_, err = db.Exec("SELECT 1")
+		require.NoError(t, err)
+		require.NoError(t, db.Close())
+		require.NoError(t, closer.Close())
+		require.Equal(t, "", m.buf.String())
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("session initialization deadlocked")
+	}
+	require.Contains(t, string(source.data), `ConnExec	2:"DELETE FROM orders"`)
+	require.Contains(t, string(source.data), `ConnExec	2:"DELETE FROM customers"`)
+	require.Contains(t, string(source.data), `ConnExec	2:"SELECT 1"`)
+}
+
 // TestUnknownDriver tests that copyist.Driver.Open returns an error when an
 // unknown driver name is passed to copyist.Register.
 func TestUnknownDriver(t *testing.T) {
@@ -85,13 +205,18 @@ func TestRecordingNotFound(t *testing.T) {
 
 type mockTestingT struct {
 	*testing.T
-	buf bytes.Buffer
+	buf  bytes.Buffer
+	logs bytes.Buffer
 }
 
 func (t *mockTestingT) Fatalf(format string, args ...interface{}) {
 	fmt.Fprintf(&t.buf, format, args...)
 }
 
+func (t *mockTestingT) Logf(format string, args ...interface{}) {
+	fmt.Fprintf(&t.logs, format, args...)
+}
+
 func TestSessionFailuresAreFatalfd(t *testing.T) {
 	// Enter playback mode.
 	*recordFlag = false
@@ -147,6 +272,707 @@ func TestFindTestFile(t *testing.T) {
 	require.Equal(t, "copyist_test.go", filepath.Base(indirectFindTestFile()))
 }
 
+// TestRecordingDir tests that the recording directory can be overridden by
+// SetRecordingDir or by the COPYIST_RECORDING_DIR environment variable.
+func TestRecordingDir(t *testing.T) {
+	testFileName := filepath.FromSlash("/src/pkg/store/store_test.go")
+	require.Equal(t, filepath.FromSlash("/src/pkg/store/testdata/store_test.copyist"),
+		recordingPathName(testFileName, "TestQuery"))
+
+	require.NoError(t, os.Setenv("COPYIST_RECORDING_DIR", filepath.FromSlash("/artifacts/env")))
+	defer os.Unsetenv("COPYIST_RECORDING_DIR")
+	require.Equal(t, filepath.FromSlash("/artifacts/env/store/store_test.copyist"),
+		recordingPathName(testFileName, "TestQuery"))
+
+	SetRecordingDir(filepath.FromSlash("/artifacts/set"))
+	defer SetRecordingDir("")
+	require.Equal(t, filepath.FromSlash("/artifacts/set/store/store_test.copyist"),
+		recordingPathName(testFileName, "TestQuery"))
+
+	// Within a module, the subdirectory is the package's path relative to the
+	// module root.
+	testFileName, err := filepath.Abs(filepath.FromSlash("cmd/copyist/main_test.go"))
+	require.NoError(t, err)
+	require.Equal(t, filepath.FromSlash("/artifacts/set/cmd/copyist/main_test.copyist"),
+		recordingPathName(testFileName, "TestQuery"))
+}
+
+// TestWindowsRecordingPath tests that recording file paths are derived from
+// Windows test file paths, which have volume names and backslash separators.
+func TestWindowsRecordingPath(t *testing.T) {
+	if runtime.GOOS != "windows" {
+		t.Skip("requires Windows")
+	}
+	require.Equal(t, `C:\src\pkg\store	estdata\store_test.copyist`,
+		recordingPathName(`C:\src\pkg\store\store_test.go`, "TestQuery"))
+
+	// runtime.Caller uses forward slashes on Windows too.
+	testFileName := indirectFindTestFile()
+	require.False(t, strings.Contains(testFileName, "/"))
+	require.Equal(t, "copyist_test.go", filepath.Base(testFileName))
+}
+
+// TestVariant tests that recording names are qualified by the variant set by
+// SetVariant or by the COPYIST_VARIANT environment variable.
+func TestVariant(t *testing.T) {
+	require.Equal(t, "TestVariant/sub", qualifyRecordingName("TestVariant/sub"))
+
+	require.NoError(t, os.Setenv("COPYIST_VARIANT", "v20.2"))
+	defer os.Unsetenv("COPYIST_VARIANT")
+	require.Equal(t, "TestVariant/sub@v20.2", qualifyRecordingName("TestVariant/sub"))
+
+	SetVariant("v21.1")
+	defer SetVariant("")
+	require.Equal(t, "TestVariant/sub@v21.1", qualifyRecordingName("TestVariant/sub"))
+}
+
+// TestRecordingPath tests that Open uses the callback passed to
+// SetRecordingPath to derive the recording file path.
+func TestRecordingPath(t *testing.T) {
+	// Enter playback mode.
+	*recordFlag = false
+	visitedRecording = true
+
+	registered = nil
+	Register("postgres4")
+
+	pathName := filepath.Join(t.TempDir(), "custom.copyist")
+	require.NoError(t, os.WriteFile(pathName, []byte(`
+1=DriverOpen	1:nil
+2=ConnExec	2:"SELECT 1"	1:nil
+
+"TestRecordingPath"=1,2
+`), 0666))
+
+	var testFileName, testName string
+	SetRecordingPath(func(fileName, name string) string {
+		testFileName, testName = fileName, name
+		return pathName
+	})
+	defer SetRecordingPath(nil)
+
+	closer := Open(t)
+	db, err := sql.Open("copyist_postgres4", "")
+	require.NoError(t, err)
+	_, err = db.Exec("SELECT 1")
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+	require.NoError(t, closer.Close())
+
+	require.Equal(t, "copyist_test.go", filepath.Base(testFileName))
+	require.Equal(t, "TestRecordingPath", testName)
+}
+
+// TestFingerprint tests that test fingerprints are derived from the source of
+// the top-level test function.
+func TestFingerprint(t *testing.T) {
+	fileName := indirectFindTestFile()
+	fingerprint := testFingerprint(fileName, "TestFingerprint")
+	require.Len(t, fingerprint, 32)
+	require.Equal(t, fingerprint, testFingerprint(fileName, "TestFingerprint/subtest"))
+	require.NotEqual(t, fingerprint, testFingerprint(fileName, "TestRecordingPath"))
+	require.Equal(t, "", testFingerprint(fileName, "TestDoesNotExist"))
+	require.Equal(t, "", testFingerprint("does_not_exist_test.go", "TestFingerprint"))
+}
+
+// TestStaleRecording tests that playing back a recording made by a different
+// version of the test logs a warning, or fails if SetFailOnStaleRecording is
+// set.
+func TestStaleRecording(t *testing.T) {
+	// Enter playback mode.
+	*recordFlag = false
+	visitedRecording = true
+
+	registered = nil
+	Register("postgres5")
+
+	pathName := filepath.Join(t.TempDir(), "stale.copyist")
+	require.NoError(t, os.WriteFile(pathName, []byte(`
+1=DriverOpen	1:nil
+2=ConnExec	2:"SELECT 1"	1:nil
+
+"TestStaleRecording"=1,2
+"TestStaleRecording"@fingerprint=0123456789abcdef0123456789abcdef
+`), 0666))
+	SetRecordingPath(func(fileName, name string) string { return pathName })
+	defer SetRecordingPath(nil)
+
+	playback := func(m *mockTestingT) {
+		closer := Open(m)
+		db, err := sql.Open("copyist_postgres5", "")
+		require.NoError(t, err)
+		_, err = db.Exec("SELECT 1")
+		require.NoError(t, err)
+		require.NoError(t, db.Close())
+		require.NoError(t, closer.Close())
+	}
+
+	const expected = "test has changed since recording TestStaleRecording was made\n\n" +
+		"Do you need to regenerate the recording? Run:\n\n" +
+		"\tgo test . -run '^TestStaleRecording$' -record"
+
+	m := &mockTestingT{T: t}
+	playback(m)
+	require.Equal(t, expected, m.logs.String())
+	require.Equal(t, "", m.buf.String())
+
+	SetFailOnStaleRecording(true)
+	defer SetFailOnStaleRecording(false)
+	m = &mockTestingT{T: t}
+	playback(m)
+	require.Equal(t, "", m.logs.String())
+	require.Equal(t, expected+"\n", m.buf.String())
+}
+
+// TestUnconsumedRecords tests that playing back a recording that has records
+// which are never played back logs a warning, or fails if
+// SetFailOnUnconsumedRecords is set.
+func TestUnconsumedRecords(t *testing.T) {
+	// Enter playback mode.
+	*recordFlag = false
+	visitedRecording = true
+
+	registered = nil
+	Register("postgres16")
+
+	pathName := filepath.Join(t.TempDir(), "unconsumed.copyist")
+	require.NoError(t, os.WriteFile(pathName, []byte(`
+1=DriverOpen	1:nil
+2=ConnExec	2:"SELECT 1"	1:nil
+3=ConnExec	2:"SELECT 2"	1:nil
+
+"TestUnconsumedRecords"=1,2,3,3
+`), 0666))
+	SetRecordingPath(func(fileName, name string) string { return pathName })
+	defer SetRecordingPath(nil)
+
+	playback := func(m *mockTestingT) {
+		closer := Open(m)
+		db, err := sql.Open("copyist_postgres16", "")
+		require.NoError(t, err)
+		_, err = db.Exec("SELECT 1")
+		require.NoError(t, err)
+		require.NoError(t, db.Close())
+		require.NoError(t, closer.Close())
+	}
+
+	const expected = "recording TestUnconsumedRecords has 2 records that were never played " +
+		"back, starting with ConnExec (#2)\n\n" +
+		"Do you need to regenerate the recording? Run:\n\n" +
+		"\tgo test . -run '^TestUnconsumedRecords$' -record"
+
+	m := &mockTestingT{T: t}
+	playback(m)
+	require.Equal(t, expected, m.logs.String())
+	require.Equal(t, "", m.buf.String())
+
+	SetFailOnUnconsumedRecords(true)
+	defer SetFailOnUnconsumedRecords(false)
+	m = &mockTestingT{T: t}
+	playback(m)
+	require.Equal(t, "", m.logs.String())
+	require.Equal(t, expected+"\n", m.buf.String())
+}
+
+// skipTestingT is a mockTestingT that records the message passed to Skipf,
+// rather than skipping the test.
+type skipTestingT struct {
+	mockTestingT
+	skipped string
+}
+
+func (t *skipTestingT) Skipf(format string, args ...interface{}) {
+	t.skipped = fmt.Sprintf(format, args...)
+}
+
+func TestSkipMissingRecordings(t *testing.T) {
+	// Enter playback mode.
+	*recordFlag = false
+	visitedRecording = true
+
+	source := NewMemorySource([]byte("1=DriverOpen\t1:nil\n\n\"TestExists\"=1\n"))
+	m := &skipTestingT{mockTestingT: mockTestingT{T: t}}
+
+	// Tests are not skipped by default.
+	skipIfMissing(m, newSession(source, "TestMissing"))
+	require.Empty(t, m.skipped)
+
+	SetSkipMissingRecordings(true)
+	defer SetSkipMissingRecordings(false)
+	skipIfMissing(m, newSession(source, "TestExists"))
+	require.Empty(t, m.skipped)
+
+	skipIfMissing(m, newSession(source, "TestMissing"))
+	require.Equal(t, "copyist: skipping test, since recording TestMissing does not exist\n\n"+
+		"Do you need to generate the recording with the -record flag?", m.skipped)
+
+	// Tests are skipped if the recording file does not exist either.
+	m.skipped = ""
+	missingFile := NewFileSource(filepath.Join(t.TempDir(), "missing.copyist"))
+	skipIfMissing(m, newSession(missingFile, "TestMissing"))
+	require.NotEmpty(t, m.skipped)
+}
+
+// TestStmtArgCount tests that playback fails if a different number of arguments
+// is passed to a prepared statement than when it was recorded. When NumInput
+// returns -1, the sql package does not check the number of arguments, so
+// copyist checks them against the recording instead.
+func TestStmtArgCount(t *testing.T) {
+	// Enter playback mode.
+	*recordFlag = false
+	visitedRecording = true
+
+	registered = nil
+	Register("postgres6")
+
+	pathName := filepath.Join(t.TempDir(), "args.copyist")
+	require.NoError(t, os.WriteFile(pathName, []byte(`
+1=DriverOpen	1:nil
+2=ConnPrepare	2:"INSERT INTO customers VALUES ($1, $2)"	1:nil
+3=StmtNumInput	3:-1
+4=StmtExec	1:nil	3:2
+5=StmtExec	1:nil
+6=StmtNumInput	3:2
+
+"TestStmtArgCount"=1,2,3,4
+"TestStmtArgCount/old"=1,2,3,5
+"TestStmtArgCount/known"=1,2,6,4
+`), 0666))
+	SetRecordingPath(func(fileName, name string) string { return pathName })
+	defer SetRecordingPath(nil)
+
+	playback := func(m *mockTestingT, args ...interface{}) error {
+		defer Open(m).Close()
+		db, err := sql.Open("copyist_postgres6", "")
+		require.NoError(t, err)
+		defer db.Close()
+		conn, err := db.Conn(context.Background())
+		require.NoError(t, err)
+		defer conn.Close()
+		stmt, err := conn.PrepareContext(context.Background(), "INSERT INTO customers VALUES ($1, $2)")
+		require.NoError(t, err)
+		defer stmt.Close()
+		_, err = stmt.Exec(args...)
+		return err
+	}
+
+	m := &mockTestingT{T: t}
+	playback(m, 1, 2)
+	require.Equal(t, "", m.buf.String())
+
+	m = &mockTestingT{T: t}
+	playback(m, 1)
+	require.Contains(t, m.buf.String(), "mismatched argument count to StmtExec, expected 2, got 1\n\n"+
+		"The driver does not know the number of placeholders in the query, "+
+		"so the number of arguments is checked against the recording.\n\n"+
+		"Do you need to regenerate the recording? Run:\n\n"+
+		"\tgo test . -run '^TestStmtArgCount$' -record\n")
+
+	// Recordings without an argument count are not checked.
+	t.Run("old", func(t *testing.T) {
+		m := &mockTestingT{T: t}
+		playback(m, 1)
+		require.Equal(t, "", m.buf.String())
+	})
+
+	// If the driver knows the number of placeholders, then the sql package
+	// checks the number of arguments before the driver is called.
+	t.Run("known", func(t *testing.T) {
+		m := &mockTestingT{T: t}
+		require.EqualError(t, playback(m, 1), "sql: expected 2 arguments, got 1")
+		require.Equal(t, "", m.buf.String())
+	})
+}
+
+// TestStmtIdentity tests that playback fails if prepared statements are used
+// in a different order than they were when recording.
+func TestStmtIdentity(t *testing.T) {
+	// Enter playback mode.
+	*recordFlag = false
+	visitedRecording = true
+
+	registered = nil
+	Register("postgres8")
+
+	pathName := filepath.Join(t.TempDir(), "identity.copyist")
+	require.NoError(t, os.WriteFile(pathName, []byte(`
+1=DriverOpen	1:nil
+2=ConnPrepare	2:"DELETE FROM customers"	1:nil	3:1
+3=ConnPrepare	2:"DELETE FROM orders"	1:nil	3:2
+4=StmtNumInput	3:0	3:1
+5=StmtExec	1:nil	3:0	3:1
+6=StmtNumInput	3:0	3:2
+7=StmtExec	1:nil	3:0	3:2
+
+"TestStmtIdentity"=1,2,3,4,5,6,7
+`), 0666))
+	SetRecordingPath(func(fileName, name string) string { return pathName })
+	defer SetRecordingPath(nil)
+
+	// NB: Don't close the connection or statements, since they're left locked
+	// by the panic that the mismatch causes.
+	playback := func(m *mockTestingT, first, second int) {
+		defer Open(m).Close()
+		db, err := sql.Open("copyist_postgres8", "")
+		require.NoError(t, err)
+		conn, err := db.Conn(context.Background())
+		require.NoError(t, err)
+
+		var stmts [2]*sql.Stmt
+		for i, query := range []string{"DELETE FROM customers", "DELETE FROM orders"} {
+			stmts[i], err = conn.PrepareContext(context.Background(), query)
+			require.NoError(t, err)
+		}
+		stmts[first].Exec()
+		stmts[second].Exec()
+	}
+
+	m := &mockTestingT{T: t}
+	playback(m, 0, 1)
+	require.Equal(t, "", m.buf.String())
+
+	m = &mockTestingT{T: t}
+	playback(m, 1, 0)
+	require.Contains(t, m.buf.String(), "mismatched statement in call to StmtNumInput, "+
+		"expected statement 1, got statement 2 (DELETE FROM orders)\n\n"+
+		"Do you need to regenerate the recording? Run:\n\n"+
+		"\tgo test . -run '^TestStmtIdentity$' -record\n")
+}
+
+// TestBadConnRetry tests that the `sql` package retries calls that fail with
+// driver.ErrBadConn on a new connection during playback, just as it did during
+// recording.
+func TestBadConnRetry(t *testing.T) {
+	// Enter playback mode.
+	*recordFlag = false
+	visitedRecording = true
+
+	registered = nil
+	Register("postgres7")
+
+	pathName := filepath.Join(t.TempDir(), "badconn.copyist")
+	require.NoError(t, os.WriteFile(pathName, []byte(`
+1=DriverOpen	1:nil
+2=ConnExec	2:"DELETE FROM customers"	7:"driver: bad connection"
+3=ConnExec	2:"DELETE FROM customers"	1:nil
+
+"TestBadConnRetry"=1,2,1,3
+`), 0666))
+	SetRecordingPath(func(fileName, name string) string { return pathName })
+	defer SetRecordingPath(nil)
+
+	m := &mockTestingT{T: t}
+	closer := Open(m)
+	db, err := sql.Open("copyist_postgres7", "")
+	require.NoError(t, err)
+	_, err = db.Exec("DELETE FROM customers")
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+	require.NoError(t, closer.Close())
+	require.Equal(t, "", m.buf.String())
+}
+
+// TestDriverStreams tests that each driver plays back its own stream of
+// records, even if calls to the drivers are interleaved differently than they
+// were when recording.
+func TestDriverStreams(t *testing.T) {
+	// Enter playback mode.
+	*recordFlag = false
+	visitedRecording = true
+
+	registered = nil
+	Register("postgres9")
+	Register("postgres10")
+
+	pathName := filepath.Join(t.TempDir(), "streams.copyist")
+	require.NoError(t, os.WriteFile(pathName, []byte(`
+1=DriverOpen	1:nil
+2=ConnExec	2:"DELETE FROM customers"	1:nil
+3=ConnExec	2:"DELETE FROM orders"	1:nil
+
+"TestDriverStreams"=1,2,1,3
+"TestDriverStreams"@streams="postgres9"*2 "postgres10"*2
+`), 0666))
+	SetRecordingPath(func(fileName, name string) string { return pathName })
+	defer SetRecordingPath(nil)
+
+	m := &mockTestingT{T: t}
+	closer := Open(m)
+	db10, err := sql.Open("copyist_postgres10", "")
+	require.NoError(t, err)
+	_, err = db10.Exec("DELETE FROM orders")
+	require.NoError(t, err)
+	db9, err := sql.Open("copyist_postgres9", "")
+	require.NoError(t, err)
+	_, err = db9.Exec("DELETE FROM customers")
+	require.NoError(t, err)
+	require.NoError(t, db9.Close())
+	require.NoError(t, db10.Close())
+	require.NoError(t, closer.Close())
+	require.Equal(t, "", m.buf.String())
+}
+
+// TestConnStreams tests that each connection plays back its own stream of
+// records, even if the connections are opened and used in a different order
+// than they were when recording.
+func TestConnStreams(t *testing.T) {
+	// Enter playback mode.
+	*recordFlag = false
+	visitedRecording = true
+
+	registered = nil
+	Register("postgres11")
+
+	pathName := filepath.Join(t.TempDir(), "conns.copyist")
+	require.NoError(t, os.WriteFile(pathName, []byte(`
+1=DriverOpen	1:nil
+2=ConnExec	2:"DELETE FROM customers"	1:nil
+3=ConnExec	2:"DELETE FROM orders"	1:nil
+
+"TestConnStreams"=1,1,2,3,2,3
+"TestConnStreams"@streams="postgres11"*2 "postgres11"#1*1 "postgres11"#2*1 "postgres11"#1*1 "postgres11"#2*1
+`), 0666))
+	SetRecordingPath(func(fileName, name string) string { return pathName })
+	defer SetRecordingPath(nil)
+
+	m := &mockTestingT{T: t}
+	closer := Open(m)
+	db, err := sql.Open("copyist_postgres11", "")
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	conn1, err := db.Conn(ctx)
+	require.NoError(t, err)
+	conn2, err := db.Conn(ctx)
+	require.NoError(t, err)
+
+	// The first connection plays back the second connection's stream.
+	for i := 0; i < 2; i++ {
+		_, err = conn1.ExecContext(ctx, "DELETE FROM orders")
+		require.NoError(t, err)
+	}
+	for i := 0; i < 2; i++ {
+		_, err = conn2.ExecContext(ctx, "DELETE FROM customers")
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, conn1.Close())
+	require.NoError(t, conn2.Close())
+	require.NoError(t, db.Close())
+	require.NoError(t, closer.Close())
+	require.Equal(t, "", m.buf.String())
+}
+
+// TestRaw tests that copyist.Raw plays back the recorded results of calls to a
+// dedicated connection's underlying driver connection, without calling f.
+func TestRaw(t *testing.T) {
+	// Enter playback mode.
+	*recordFlag = false
+	visitedRecording = true
+
+	registered = nil
+	Register("postgres14")
+
+	pathName := filepath.Join(t.TempDir(), "raw.copyist")
+	require.NoError(t, os.WriteFile(pathName, []byte(`
+1=DriverOpen	1:nil
+2=ConnRaw	1:nil
+3=ConnRaw	7:"copy failed"
+4=ConnExec	2:"DELETE FROM customers"	1:nil
+
+"TestRaw"=1,1,2,3,4
+"TestRaw"@streams="postgres14"*2 "postgres14"#1*1 "postgres14"#1*1 "postgres14"#2*1
+`), 0666))
+	SetRecordingPath(func(fileName, name string) string { return pathName })
+	defer SetRecordingPath(nil)
+
+	m := &mockTestingT{T: t}
+	closer := Open(m)
+	db, err := sql.Open("copyist_postgres14", "")
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	conn1, err := db.Conn(ctx)
+	require.NoError(t, err)
+	conn2, err := db.Conn(ctx)
+	require.NoError(t, err)
+
+	called := false
+	f := func(driverConn interface{}) error {
+		called = true
+		return nil
+	}
+	require.NoError(t, Raw(conn1, f))
+	require.EqualError(t, Raw(conn1, f), "copy failed")
+	require.False(t, called)
+
+	_, err = conn2.ExecContext(ctx, "DELETE FROM customers")
+	require.NoError(t, err)
+
+	require.NoError(t, conn1.Close())
+	require.NoError(t, conn2.Close())
+	require.NoError(t, db.Close())
+	require.NoError(t, closer.Close())
+	require.Equal(t, "", m.buf.String())
+}
+
+// TestOpenFuzz tests that every input of a fuzz target plays back the same
+// recording from its beginning, and that recording is rejected while fuzzing.
+func TestOpenFuzz(t *testing.T) {
+	// Enter playback mode.
+	*recordFlag = false
+	visitedRecording = true
+
+	registered = nil
+	Register("postgres15")
+
+	pathName := filepath.Join(t.TempDir(), "fuzz.copyist")
+	require.NoError(t, os.WriteFile(pathName, []byte(`
+1=DriverOpen	1:nil
+2=ConnExec	2:"DELETE FROM customers"	1:nil
+
+"TestOpenFuzz"=1,2
+`), 0666))
+	SetRecordingPath(func(fileName, name string) string { return pathName })
+	defer SetRecordingPath(nil)
+
+	for _, input := range []string{"seed#0", "seed#1", "5a3b1c"} {
+		t.Run(input, func(t *testing.T) {
+			m := &mockTestingT{T: t}
+			closer := OpenFuzz(m)
+			db, err := sql.Open("copyist_postgres15", "")
+			require.NoError(t, err)
+			_, err = db.Exec("DELETE FROM customers")
+			require.NoError(t, err)
+			require.NoError(t, db.Close())
+			require.NoError(t, closer.Close())
+			require.Equal(t, "", m.buf.String())
+		})
+	}
+
+	// Recording is rejected under -fuzz.
+	*recordFlag = true
+	defer func() { *recordFlag = false }()
+	require.NoError(t, flag.Set("test.fuzz", "FuzzNothing"))
+	defer func() { require.NoError(t, flag.Set("test.fuzz", "")) }()
+	require.PanicsWithError(t, "copyist cannot record while fuzzing; "+
+		"record the seed corpus without -fuzz instead", func() { OpenFuzz(t) })
+}
+
+// TestFormatStreams tests that the stream of each record round-trips through
+// the streams metadata.
+func TestFormatStreams(t *testing.T) {
+	require.Equal(t, "", formatStreams(nil))
+	require.Equal(t, "", formatStreams([]streamKey{{"pq", 0}, {"pq", 1}, {"pq", 1}}))
+
+	keys := []streamKey{{"pq", 0}, {"pq", 1}, {"pq", 1}, {"pgx", 2}, {`my "driver"`, 0}, {"pq", 3}}
+	formatted := formatStreams(keys)
+	require.Equal(t, `"pq"*1 "pq"#1*2 "pgx"#2*1 "my \"driver\""*1 "pq"#3*1`, formatted)
+
+	rec := make(recording, len(keys))
+	for i := range rec {
+		rec[i] = &record{Typ: ConnExec, Args: recordArgs{fmt.Sprint(i), nil}}
+	}
+	streams, err := splitStreams(rec, formatted)
+	require.NoError(t, err)
+	require.Len(t, streams, 5)
+	require.Equal(t, recording{rec[0]}, streams[streamKey{"pq", 0}].records)
+	require.Equal(t, recording{rec[1], rec[2]}, streams[streamKey{"pq", 1}].records)
+	require.Equal(t, recording{rec[3]}, streams[streamKey{"pgx", 2}].records)
+	require.Equal(t, recording{rec[4]}, streams[streamKey{`my "driver"`, 0}].records)
+	require.Equal(t, recording{rec[5]}, streams[streamKey{"pq", 3}].records)
+
+	// A recording without streams has a single stream.
+	streams, err = splitStreams(rec, "")
+	require.NoError(t, err)
+	require.Equal(t, rec, streams[streamKey{}].records)
+
+	_, err = splitStreams(rec, `pq*6`)
+	require.EqualError(t, err, "expected quoted driver name: pq*6")
+	_, err = splitStreams(rec, `"pq"*2 "pgx"`)
+	require.EqualError(t, err, `expected record count for driver "pgx"`)
+	_, err = splitStreams(rec, `"pq"#0*6`)
+	require.EqualError(t, err, `invalid connection ID: #0*6`)
+	_, err = splitStreams(rec, `"pq"*7`)
+	require.EqualError(t, err, `invalid record count: *7`)
+	_, err = splitStreams(rec, `"pq"*4`)
+	require.EqualError(t, err, "expected 6 records, got 4")
+}
+
+// TestOrderedPlayback tests that calls are played back in the recorded order
+// across connections when the recording was made with serialized calls.
+func TestOrderedPlayback(t *testing.T) {
+	// Enter playback mode.
+	*recordFlag = false
+	visitedRecording = true
+
+	registered = nil
+	Register("postgres12")
+
+	pathName := filepath.Join(t.TempDir(), "ordered.copyist")
+	require.NoError(t, os.WriteFile(pathName, []byte(`
+1=DriverOpen	1:nil
+2=ConnExec	2:"DELETE FROM customers"	1:nil
+3=ConnExec	2:"DELETE FROM orders"	1:nil
+
+"TestOrderedPlayback"=1,1,2,3
+"TestOrderedPlayback"@goroutines=1*3 2*1
+"TestOrderedPlayback"@streams="postgres12"*2 "postgres12"#1*1 "postgres12"#2*1
+`), 0666))
+	SetRecordingPath(func(fileName, name string) string { return pathName })
+	defer SetRecordingPath(nil)
+
+	m := &mockTestingT{T: t}
+	closer := Open(m)
+	db, err := sql.Open("copyist_postgres12", "")
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	conn1, err := db.Conn(ctx)
+	require.NoError(t, err)
+	conn2, err := db.Conn(ctx)
+	require.NoError(t, err)
+
+	// The goroutine's call waits until the call recorded before it is made.
+	var mu sync.Mutex
+	var order []string
+	done := make(chan error)
+	go func() {
+		_, err := conn2.ExecContext(ctx, "DELETE FROM orders")
+		mu.Lock()
+		order = append(order, "orders")
+		mu.Unlock()
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	_, err = conn1.ExecContext(ctx, "DELETE FROM customers")
+	require.NoError(t, err)
+	mu.Lock()
+	order = append(order, "customers")
+	mu.Unlock()
+	require.NoError(t, <-done)
+	require.Equal(t, []string{"customers", "orders"}, order)
+
+	require.NoError(t, conn1.Close())
+	require.NoError(t, conn2.Close())
+	require.NoError(t, db.Close())
+	require.NoError(t, closer.Close())
+	require.Equal(t, "", m.buf.String())
+}
+
+// TestFormatGoroutines tests the goroutines metadata of serialized recordings.
+func TestFormatGoroutines(t *testing.T) {
+	require.Equal(t, "", formatGoroutines(nil))
+	require.Equal(t, "", formatGoroutines([]int{1, 1}))
+	require.Equal(t, "1*2 2*1 1*1", formatGoroutines([]int{1, 1, 2, 1}))
+
+	id := goroutineID()
+	require.NotZero(t, id)
+	other := make(chan uint64)
+	go func() { other <- goroutineID() }()
+	require.NotEqual(t, id, <-other)
+}
+
 func ignorePanic(f func()) {
 	defer func() {
 		recover()
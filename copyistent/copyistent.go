@@ -0,0 +1,62 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package copyistent helps tests that use the ent entity framework to record
+// and play back their SQL calls using copyist.
+package copyistent
+
+import (
+	"database/sql"
+
+	"entgo.io/ent/dialect"
+	entsql "entgo.io/ent/dialect/sql"
+	"github.com/cockroachdb/copyist"
+)
+
+// dialects maps the names of SQL drivers to the names of the ent dialects that
+// they use, for drivers whose names differ from the names of their dialects.
+var dialects = map[string]string{
+	"pgx": dialect.Postgres,
+}
+
+// Open opens a database using the copyist driver that wraps the SQL driver of
+// the given name, and returns an ent driver that uses it. copyist.Register must
+// already have been called for the SQL driver, and must have been passed the
+// same options as Open, so that Open uses the right driver name if it was set
+// by copyist.WithName. ent usually determines its SQL dialect from the name of
+// the SQL driver, which does not work for the copyist driver. Open determines
+// the dialect from the name of the wrapped driver instead. Here is an example:
+//
+//	func TestMyStuff(t *testing.T) {
+//	  defer copyist.Open(t).Close()
+//
+//	  drv, _ := copyistent.Open("postgres", "postgresql://root@localhost")
+//	  client := ent.NewClient(ent.Driver(drv))
+//	  defer client.Close()
+//	  ...
+//	}
+func Open(
+	driverName, dataSourceName string, opts ...copyist.RegisterOption,
+) (*entsql.Driver, error) {
+	db, err := sql.Open(copyist.DriverName(driverName, opts...), dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+
+	dialectName, ok := dialects[driverName]
+	if !ok {
+		dialectName = driverName
+	}
+	return entsql.OpenDB(dialectName, db), nil
+}
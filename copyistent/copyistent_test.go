@@ -0,0 +1,48 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package copyistent
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"testing"
+
+	"github.com/cockroachdb/copyist"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeDriver is a SQL driver that cannot open connections. It is only used to
+// register a copyist driver.
+type fakeDriver struct{}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	return nil, errors.New("not implemented")
+}
+
+// TestOpenWithName tests that Open uses the name given to the copyist driver
+// by copyist.WithName.
+func TestOpenWithName(t *testing.T) {
+	sql.Register("copyistent_fake", fakeDriver{})
+	copyist.Register("copyistent_fake", copyist.WithName("recorded_fake"))
+
+	drv, err := Open("copyistent_fake", "", copyist.WithName("recorded_fake"))
+	require.NoError(t, err)
+	defer drv.Close()
+	require.Equal(t, "copyistent_fake", drv.Dialect())
+
+	_, err = Open("copyistent_fake", "")
+	require.EqualError(t, err, `sql: unknown driver "copyist_copyistent_fake" (forgotten import?)`)
+}
@@ -0,0 +1,13 @@
+module github.com/cockroachdb/copyist/copyistent
+
+go 1.16
+
+// Use separate go.mod file so that the copyist package does not depend on ent.
+require (
+	entgo.io/ent v0.9.1
+	github.com/cockroachdb/copyist v0.0.0-00010101000000-000000000000
+	github.com/stretchr/testify v1.7.0
+)
+
+// Reference copyist in the same repo.
+replace github.com/cockroachdb/copyist => ./..
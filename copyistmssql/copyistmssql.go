@@ -0,0 +1,62 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package copyistmssql records and plays back the errors returned by the
+// denisenkom/go-mssqldb driver, with all of their fields. The core copyist
+// package does not depend on go-mssqldb, so projects that use it should import
+// this package for its side effects:
+//
+//	import _ "github.com/cockroachdb/copyist/copyistmssql"
+//
+// Otherwise, recording fails when go-mssqldb returns an error, and recordings
+// that contain go-mssqldb errors cannot be played back.
+package copyistmssql
+
+import (
+	"encoding/json"
+
+	"github.com/cockroachdb/copyist"
+	mssql "github.com/denisenkom/go-mssqldb"
+)
+
+// mssqlErrorType is the number that identifies go-mssqldb errors in recording
+// files.
+const mssqlErrorType = 300
+
+func init() {
+	copyist.RegisterValueCodec(mssqlErrorType, copyist.ValueCodec{Format: formatError, Parse: parseError})
+}
+
+// formatError encodes the fields of the given error as JSON, if it is a
+// go-mssqldb error.
+func formatError(val interface{}) (string, bool) {
+	mssqlErr, ok := val.(mssql.Error)
+	if !ok {
+		return "", false
+	}
+	b, err := json.Marshal(mssqlErr)
+	if err != nil {
+		panic(err)
+	}
+	return string(b), true
+}
+
+// parseError decodes a go-mssqldb error that was encoded by formatError.
+func parseError(s string) (interface{}, error) {
+	var mssqlErr mssql.Error
+	if err := json.Unmarshal([]byte(s), &mssqlErr); err != nil {
+		return nil, err
+	}
+	return mssqlErr, nil
+}
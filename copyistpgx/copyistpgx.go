@@ -0,0 +1,123 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package copyistpgx records and plays back the errors returned by the pgx
+// driver, with all of their fields, and the connections made by pgx's native
+// API. The core copyist package does not depend on pgx, so projects that use it
+// should import this package, if only for its side effects:
+//
+//	import _ "github.com/cockroachdb/copyist/copyistpgx"
+//
+// Otherwise, recording fails when pgx returns an error, and recordings that
+// contain pgx errors cannot be played back.
+package copyistpgx
+
+import (
+	"context"
+
+	"github.com/cockroachdb/copyist"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgproto3/v2"
+)
+
+// pgConnErrorType is the number that identifies pgx errors in recording files.
+const pgConnErrorType = 200
+
+func init() {
+	copyist.RegisterValueCodec(pgConnErrorType, copyist.ValueCodec{Format: formatError, Parse: parseError})
+}
+
+// ConfigurePgConn modifies the given pgconn configuration so that connections
+// made with it are recorded or played back by the current copyist session.
+// copyist.RegisterPgConn must already have been called. Here is an example that
+// uses a pgxpool:
+//
+//	func TestMyStuff(t *testing.T) {
+//	  defer copyist.Open(t).Close()
+//
+//	  config, _ := pgxpool.ParseConfig("postgresql://root@localhost")
+//	  copyistpgx.ConfigurePgConn(&config.ConnConfig.Config)
+//	  pool, _ := pgxpool.ConnectConfig(ctx, config)
+//	  defer pool.Close()
+//	  ...
+//	}
+//
+// TLS is disabled, since encrypted messages cannot be played back, and host
+// names are not resolved, so that playback does not depend on DNS. See
+// copyist.WrapPgConnDial for more details.
+func ConfigurePgConn(config *pgconn.Config) {
+	if noopMode {
+		return
+	}
+
+	// Only the first of any fallbacks that are identical once TLS is disabled
+	// needs to be tried.
+	config.TLSConfig = nil
+	var fallbacks []*pgconn.FallbackConfig
+	for _, fallback := range config.Fallbacks {
+		if fallback.Host == config.Host && fallback.Port == config.Port {
+			continue
+		}
+		fallback.TLSConfig = nil
+		fallbacks = append(fallbacks, fallback)
+	}
+	config.Fallbacks = fallbacks
+
+	config.LookupFunc = func(ctx context.Context, host string) ([]string, error) {
+		return []string{host}, nil
+	}
+
+	config.DialFunc = pgconn.DialFunc(copyist.WrapPgConnDial(copyist.DialFunc(config.DialFunc)))
+}
+
+// formatError encodes the given error using the Postgres wire protocol, if it
+// is a pgx error.
+func formatError(val interface{}) (string, bool) {
+	pgErr, ok := val.(*pgconn.PgError)
+	if !ok {
+		return "", false
+	}
+
+	resp := pgproto3.ErrorResponse{
+		Severity:         pgErr.Severity,
+		Code:             pgErr.Code,
+		Message:          copyist.ScrubDSN(pgErr.Message),
+		Detail:           copyist.ScrubDSN(pgErr.Detail),
+		Hint:             pgErr.Hint,
+		Position:         pgErr.Position,
+		InternalPosition: pgErr.InternalPosition,
+		InternalQuery:    pgErr.InternalQuery,
+		Where:            pgErr.Where,
+		SchemaName:       pgErr.SchemaName,
+		TableName:        pgErr.TableName,
+		ColumnName:       pgErr.ColumnName,
+		DataTypeName:     pgErr.DataTypeName,
+		ConstraintName:   pgErr.ConstraintName,
+		File:             pgErr.File,
+		Line:             pgErr.Line,
+		Routine:          pgErr.Routine,
+	}
+
+	// Encode using the pgproto3 library and skip the Error header bytes.
+	return string(resp.Encode(nil)[5:]), true
+}
+
+// parseError decodes a pgx error that was encoded by formatError.
+func parseError(s string) (interface{}, error) {
+	var resp pgproto3.ErrorResponse
+	if err := resp.Decode([]byte(s)); err != nil {
+		return nil, err
+	}
+	return pgconn.ErrorResponseToPgError(&resp), nil
+}
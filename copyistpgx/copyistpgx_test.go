@@ -0,0 +1,86 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package copyistpgx
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cockroachdb/copyist"
+	"github.com/jackc/pgconn"
+	"github.com/stretchr/testify/require"
+)
+
+// TestPgError tests that pgx errors are round-tripped through recording files
+// with all of their fields when this package is imported.
+func TestPgError(t *testing.T) {
+	pgErr := &pgconn.PgError{
+		Severity:         "FATAL",
+		Code:             "53200",
+		Message:          "out of memory",
+		Detail:           "bad password=secret",
+		Hint:             "some hint",
+		Position:         123,
+		InternalPosition: 456,
+		InternalQuery:    "some query",
+		Where:            "somewhere",
+		SchemaName:       "some schema",
+		TableName:        "some table",
+		ColumnName:       "some column",
+		DataTypeName:     "some datatype",
+		ConstraintName:   "some constraint",
+		File:             "some file",
+		Line:             789,
+		Routine:          "some routine",
+	}
+
+	source := copyist.NewMemorySource(nil)
+	file, err := copyist.ReadRecordingFile(source)
+	require.NoError(t, err)
+	require.NoError(t, file.SetRecording("TestPgError", []copyist.Record{
+		{Type: "DriverOpen", Args: []interface{}{pgErr}},
+	}))
+	require.NoError(t, file.Write())
+
+	data, err := source.ReadAll()
+	require.NoError(t, err)
+	require.Contains(t, string(data), `1=DriverOpen	200:"SFATAL\x00C53200\x00Mout of memory\x00`)
+
+	file, err = copyist.ReadRecordingFile(source)
+	require.NoError(t, err)
+	records, err := file.Recording("TestPgError")
+	require.NoError(t, err)
+	scrubbed := *pgErr
+	scrubbed.Detail = "bad password=xxxxx"
+	require.Equal(t, &scrubbed, records[0].Args[0])
+}
+
+// TestConfigurePgConn tests that ConfigurePgConn disables TLS and host name
+// resolution, and dials connections through copyist.
+func TestConfigurePgConn(t *testing.T) {
+	copyist.RegisterPgConn()
+
+	config, err := pgconn.ParseConfig("postgresql://root@db.example.com:26257/defaultdb")
+	require.NoError(t, err)
+	require.NotNil(t, config.TLSConfig)
+
+	ConfigurePgConn(config)
+	require.Nil(t, config.TLSConfig)
+	require.Empty(t, config.Fallbacks)
+	addrs, err := config.LookupFunc(context.Background(), "db.example.com")
+	require.NoError(t, err)
+	require.Equal(t, []string{"db.example.com"}, addrs)
+	require.NotNil(t, config.DialFunc)
+}
@@ -0,0 +1,109 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package copyistpq records and plays back the errors returned by the lib/pq
+// driver, with all of their fields. The core copyist package does not depend on
+// lib/pq, so projects that use it should import this package for its side
+// effects:
+//
+//	import _ "github.com/cockroachdb/copyist/copyistpq"
+//
+// Otherwise, recording fails when lib/pq returns an error, and recordings that
+// contain lib/pq errors cannot be played back.
+package copyistpq
+
+import (
+	"strconv"
+
+	"github.com/cockroachdb/copyist"
+	"github.com/jackc/pgproto3/v2"
+	"github.com/lib/pq"
+)
+
+// pqErrorType is the number that identifies lib/pq errors in recording files.
+const pqErrorType = 100
+
+func init() {
+	copyist.RegisterValueCodec(pqErrorType, copyist.ValueCodec{Format: formatError, Parse: parseError})
+}
+
+// formatError encodes the given error using the Postgres wire protocol, if it
+// is a lib/pq error.
+func formatError(val interface{}) (string, bool) {
+	pqErr, ok := val.(*pq.Error)
+	if !ok {
+		return "", false
+	}
+
+	resp := pgproto3.ErrorResponse{
+		Severity:         pqErr.Severity,
+		Code:             string(pqErr.Code),
+		Message:          copyist.ScrubDSN(pqErr.Message),
+		Detail:           copyist.ScrubDSN(pqErr.Detail),
+		Hint:             pqErr.Hint,
+		Position:         stringToInt32OrZero(pqErr.Position),
+		InternalPosition: stringToInt32OrZero(pqErr.InternalPosition),
+		InternalQuery:    pqErr.InternalQuery,
+		Where:            pqErr.Where,
+		SchemaName:       pqErr.Schema,
+		TableName:        pqErr.Table,
+		ColumnName:       pqErr.Column,
+		DataTypeName:     pqErr.DataTypeName,
+		ConstraintName:   pqErr.Constraint,
+		File:             pqErr.File,
+		Line:             stringToInt32OrZero(pqErr.Line),
+		Routine:          pqErr.Routine,
+	}
+
+	// Encode using the pgproto3 library and skip the Error header bytes.
+	return string(resp.Encode(nil)[5:]), true
+}
+
+// parseError decodes a lib/pq error that was encoded by formatError.
+func parseError(s string) (interface{}, error) {
+	var resp pgproto3.ErrorResponse
+	if err := resp.Decode([]byte(s)); err != nil {
+		return nil, err
+	}
+
+	return &pq.Error{
+		Severity:         resp.Severity,
+		Code:             pq.ErrorCode(resp.Code),
+		Message:          resp.Message,
+		Detail:           resp.Detail,
+		Hint:             resp.Hint,
+		Position:         strconv.Itoa(int(resp.Position)),
+		InternalPosition: strconv.Itoa(int(resp.InternalPosition)),
+		InternalQuery:    resp.InternalQuery,
+		Where:            resp.Where,
+		Schema:           resp.SchemaName,
+		Table:            resp.TableName,
+		Column:           resp.ColumnName,
+		DataTypeName:     resp.DataTypeName,
+		Constraint:       resp.ConstraintName,
+		File:             resp.File,
+		Line:             strconv.Itoa(int(resp.Line)),
+		Routine:          resp.Routine,
+	}, nil
+}
+
+// stringToInt32OrZero converts the given string into an int32 value, or returns
+// zero if it cannot (typically when string is empty).
+func stringToInt32OrZero(val string) int32 {
+	pos, err := strconv.ParseInt(val, 10, 32)
+	if err != nil {
+		return 0
+	}
+	return int32(pos)
+}
@@ -0,0 +1,47 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Command notimported records and plays back a lib/pq error without importing
+// the copyistpq package, and prints the resulting errors.
+package main
+
+import (
+	"fmt"
+
+	"github.com/cockroachdb/copyist"
+	"github.com/lib/pq"
+)
+
+func main() {
+	func() {
+		defer func() { fmt.Println(recover()) }()
+		file, err := copyist.ReadRecordingFile(copyist.NewMemorySource(nil))
+		if err != nil {
+			panic(err)
+		}
+		file.SetRecording("TestPqError", []copyist.Record{
+			{Type: "DriverOpen", Args: []interface{}{&pq.Error{Code: "53200", Message: "out of memory"}}},
+		})
+		file.Write()
+	}()
+
+	file, err := copyist.ReadRecordingFile(copyist.NewMemorySource([]byte(
+		"1=DriverOpen\t100:\"SFATAL\\x00C53200\\x00Mout of memory\\x00\\x00\"\n\n" +
+			"\"TestPqError\"=1\n")))
+	if err != nil {
+		panic(err)
+	}
+	_, err = file.Recording("TestPqError")
+	fmt.Println(err)
+}
@@ -0,0 +1,80 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package copyistprom exports the copyist metrics to Prometheus.
+package copyistprom
+
+import (
+	"github.com/cockroachdb/copyist"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// collector is a prometheus.Collector that collects the copyist metrics.
+type collector struct {
+	sessionsOpened    *prometheus.Desc
+	recordsRecorded   *prometheus.Desc
+	recordsPlayedBack *prometheus.Desc
+	mismatches        *prometheus.Desc
+	recordingsWritten *prometheus.Desc
+	bytesWritten      *prometheus.Desc
+}
+
+// NewCollector returns a Prometheus collector that collects the copyist
+// metrics (see copyist.Metrics) as counters. Here is an example:
+//
+//	prometheus.MustRegister(copyistprom.NewCollector())
+func NewCollector() prometheus.Collector {
+	return &collector{
+		sessionsOpened: prometheus.NewDesc("copyist_sessions_opened_total",
+			"Number of copyist recording and playback sessions that have been opened.", nil, nil),
+		recordsRecorded: prometheus.NewDesc("copyist_records_recorded_total",
+			"Number of calls to driver methods that have been recorded.", nil, nil),
+		recordsPlayedBack: prometheus.NewDesc("copyist_records_played_back_total",
+			"Number of recorded calls that have been played back.", nil, nil),
+		mismatches: prometheus.NewDesc("copyist_mismatches_total",
+			"Number of calls during playback that did not match the recording.", nil, nil),
+		recordingsWritten: prometheus.NewDesc("copyist_recordings_written_total",
+			"Number of recordings that have been written.", nil, nil),
+		bytesWritten: prometheus.NewDesc("copyist_written_bytes_total",
+			"Number of bytes that have been written in order to save recordings.", nil, nil),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.sessionsOpened
+	ch <- c.recordsRecorded
+	ch <- c.recordsPlayedBack
+	ch <- c.mismatches
+	ch <- c.recordingsWritten
+	ch <- c.bytesWritten
+}
+
+// Collect implements prometheus.Collector.
+func (c *collector) Collect(ch chan<- prometheus.Metric) {
+	m := copyist.ReadMetrics()
+	for _, counter := range []struct {
+		desc  *prometheus.Desc
+		value int64
+	}{
+		{c.sessionsOpened, m.SessionsOpened},
+		{c.recordsRecorded, m.RecordsRecorded},
+		{c.recordsPlayedBack, m.RecordsPlayedBack},
+		{c.mismatches, m.Mismatches},
+		{c.recordingsWritten, m.RecordingsWritten},
+		{c.bytesWritten, m.BytesWritten},
+	} {
+		ch <- prometheus.MustNewConstMetric(counter.desc, prometheus.CounterValue, float64(counter.value))
+	}
+}
@@ -0,0 +1,13 @@
+module github.com/cockroachdb/copyist/copyistprom
+
+go 1.16
+
+// Use separate go.mod file so that the copyist package does not depend on the
+// Prometheus client.
+require (
+	github.com/cockroachdb/copyist v0.0.0-00010101000000-000000000000
+	github.com/prometheus/client_golang v1.11.0
+)
+
+// Reference copyist in the same repo.
+replace github.com/cockroachdb/copyist => ./..
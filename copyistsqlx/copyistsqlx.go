@@ -0,0 +1,39 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package copyistsqlx helps tests that use the sqlx package to record and play
+// back their SQL calls using copyist.
+package copyistsqlx
+
+import (
+	"github.com/cockroachdb/copyist"
+	"github.com/jmoiron/sqlx"
+)
+
+// Register calls copyist.Register to construct a proxy driver that wraps the
+// SQL driver of the given name, with the given options, and then registers the
+// proxy driver with sqlx. sqlx uses a default list of driver names to determine
+// how to represent parameters in prepared queries. For example, postgres uses
+// $1, mysql uses ?, sqlserver uses @, and so on. But since copyist defines a
+// custom driver name, sqlx falls back to the default ?, which won't work with
+// some databases. Register tells sqlx to use the bind type of the wrapped
+// driver instead. Here is an example:
+//
+//	func init() {
+//	  copyistsqlx.Register("postgres")
+//	}
+func Register(driverName string, opts ...copyist.RegisterOption) {
+	copyist.Register(driverName, opts...)
+	sqlx.BindDriver(copyist.DriverName(driverName, opts...), sqlx.BindType(driverName))
+}
@@ -0,0 +1,36 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package copyistsqlx
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/cockroachdb/copyist"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/require"
+)
+
+// TestRegister tests that Register registers the copyist driver with both the
+// `sql` package and sqlx, using the bind type of the wrapped driver.
+func TestRegister(t *testing.T) {
+	Register("postgres")
+	require.Contains(t, sql.Drivers(), "copyist_postgres")
+	require.Equal(t, sqlx.DOLLAR, sqlx.BindType("copyist_postgres"))
+
+	Register("sqlserver", copyist.WithName("recorded_sqlserver"))
+	require.Contains(t, sql.Drivers(), "recorded_sqlserver")
+	require.Equal(t, sqlx.AT, sqlx.BindType("recorded_sqlserver"))
+}
@@ -0,0 +1,91 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package copyist
+
+import (
+	"log"
+	"os"
+	"strings"
+)
+
+// maxLoggedQueryLen is the maximum number of characters of a query that are
+// included in debug log messages.
+const maxLoggedQueryLen = 60
+
+// LoggerCallback types a function that logs a formatted message, such as the
+// Printf method of a log.Logger, or the Logf method of a testing.T.
+type LoggerCallback func(format string, args ...interface{})
+
+// logger is the callback set by SetLogger, or nil if it has not been set.
+var logger LoggerCallback
+
+// SetLogger sets the callback function that copyist uses to log every record
+// that is added while recording, and every record that is played back. Each
+// message includes the name of the recording, the type of the record, its
+// index within the recording, and the start of its query, if it has one. This
+// makes it feasible to debug "unexpected call" failures in complex tests, by
+// comparing the calls made while recording with the calls made during
+// playback:
+//
+//	copyist.SetLogger(log.New(os.Stderr, "", log.LstdFlags).Printf)
+//
+// If SetLogger is not called, then records are logged to stderr if the
+// COPYIST_DEBUG environment variable is defined. Calling SetLogger with nil
+// restores the default behavior.
+func SetLogger(callback LoggerCallback) {
+	logger = callback
+}
+
+// getLogger returns the callback set by SetLogger, or else a callback that
+// logs to stderr if the COPYIST_DEBUG environment variable is defined. It
+// returns nil if neither is set.
+func getLogger() LoggerCallback {
+	if logger != nil {
+		return logger
+	}
+	if os.Getenv("COPYIST_DEBUG") != "" {
+		return log.New(os.Stderr, "copyist: ", log.LstdFlags).Printf
+	}
+	return nil
+}
+
+// logRecord logs the given record, if a logger is set. The verb describes what
+// happened to the record (e.g. "recorded"), and index is its index within the
+// recording.
+func logRecord(recordingName, verb string, index int, rec *record) {
+	logf := getLogger()
+	if logf == nil {
+		return
+	}
+	if query, ok := recordQuery(rec); ok {
+		logf("%s: %s %s #%d %q", recordingName, verb, rec.Typ.String(), index, query)
+	} else {
+		logf("%s: %s %s #%d", recordingName, verb, rec.Typ.String(), index)
+	}
+}
+
+// recordQuery returns the start of the SQL text of the given record, if it
+// has one, with runs of whitespace collapsed to single spaces.
+func recordQuery(rec *record) (string, bool) {
+	query, ok := recordQueryText(rec)
+	if !ok {
+		return "", false
+	}
+	query = strings.Join(strings.Fields(query), " ")
+	if len(query) > maxLoggedQueryLen {
+		query = query[:maxLoggedQueryLen] + "..."
+	}
+	return query, true
+}
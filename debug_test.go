@@ -0,0 +1,53 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package copyist
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestLogger tests that records are logged when they are recorded and when
+// they are played back.
+func TestLogger(t *testing.T) {
+	var logged []string
+	SetLogger(func(format string, args ...interface{}) {
+		logged = append(logged, fmt.Sprintf(format, args...))
+	})
+	defer SetLogger(nil)
+
+	// Record.
+	s := newSession(&memorySource{}, "TestLogger")
+	c := &proxyConn{driver: &proxyDriver{driverName: "fake"}, session: s}
+	query := "SELECT name\n  FROM customers WHERE " + strings.Repeat("id = 1 OR ", 10) + "false"
+	s.AddRecord(c, &record{Typ: ConnQuery, Args: recordArgs{query, nil}})
+	s.AddRecord(c, &record{Typ: RowsColumns, Args: recordArgs{[]string{"name"}}})
+
+	// Play back.
+	s.streams = map[streamKey]*recordStream{{}: {records: s.recording}}
+	_, err := s.VerifyRecord(c, ConnQuery)
+	require.NoError(t, err)
+	_, err = s.VerifyRecord(c, ConnQuery)
+	require.Error(t, err)
+
+	require.Equal(t, []string{
+		`TestLogger: recorded ConnQuery #0 "SELECT name FROM customers WHERE id = 1 OR id = 1 OR id = 1 ..."`,
+		`TestLogger: recorded RowsColumns #1`,
+		`TestLogger: played back ConnQuery #0 "SELECT name FROM customers WHERE id = 1 OR id = 1 OR id = 1 ..."`,
+	}, logged)
+}
@@ -0,0 +1,214 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package copyist
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// maxFileNameLen is the maximum length of an escaped recording name in a
+// directory source, not including the extension. Longer names are truncated
+// and suffixed with a hash of the full name, so that the file name stays well
+// within the limits of common file systems.
+const maxFileNameLen = 128
+
+// recordingSourcer is implemented by Sources that store each recording
+// separately. When a session is opened, it only reads and writes the Source
+// returned for its recording name, rather than the entire Source.
+type recordingSourcer interface {
+	RecordingSource(recordingName string) Source
+}
+
+// dirSource is a Source that stores each recording in its own file within a
+// directory. See NewDirSource for more details.
+type dirSource struct {
+	// DirName is the location of the directory containing the recording files
+	// (can be relative or absolute).
+	DirName string
+}
+
+var _ recordingSourcer = dirSource{}
+
+// NewDirSource returns a Source that maps each recording name to its own
+// recording file in the given directory, rather than storing all recordings
+// for a test file in a single recording file. Recording files are only read
+// when their recording is played back, and recording a test only rewrites the
+// file for that test's recording. Here is an example:
+//
+//	func TestMyStuff(t *testing.T) {
+//	  source := copyist.NewDirSource("testdata/mystuff")
+//	  defer copyist.OpenSource(t, source, t.Name()).Close()
+//	  ...
+//	}
+func NewDirSource(dirName string) Source {
+	return dirSource{DirName: dirName}
+}
+
+// RecordingSource returns the Source for the recording file containing the
+// recording of the given name.
+func (s dirSource) RecordingSource(recordingName string) Source {
+	return NewFileSource(s.recordingPathName(recordingName))
+}
+
+// recordingPathName returns the path of the recording file containing the
+// recording of the given name. Recording names that differ only in case map to
+// the same file on case-insensitive file systems (e.g. on macOS and Windows).
+// To behave the same way everywhere, if a recording file already exists whose
+// name only differs in case, then that file is used instead, and the colliding
+// recordings are stored together in it.
+func (s dirSource) recordingPathName(recordingName string) string {
+	fileName := recordingFileName(recordingName)
+	entries, err := os.ReadDir(s.DirName)
+	if err == nil {
+		for _, entry := range entries {
+			if entry.Name() == fileName {
+				break
+			}
+			if strings.EqualFold(entry.Name(), fileName) {
+				fileName = entry.Name()
+				break
+			}
+		}
+	}
+	return filepath.Join(s.DirName, fileName)
+}
+
+// ReadAll implements Source. It merges the recordings from every recording
+// file in the directory into a single recording file.
+func (s dirSource) ReadAll() ([]byte, error) {
+	entries, err := os.ReadDir(s.DirName)
+	if err != nil {
+		return nil, err
+	}
+
+	var layers []Source
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".copyist") {
+			continue
+		}
+		layers = append(layers, NewFileSource(filepath.Join(s.DirName, entry.Name())))
+	}
+	return NewLayeredSource(nil, layers...).ReadAll()
+}
+
+// WriteAll implements Source. It splits the given recording file into its
+// recordings and writes each recording to its own file. Recordings whose file
+// names collide are written to the same file.
+func (s dirSource) WriteAll(data []byte) error {
+	all := newRecordingSource(&memorySource{data: data})
+	if err := all.Parse(); err != nil {
+		return err
+	}
+
+	recordingNames := make([]string, 0, len(all.recordingDecls))
+	for recordingName := range all.recordingDecls {
+		recordingNames = append(recordingNames, recordingName)
+	}
+	sort.Strings(recordingNames)
+
+	// Group recordings by file, detecting names that map to the same file.
+	var fileNames []string
+	groups := make(map[string][]string)
+	for _, recordingName := range recordingNames {
+		fileName := strings.ToLower(recordingFileName(recordingName))
+		if _, ok := groups[fileName]; !ok {
+			fileNames = append(fileNames, fileName)
+		}
+		groups[fileName] = append(groups[fileName], recordingName)
+	}
+
+	for _, fileName := range fileNames {
+		group := groups[fileName]
+		one := newRecordingSource(s.RecordingSource(group[0]))
+		one.recordDecls = make(map[int]string)
+		one.recordingDecls = make(map[string]string)
+		for _, recordingName := range group {
+			one.Merge(&recordingSource{
+				recordDecls:    all.recordDecls,
+				recordingDecls: map[string]string{recordingName: all.recordingDecls[recordingName]},
+				metadata:       map[string]map[string]string{recordingName: all.metadata[recordingName]},
+			})
+		}
+		one.WriteRecording()
+	}
+	return nil
+}
+
+// recordingFileName returns the name of the file that stores the recording of
+// the given name in a directory source. The recording name is escaped so that
+// it is a valid file name on every platform, even if it contains path
+// separators (e.g. sub-tests) or characters that are reserved on Windows. Every
+// byte other than an ASCII letter, digit, '-', '_' or non-leading '.' is
+// escaped as %XX, so distinct names never map to the same file name (except
+// on case-insensitive file systems, see recordingPathName). The first letter
+// of names that Windows reserves for devices, like "CON" or "LPT1", is escaped
+// as well. Windows also strips trailing dots and spaces from file names, but
+// spaces are always escaped, and the ".copyist" extension always follows any
+// trailing dots. Names that are too long are truncated and suffixed with a
+// hash of the full name.
+func recordingFileName(recordingName string) string {
+	var b strings.Builder
+	for i := 0; i < len(recordingName); i++ {
+		c := recordingName[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9',
+			c == '-', c == '_', c == '.' && i > 0:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	fileName := b.String()
+	if isReservedFileName(fileName) {
+		fileName = fmt.Sprintf("%%%02X", fileName[0]) + fileName[1:]
+	}
+	if len(fileName) > maxFileNameLen {
+		// Don't split an escape sequence.
+		prefix := fileName[:maxFileNameLen-17]
+		if i := strings.LastIndexByte(prefix, '%'); i >= len(prefix)-2 {
+			prefix = prefix[:i]
+		}
+		fileName = fmt.Sprintf("%s-%016x", prefix, xxhash.Sum64String(recordingName))
+	}
+	return fileName + ".copyist"
+}
+
+// isReservedFileName returns true if the given file name is reserved for a
+// device on Windows. Device names are reserved regardless of case, and even if
+// they are followed by an extension, like "nul.copyist".
+func isReservedFileName(fileName string) bool {
+	stem := fileName
+	if i := strings.IndexByte(stem, '.'); i != -1 {
+		stem = stem[:i]
+	}
+	switch strings.ToUpper(stem) {
+	case "CON", "PRN", "AUX", "NUL":
+		return true
+	}
+	if len(stem) == 4 && stem[3] >= '0' && stem[3] <= '9' {
+		switch strings.ToUpper(stem[:3]) {
+		case "COM", "LPT":
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,146 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package copyist
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestDirSource tests that a directory source writes one file per recording,
+// and can read them back individually or all together.
+func TestDirSource(t *testing.T) {
+	dirName := filepath.Join(t.TempDir(), "recordings")
+	source := NewDirSource(dirName)
+
+	require.NoError(t, source.WriteAll([]byte(`
+1=DriverOpen	1:nil
+2=ConnQuery	2:"SELECT 1"	1:nil
+3=ConnExec	2:"DELETE FROM customers"	1:nil
+
+"TestQuery"=1,2
+"TestExec/sub test"=1,3
+`)))
+
+	entries, err := os.ReadDir(dirName)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	require.Equal(t, "TestExec%2Fsub%20test.copyist", entries[0].Name())
+	require.Equal(t, "TestQuery.copyist", entries[1].Name())
+
+	// Read a single recording.
+	one := newRecordingSource(source.(recordingSourcer).RecordingSource("TestExec/sub test"))
+	require.NoError(t, one.Parse())
+	require.Len(t, one.recordingDecls, 1)
+	rec := one.GetRecording("TestExec/sub test")
+	require.Len(t, rec, 2)
+	require.Equal(t, "DELETE FROM customers", rec[1].Args[0])
+
+	// Read all recordings.
+	all := newRecordingSource(source)
+	require.NoError(t, all.Parse())
+	require.Len(t, all.recordingDecls, 2)
+	rec = all.GetRecording("TestQuery")
+	require.Len(t, rec, 2)
+	require.Equal(t, "SELECT 1", rec[1].Args[0])
+}
+
+// TestRecordingFileName tests that recording names are escaped to file names
+// that are valid on every platform.
+func TestRecordingFileName(t *testing.T) {
+	testCases := []struct {
+		name     string
+		expected string
+	}{
+		{name: "TestQuery", expected: "TestQuery.copyist"},
+		{name: "TestExec/sub test", expected: "TestExec%2Fsub%20test.copyist"},
+		{name: "TestQuery@v21.1", expected: "TestQuery%40v21.1.copyist"},
+		{name: `Test<a>:b|c?*"d\e`, expected: "Test%3Ca%3E%3Ab%7Cc%3F%2A%22d%5Ce.copyist"},
+		{name: "..", expected: "%2E..copyist"},
+		{name: "100%", expected: "100%25.copyist"},
+		{name: "TestÄ", expected: "Test%C3%84.copyist"},
+		{name: "Test.", expected: "Test..copyist"},
+		{name: "CON", expected: "%43ON.copyist"},
+		{name: "nul", expected: "%6Eul.copyist"},
+		{name: "Aux.v21", expected: "%41ux.v21.copyist"},
+		{name: "COM1", expected: "%43OM1.copyist"},
+		{name: "lpt9", expected: "%6Cpt9.copyist"},
+		{name: "LPT1/sub", expected: "LPT1%2Fsub.copyist"},
+		{name: "CONSOLE", expected: "CONSOLE.copyist"},
+		{name: "COM10", expected: "COM10.copyist"},
+	}
+	for _, tc := range testCases {
+		require.Equal(t, tc.expected, recordingFileName(tc.name))
+	}
+
+	// Long names are truncated and suffixed with a hash, without splitting an
+	// escape sequence.
+	long := strings.Repeat("/", 30) + strings.Repeat("a", 200)
+	fileName := recordingFileName(long)
+	require.LessOrEqual(t, len(fileName), maxFileNameLen+len(".copyist"))
+	require.True(t, strings.HasPrefix(fileName, strings.Repeat("%2F", 30)))
+	require.NotEqual(t, fileName, recordingFileName(long+"b"))
+
+	fileName = recordingFileName(strings.Repeat("/", 100))
+	require.Regexp(t, `^(%2F){37}-[0-9a-f]{16}\.copyist$`, fileName)
+}
+
+// TestDirSourceCollision tests that recordings whose file names only differ in
+// case are stored in the same file, so that they do not overwrite one another
+// on case-insensitive file systems.
+func TestDirSourceCollision(t *testing.T) {
+	dirName := t.TempDir()
+	source := NewDirSource(dirName)
+
+	require.NoError(t, source.WriteAll([]byte(`
+1=DriverOpen	1:nil
+2=ConnQuery	2:"SELECT 1"	1:nil
+3=ConnExec	2:"DELETE FROM customers"	1:nil
+
+"TestCase"=1,2
+"Testcase"=1,3
+`)))
+
+	entries, err := os.ReadDir(dirName)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, "TestCase.copyist", entries[0].Name())
+
+	// Both recordings can be read back individually.
+	one := newRecordingSource(source.(recordingSourcer).RecordingSource("Testcase"))
+	require.NoError(t, one.Parse())
+	require.Len(t, one.recordingDecls, 2)
+	rec := one.GetRecording("Testcase")
+	require.Len(t, rec, 2)
+	require.Equal(t, "DELETE FROM customers", rec[1].Args[0])
+
+	// A new recording that collides with an existing file is added to it.
+	one = newRecordingSource(source.(recordingSourcer).RecordingSource("TESTCASE"))
+	require.NoError(t, one.Parse())
+	one.AddRecording("TESTCASE", rec)
+	one.WriteRecording()
+
+	entries, err = os.ReadDir(dirName)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	all := newRecordingSource(source)
+	require.NoError(t, all.Parse())
+	require.Len(t, all.recordingDecls, 3)
+}
@@ -0,0 +1,158 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package copyist
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/cockroachdb/copyist/internal/linediff"
+)
+
+// driftContextLines is the number of unchanged lines shown before and after
+// each change when reporting drift.
+const driftContextLines = 3
+
+// isDiffing returns true if copyist is recording in diff mode (-record=diff),
+// in which case new recordings are compared with the existing recordings
+// rather than being saved.
+func isDiffing() bool {
+	return IsRecording() && *diffFlag
+}
+
+// checkDrift returns an error that describes how the recording made by this
+// session differs from the existing recording of the same name, if recording
+// in diff mode. It returns nil if they do not differ, or if not in diff mode.
+// Records made by each connection are compared separately, so that calls made
+// concurrently by different connections can be interleaved differently without
+// being reported.
+func (s *session) checkDrift() error {
+	if !isDiffing() {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.recordingSource.Parse(); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error parsing recording file: %v", err)
+	}
+	prev := s.recordingSource.GetRecording(s.recordingName)
+	if prev == nil {
+		return fmt.Errorf("recording %s does not exist, so it cannot be compared "+
+			"with the database\n\nDo you need to generate the recording with the -record flag?",
+			s.recordingName)
+	}
+	prevMetadata := s.recordingSource.GetMetadata(s.recordingName)
+	prevStreams, err := splitStreams(prev, prevMetadata[streamsMetadataKey])
+	if err != nil {
+		return fmt.Errorf("error parsing streams of recording %s: %v", s.recordingName, err)
+	}
+	nextStreams, err := splitStreams(s.recording, formatStreams(s.streamKeys))
+	if err != nil {
+		return err
+	}
+
+	// If the connections differ, then the streams cannot be matched up, so
+	// compare the recordings as a whole.
+	sameKeys := len(prevStreams) == len(nextStreams)
+	for key := range nextStreams {
+		if _, ok := prevStreams[key]; !ok {
+			sameKeys = false
+		}
+	}
+	if !sameKeys {
+		prevStreams = map[streamKey]*recordStream{{}: {records: prev}}
+		nextStreams = map[streamKey]*recordStream{{}: {records: s.recording}}
+	}
+
+	keys := make([]streamKey, 0, len(nextStreams))
+	for key := range nextStreams {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].driverName != keys[j].driverName {
+			return keys[i].driverName < keys[j].driverName
+		}
+		return keys[i].connID < keys[j].connID
+	})
+
+	var b strings.Builder
+	for _, key := range keys {
+		diff := linediff.Lines(
+			formatRecords(prevStreams[key].records), formatRecords(nextStreams[key].records))
+		changed := false
+		for _, line := range diff {
+			if line.Op != linediff.Equal {
+				changed = true
+				break
+			}
+		}
+		if !changed {
+			continue
+		}
+		if key.driverName != "" {
+			fmt.Fprintf(&b, "driver %q, connection %d:\n", key.driverName, key.connID)
+		}
+		b.WriteString(compactDiff(formatDiff(diff), driftContextLines))
+		b.WriteByte('\n')
+	}
+	if b.Len() == 0 {
+		return nil
+	}
+	return fmt.Errorf("recording %s no longer matches the database:\n\n%s%s",
+		s.recordingName, b.String(), s.regenerateHint())
+}
+
+// compactDiff removes the unchanged lines of the given diff, as returned by
+// unifiedDiff, that are more than the given number of lines away from any
+// changed line, replacing each run of removed lines with "...".
+func compactDiff(diff string, context int) string {
+	lines := strings.Split(strings.TrimSuffix(diff, "\n"), "\n")
+	keep := make([]bool, len(lines))
+	for i, line := range lines {
+		// The first two lines are the "--- expected" and "+++ actual" headers.
+		if i < 2 {
+			keep[i] = true
+			continue
+		}
+		if strings.HasPrefix(line, " ") {
+			continue
+		}
+		for j := i - context; j <= i+context; j++ {
+			if j >= 2 && j < len(lines) {
+				keep[j] = true
+			}
+		}
+	}
+
+	var b strings.Builder
+	elided := false
+	for i, line := range lines {
+		if !keep[i] {
+			if !elided {
+				b.WriteString(" ...\n")
+				elided = true
+			}
+			continue
+		}
+		b.WriteString(line)
+		b.WriteByte('\n')
+		elided = false
+	}
+	return b.String()
+}
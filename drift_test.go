@@ -0,0 +1,99 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package copyist
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestDrift tests that recording in diff mode reports how new recordings differ
+// from existing recordings, without saving them.
+func TestDrift(t *testing.T) {
+	*recordFlag = true
+	visitedRecording = true
+	defer func() { *recordFlag = false }()
+
+	source := &memorySource{}
+	recordQueries := func(queries ...string) *session {
+		s := newSession(source, "TestDrift")
+		c := &proxyConn{driver: &proxyDriver{driverName: "fake"}, session: s}
+		s.AddRecord(c, &record{Typ: DriverOpen, Args: recordArgs{nil}})
+		for _, query := range queries {
+			s.AddRecord(c, &record{Typ: ConnExec, Args: recordArgs{query, nil}})
+		}
+		return s
+	}
+
+	// Nothing to compare with yet.
+	*diffFlag = true
+	defer func() { *diffFlag = false }()
+	s := recordQueries("SELECT 1")
+	require.EqualError(t, s.checkDrift(), "recording TestDrift does not exist, so it cannot "+
+		"be compared with the database\n\n"+
+		"Do you need to generate the recording with the -record flag?")
+
+	*diffFlag = false
+	s = recordQueries("SELECT 1", "SELECT 2", "SELECT 3", "SELECT 4", "SELECT 5", "SELECT 6")
+	require.NoError(t, s.checkDrift())
+	s.Close()
+	saved := string(source.data)
+
+	*diffFlag = true
+	s = recordQueries("SELECT 1", "SELECT 2", "SELECT 3", "SELECT 4", "SELECT 5", "SELECT 6")
+	require.NoError(t, s.checkDrift())
+
+	s = recordQueries("SELECT 1", "SELECT 2", "SELECT 3", "SELECT 4", "SELECT 5", "SELECT 7")
+	require.EqualError(t, s.checkDrift(), "recording TestDrift no longer matches the database:\n\n"+
+		"--- expected\n"+
+		"+++ actual\n"+
+		" ...\n"+
+		" ConnExec\t2:\"SELECT 3\"\t1:nil\n"+
+		" ConnExec\t2:\"SELECT 4\"\t1:nil\n"+
+		" ConnExec\t2:\"SELECT 5\"\t1:nil\n"+
+		"-ConnExec\t2:\"SELECT 6\"\t1:nil\n"+
+		"+ConnExec\t2:\"SELECT 7\"\t1:nil\n\n"+
+		"Do you need to regenerate the recording with the -record flag?")
+
+	// The recording is not overwritten.
+	s.Close()
+	require.Equal(t, saved, string(source.data))
+}
+
+// TestRecordFlagValue tests parsing the value of the "record" flag.
+func TestRecordFlagValue(t *testing.T) {
+	defer func() { *recordFlag, *diffFlag, *verifyFlag = false, false, false }()
+
+	var value recordFlagValue
+	require.NoError(t, value.Set("diff"))
+	require.True(t, *recordFlag)
+	require.True(t, *diffFlag)
+	require.Equal(t, "diff", value.String())
+
+	require.NoError(t, value.Set("verify"))
+	require.True(t, *recordFlag)
+	require.False(t, *diffFlag)
+	require.True(t, *verifyFlag)
+	require.Equal(t, "verify", value.String())
+
+	require.NoError(t, value.Set("true"))
+	require.True(t, *recordFlag)
+	require.False(t, *diffFlag)
+	require.False(t, *verifyFlag)
+	require.Equal(t, "true", value.String())
+
+	require.Error(t, value.Set("maybe"))
+}
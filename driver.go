@@ -19,6 +19,7 @@ import (
 	"database/sql"
 	"database/sql/driver"
 	"errors"
+	"sync"
 )
 
 // recordArgs is an untyped list of arguments and/or return values to/from a SQL
@@ -75,9 +76,29 @@ type proxyDriver struct {
 	// if in playback mode.
 	wrapped driver.Driver
 
-	// driverName is the name of the wrapped driver.
+	// driverName identifies the proxy driver, and the streams of records that
+	// it records and plays back. It is the name of the wrapped driver, unless
+	// the proxy driver was registered with the WithName option, in which case
+	// it is that name.
 	driverName string
 
+	// wrappedName is the name of the wrapped driver, if it differs from
+	// driverName.
+	wrappedName string
+
+	// sessionInit is called at the beginning of each recording session that
+	// uses the proxy driver, if not nil. See WithSessionInit.
+	sessionInit SessionInitCallback
+
+	// connector is the wrapped connector, if the proxy driver was constructed
+	// by RegisterWithConnector. Connections are opened with it, rather than
+	// with the wrapped driver.
+	connector driver.Connector
+
+	// mu synchronizes access to the pooled connection, since parallel sessions
+	// may open and close connections concurrently. See OpenParallel.
+	mu sync.Mutex
+
 	// pooled caches a copyist connection for reuse. For more information, see
 	// the proxyDriver comment regarding connection pooling.
 	pooled *proxyConn
@@ -93,23 +114,39 @@ type proxyDriver struct {
 // The returned connection is only used by one goroutine at a
 // time.
 func (d *proxyDriver) Open(name string) (driver.Conn, error) {
-	// Notify session that Open has been called so that it can do any needed
-	// per-session initialization.
-	if currentSession == nil {
+	return d.open(context.Background(), name)
+}
+
+// open returns a new connection to the database, which is opened with the
+// wrapped connector if there is one, or else with the wrapped driver and the
+// given name.
+func (d *proxyDriver) open(ctx context.Context, name string) (driver.Conn, error) {
+	// Find the session to which the connection belongs, and notify it that
+	// Open has been called so that it can do any needed per-session
+	// initialization.
+	s, name := findSession(name)
+	if s == nil {
 		panic(errors.New("copyist.Open was never called"))
 	}
-	currentSession.OnDriverOpen(d)
+	s.OnDriverOpen(d)
 
 	// Reuse pooled connection, if available and matching.
-	if conn := d.tryReuseConnection(name); conn != nil {
+	if conn := d.tryReuseConnection(s, name); conn != nil {
 		return conn, nil
 	}
 
 	if IsRecording() {
-		// Lazily get the wrapped driver.
-		if d.wrapped == nil {
+		c := &proxyConn{driver: d, name: name, session: s}
+		defer s.SerializeCall(c)()
+		// Lazily get the wrapped driver, unless connections are opened with
+		// the wrapped connector instead.
+		if d.wrapped == nil && d.connector == nil {
 			// Open the database in order to get the sql.Driver object to wrap.
-			db, err := sql.Open(d.driverName, name)
+			wrappedName := d.driverName
+			if d.wrappedName != "" {
+				wrappedName = d.wrappedName
+			}
+			db, err := sql.Open(wrappedName, name)
 			if err != nil {
 				return nil, err
 			}
@@ -117,15 +154,25 @@ func (d *proxyDriver) Open(name string) (driver.Conn, error) {
 			db.Close()
 		}
 
-		conn, err := d.wrapped.Open(name)
-		currentSession.AddRecord(&record{Typ: DriverOpen, Args: recordArgs{err}})
+		// Assign each connection an ID, so that playback can play back the
+		// calls made by each connection separately.
+		c.id = s.nextConnID()
+		var err error
+		if d.connector != nil {
+			c.conn, err = d.connector.Connect(ctx)
+		} else {
+			c.conn, err = d.wrapped.Open(name)
+		}
+		s.AddRecord(c, &record{Typ: DriverOpen, Args: recordArgs{err}})
 		if err != nil {
 			return nil, err
 		}
-		return &proxyConn{driver: d, conn: conn, name: name, session: currentSession}, nil
+		s.captureSchema(c)
+		return c, nil
 	}
 
-	rec, err := currentSession.VerifyRecord(DriverOpen)
+	c := &proxyConn{driver: d, name: name, session: s}
+	rec, err := s.VerifyRecord(c, DriverOpen)
 	if err != nil {
 		return nil, err
 	}
@@ -133,7 +180,7 @@ func (d *proxyDriver) Open(name string) (driver.Conn, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &proxyConn{driver: d, name: name, session: currentSession}, nil
+	return c, nil
 }
 
 // tryPoolConnection puts the given connection into the pool if:
@@ -145,6 +192,9 @@ func (d *proxyDriver) Open(name string) (driver.Conn, error) {
 //      connection is nil, or doesn't implement the driver.SessionResetter
 //      interface).
 func (d *proxyDriver) tryPoolConnection(c *proxyConn) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
 	if d.pooled != nil {
 		// Already another connection in the pool.
 		return false
@@ -171,10 +221,13 @@ func (d *proxyDriver) tryPoolConnection(c *proxyConn) bool {
 	return true
 }
 
-// tryReuseConnection returns the pooled connection if it exists and if its name
-// matches the given name, or nil if not.
-func (d *proxyDriver) tryReuseConnection(name string) *proxyConn {
-	if d.pooled != nil && d.pooled.name == name {
+// tryReuseConnection returns the pooled connection if it exists and if its
+// session and name match the given session and name, or nil if not.
+func (d *proxyDriver) tryReuseConnection(s *session, name string) *proxyConn {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.pooled != nil && d.pooled.session == s && d.pooled.name == name {
 		pooled := d.pooled
 		d.pooled = nil
 		return pooled
@@ -184,8 +237,12 @@ func (d *proxyDriver) tryReuseConnection(name string) *proxyConn {
 
 // clearPooledConnection closes and clears the pooled connection, if it exists.
 func (d *proxyDriver) clearPooledConnection() {
-	if d.pooled != nil {
-		d.pooled.Close()
-		d.pooled = nil
+	d.mu.Lock()
+	pooled := d.pooled
+	d.pooled = nil
+	d.mu.Unlock()
+
+	if pooled != nil && IsRecording() {
+		pooled.conn.Close()
 	}
 }
@@ -0,0 +1,119 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package clickhousetest
+
+import (
+	"database/sql"
+	"math"
+	"net"
+	"testing"
+
+	"github.com/cockroachdb/copyist"
+	"github.com/cockroachdb/copyist/drivertest/commontest"
+	"github.com/fortytw2/leaktest"
+	"github.com/stretchr/testify/require"
+
+	_ "github.com/ClickHouse/clickhouse-go"
+)
+
+// TestMain runs all ClickHouse driver-specific tests. To use:
+//
+//   1. Run the tests with the "-record" command-line flag. This will run the
+//      tests against the real ClickHouse driver and create recording files in
+//      the testdata directory. This tests generation of recordings.
+//   2. Run the test without the "-record" flag. This will run the tests against
+//      the copyist driver that plays back the recordings created by step #1.
+//      This tests playback of recording.
+//
+func TestMain(m *testing.M) {
+	commontest.RunAllTestsWithReset(
+		m, commontest.ClickHouseConfig("clickhouse"), commontest.ClickHouseResetScript)
+}
+
+// TestQuery fetches a single customer. The ClickHouse driver does not execute
+// queries directly, so they are always prepared.
+func TestQuery(t *testing.T) {
+	defer leaktest.Check(t)()
+	defer copyist.Open(t).Close()
+
+	db, err := sql.Open("copyist_clickhouse", commontest.ClickHouseDataSourceName)
+	require.NoError(t, err)
+	defer db.Close()
+
+	var name string
+	err = db.QueryRow("SELECT name FROM customers WHERE id = ?", 1).Scan(&name)
+	require.NoError(t, err)
+	require.Equal(t, "Andy", name)
+}
+
+// TestDataTypes queries data types that ClickHouse's driver returns without
+// converting them to the types that database/sql drivers usually return.
+func TestDataTypes(t *testing.T) {
+	defer leaktest.Check(t)()
+	defer copyist.Open(t).Close()
+
+	db, err := sql.Open("copyist_clickhouse", commontest.ClickHouseDataSourceName)
+	require.NoError(t, err)
+	defer db.Close()
+
+	var (
+		u     uint64
+		arr   []int32
+		ipv4  net.IP
+		ipv6  net.IP
+		tuple []interface{}
+	)
+	err = db.QueryRow(`
+		SELECT toUInt64(18446744073709551615) AS u, [toInt32(1), 2, 3] AS arr,
+			toIPv4('10.0.0.1') AS ipv4, toIPv6('2001:db8::1') AS ipv6,
+			tuple(toUInt8(1), 'a') AS tuple
+	`).Scan(&u, &arr, &ipv4, &ipv6, &tuple)
+	require.NoError(t, err)
+	require.Equal(t, uint64(math.MaxUint64), u)
+	require.Equal(t, []int32{1, 2, 3}, arr)
+	require.True(t, net.ParseIP("10.0.0.1").Equal(ipv4))
+	require.True(t, net.ParseIP("2001:db8::1").Equal(ipv6))
+	require.Equal(t, []interface{}{uint8(1), "a"}, tuple)
+}
+
+// TestBatchInsert inserts rows in a batch, which is the only way that the
+// ClickHouse driver inserts rows, passing arrays as arguments.
+func TestBatchInsert(t *testing.T) {
+	defer leaktest.Check(t)()
+	defer copyist.Open(t).Close()
+
+	db, err := sql.Open("copyist_clickhouse", commontest.ClickHouseDataSourceName)
+	require.NoError(t, err)
+	defer db.Close()
+
+	_, err = db.Exec("DROP TABLE IF EXISTS events")
+	require.NoError(t, err)
+	_, err = db.Exec("CREATE TABLE events (id UInt64, tags Array(String)) ENGINE = Memory")
+	require.NoError(t, err)
+
+	tx, err := db.Begin()
+	require.NoError(t, err)
+	stmt, err := tx.Prepare("INSERT INTO events (id, tags) VALUES (?, ?)")
+	require.NoError(t, err)
+	_, err = stmt.Exec(uint64(1), []string{"a", "b"})
+	require.NoError(t, err)
+	_, err = stmt.Exec(uint64(2), []string{})
+	require.NoError(t, err)
+	require.NoError(t, tx.Commit())
+
+	var count uint64
+	require.NoError(t, db.QueryRow("SELECT count() FROM events").Scan(&count))
+	require.Equal(t, uint64(2), count)
+}
@@ -0,0 +1,15 @@
+module github.com/cockroachdb/copyist/drivertest/clickhousetest
+
+go 1.16
+
+// Use separate go.mod file so that the copyist package does not depend on
+// clickhouse-go.
+require (
+	github.com/ClickHouse/clickhouse-go v1.4.5
+	github.com/cockroachdb/copyist v0.0.0-00010101000000-000000000000
+	github.com/fortytw2/leaktest v1.3.0
+	github.com/stretchr/testify v1.7.0
+)
+
+// Reference copyist in the same repo.
+replace github.com/cockroachdb/copyist => ./../..
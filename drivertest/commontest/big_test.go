@@ -21,41 +21,16 @@ import (
 
 	"github.com/cockroachdb/copyist"
 	"github.com/fortytw2/leaktest"
-	"github.com/stretchr/testify/require"
 )
 
-// TestBigRecording tests that copyist works with large recordings, and also
-// fails when the recording length > copyist.MaxRecordingSize.
+// TestBigRecording tests that copyist works with large recordings.
 func TestBigRecording(t *testing.T) {
 	defer leaktest.Check(t)()
 
-	fn := func() {
-		closer := copyist.Open(t)
-		// Subtle: run the closer in a closure in order to disable the recovery
-		// handling.
-		defer func() {
-			closer.Close()
-		}()
-		db, _ := sql.Open("copyist_"+driverName, dataSourceName)
-		defer db.Close()
-		queryBigResult(db)
-	}
-
-	// Verify that copyist panics when writing/reading with a lower value of
-	// copyist.MaxRecordingSize, but succeeds with a higher value. The only
-	// difference between reading and writing is the error message.
-	var expected string
-	if copyist.IsRecording() {
-		expected = "recording exceeds copyist.MaxRecordingSize and cannot be written"
-	} else {
-		expected = "error parsing recording file: recording exceeds copyist.MaxRecordingSize and cannot be read"
-	}
-
-	original := copyist.MaxRecordingSize
-	copyist.MaxRecordingSize = 1024
-	require.PanicsWithError(t, expected, fn)
-	copyist.MaxRecordingSize = original
-	fn()
+	defer copyist.Open(t).Close()
+	db, _ := sql.Open("copyist_"+driverName, dataSourceName)
+	defer db.Close()
+	queryBigResult(db)
 }
 
 func queryBigResult(db *sql.DB) {
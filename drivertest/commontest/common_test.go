@@ -18,10 +18,10 @@ import (
 	"bytes"
 	"database/sql"
 	"fmt"
-	"io"
 	"testing"
 
 	"github.com/cockroachdb/copyist"
+	_ "github.com/cockroachdb/copyist/copyistpq"
 	"github.com/cockroachdb/copyist/drivertest/commontest"
 	"github.com/fortytw2/leaktest"
 	"github.com/stretchr/testify/require"
@@ -32,14 +32,11 @@ import (
 // Arbitrarily use PQ driver for tests that aren't driver-specific.
 const (
 	driverName     = "postgres"
-	dataSourceName = "postgresql://root@localhost:26888?sslmode=disable"
-
-	// Don't use default CRDB port in case another instance is already running.
-	dockerArgs = "-p 26888:26257 cockroachdb/cockroach:v20.2.4 start-single-node --insecure"
+	dataSourceName = commontest.PostgresDataSourceName
 )
 
 func TestMain(m *testing.M) {
-	commontest.RunAllTests(m, driverName, dataSourceName, dockerArgs)
+	commontest.RunAllTests(m, commontest.PostgresConfig(driverName))
 }
 
 // TestIndirectOpen calls copyist.Open indirectly in a helper function.
@@ -74,7 +71,7 @@ func TestOpenNamed(t *testing.T) {
 }
 
 func TestOpenReadWriteCloser(t *testing.T) {
-	source := CopyistSource(bytes.NewBuffer([]byte(`
+	source := copyist.NewReadWriteSource(bytes.NewBuffer([]byte(`
 1=DriverOpen	1:nil
 2=ConnQuery	2:"SELECT 1"	1:nil
 3=RowsColumns	9:["?column?"]
@@ -110,11 +107,11 @@ func TestRollbackWithRecover(t *testing.T) {
 	// recordings.
 	// We assert that we hit an out of date error and that rollback is called
 	// and returns.
-	source := CopyistSource(bytes.NewBuffer([]byte(`
+	source := copyist.NewMemorySource([]byte(`
 1=DriverOpen	1:nil
 2=ConnBegin	1:nil
 
-"TestRollbackWithRecover"=1,2`)))
+"TestRollbackWithRecover"=1,2`))
 
 	defer leaktest.Check(t)()
 
@@ -228,22 +225,6 @@ func TestPooling(t *testing.T) {
 	})
 }
 
-type copyistSource struct {
-	io.Reader
-}
-
-func (s copyistSource) ReadAll() ([]byte, error) {
-	return io.ReadAll(s.Reader)
-}
-
-func (s copyistSource) WriteAll([]byte) error {
-	return nil
-}
-
-func CopyistSource(r io.Reader) copyist.Source {
-	return copyistSource{r}
-}
-
 type mockT struct {
 	failure string
 }
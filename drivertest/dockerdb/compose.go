@@ -0,0 +1,123 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package dockerdb
+
+import (
+	"fmt"
+)
+
+// ComposeConfig describes a set of services defined by compose files, such as
+// a database plus a migration runner, or multiple databases.
+type ComposeConfig struct {
+	// Runtime is the docker-compatible container CLI whose "compose" command is
+	// run. If it is empty, then it is detected in the same way as
+	// Config.Runtime.
+	Runtime string
+
+	// Files is the list of compose files that define the services.
+	Files []string
+
+	// Project is the name of the compose project. If it is empty, then
+	// "copyist-testing" is used.
+	Project string
+
+	// Services is the list of services to bring up. If it is empty, then all
+	// services in the compose files are brought up.
+	Services []string
+
+	// Databases is the list of databases that must be ready before StartCompose
+	// returns. Only the fields of each Config that determine how to connect to
+	// the database and check that it is ready are used (i.e. DriverName,
+	// DataSourceName, Ready, PollInterval and Timeout).
+	Databases []Config
+}
+
+// Compose is a set of running services, started by StartCompose. The caller
+// must call Close when the services are no longer needed.
+type Compose struct {
+	runtime string
+	cfg     ComposeConfig
+}
+
+// StartCompose brings up the services defined by the given compose
+// configuration, and then waits for each of its databases to be ready. Here is
+// an example invocation:
+//
+//	c, err := dockerdb.StartCompose(dockerdb.ComposeConfig{
+//	  Files: []string{"testdata/docker-compose.yml"},
+//	  Databases: []dockerdb.Config{
+//	    {DriverName: "postgres", DataSourceName: "postgresql://root@localhost:26257?sslmode=disable"},
+//	    {DriverName: "mysql", DataSourceName: "root@tcp(localhost:3306)/test"},
+//	  },
+//	})
+//	if err != nil {
+//	  ...
+//	}
+//	defer c.Close()
+func StartCompose(cfg ComposeConfig) (*Compose, error) {
+	if len(cfg.Files) == 0 {
+		return nil, fmt.Errorf("compose file must be specified")
+	}
+	if cfg.Project == "" {
+		cfg.Project = "copyist-testing"
+	}
+	c := &Compose{runtime: containerRuntime(cfg.Runtime), cfg: cfg}
+
+	// Tear down any services left over from a previous run, and then bring up
+	// the services in the background.
+	c.Close()
+	args := append(c.composeArgs("up", "-d"), cfg.Services...)
+	if out, err := runtimeCommand(c.runtime, args...).CombinedOutput(); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("%v\n%s", err, out)
+	}
+
+	for i := range cfg.Databases {
+		if err := waitForDB(&cfg.Databases[i], nil); err != nil {
+			logs, _ := c.Logs()
+			c.Close()
+			return nil, logsError(err, logs)
+		}
+	}
+	return c, nil
+}
+
+// Logs returns the output of the services so far, which can help to diagnose
+// why a database is misbehaving.
+func (c *Compose) Logs() (string, error) {
+	args := c.composeArgs("logs", "--no-color")
+	out, err := runtimeCommand(c.runtime, args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%v\n%s", err, out)
+	}
+	return string(out), nil
+}
+
+// Close tears down the services, including their volumes.
+func (c *Compose) Close() error {
+	runtimeCommand(c.runtime, c.composeArgs("down", "-v")...).Run()
+	return nil
+}
+
+// composeArgs returns the arguments to pass to the container CLI in order to
+// run the given compose command.
+func (c *Compose) composeArgs(args ...string) []string {
+	composeArgs := []string{"compose"}
+	for _, file := range c.cfg.Files {
+		composeArgs = append(composeArgs, "-f", file)
+	}
+	composeArgs = append(composeArgs, "-p", c.cfg.Project)
+	return append(composeArgs, args...)
+}
@@ -18,24 +18,389 @@ import (
 	"bytes"
 	"database/sql"
 	"errors"
-	"io"
+	"fmt"
 	"log"
-	"os/exec"
+	"os"
+	"sort"
+	"strconv"
 	"strings"
-	"sync/atomic"
 	"time"
 )
 
-// closer implements the io.Closer interface by invoking an arbitrary function
-// when Close is called.
-type closer func() error
+// Config describes a database docker container, and how to connect to the
+// database that it runs.
+type Config struct {
+	// DriverName is the name of the SQL driver used to connect to the database
+	// in order to determine when it is ready (e.g. "postgres").
+	DriverName string
 
-func (c closer) Close() error {
-	return c()
+	// DataSourceName is the string used to connect to the database in order to
+	// determine when it is ready. It can contain "{port}" placeholders, which
+	// are replaced by the host port of the first published port, or
+	// placeholders like "{port:26257}", which are replaced by the host port
+	// that publishes the given container port. This allows the database to be
+	// reached at a host port that is allocated when the container starts.
+	DataSourceName string
+
+	// Name is the name of the container. If it is empty, then the name is
+	// derived from DriverName. Containers that are started at the same time
+	// must have different names.
+	Name string
+
+	// Runtime is the docker-compatible container CLI to run (e.g. "podman"). If
+	// it is empty, then the COPYIST_CONTAINER_RUNTIME environment variable is
+	// used, or else the first of docker, podman, or nerdctl that is installed.
+	Runtime string
+
+	// Image is the name of the docker image to run (e.g.
+	// "cockroachdb/cockroach").
+	Image string
+
+	// Tag is the tag of the docker image to run (e.g. "v20.2.4"). If it is
+	// empty, then the "latest" tag is used. The COPYIST_DOCKER_TAG environment
+	// variable overrides the tag, which allows the same tests to be recorded
+	// against multiple versions of the database (see copyist.SetVariant).
+	Tag string
+
+	// Env is the set of environment variables to set in the container.
+	Env map[string]string
+
+	// Ports is the list of container ports to publish on the host. A host port
+	// of zero is replaced by a free port when the container starts.
+	Ports []Port
+
+	// Volumes is the list of host paths to mount in the container.
+	Volumes []Volume
+
+	// Command is the command and arguments to run in the container, overriding
+	// the default command of the image, if any.
+	Command []string
+
+	// Memory is the memory limit of the container (e.g. "1g"). If it is empty,
+	// then the memory is not limited.
+	Memory string
+
+	// CPUs is the number of CPUs available to the container (e.g. "1.5"). If it
+	// is empty, then the CPUs are not limited.
+	CPUs string
+
+	// Labels is the set of labels to attach to the container.
+	Labels map[string]string
+
+	// Ready reports whether the database is ready to be used, returning an
+	// error if it is not. If it is nil, then the database is ready once it can
+	// be pinged. See ReadyQuery for a common readiness check.
+	Ready func(db *sql.DB) error
+
+	// PollInterval is how often to check whether the database is ready. If it
+	// is zero, then the database is checked every 100 milliseconds.
+	PollInterval time.Duration
+
+	// Timeout is how long to wait for the database to be ready before giving
+	// up. If it is zero, then the timeout is 60 seconds.
+	Timeout time.Duration
+
+	// External is the data source name of an already-running database to use
+	// rather than starting a container, such as a managed cloud database. See
+	// WithExternal for more details.
+	External string
+
+	// Reuse leaves the container running when it is closed, so that it can be
+	// reused by later calls to StartContainer with the same configuration,
+	// including calls from other processes. See WithReuse for more details.
+	Reuse bool
+}
+
+// logTailLines is the number of lines of container logs that are included in
+// errors when a database fails to start.
+const logTailLines = 50
+
+// These are the default readiness polling settings.
+const (
+	defaultPollInterval = 100 * time.Millisecond
+	defaultTimeout      = 60 * time.Second
+)
+
+// Port maps a port on the host to a port in the container.
+type Port struct {
+	Host      int
+	Container int
+}
+
+// Volume mounts a file or directory on the host in the container.
+type Volume struct {
+	Host      string
+	Container string
+	ReadOnly  bool
+}
+
+// Option customizes a Config.
+type Option func(cfg *Config)
+
+// WithRuntime sets the docker-compatible container CLI to run, such as "podman"
+// or "nerdctl", rather than detecting it.
+func WithRuntime(runtime string) Option {
+	return func(cfg *Config) {
+		cfg.Runtime = runtime
+	}
+}
+
+// WithImage sets the docker image and tag to run.
+func WithImage(image, tag string) Option {
+	return func(cfg *Config) {
+		cfg.Image = image
+		cfg.Tag = tag
+	}
+}
+
+// WithEnv sets an environment variable in the container.
+func WithEnv(name, value string) Option {
+	return func(cfg *Config) {
+		if cfg.Env == nil {
+			cfg.Env = make(map[string]string)
+		}
+		cfg.Env[name] = value
+	}
+}
+
+// WithPort publishes the given container port on the given host port. If the
+// host port is zero, then a free port is allocated when the container starts.
+// Use a "{port}" placeholder in the data source name to refer to it.
+func WithPort(hostPort, containerPort int) Option {
+	return func(cfg *Config) {
+		cfg.Ports = append(cfg.Ports, Port{Host: hostPort, Container: containerPort})
+	}
+}
+
+// WithVolume mounts the given file or directory on the host at the given path
+// in the container.
+func WithVolume(hostPath, containerPath string, readOnly bool) Option {
+	return func(cfg *Config) {
+		cfg.Volumes = append(cfg.Volumes, Volume{
+			Host: hostPath, Container: containerPath, ReadOnly: readOnly,
+		})
+	}
+}
+
+// WithCommand sets the command and arguments to run in the container.
+func WithCommand(args ...string) Option {
+	return func(cfg *Config) {
+		cfg.Command = args
+	}
+}
+
+// WithMemory limits the memory available to the container (e.g. "1g").
+func WithMemory(limit string) Option {
+	return func(cfg *Config) {
+		cfg.Memory = limit
+	}
+}
+
+// WithCPUs limits the number of CPUs available to the container (e.g. "1.5").
+func WithCPUs(cpus string) Option {
+	return func(cfg *Config) {
+		cfg.CPUs = cpus
+	}
+}
+
+// WithReady sets the function that reports whether the database is ready to be
+// used. This is necessary for databases that can be pinged before they can be
+// used, such as those that run initialization scripts on startup.
+func WithReady(ready func(db *sql.DB) error) Option {
+	return func(cfg *Config) {
+		cfg.Ready = ready
+	}
+}
+
+// WithPollInterval sets how often to check whether the database is ready.
+func WithPollInterval(d time.Duration) Option {
+	return func(cfg *Config) {
+		cfg.PollInterval = d
+	}
+}
+
+// WithTimeout sets how long to wait for the database to be ready, which may
+// need to be increased for slow images.
+func WithTimeout(d time.Duration) Option {
+	return func(cfg *Config) {
+		cfg.Timeout = d
+	}
+}
+
+// ReadyQuery returns a readiness function that runs the given query and checks
+// that it returns a row having the given column values, formatted as strings.
+// For example:
+//
+//	dockerdb.WithReady(dockerdb.ReadyQuery(
+//	  "SELECT count(*) FROM information_schema.tables WHERE table_name = 'users'", "1"))
+func ReadyQuery(query string, expected ...string) func(db *sql.DB) error {
+	return func(db *sql.DB) error {
+		rows, err := db.Query(query)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		if !rows.Next() {
+			if err := rows.Err(); err != nil {
+				return err
+			}
+			return errors.New("readiness query returned no rows")
+		}
+
+		actual := make([]sql.NullString, len(expected))
+		dest := make([]interface{}, len(expected))
+		for i := range actual {
+			dest[i] = &actual[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return err
+		}
+		for i := range expected {
+			if actual[i].String != expected[i] {
+				return fmt.Errorf("readiness query returned %q, expected %q",
+					actual[i].String, expected[i])
+			}
+		}
+		return nil
+	}
+}
+
+// WithLabel attaches a label to the container.
+func WithLabel(name, value string) Option {
+	return func(cfg *Config) {
+		if cfg.Labels == nil {
+			cfg.Labels = make(map[string]string)
+		}
+		cfg.Labels[name] = value
+	}
+}
+
+// WithExternal uses the already-running database at the given data source name
+// rather than starting a container. This is useful on CI runners that do not
+// have docker, or to record against managed cloud databases. Setting the
+// COPYIST_DSN_<DRIVER> environment variable, where <DRIVER> is the upper-case
+// driver name (e.g. COPYIST_DSN_POSTGRES), has the same effect as this option.
+func WithExternal(dataSourceName string) Option {
+	return func(cfg *Config) {
+		cfg.External = dataSourceName
+	}
+}
+
+// WithReuse reuses an already-running container that was started with the same
+// configuration, rather than starting a new container. If there is no such
+// container, then one is started, and left running when it is closed. This
+// avoids starting and stopping a container for every test package when
+// recording a multi-package repo. Reused containers can be removed by calling
+// RemoveReusedContainers. Setting the COPYIST_DOCKER_REUSE environment variable
+// has the same effect as this option.
+func WithReuse() Option {
+	return func(cfg *Config) {
+		cfg.Reuse = true
+	}
+}
+
+// runArgs returns the arguments to pass to "docker run" in order to start a
+// container described by this configuration.
+func (cfg *Config) runArgs() []string {
+	var args []string
+
+	names := make([]string, 0, len(cfg.Env))
+	for name := range cfg.Env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		args = append(args, "-e", name+"="+cfg.Env[name])
+	}
+
+	names = names[:0]
+	for name := range cfg.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		args = append(args, "--label", name+"="+cfg.Labels[name])
+	}
+
+	for _, port := range cfg.Ports {
+		args = append(args, "-p", strconv.Itoa(port.Host)+":"+strconv.Itoa(port.Container))
+	}
+	for _, volume := range cfg.Volumes {
+		spec := volume.Host + ":" + volume.Container
+		if volume.ReadOnly {
+			spec += ":ro"
+		}
+		args = append(args, "-v", spec)
+	}
+	if cfg.Memory != "" {
+		args = append(args, "--memory", cfg.Memory)
+	}
+	if cfg.CPUs != "" {
+		args = append(args, "--cpus", cfg.CPUs)
+	}
+
+	tag := cfg.Tag
+	if tag == "" {
+		tag = "latest"
+	}
+	args = append(args, cfg.Image+":"+tag)
+	return append(args, cfg.Command...)
+}
+
+// Container is a running database docker container, started by StartContainer.
+// The caller must call Close when the container is no longer needed.
+type Container struct {
+	name    string
+	runtime string
+	cfg     Config
+
+	// reused is true if the container should be left running when it is
+	// closed.
+	reused bool
+
+	// external is true if the database is not running in a container at all,
+	// but is an already-running database. See WithExternal.
+	external bool
+}
+
+// Config returns the configuration of the container, with any free ports that
+// were allocated when it started.
+func (c *Container) Config() Config {
+	return c.cfg
+}
+
+// DataSourceName returns the string used to connect to the container's
+// database, with any port placeholders replaced by the allocated host ports.
+func (c *Container) DataSourceName() string {
+	return c.cfg.DataSourceName
+}
+
+// Logs returns the output of the container so far, which can help to diagnose
+// why a database is misbehaving.
+func (c *Container) Logs() (string, error) {
+	if c.external {
+		return "", errors.New("external databases do not have container logs")
+	}
+	out, err := runtimeCommand(c.runtime, "logs", c.name).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%v\n%s", err, out)
+	}
+	return string(out), nil
+}
+
+// Close terminates and removes the container, unless it is being reused, or
+// is an external database.
+func (c *Container) Close() error {
+	if c.reused || c.external {
+		return nil
+	}
+	runtimeCommand(c.runtime, "rm", c.name, "-f").Run()
+	return nil
 }
 
 // Run docker with the given args, then wait for the given database to be
-// ready. Start returns an io.Closer interface. The caller must call Close when
+// ready. Start returns the running container. The caller must call Close when
 // the docker container is no longer needed, and should be terminated. Here is
 // an example invocation:
 //
@@ -45,64 +410,204 @@ func (c closer) Close() error {
 //     "postgresql://root@localhost:26257?sslmode=disable",
 //   ).Close()
 //
-func Start(dockerArgs, driverName, dataSourceName string) io.Closer {
-	containerName := driverName + "-copyist-testing"
+// The docker args are split on spaces, so they cannot contain quoted arguments.
+// StartContainer does not have this limitation. Any "{port}" placeholders in
+// the docker args and data source name are replaced by a free host port, which
+// can be used to publish the database port (e.g. "-p {port}:26257").
+func Start(dockerArgs, driverName, dataSourceName string) *Container {
+	if external := os.Getenv(externalEnvVar(driverName)); external != "" {
+		cfg := Config{DriverName: driverName, DataSourceName: external}
+		c, err := startExternal(cfg)
+		if err != nil {
+			panic(err)
+		}
+		return c
+	}
+
+	if strings.Contains(dockerArgs, portPlaceholder) {
+		port, err := freePort(0)
+		if err != nil {
+			panic(err)
+		}
+		dockerArgs = strings.ReplaceAll(dockerArgs, portPlaceholder, strconv.Itoa(port))
+		dataSourceName = strings.ReplaceAll(dataSourceName, portPlaceholder, strconv.Itoa(port))
+	}
+
+	cfg := Config{DriverName: driverName, DataSourceName: dataSourceName}
+	c, err := start(cfg, strings.Split(dockerArgs, " "))
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+// StartContainer starts a database docker container described by the given
+// configuration, customized by the given options, and then waits for the
+// database to be ready. Here is an example invocation:
+//
+//	c, err := dockerdb.StartContainer(
+//	  dockerdb.Config{
+//	    DriverName:     "postgres",
+//	    DataSourceName: "postgresql://root@localhost:26257?sslmode=disable",
+//	  },
+//	  dockerdb.WithImage("cockroachdb/cockroach", "v20.2.4"),
+//	  dockerdb.WithPort(26257, 26257),
+//	  dockerdb.WithCommand("start-single-node", "--insecure"),
+//	)
+//	if err != nil {
+//	  ...
+//	}
+//	defer c.Close()
+func StartContainer(cfg Config, opts ...Option) (*Container, error) {
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if tag := os.Getenv("COPYIST_DOCKER_TAG"); tag != "" {
+		cfg.Tag = tag
+	}
+	if cfg.External == "" {
+		cfg.External = os.Getenv(externalEnvVar(cfg.DriverName))
+	}
+	if cfg.External != "" {
+		cfg.DataSourceName = cfg.External
+		return startExternal(cfg)
+	}
+	if cfg.Image == "" {
+		return nil, fmt.Errorf("docker image must be specified")
+	}
+	if cfg.Reuse || os.Getenv("COPYIST_DOCKER_REUSE") != "" {
+		return startReused(cfg)
+	}
+	if err := cfg.resolvePorts(freePort); err != nil {
+		return nil, err
+	}
+	return start(cfg, cfg.runArgs())
+}
+
+// startExternal waits for the already-running database described by the given
+// configuration to be ready, without starting a container.
+func startExternal(cfg Config) (*Container, error) {
+	if err := waitForDB(&cfg, nil); err != nil {
+		return nil, err
+	}
+	return &Container{cfg: cfg, external: true}, nil
+}
+
+// externalEnvVar returns the name of the environment variable that overrides
+// the data source name of the given driver, such as COPYIST_DSN_POSTGRES.
+// Characters that are not valid in environment variable names are replaced by
+// underscores.
+func externalEnvVar(driverName string) string {
+	name := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, driverName)
+	return "COPYIST_DSN_" + strings.ToUpper(name)
+}
+
+// start runs docker with the given args, and then waits for the database
+// described by the given configuration to be ready.
+func start(cfg Config, dockerArgs []string) (*Container, error) {
+	name := cfg.Name
+	if name == "" {
+		name = cfg.DriverName + "-copyist-testing"
+	}
+	c := &Container{name: name, runtime: containerRuntime(cfg.Runtime), cfg: cfg}
 
 	// Remove any docker containers of this name.
-	exec.Command("docker", "rm", containerName, "-f").Run()
+	c.Close()
 
 	// Start up docker.
 	var out bytes.Buffer
-	args := strings.Split(dockerArgs, " ")
-	args = append([]string{"run", "--name", containerName}, args...)
-	cmd := exec.Command("docker", args...)
+	args := append([]string{"run", "--name", c.name}, dockerArgs...)
+	cmd := runtimeCommand(c.runtime, args...)
 	cmd.Stderr = &out
 	cmd.Stdout = &out
 	if err := cmd.Start(); err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	// Wait for the database to start. If the docker process exits before the
-	// database has started, then something must have gone wrong, so panic with
-	// output of the docker process.
-	var noPanic int64
+	// database has started, then something must have gone wrong, so fail with
+	// the output of the docker process. The output is only read once the
+	// process has exited, since it is written concurrently until then.
+	exited := make(chan struct{})
 	go func() {
 		cmd.Wait()
-		if atomic.LoadInt64(&noPanic) == 0 {
-			panic(out.String())
-		}
+		close(exited)
 	}()
-	waitForDB(driverName, dataSourceName)
+	if err := waitForDB(&cfg, exited); err != nil {
+		c.Close()
+		<-exited
+		return nil, logsError(err, out.String())
+	}
+	return c, nil
+}
 
-	// Database has successfully started, so don't panic when docker process
-	// exits.
-	atomic.AddInt64(&noPanic, 1)
+// logsError returns an error that includes the last lines of the given
+// container logs.
+func logsError(err error, logs string) error {
+	return fmt.Errorf("%v\n\ncontainer logs (last %d lines):\n%s",
+		err, logTailLines, lastLines(logs, logTailLines))
+}
 
-	// Remove container
-	return closer(func() error {
-		exec.Command("docker", "rm", containerName, "-f").Run()
-		return nil
-	})
+// lastLines returns the last n lines of the given text.
+func lastLines(text string, n int) string {
+	lines := strings.SplitAfter(strings.TrimRight(text, "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "")
 }
 
-func waitForDB(driverName, dataSourceName string) {
-	db, err := sql.Open(driverName, dataSourceName)
+// waitForDB waits for the database described by the given configuration to be
+// ready, or for the exited channel to be closed, whichever happens first.
+func waitForDB(cfg *Config, exited <-chan struct{}) error {
+	db, err := sql.Open(cfg.DriverName, cfg.DataSourceName)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	defer db.Close()
 
-	// Wait for up to 60 seconds for database to be ready (docker might be
-	// downloading image, starting up, etc).
-	for i := 0; i < 12; i++ {
-		end := time.Now().Add(time.Second * 5)
-		for time.Now().Before(end) {
-			if db.Ping() == nil {
-				return
-			}
-		}
-		log.Printf("waited %d seconds for database to start...", (i+1)*5)
+	ready := cfg.Ready
+	if ready == nil {
+		ready = func(db *sql.DB) error { return db.Ping() }
+	}
+	pollInterval := cfg.PollInterval
+	if pollInterval == 0 {
+		pollInterval = defaultPollInterval
+	}
+	timeout := cfg.Timeout
+	if timeout == 0 {
+		timeout = defaultTimeout
 	}
 
-	panic(errors.New("database did not start up within 60 seconds"))
+	// Wait for the database to be ready (docker might be downloading image,
+	// starting up, etc).
+	start := time.Now()
+	nextLog := start.Add(5 * time.Second)
+	for {
+		err := ready(db)
+		if err == nil {
+			return nil
+		}
+
+		select {
+		case <-exited:
+			return fmt.Errorf("container exited before database started")
+		default:
+		}
+
+		now := time.Now()
+		if now.Sub(start) >= timeout {
+			return fmt.Errorf("database did not start up within %s: %v", timeout, err)
+		}
+		if now.After(nextLog) {
+			log.Printf("waited %s for database to start...", now.Sub(start).Round(time.Second))
+			nextLog = nextLog.Add(5 * time.Second)
+		}
+		time.Sleep(pollInterval)
+	}
 }
@@ -0,0 +1,205 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package dockerdb
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestRunArgs tests that configurations are translated into "docker run"
+// arguments without needing to split or quote them.
+func TestRunArgs(t *testing.T) {
+	cfg := Config{Image: "postgres"}
+	require.Equal(t, []string{"postgres:latest"}, cfg.runArgs())
+
+	for _, opt := range []Option{
+		WithImage("cockroachdb/cockroach", "v20.2.4"),
+		WithEnv("TZ", "America/Los Angeles"),
+		WithEnv("COCKROACH_USER", "root"),
+		WithPort(26888, 26257),
+		WithPort(8080, 8080),
+		WithLabel("owner", "copyist"),
+		WithVolume("/tmp/certs", "/certs", true),
+		WithCommand("start-single-node", "--insecure"),
+		WithMemory("1g"),
+		WithCPUs("1.5"),
+	} {
+		opt(&cfg)
+	}
+	require.Equal(t, []string{
+		"-e", "COCKROACH_USER=root",
+		"-e", "TZ=America/Los Angeles",
+		"--label", "owner=copyist",
+		"-p", "26888:26257",
+		"-p", "8080:8080",
+		"-v", "/tmp/certs:/certs:ro",
+		"--memory", "1g",
+		"--cpus", "1.5",
+		"cockroachdb/cockroach:v20.2.4",
+		"start-single-node", "--insecure",
+	}, cfg.runArgs())
+
+	_, err := StartContainer(Config{DriverName: "postgres"})
+	require.EqualError(t, err, "docker image must be specified")
+}
+
+// nullDriver is a SQL driver that cannot open connections. It allows
+// readiness checks to be tested without a database.
+type nullDriver struct{}
+
+func (nullDriver) Open(name string) (driver.Conn, error) {
+	return nil, errors.New("cannot open connection")
+}
+
+func init() {
+	sql.Register("dockerdb-null", nullDriver{})
+}
+
+// TestWaitForDB tests that the readiness check is polled until it succeeds, or
+// until the timeout expires.
+func TestWaitForDB(t *testing.T) {
+	calls := 0
+	cfg := Config{
+		DriverName: "dockerdb-null",
+		Ready: func(db *sql.DB) error {
+			calls++
+			if calls < 3 {
+				return errors.New("not ready")
+			}
+			return nil
+		},
+		PollInterval: time.Millisecond,
+		Timeout:      time.Minute,
+	}
+	require.NoError(t, waitForDB(&cfg, nil))
+	require.Equal(t, 3, calls)
+
+	// Default readiness check pings the database.
+	cfg.Ready = nil
+	cfg.Timeout = 10 * time.Millisecond
+	require.EqualError(t, waitForDB(&cfg, nil),
+		"database did not start up within 10ms: cannot open connection")
+
+	// Docker exits before the database is ready.
+	exited := make(chan struct{})
+	close(exited)
+	cfg.Timeout = time.Minute
+	require.EqualError(t, waitForDB(&cfg, exited), "container exited before database started")
+}
+
+// TestContainerRuntime tests that the container runtime can be configured
+// explicitly or by the COPYIST_CONTAINER_RUNTIME environment variable.
+func TestContainerRuntime(t *testing.T) {
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	require.NoError(t, os.Setenv("PATH", ""))
+	require.Equal(t, "docker", containerRuntime(""))
+
+	require.NoError(t, os.Setenv("COPYIST_CONTAINER_RUNTIME", "nerdctl"))
+	defer os.Unsetenv("COPYIST_CONTAINER_RUNTIME")
+	require.Equal(t, "nerdctl", containerRuntime(""))
+	require.Equal(t, "podman", containerRuntime("podman"))
+}
+
+// TestComposeArgs tests that compose commands refer to the configured files
+// and project.
+func TestComposeArgs(t *testing.T) {
+	c := &Compose{cfg: ComposeConfig{
+		Files:   []string{"base.yml", "override.yml"},
+		Project: "test",
+	}}
+	require.Equal(t, []string{
+		"compose", "-f", "base.yml", "-f", "override.yml", "-p", "test", "up", "-d",
+	}, c.composeArgs("up", "-d"))
+
+	_, err := StartCompose(ComposeConfig{})
+	require.EqualError(t, err, "compose file must be specified")
+}
+
+// TestLogsError tests that errors include the last lines of container logs.
+func TestLogsError(t *testing.T) {
+	var logs strings.Builder
+	for i := 1; i <= logTailLines+10; i++ {
+		fmt.Fprintf(&logs, "line %d\n", i)
+	}
+	err := logsError(errors.New("database did not start"), logs.String())
+	require.True(t, strings.HasPrefix(err.Error(),
+		"database did not start\n\ncontainer logs (last 50 lines):\nline 11\nline 12\n"))
+	require.True(t, strings.HasSuffix(err.Error(), "line 59\nline 60"))
+
+	require.Equal(t, "a\nb", lastLines("a\nb\n", 5))
+	require.Equal(t, "", lastLines("", 5))
+}
+
+// TestResolvePorts tests that free host ports are allocated and substituted
+// into the data source name.
+func TestResolvePorts(t *testing.T) {
+	cfg := Config{
+		DataSourceName: "postgresql://root@localhost:{port}?sslmode=disable&http={port:8080}",
+		Ports:          []Port{{Container: 26257}, {Host: 9000, Container: 8080}},
+	}
+	require.NoError(t, cfg.resolvePorts(func(containerPort int) (int, error) {
+		return containerPort + 10000, nil
+	}))
+	require.Equal(t, []Port{{Host: 36257, Container: 26257}, {Host: 9000, Container: 8080}}, cfg.Ports)
+	require.Equal(t, "postgresql://root@localhost:36257?sslmode=disable&http=9000", cfg.DataSourceName)
+
+	port, err := freePort(0)
+	require.NoError(t, err)
+	require.NotZero(t, port)
+}
+
+// TestStartContainers tests that an error is returned for each container that
+// fails to start.
+func TestStartContainers(t *testing.T) {
+	_, err := StartContainers(Config{DriverName: "postgres"}, Config{DriverName: "mysql"})
+	require.EqualError(t, err, "container 1 (postgres): docker image must be specified\n"+
+		"container 2 (mysql): docker image must be specified")
+
+	cs, err := StartContainers()
+	require.NoError(t, err)
+	require.NoError(t, cs.Close())
+}
+
+// TestExternal tests that an already-running database is used rather than
+// starting a container, when configured.
+func TestExternal(t *testing.T) {
+	require.Equal(t, "COPYIST_DSN_POSTGRES", externalEnvVar("postgres"))
+	require.Equal(t, "COPYIST_DSN_DOCKERDB_NULL", externalEnvVar("dockerdb-null"))
+
+	require.NoError(t, os.Setenv("COPYIST_DSN_DOCKERDB_NULL", "external"))
+	defer os.Unsetenv("COPYIST_DSN_DOCKERDB_NULL")
+
+	ready := func(db *sql.DB) error { return nil }
+	c, err := StartContainer(Config{DriverName: "dockerdb-null", Ready: ready})
+	require.NoError(t, err)
+	require.Equal(t, "external", c.DataSourceName())
+	require.NoError(t, c.Close())
+
+	c, err = StartContainer(Config{DriverName: "dockerdb-null", Ready: ready},
+		WithExternal("option"))
+	require.NoError(t, err)
+	require.Equal(t, "option", c.DataSourceName())
+	_, err = c.Logs()
+	require.Error(t, err)
+}
@@ -0,0 +1,79 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package dockerdb
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Containers is a set of running database containers, started by
+// StartContainers. The caller must call Close when the containers are no
+// longer needed.
+type Containers []*Container
+
+// Close terminates and removes all of the containers.
+func (cs Containers) Close() error {
+	for i := len(cs) - 1; i >= 0; i-- {
+		cs[i].Close()
+	}
+	return nil
+}
+
+// StartContainers starts a database container for each of the given
+// configurations, such as Postgres plus MySQL, and waits for all of their
+// databases to be ready, using each configuration's readiness check. The
+// containers are started in parallel. If any container fails to start, then
+// all of them are closed. Containers that use the same driver must be given
+// distinct names (see Config.Name). Here is an example invocation:
+//
+//	cs, err := dockerdb.StartContainers(postgresConfig, mysqlConfig)
+//	if err != nil {
+//	  ...
+//	}
+//	defer cs.Close()
+func StartContainers(cfgs ...Config) (Containers, error) {
+	cs := make(Containers, len(cfgs))
+	errs := make([]error, len(cfgs))
+
+	var wg sync.WaitGroup
+	for i := range cfgs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			cs[i], errs[i] = StartContainer(cfgs[i])
+		}(i)
+	}
+	wg.Wait()
+
+	var msgs []string
+	for i, err := range errs {
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("container %d (%s): %v", i+1, cfgs[i].DriverName, err))
+		}
+	}
+	if len(msgs) == 0 {
+		return cs, nil
+	}
+
+	for _, c := range cs {
+		if c != nil {
+			c.Close()
+		}
+	}
+	return nil, errors.New(strings.Join(msgs, "\n"))
+}
@@ -0,0 +1,95 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package dockerdb
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// portPlaceholder is replaced by the host port of the first published port
+// wherever it appears in a data source name. The host port of a specific
+// container port can be referenced using a placeholder like "{port:26257}".
+const portPlaceholder = "{port}"
+
+// resolvePorts assigns a host port to each published port in the configuration
+// that does not have one, by calling the given function with its container
+// port, and then substitutes the host ports into the data source name.
+func (cfg *Config) resolvePorts(hostPort func(containerPort int) (int, error)) error {
+	ports := make([]Port, len(cfg.Ports))
+	copy(ports, cfg.Ports)
+	for i := range ports {
+		if ports[i].Host != 0 {
+			continue
+		}
+		port, err := hostPort(ports[i].Container)
+		if err != nil {
+			return err
+		}
+		ports[i].Host = port
+	}
+	cfg.Ports = ports
+	cfg.DataSourceName = substitutePorts(cfg.DataSourceName, ports)
+	return nil
+}
+
+// substitutePorts replaces port placeholders in the given data source name
+// with the corresponding host ports.
+func substitutePorts(dataSourceName string, ports []Port) string {
+	for _, port := range ports {
+		placeholder := fmt.Sprintf("{port:%d}", port.Container)
+		dataSourceName = strings.ReplaceAll(dataSourceName, placeholder, strconv.Itoa(port.Host))
+	}
+	if len(ports) != 0 {
+		dataSourceName = strings.ReplaceAll(
+			dataSourceName, portPlaceholder, strconv.Itoa(ports[0].Host))
+	}
+	return dataSourceName
+}
+
+// freePort returns a host port that is not currently in use. The container port
+// is ignored.
+func freePort(int) (int, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, fmt.Errorf("could not allocate a free port: %v", err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port, nil
+}
+
+// publishedPort returns a function that looks up the host port on which the
+// given container publishes each container port.
+func publishedPort(runtime, name string) func(containerPort int) (int, error) {
+	return func(containerPort int) (int, error) {
+		out, err := runtimeCommand(runtime, "port", name, strconv.Itoa(containerPort)).Output()
+		if err != nil {
+			return 0, fmt.Errorf("could not find published port %d: %v", containerPort, err)
+		}
+
+		// The output is a list of addresses like "0.0.0.0:49153".
+		fields := strings.Fields(string(out))
+		if len(fields) == 0 {
+			return 0, fmt.Errorf("port %d is not published", containerPort)
+		}
+		_, port, err := net.SplitHostPort(fields[0])
+		if err != nil {
+			return 0, err
+		}
+		return strconv.Atoi(port)
+	}
+}
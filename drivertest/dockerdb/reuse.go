@@ -0,0 +1,146 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package dockerdb
+
+import (
+	"crypto/md5"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// reuseLabel is the label attached to reused containers. Its value is a hash of
+// the container's configuration, so that containers are only reused by callers
+// that would have started an identical container.
+const reuseLabel = "copyist.reuse"
+
+// staleLockTimeout is the duration after which a lock on a reused container is
+// assumed to have been abandoned, and is broken.
+const staleLockTimeout = time.Minute
+
+// startReused finds an already-running container that was started with the
+// given configuration, or starts a new one in the background if there is none,
+// and then waits for its database to be ready. The container is left running
+// when it is closed. Any free ports are allocated when the container is
+// started, so that reusers of the container use the same ports.
+func startReused(cfg Config) (*Container, error) {
+	hash := fmt.Sprintf("%x", md5.Sum([]byte(strings.Join(cfg.runArgs(), "\x00"))))
+	c := &Container{
+		name:    "copyist-reuse-" + hash[:12],
+		runtime: containerRuntime(cfg.Runtime),
+		cfg:     cfg,
+		reused:  true,
+	}
+
+	// Hold a lock while finding or starting the container, so that test
+	// packages running in parallel don't each start their own container.
+	unlock, err := lockReuse(c.name)
+	if err != nil {
+		return nil, err
+	}
+	err = findOrRunReused(c.runtime, c.name, hash, &cfg)
+	unlock()
+	if err != nil {
+		return nil, err
+	}
+	c.cfg = cfg
+
+	// Wait for the database outside of the lock, since it can take a while
+	// (e.g. if docker is downloading the image).
+	if err := waitForDB(&cfg, nil); err != nil {
+		logs, _ := c.Logs()
+		return nil, logsError(err, logs)
+	}
+	return c, nil
+}
+
+// findOrRunReused starts a container of the given name in the background,
+// unless one with the given configuration hash is already running. It resolves
+// the ports of the configuration to those published by the container.
+func findOrRunReused(runtime, name, hash string, cfg *Config) error {
+	out, err := runtimeCommand(
+		runtime, "ps", "-q", "--filter", "label="+reuseLabel+"="+hash).Output()
+	if err != nil {
+		return fmt.Errorf("could not list docker containers: %v", err)
+	}
+	if len(strings.TrimSpace(string(out))) != 0 {
+		return cfg.resolvePorts(publishedPort(runtime, name))
+	}
+
+	// Remove any stopped container of this name and start a new one.
+	runtimeCommand(runtime, "rm", name, "-f").Run()
+
+	if err := cfg.resolvePorts(freePort); err != nil {
+		return err
+	}
+	runCfg := *cfg
+	runCfg.Labels = map[string]string{reuseLabel: hash}
+	for name, value := range cfg.Labels {
+		runCfg.Labels[name] = value
+	}
+	args := append([]string{"run", "-d", "--name", name}, runCfg.runArgs()...)
+	if out, err := runtimeCommand(runtime, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%v\n%s", err, out)
+	}
+	return nil
+}
+
+// RemoveReusedContainers terminates and removes all containers that were
+// started with the WithReuse option, using the default container runtime.
+func RemoveReusedContainers() error {
+	runtime := containerRuntime("")
+	out, err := runtimeCommand(runtime, "ps", "-aq", "--filter", "label="+reuseLabel).Output()
+	if err != nil {
+		return fmt.Errorf("could not list docker containers: %v", err)
+	}
+	ids := strings.Fields(string(out))
+	if len(ids) == 0 {
+		return nil
+	}
+	args := append([]string{"rm", "-f"}, ids...)
+	if out, err := runtimeCommand(runtime, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%v\n%s", err, out)
+	}
+	return nil
+}
+
+// lockReuse acquires a lock, shared across processes, on the reused container
+// of the given name, by exclusively creating a lock file in the temporary
+// directory.
+func lockReuse(name string) (unlock func(), err error) {
+	lockName := filepath.Join(os.TempDir(), name+".lock")
+	for {
+		file, err := os.OpenFile(lockName, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0666)
+		if err == nil {
+			file.Close()
+			return func() { os.Remove(lockName) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+
+		// Break the lock if it was abandoned by a process that exited without
+		// unlocking it.
+		if info, err := os.Stat(lockName); err == nil {
+			if time.Since(info.ModTime()) > staleLockTimeout {
+				os.Remove(lockName)
+				continue
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package dockerdb
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// knownRuntimes is the list of docker-compatible container CLIs that are
+// searched for when no runtime is configured, in order of preference.
+var knownRuntimes = []string{"docker", "podman", "nerdctl"}
+
+// dockerSockets is the list of docker sockets, relative to the home directory,
+// that are exposed by VM-based runtimes like colima and lima. They are used if
+// the default docker socket does not exist.
+var dockerSockets = []string{
+	".colima/default/docker.sock",
+	".colima/docker.sock",
+	".lima/docker/sock/docker.sock",
+}
+
+// defaultDockerSocket is the socket used by the docker CLI if DOCKER_HOST is
+// not set.
+const defaultDockerSocket = "/var/run/docker.sock"
+
+// containerRuntime returns the name of the container CLI to run. If the given
+// runtime is empty, then the COPYIST_CONTAINER_RUNTIME environment variable is
+// used. If that is not set either, then the first known runtime that is
+// installed is used, falling back to "docker".
+func containerRuntime(runtime string) string {
+	if runtime != "" {
+		return runtime
+	}
+	if runtime := os.Getenv("COPYIST_CONTAINER_RUNTIME"); runtime != "" {
+		return runtime
+	}
+	for _, runtime := range knownRuntimes {
+		if _, err := exec.LookPath(runtime); err == nil {
+			return runtime
+		}
+	}
+	return "docker"
+}
+
+// runtimeCommand returns a command that runs the given container CLI with the
+// given arguments. If the docker CLI is run without a configured docker host,
+// and the default socket does not exist, then it is pointed at the socket of a
+// VM-based runtime like colima or lima, if one exists.
+func runtimeCommand(runtime string, args ...string) *exec.Cmd {
+	cmd := exec.Command(runtime, args...)
+	if filepath.Base(runtime) != "docker" || os.Getenv("DOCKER_HOST") != "" {
+		return cmd
+	}
+	if _, err := os.Stat(defaultDockerSocket); err == nil {
+		return cmd
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return cmd
+	}
+	for _, socket := range dockerSockets {
+		socket = filepath.Join(home, socket)
+		if _, err := os.Stat(socket); err == nil {
+			cmd.Env = append(os.Environ(), "DOCKER_HOST=unix://"+socket)
+			break
+		}
+	}
+	return cmd
+}
@@ -0,0 +1,209 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package dockerdb
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// certValidity is how long generated certificates are valid for.
+const certValidity = 24 * time.Hour
+
+// Certs is a set of self-signed TLS certificates, generated by GenerateCerts,
+// that allow a database to be run with TLS enabled. The certificate files are
+// named according to CockroachDB's conventions, so that the directory can be
+// mounted as its --certs-dir:
+//
+//	ca.crt, ca.key                the certificate authority
+//	node.crt, node.key            the database server
+//	client.<user>.crt, .key       the database client
+type Certs struct {
+	// Dir is the directory that contains the certificate files.
+	Dir string
+
+	// User is the name of the database user that the client certificate
+	// authenticates.
+	User string
+}
+
+// GenerateCerts generates a certificate authority, along with server and client
+// certificates signed by it, and writes them to the given directory. The server
+// certificate is valid for the given hosts (e.g. "localhost" or "127.0.0.1"),
+// or for localhost if none are given. The client certificate authenticates the
+// given database user.
+func GenerateCerts(dir, user string, hosts ...string) (*Certs, error) {
+	if len(hosts) == 0 {
+		hosts = []string{"localhost", "127.0.0.1"}
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	certs := &Certs{Dir: dir, User: user}
+
+	caTemplate := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "Copyist Test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	caCert, caKey, err := writeCert(certs.CACert(), filepath.Join(dir, "ca.key"), caTemplate, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// CockroachDB requires the node certificate to have the "node" common name,
+	// and to be usable for both server and client authentication.
+	nodeTemplate := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "node"},
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			nodeTemplate.IPAddresses = append(nodeTemplate.IPAddresses, ip)
+		} else {
+			nodeTemplate.DNSNames = append(nodeTemplate.DNSNames, host)
+		}
+	}
+	if _, _, err := writeCert(
+		certs.NodeCert(), certs.NodeKey(), nodeTemplate, caCert, caKey,
+	); err != nil {
+		return nil, err
+	}
+
+	clientTemplate := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: user},
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if _, _, err := writeCert(
+		certs.ClientCert(), certs.ClientKey(), clientTemplate, caCert, caKey,
+	); err != nil {
+		return nil, err
+	}
+	return certs, nil
+}
+
+// CACert returns the path of the certificate authority's certificate.
+func (c *Certs) CACert() string {
+	return filepath.Join(c.Dir, "ca.crt")
+}
+
+// NodeCert returns the path of the database server's certificate.
+func (c *Certs) NodeCert() string {
+	return filepath.Join(c.Dir, "node.crt")
+}
+
+// NodeKey returns the path of the database server's private key.
+func (c *Certs) NodeKey() string {
+	return filepath.Join(c.Dir, "node.key")
+}
+
+// ClientCert returns the path of the database client's certificate.
+func (c *Certs) ClientCert() string {
+	return filepath.Join(c.Dir, "client."+c.User+".crt")
+}
+
+// ClientKey returns the path of the database client's private key.
+func (c *Certs) ClientKey() string {
+	return filepath.Join(c.Dir, "client."+c.User+".key")
+}
+
+// PostgresDataSourceName returns the given Postgres URL, modified to connect
+// using TLS, verifying the server certificate and authenticating with the
+// client certificate. For example:
+//
+//	postgresql://root@localhost:26257?sslmode=verify-full&sslrootcert=...
+func (c *Certs) PostgresDataSourceName(dataSourceName string) (string, error) {
+	u, err := url.Parse(dataSourceName)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	query.Set("sslmode", "verify-full")
+	query.Set("sslrootcert", c.CACert())
+	query.Set("sslcert", c.ClientCert())
+	query.Set("sslkey", c.ClientKey())
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// WithCerts mounts the directory containing the given certificates at the
+// given path in the container, so that the database can be started with TLS
+// enabled.
+func WithCerts(certs *Certs, containerDir string) Option {
+	return WithVolume(certs.Dir, containerDir, true)
+}
+
+// writeCert generates a private key and a certificate from the given template,
+// signed by the given parent certificate and key (or self-signed if they are
+// nil), and writes them in PEM format to the given paths.
+func writeCert(
+	certPath, keyPath string, template, parent *x509.Certificate, parentKey crypto.Signer,
+) (*x509.Certificate, crypto.Signer, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(certValidity)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Database clients and servers refuse to use private keys that are
+	// readable by other users.
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := os.WriteFile(certPath, certPEM, 0644); err != nil {
+		return nil, nil, err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		return nil, nil, fmt.Errorf("could not write private key: %v", err)
+	}
+	return cert, key, nil
+}
@@ -0,0 +1,73 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package dockerdb
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestGenerateCerts tests that generated server and client certificates are
+// signed by the generated certificate authority.
+func TestGenerateCerts(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "certs")
+	certs, err := GenerateCerts(dir, "root")
+	require.NoError(t, err)
+
+	caPEM, err := os.ReadFile(certs.CACert())
+	require.NoError(t, err)
+	roots := x509.NewCertPool()
+	require.True(t, roots.AppendCertsFromPEM(caPEM))
+
+	verify := func(certPath, keyPath, host string, usage x509.ExtKeyUsage) *x509.Certificate {
+		pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+		require.NoError(t, err)
+		cert, err := x509.ParseCertificate(pair.Certificate[0])
+		require.NoError(t, err)
+		_, err = cert.Verify(x509.VerifyOptions{
+			DNSName: host, Roots: roots, KeyUsages: []x509.ExtKeyUsage{usage},
+		})
+		require.NoError(t, err)
+		return cert
+	}
+	node := verify(certs.NodeCert(), certs.NodeKey(), "localhost", x509.ExtKeyUsageServerAuth)
+	require.Equal(t, "node", node.Subject.CommonName)
+	client := verify(certs.ClientCert(), certs.ClientKey(), "", x509.ExtKeyUsageClientAuth)
+	require.Equal(t, "root", client.Subject.CommonName)
+
+	info, err := os.Stat(certs.ClientKey())
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	dsn, err := certs.PostgresDataSourceName("postgresql://root@localhost:26257?sslmode=disable")
+	require.NoError(t, err)
+	require.Equal(t, "postgresql://root@localhost:26257?"+
+		"sslcert="+filepath.Join(dir, "client.root.crt")+
+		"&sslkey="+filepath.Join(dir, "client.root.key")+
+		"&sslmode=verify-full"+
+		"&sslrootcert="+filepath.Join(dir, "ca.crt"), unescape(t, dsn))
+}
+
+func unescape(t *testing.T, s string) string {
+	s, err := url.QueryUnescape(s)
+	require.NoError(t, err)
+	return s
+}
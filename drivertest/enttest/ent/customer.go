@@ -0,0 +1,125 @@
+// Code generated by entc, DO NOT EDIT.
+
+package ent
+
+import (
+	"fmt"
+	"strings"
+
+	"entgo.io/ent/dialect/sql"
+	"github.com/cockroachdb/copyist/drivertest/enttest/ent/customer"
+)
+
+// Customer is the model entity for the Customer schema.
+type Customer struct {
+	config `json:"-"`
+	// ID of the ent.
+	ID int `json:"id,omitempty"`
+	// Name holds the value of the "name" field.
+	Name string `json:"name,omitempty"`
+	// Edges holds the relations/edges for other nodes in the graph.
+	// The values are being populated by the CustomerQuery when eager-loading is set.
+	Edges CustomerEdges `json:"edges"`
+}
+
+// CustomerEdges holds the relations/edges for other nodes in the graph.
+type CustomerEdges struct {
+	// Orders holds the value of the orders edge.
+	Orders []*Order `json:"orders,omitempty"`
+	// loadedTypes holds the information for reporting if a
+	// type was loaded (or requested) in eager-loading or not.
+	loadedTypes [1]bool
+}
+
+// OrdersOrErr returns the Orders value or an error if the edge
+// was not loaded in eager-loading.
+func (e CustomerEdges) OrdersOrErr() ([]*Order, error) {
+	if e.loadedTypes[0] {
+		return e.Orders, nil
+	}
+	return nil, &NotLoadedError{edge: "orders"}
+}
+
+// scanValues returns the types for scanning values from sql.Rows.
+func (*Customer) scanValues(columns []string) ([]interface{}, error) {
+	values := make([]interface{}, len(columns))
+	for i := range columns {
+		switch columns[i] {
+		case customer.FieldID:
+			values[i] = new(sql.NullInt64)
+		case customer.FieldName:
+			values[i] = new(sql.NullString)
+		default:
+			return nil, fmt.Errorf("unexpected column %q for type Customer", columns[i])
+		}
+	}
+	return values, nil
+}
+
+// assignValues assigns the values that were returned from sql.Rows (after scanning)
+// to the Customer fields.
+func (c *Customer) assignValues(columns []string, values []interface{}) error {
+	if m, n := len(values), len(columns); m < n {
+		return fmt.Errorf("mismatch number of scan values: %d != %d", m, n)
+	}
+	for i := range columns {
+		switch columns[i] {
+		case customer.FieldID:
+			value, ok := values[i].(*sql.NullInt64)
+			if !ok {
+				return fmt.Errorf("unexpected type %T for field id", value)
+			}
+			c.ID = int(value.Int64)
+		case customer.FieldName:
+			if value, ok := values[i].(*sql.NullString); !ok {
+				return fmt.Errorf("unexpected type %T for field name", values[i])
+			} else if value.Valid {
+				c.Name = value.String
+			}
+		}
+	}
+	return nil
+}
+
+// QueryOrders queries the "orders" edge of the Customer entity.
+func (c *Customer) QueryOrders() *OrderQuery {
+	return (&CustomerClient{config: c.config}).QueryOrders(c)
+}
+
+// Update returns a builder for updating this Customer.
+// Note that you need to call Customer.Unwrap() before calling this method if this Customer
+// was returned from a transaction, and the transaction was committed or rolled back.
+func (c *Customer) Update() *CustomerUpdateOne {
+	return (&CustomerClient{config: c.config}).UpdateOne(c)
+}
+
+// Unwrap unwraps the Customer entity that was returned from a transaction after it was closed,
+// so that all future queries will be executed through the driver which created the transaction.
+func (c *Customer) Unwrap() *Customer {
+	tx, ok := c.config.driver.(*txDriver)
+	if !ok {
+		panic("ent: Customer is not a transactional entity")
+	}
+	c.config.driver = tx.drv
+	return c
+}
+
+// String implements the fmt.Stringer.
+func (c *Customer) String() string {
+	var builder strings.Builder
+	builder.WriteString("Customer(")
+	builder.WriteString(fmt.Sprintf("id=%v", c.ID))
+	builder.WriteString(", name=")
+	builder.WriteString(c.Name)
+	builder.WriteByte(')')
+	return builder.String()
+}
+
+// Customers is a parsable slice of Customer.
+type Customers []*Customer
+
+func (c Customers) config(cfg config) {
+	for _i := range c {
+		c[_i].config = cfg
+	}
+}
@@ -0,0 +1,129 @@
+// Code generated by entc, DO NOT EDIT.
+
+package ent
+
+import (
+	"fmt"
+	"strings"
+
+	"entgo.io/ent/dialect/sql"
+	"github.com/cockroachdb/copyist/drivertest/enttest/ent/customer"
+	"github.com/cockroachdb/copyist/drivertest/enttest/ent/order"
+)
+
+// Order is the model entity for the Order schema.
+type Order struct {
+	config `json:"-"`
+	// ID of the ent.
+	ID int `json:"id,omitempty"`
+	// CustomerID holds the value of the "customer_id" field.
+	CustomerID int `json:"customer_id,omitempty"`
+	// Edges holds the relations/edges for other nodes in the graph.
+	// The values are being populated by the OrderQuery when eager-loading is set.
+	Edges OrderEdges `json:"edges"`
+}
+
+// OrderEdges holds the relations/edges for other nodes in the graph.
+type OrderEdges struct {
+	// Customer holds the value of the customer edge.
+	Customer *Customer `json:"customer,omitempty"`
+	// loadedTypes holds the information for reporting if a
+	// type was loaded (or requested) in eager-loading or not.
+	loadedTypes [1]bool
+}
+
+// CustomerOrErr returns the Customer value or an error if the edge
+// was not loaded in eager-loading, or loaded but was not found.
+func (e OrderEdges) CustomerOrErr() (*Customer, error) {
+	if e.loadedTypes[0] {
+		if e.Customer == nil {
+			// The edge customer was loaded in eager-loading,
+			// but was not found.
+			return nil, &NotFoundError{label: customer.Label}
+		}
+		return e.Customer, nil
+	}
+	return nil, &NotLoadedError{edge: "customer"}
+}
+
+// scanValues returns the types for scanning values from sql.Rows.
+func (*Order) scanValues(columns []string) ([]interface{}, error) {
+	values := make([]interface{}, len(columns))
+	for i := range columns {
+		switch columns[i] {
+		case order.FieldID, order.FieldCustomerID:
+			values[i] = new(sql.NullInt64)
+		default:
+			return nil, fmt.Errorf("unexpected column %q for type Order", columns[i])
+		}
+	}
+	return values, nil
+}
+
+// assignValues assigns the values that were returned from sql.Rows (after scanning)
+// to the Order fields.
+func (o *Order) assignValues(columns []string, values []interface{}) error {
+	if m, n := len(values), len(columns); m < n {
+		return fmt.Errorf("mismatch number of scan values: %d != %d", m, n)
+	}
+	for i := range columns {
+		switch columns[i] {
+		case order.FieldID:
+			value, ok := values[i].(*sql.NullInt64)
+			if !ok {
+				return fmt.Errorf("unexpected type %T for field id", value)
+			}
+			o.ID = int(value.Int64)
+		case order.FieldCustomerID:
+			if value, ok := values[i].(*sql.NullInt64); !ok {
+				return fmt.Errorf("unexpected type %T for field customer_id", values[i])
+			} else if value.Valid {
+				o.CustomerID = int(value.Int64)
+			}
+		}
+	}
+	return nil
+}
+
+// QueryCustomer queries the "customer" edge of the Order entity.
+func (o *Order) QueryCustomer() *CustomerQuery {
+	return (&OrderClient{config: o.config}).QueryCustomer(o)
+}
+
+// Update returns a builder for updating this Order.
+// Note that you need to call Order.Unwrap() before calling this method if this Order
+// was returned from a transaction, and the transaction was committed or rolled back.
+func (o *Order) Update() *OrderUpdateOne {
+	return (&OrderClient{config: o.config}).UpdateOne(o)
+}
+
+// Unwrap unwraps the Order entity that was returned from a transaction after it was closed,
+// so that all future queries will be executed through the driver which created the transaction.
+func (o *Order) Unwrap() *Order {
+	tx, ok := o.config.driver.(*txDriver)
+	if !ok {
+		panic("ent: Order is not a transactional entity")
+	}
+	o.config.driver = tx.drv
+	return o
+}
+
+// String implements the fmt.Stringer.
+func (o *Order) String() string {
+	var builder strings.Builder
+	builder.WriteString("Order(")
+	builder.WriteString(fmt.Sprintf("id=%v", o.ID))
+	builder.WriteString(", customer_id=")
+	builder.WriteString(fmt.Sprintf("%v", o.CustomerID))
+	builder.WriteByte(')')
+	return builder.String()
+}
+
+// Orders is a parsable slice of Order.
+type Orders []*Order
+
+func (o Orders) config(cfg config) {
+	for _i := range o {
+		o[_i].config = cfg
+	}
+}
@@ -0,0 +1,39 @@
+// Code generated by entc, DO NOT EDIT.
+
+package order
+
+const (
+	// Label holds the string label denoting the order type in the database.
+	Label = "order"
+	// FieldID holds the string denoting the id field in the database.
+	FieldID = "id"
+	// FieldCustomerID holds the string denoting the customer_id field in the database.
+	FieldCustomerID = "customer_id"
+	// EdgeCustomer holds the string denoting the customer edge name in mutations.
+	EdgeCustomer = "customer"
+	// Table holds the table name of the order in the database.
+	Table = "orders"
+	// CustomerTable is the table that holds the customer relation/edge.
+	CustomerTable = "orders"
+	// CustomerInverseTable is the table name for the Customer entity.
+	// It exists in this package in order to avoid circular dependency with the "customer" package.
+	CustomerInverseTable = "customers"
+	// CustomerColumn is the table column denoting the customer relation/edge.
+	CustomerColumn = "customer_id"
+)
+
+// Columns holds all SQL columns for order fields.
+var Columns = []string{
+	FieldID,
+	FieldCustomerID,
+}
+
+// ValidColumn reports if the column name is valid (part of the table columns).
+func ValidColumn(column string) bool {
+	for i := range Columns {
+		if column == Columns[i] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,13 @@
+// Code generated by entc, DO NOT EDIT.
+
+package predicate
+
+import (
+	"entgo.io/ent/dialect/sql"
+)
+
+// Customer is the predicate function for customer builders.
+type Customer func(*sql.Selector)
+
+// Order is the predicate function for order builders.
+type Order func(*sql.Selector)
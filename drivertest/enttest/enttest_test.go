@@ -0,0 +1,135 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// enttest tests the query patterns of ent's generated code, using an ent client
+// whose driver is opened by copyistent. It has its own go.mod file so that the
+// copyist package does not depend on ent. The client is generated from the
+// schema in the ent/schema directory, by running "go generate ./ent".
+
+package enttest
+
+import (
+	"context"
+	"testing"
+
+	entsql "entgo.io/ent/dialect/sql"
+	"github.com/cockroachdb/copyist"
+	"github.com/cockroachdb/copyist/copyistent"
+	"github.com/cockroachdb/copyist/drivertest/commontest"
+	"github.com/cockroachdb/copyist/drivertest/enttest/ent"
+	"github.com/cockroachdb/copyist/drivertest/enttest/ent/customer"
+	"github.com/cockroachdb/copyist/drivertest/enttest/ent/order"
+	"github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/require"
+)
+
+// TestMain runs all ent tests. To use:
+//
+//   1. Run the tests with the "-record" command-line flag. This will run the
+//      tests against the real SQLite driver and create recording files in the
+//      testdata directory. This tests generation of recordings.
+//   2. Run the test without the "-record" flag. This will run the tests against
+//      the copyist driver that plays back the recordings created by step #1.
+//      This tests playback of recording.
+//
+// The tests use SQLite, which runs in-process, so no docker container is
+// needed in order to record.
+func TestMain(m *testing.M) {
+	// The in-memory database is destroyed once its last connection is closed,
+	// so keep a connection open until the tests are complete.
+	if _, err := (&sqlite3.SQLiteDriver{}).Open(commontest.SQLiteDataSourceName); err != nil {
+		panic(err)
+	}
+
+	commontest.RunAllTestsWithReset(m, commontest.SQLiteConfig("sqlite3"), commontest.SQLiteResetScript)
+}
+
+// TestEagerLoading loads customers along with their orders, using the WithOrders
+// method of the generated client. ent eagerly loads the orders of all of the
+// customers at once, once the customers have been queried.
+func TestEagerLoading(t *testing.T) {
+	defer copyist.Open(t).Close()
+
+	drv, err := copyistent.Open("sqlite3", commontest.SQLiteDataSourceName)
+	require.NoError(t, err)
+	client := ent.NewClient(ent.Driver(drv))
+	defer client.Close()
+
+	ctx := context.Background()
+	createOrders(t, drv)
+
+	customers, err := client.Customer.Query().
+		Where(customer.IDLT(3)).
+		WithOrders(func(q *ent.OrderQuery) {
+			q.Order(ent.Asc(order.FieldID))
+		}).
+		Order(ent.Asc(customer.FieldID)).
+		All(ctx)
+	require.NoError(t, err)
+
+	orders := make(map[string][]int)
+	for _, cust := range customers {
+		for _, ord := range cust.Edges.Orders {
+			orders[cust.Name] = append(orders[cust.Name], ord.ID)
+		}
+	}
+	require.Equal(t, map[string][]int{"Andy": {1, 2}, "Jay": {3}}, orders)
+}
+
+// TestUpsert inserts customers within a transaction, updating the names of
+// customers that already exist, using the upsert methods of the generated
+// client.
+func TestUpsert(t *testing.T) {
+	defer copyist.Open(t).Close()
+
+	drv, err := copyistent.Open("sqlite3", commontest.SQLiteDataSourceName)
+	require.NoError(t, err)
+	client := ent.NewClient(ent.Driver(drv))
+	defer client.Close()
+
+	ctx := context.Background()
+	tx, err := client.Tx(ctx)
+	require.NoError(t, err)
+
+	err = tx.Customer.CreateBulk(
+		tx.Customer.Create().SetID(1).SetName("Andrew"),
+		tx.Customer.Create().SetID(4).SetName("Rebecca"),
+	).
+		OnConflictColumns(customer.FieldID).
+		UpdateNewValues().
+		Exec(ctx)
+	require.NoError(t, err)
+	require.NoError(t, tx.Commit())
+
+	names, err := client.Customer.Query().
+		Where(customer.IDIn(1, 4)).
+		Order(ent.Asc(customer.FieldID)).
+		Select(customer.FieldName).
+		Strings(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []string{"Andrew", "Rebecca"}, names)
+}
+
+// createOrders creates an orders table that references the customers table
+// created by the reset script, and inserts some orders into it.
+func createOrders(t *testing.T, drv *entsql.Driver) {
+	ctx := context.Background()
+	for _, query := range []string{
+		"DROP TABLE IF EXISTS orders",
+		"CREATE TABLE orders (id INTEGER PRIMARY KEY, customer_id INTEGER REFERENCES customers (id))",
+		"INSERT INTO orders VALUES (1, 1), (2, 1), (3, 2), (4, 3)",
+	} {
+		require.NoError(t, drv.Exec(ctx, query, []interface{}{}, nil))
+	}
+}
@@ -21,6 +21,8 @@ import (
 	"github.com/stretchr/testify/require"
 	"testing"
 
+	_ "github.com/cockroachdb/copyist/copyistpgx"
+	_ "github.com/cockroachdb/copyist/copyistpq"
 	"github.com/cockroachdb/copyist/drivertest/commontest"
 
 	_ "github.com/jackc/pgx/v4/stdlib"
@@ -32,7 +34,7 @@ import (
 func TestMain(m *testing.M) {
 	// Register PGX driver and then have RunAllTests register the PQ driver.
 	copyist.Register("pgx")
-	commontest.RunAllTests(m, "postgres", commontest.PostgresDataSourceName, commontest.PostgresDockerArgs)
+	commontest.RunAllTests(m, commontest.PostgresConfig("postgres"))
 }
 
 // TestMultipleDrivers uses two different drivers in same test, with interleaved
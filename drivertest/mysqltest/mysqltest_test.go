@@ -0,0 +1,148 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mysqltest
+
+import (
+	"database/sql"
+	"math"
+	"testing"
+
+	"github.com/cockroachdb/copyist"
+	"github.com/cockroachdb/copyist/drivertest/commontest"
+	"github.com/fortytw2/leaktest"
+	"github.com/stretchr/testify/require"
+
+	_ "github.com/go-sql-driver/mysql"
+)
+
+// TestMain runs all MySQL driver-specific tests. To use:
+//
+//   1. Run the tests with the "-record" command-line flag. This will run the
+//      tests against the real MySQL driver and create recording files in the
+//      testdata directory. This tests generation of recordings.
+//   2. Run the test without the "-record" flag. This will run the tests against
+//      the copyist driver that plays back the recordings created by step #1.
+//      This tests playback of recording.
+//
+func TestMain(m *testing.M) {
+	commontest.RunAllTestsWithReset(m, commontest.MySQLConfig("mysql"), commontest.MySQLResetScript)
+}
+
+// TestQuery fetches a single customer, using a query with an argument. The
+// MySQL driver does not interpolate arguments by default, so the query is
+// prepared and executed using the binary protocol.
+func TestQuery(t *testing.T) {
+	defer leaktest.Check(t)()
+	defer copyist.Open(t).Close()
+
+	db, err := sql.Open("copyist_mysql", commontest.MySQLDataSourceName)
+	require.NoError(t, err)
+	defer db.Close()
+
+	var id int
+	var name string
+	err = db.QueryRow("SELECT id, name FROM customers WHERE id=?", 1).Scan(&id, &name)
+	require.NoError(t, err)
+	require.Equal(t, 1, id)
+	require.Equal(t, "Andy", name)
+}
+
+// TestLastInsertId inserts rows into a table with an AUTO_INCREMENT column,
+// and checks the ID of the first inserted row.
+func TestLastInsertId(t *testing.T) {
+	defer leaktest.Check(t)()
+	defer copyist.Open(t).Close()
+
+	db, err := sql.Open("copyist_mysql", commontest.MySQLDataSourceName)
+	require.NoError(t, err)
+	defer db.Close()
+
+	_, err = db.Exec(`
+		DROP TABLE IF EXISTS orders;
+		CREATE TABLE orders (id INT AUTO_INCREMENT PRIMARY KEY, item TEXT);
+	`)
+	require.NoError(t, err)
+
+	res, err := db.Exec("INSERT INTO orders (item) VALUES ('apple'), ('pear')")
+	require.NoError(t, err)
+
+	id, err := res.LastInsertId()
+	require.NoError(t, err)
+	require.Equal(t, int64(1), id)
+
+	affected, err := res.RowsAffected()
+	require.NoError(t, err)
+	require.Equal(t, int64(2), affected)
+}
+
+// TestUnsigned passes an unsigned 64-bit integer having its high bit set, which
+// the MySQL driver supports, but the database/sql default converter does not.
+func TestUnsigned(t *testing.T) {
+	defer leaktest.Check(t)()
+	defer copyist.Open(t).Close()
+
+	db, err := sql.Open("copyist_mysql", commontest.MySQLDataSourceName)
+	require.NoError(t, err)
+	defer db.Close()
+
+	var val uint64
+	err = db.QueryRow("SELECT CAST(? AS UNSIGNED)", uint64(math.MaxUint64)).Scan(&val)
+	require.NoError(t, err)
+	require.Equal(t, uint64(math.MaxUint64), val)
+}
+
+// TestMultipleResultSets runs multiple SELECT statements in a single Query
+// operation, and iterates over each of their result sets.
+func TestMultipleResultSets(t *testing.T) {
+	defer leaktest.Check(t)()
+	defer copyist.Open(t).Close()
+
+	db, err := sql.Open("copyist_mysql", commontest.MySQLDataSourceName)
+	require.NoError(t, err)
+	defer db.Close()
+
+	rows, err := db.Query("SELECT name FROM customers WHERE id=1; SELECT COUNT(*) FROM customers")
+	require.NoError(t, err)
+	defer rows.Close()
+
+	var name string
+	require.True(t, rows.Next())
+	require.NoError(t, rows.Scan(&name))
+	require.Equal(t, "Andy", name)
+	require.False(t, rows.Next())
+
+	require.True(t, rows.NextResultSet())
+	var count int
+	require.True(t, rows.Next())
+	require.NoError(t, rows.Scan(&count))
+	require.Equal(t, 3, count)
+	require.False(t, rows.Next())
+
+	require.False(t, rows.NextResultSet())
+	require.NoError(t, rows.Err())
+}
+
+// TestMySQLError ensures that MySQL errors are recorded and played back.
+func TestMySQLError(t *testing.T) {
+	defer leaktest.Check(t)()
+	defer copyist.Open(t).Close()
+
+	db, err := sql.Open("copyist_mysql", commontest.MySQLDataSourceName)
+	require.NoError(t, err)
+	defer db.Close()
+
+	_, err = db.Exec("SELECT * FROM missing")
+	require.EqualError(t, err, "Error 1146: Table 'copyist.missing' doesn't exist")
+}
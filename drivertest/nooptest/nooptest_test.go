@@ -0,0 +1,86 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+//go:build copyist_noop
+// +build copyist_noop
+
+// nooptest tests copyist when it is built with the "copyist_noop" build tag,
+// in which case it never records or plays back calls. Run it with:
+//
+//	go test -tags copyist_noop ./drivertest/nooptest
+package nooptest
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"flag"
+	"testing"
+
+	"github.com/cockroachdb/copyist"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeDriver is a fake driver whose connections execute statements without
+// doing anything.
+type fakeDriver struct {
+	opened []string
+}
+
+func (d *fakeDriver) Open(name string) (driver.Conn, error) {
+	d.opened = append(d.opened, name)
+	return &fakeConn{}, nil
+}
+
+type fakeConn struct {
+	driver.Conn
+}
+
+func (c *fakeConn) ExecContext(
+	ctx context.Context, query string, args []driver.NamedValue,
+) (driver.Result, error) {
+	return driver.RowsAffected(1), nil
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+// TestNoop tests that copyist is a passthrough no-op.
+func TestNoop(t *testing.T) {
+	fake := &fakeDriver{}
+	sql.Register("fake", fake)
+	copyist.Register("fake")
+
+	// The "record" flag is not defined, and copyist never records.
+	require.Nil(t, flag.Lookup("record"))
+	require.False(t, copyist.IsRecording())
+
+	// Sessions do nothing, and connections are opened by the wrapped driver,
+	// even when no session is open.
+	require.NoError(t, copyist.Open(t).Close())
+	db, err := sql.Open("copyist_fake", "some dsn")
+	require.NoError(t, err)
+	defer db.Close()
+	res, err := db.Exec("DELETE FROM customers")
+	require.NoError(t, err)
+	affected, err := res.RowsAffected()
+	require.NoError(t, err)
+	require.Equal(t, int64(1), affected)
+	require.Contains(t, fake.opened, "some dsn")
+
+	s := copyist.OpenParallel(t, copyist.NewMemorySource(nil), "TestNoop")
+	require.Equal(t, "some dsn", s.DataSourceName("some dsn"))
+	require.NoError(t, s.Close())
+}
@@ -22,6 +22,7 @@ import (
 	"github.com/stretchr/testify/require"
 	"testing"
 
+	_ "github.com/cockroachdb/copyist/copyistpgx"
 	"github.com/cockroachdb/copyist/drivertest/commontest"
 	_ "github.com/jackc/pgx/v4/stdlib"
 )
@@ -36,7 +37,7 @@ import (
 //      This tests playback of recording.
 //
 func TestMain(m *testing.M) {
-	commontest.RunAllTests(m, "pgx", commontest.PostgresDataSourceName, commontest.PostgresDockerArgs)
+	commontest.RunAllTests(m, commontest.PostgresConfig("pgx"))
 }
 
 // TestQuery fetches a single customer.
@@ -21,6 +21,7 @@ import (
 	"github.com/lib/pq"
 
 	"github.com/cockroachdb/copyist"
+	_ "github.com/cockroachdb/copyist/copyistpq"
 	"github.com/cockroachdb/copyist/drivertest/commontest"
 	"github.com/fortytw2/leaktest"
 	"github.com/stretchr/testify/require"
@@ -38,7 +39,7 @@ import (
 //      This tests playback of recording.
 //
 func TestMain(m *testing.M) {
-	commontest.RunAllTests(m, "postgres", commontest.PostgresDataSourceName, commontest.PostgresDockerArgs)
+	commontest.RunAllTests(m, commontest.PostgresConfig("postgres"))
 }
 
 // TestQuery fetches a single customer.
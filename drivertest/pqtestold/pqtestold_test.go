@@ -21,6 +21,7 @@ package pqtestold
 import (
 	"testing"
 
+	_ "github.com/cockroachdb/copyist/copyistpq"
 	"github.com/cockroachdb/copyist/drivertest/commontest"
 	_ "github.com/lib/pq"
 )
@@ -35,7 +36,7 @@ import (
 //      This tests playback of recording.
 //
 func TestMain(m *testing.M) {
-	commontest.RunAllTests(m, "postgres", commontest.PostgresDataSourceName, commontest.PostgresDockerArgs)
+	commontest.RunAllTests(m, commontest.PostgresConfig("postgres"))
 }
 
 // TestQuery fetches a single customer.
@@ -0,0 +1,215 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package sqlitetest
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/copyist"
+	"github.com/cockroachdb/copyist/drivertest/commontest"
+	"github.com/cockroachdb/copyist/suiteutil"
+	"github.com/fortytw2/leaktest"
+	"github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+// TestMain runs all SQLite driver-specific tests. To use:
+//
+//   1. Run the tests with the "-record" command-line flag. This will run the
+//      tests against the real SQLite driver and create recording files in the
+//      testdata directory. This tests generation of recordings.
+//   2. Run the test without the "-record" flag. This will run the tests against
+//      the copyist driver that plays back the recordings created by step #1.
+//      This tests playback of recording.
+//
+// SQLite runs in-process, so unlike other driver tests, no docker container is
+// needed in order to record.
+func TestMain(m *testing.M) {
+	// The in-memory database is destroyed once its last connection is closed,
+	// so keep a connection open until the tests are complete. Open it using
+	// the driver directly, since a sql.DB starts a goroutine that leaktest
+	// would report.
+	if _, err := (&sqlite3.SQLiteDriver{}).Open(commontest.SQLiteDataSourceName); err != nil {
+		panic(err)
+	}
+
+	commontest.RunAllTestsWithReset(m, commontest.SQLiteConfig("sqlite3"), commontest.SQLiteResetScript)
+}
+
+// TestQuery fetches a single customer.
+func TestQuery(t *testing.T) {
+	defer leaktest.Check(t)()
+	defer copyist.Open(t).Close()
+
+	db, err := sql.Open("copyist_sqlite3", commontest.SQLiteDataSourceName)
+	require.NoError(t, err)
+	defer db.Close()
+
+	var id int
+	var name string
+	err = db.QueryRow("SELECT id, name FROM customers WHERE id=?", 1).Scan(&id, &name)
+	require.NoError(t, err)
+	require.Equal(t, 1, id)
+	require.Equal(t, "Andy", name)
+}
+
+// TestDataTypes queries the data types that the SQLite driver returns. SQLite
+// stores all integers as int64, and returns text as string, unless the column
+// is declared as a date or time type.
+func TestDataTypes(t *testing.T) {
+	defer leaktest.Check(t)()
+	defer copyist.Open(t).Close()
+
+	db, err := sql.Open("copyist_sqlite3", commontest.SQLiteDataSourceName)
+	require.NoError(t, err)
+	defer db.Close()
+
+	_, err = db.Exec(`
+		CREATE TABLE datatypes
+		(i INTEGER, r REAL, s TEXT, by BLOB, b BOOLEAN, t TIMESTAMP, n NUMERIC)
+	`)
+	require.NoError(t, err)
+
+	_, err = db.Exec(`
+		INSERT INTO datatypes VALUES
+			(1, 1.1, 'foo' || CHAR(9) || CHAR(10) || ' ,]', X'41424344', TRUE,
+			 '2000-01-01 10:00:00', 100.5),
+			(-1, -1e10, '', X'', FALSE,
+			 '2000-02-02T11:11:11-08:00', NULL)
+	`)
+	require.NoError(t, err)
+
+	rows, err := db.Query("SELECT i, r, s, by, b, t, n FROM datatypes ORDER BY i DESC")
+	require.NoError(t, err)
+	defer rows.Close()
+
+	var (
+		i  int64
+		r  float64
+		s  string
+		by []byte
+		b  bool
+		tm time.Time
+		n  sql.NullFloat64
+	)
+	require.True(t, rows.Next())
+	require.NoError(t, rows.Scan(&i, &r, &s, &by, &b, &tm, &n))
+	require.Equal(t, int64(1), i)
+	require.Equal(t, 1.1, r)
+	require.Equal(t, "foo\t\n ,]", s)
+	require.Equal(t, []byte("ABCD"), by)
+	require.True(t, b)
+	require.Equal(t, time.Date(2000, 1, 1, 10, 0, 0, 0, time.UTC), tm.UTC())
+	require.Equal(t, sql.NullFloat64{Float64: 100.5, Valid: true}, n)
+
+	require.True(t, rows.Next())
+	require.NoError(t, rows.Scan(&i, &r, &s, &by, &b, &tm, &n))
+	require.Equal(t, int64(-1), i)
+	require.Equal(t, -1e10, r)
+	require.Equal(t, "", s)
+	require.Empty(t, by)
+	require.False(t, b)
+	require.Equal(t, time.Date(2000, 2, 2, 19, 11, 11, 0, time.UTC), tm.UTC())
+	require.False(t, n.Valid)
+
+	require.False(t, rows.Next())
+	require.NoError(t, rows.Err())
+}
+
+// TestLastInsertId inserts a row into a table with an INTEGER PRIMARY KEY
+// column, which SQLite automatically assigns.
+func TestLastInsertId(t *testing.T) {
+	defer leaktest.Check(t)()
+	defer copyist.Open(t).Close()
+
+	db, err := sql.Open("copyist_sqlite3", commontest.SQLiteDataSourceName)
+	require.NoError(t, err)
+	defer db.Close()
+
+	res, err := db.Exec("INSERT INTO customers (name) VALUES (?)", "Sam")
+	require.NoError(t, err)
+
+	id, err := res.LastInsertId()
+	require.NoError(t, err)
+	require.Equal(t, int64(4), id)
+
+	affected, err := res.RowsAffected()
+	require.NoError(t, err)
+	require.Equal(t, int64(1), affected)
+}
+
+// TestTxns commits and aborts transactions.
+func TestTxns(t *testing.T) {
+	defer leaktest.Check(t)()
+	defer copyist.Open(t).Close()
+
+	db, err := sql.Open("copyist_sqlite3", commontest.SQLiteDataSourceName)
+	require.NoError(t, err)
+	defer db.Close()
+
+	tx, err := db.Begin()
+	require.NoError(t, err)
+	_, err = tx.Exec("INSERT INTO customers VALUES (?, ?)", 100, "Kenny")
+	require.NoError(t, err)
+	require.NoError(t, tx.Rollback())
+
+	tx, err = db.Begin()
+	require.NoError(t, err)
+	_, err = tx.Exec("INSERT INTO customers VALUES (?, ?)", 101, "Sally")
+	require.NoError(t, err)
+	require.NoError(t, tx.Commit())
+
+	var count int
+	require.NoError(t, db.QueryRow("SELECT COUNT(*) FROM customers").Scan(&count))
+	require.Equal(t, 4, count)
+}
+
+// TestSQLiteError ensures that SQLite errors are recorded and played back.
+func TestSQLiteError(t *testing.T) {
+	defer leaktest.Check(t)()
+	defer copyist.Open(t).Close()
+
+	db, err := sql.Open("copyist_sqlite3", commontest.SQLiteDataSourceName)
+	require.NoError(t, err)
+	defer db.Close()
+
+	_, err = db.Exec("SELECT * FROM missing")
+	require.EqualError(t, err, "no such table: missing")
+}
+
+// querySuite is a testify suite whose tests are recorded by copyist.
+type querySuite struct {
+	suiteutil.Suite
+}
+
+// TestQuery fetches a single customer.
+func (s *querySuite) TestQuery() {
+	var name string
+	s.Require().NoError(
+		s.DB.QueryRow("SELECT name FROM customers WHERE id=?", 1).Scan(&name))
+	s.Require().Equal("Andy", name)
+}
+
+// TestSuite tests that the tests of a testify suite are recorded and played
+// back using suiteutil.
+func TestSuite(t *testing.T) {
+	suite.Run(t, &querySuite{Suite: suiteutil.Suite{
+		DriverName:     "sqlite3",
+		DataSourceName: commontest.SQLiteDataSourceName,
+	}})
+}
@@ -0,0 +1,101 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package sqlservertest
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+
+	"github.com/cockroachdb/copyist"
+	_ "github.com/cockroachdb/copyist/copyistmssql"
+	"github.com/cockroachdb/copyist/drivertest/commontest"
+	mssql "github.com/denisenkom/go-mssqldb"
+	"github.com/fortytw2/leaktest"
+	"github.com/stretchr/testify/require"
+)
+
+// TestMain runs all SQL Server driver-specific tests. To use:
+//
+//   1. Run the tests with the "-record" command-line flag. This will run the
+//      tests against the real SQL Server driver and create recording files in
+//      the testdata directory. This tests generation of recordings.
+//   2. Run the test without the "-record" flag. This will run the tests against
+//      the copyist driver that plays back the recordings created by step #1.
+//      This tests playback of recording.
+//
+func TestMain(m *testing.M) {
+	commontest.RunAllTestsWithReset(
+		m, commontest.SQLServerConfig("sqlserver"), commontest.SQLServerResetScript)
+}
+
+// TestQuery fetches a single customer, using a named argument. The SQL Server
+// driver does not execute queries directly, so they are always prepared.
+func TestQuery(t *testing.T) {
+	defer leaktest.Check(t)()
+	defer copyist.Open(t).Close()
+
+	db, err := sql.Open("copyist_sqlserver", commontest.SQLServerDataSourceName)
+	require.NoError(t, err)
+	defer db.Close()
+
+	var id int
+	var name string
+	err = db.QueryRow("SELECT id, name FROM customers WHERE id=@id", sql.Named("id", 1)).
+		Scan(&id, &name)
+	require.NoError(t, err)
+	require.Equal(t, 1, id)
+	require.Equal(t, "Andy", name)
+}
+
+// TestInsert inserts a row using positional and named arguments, and ensures
+// that it's been committed.
+func TestInsert(t *testing.T) {
+	defer leaktest.Check(t)()
+	defer copyist.Open(t).Close()
+
+	db, err := sql.Open("copyist_sqlserver", commontest.SQLServerDataSourceName)
+	require.NoError(t, err)
+	defer db.Close()
+
+	res, err := db.Exec("INSERT INTO customers VALUES (@p1, @name)", 4, sql.Named("name", "Sam"))
+	require.NoError(t, err)
+	affected, err := res.RowsAffected()
+	require.NoError(t, err)
+	require.Equal(t, int64(1), affected)
+
+	var count int
+	require.NoError(t, db.QueryRow("SELECT COUNT(*) FROM customers").Scan(&count))
+	require.Equal(t, 4, count)
+}
+
+// TestMSSQLError ensures that SQL Server errors are recorded and played back
+// with all of their fields.
+func TestMSSQLError(t *testing.T) {
+	defer leaktest.Check(t)()
+	defer copyist.Open(t).Close()
+
+	db, err := sql.Open("copyist_sqlserver", commontest.SQLServerDataSourceName)
+	require.NoError(t, err)
+	defer db.Close()
+
+	_, err = db.Exec("SELECT * FROM missing")
+	require.EqualError(t, err, "mssql: Invalid object name 'missing'.")
+
+	var mssqlErr mssql.Error
+	require.True(t, errors.As(err, &mssqlErr))
+	require.Equal(t, int32(208), mssqlErr.Number)
+	require.Equal(t, uint8(16), mssqlErr.Class)
+}
@@ -0,0 +1,125 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package copyist
+
+import (
+	"fmt"
+	"os"
+)
+
+// isVerifying returns true if copyist is recording in verify mode
+// (-record=verify), in which case each new record is checked against the
+// existing recording as it is made, rather than being saved.
+func isVerifying() bool {
+	return IsRecording() && *verifyFlag
+}
+
+// loadExpected loads the existing recording that records are checked against
+// in verify mode, and splits it into streams. It must be called with the
+// session's lock held.
+func (s *session) loadExpected() {
+	if err := s.recordingSource.ParseCached(); err != nil && !os.IsNotExist(err) {
+		panicf("error parsing recording file: %v", err)
+	}
+	s.expected = s.recordingSource.GetRecording(s.recordingName)
+	if s.expected == nil {
+		panicf("no recording exists with this name: %v", s.recordingName)
+	}
+	metadata := s.recordingSource.GetMetadata(s.recordingName)
+	streams, err := splitStreams(s.expected, metadata[streamsMetadataKey])
+	if err != nil {
+		panicf("error parsing streams of recording %s: %v", s.recordingName, err)
+	}
+	s.streams = streams
+}
+
+// verifyRecorded checks that the given record, which was just made by the given
+// connection, matches the next record in the connection's stream of the
+// existing recording. Only the first mismatch is reported, since later records
+// are likely to differ as a result of it.
+func (s *session) verifyRecorded(c *proxyConn, rec *record) {
+	s.mu.Lock()
+	if s.verificationErr != nil || s.streams == nil {
+		s.mu.Unlock()
+		return
+	}
+	key := streamKey{driverName: c.driver.driverName}
+	if rec.Typ != DriverOpen {
+		key.connID = c.id
+	}
+	stream, ok := s.streams[key]
+	if !ok {
+		// Recordings made by a single connection have a single stream.
+		stream = s.streams[streamKey{}]
+	}
+	var expected *record
+	offset := -1
+	if stream != nil && stream.index < len(stream.records) {
+		expected = stream.records[stream.index]
+		offset = stream.offset(stream.index)
+		stream.index++
+	}
+	s.mu.Unlock()
+
+	actual := exportRecord(rec)
+	if expected == nil {
+		mismatch := &MismatchError{Index: -1, Call: actual.Type, Args: actual.Args}
+		s.mismatchErr(mismatch, "too many calls to %s\n\n%s", actual.Type, s.regenerateHint())
+		return
+	}
+	if exportRecord(expected).String() == actual.String() {
+		return
+	}
+	mismatch := &MismatchError{
+		Index:    offset,
+		Expected: exportRecord(expected),
+		Call:     actual.Type,
+		Args:     actual.Args,
+	}
+	s.mismatchErr(mismatch, "recorded call to %s does not match record #%d of recording %s\n\n%s\n"+
+		"%s",
+		actual.Type, offset, s.recordingName,
+		unifiedDiff(exportRecord(expected).String(), actual.String()), s.regenerateHint())
+}
+
+// checkVerified returns an error if recording in verify mode, and the test made
+// fewer calls than the existing recording.
+func (s *session) checkVerified() error {
+	if !isVerifying() {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	missing := 0
+	first := -1
+	for _, stream := range s.streams {
+		if stream.index >= len(stream.records) {
+			continue
+		}
+		missing += len(stream.records) - stream.index
+		if offset := stream.offset(stream.index); first == -1 || offset < first {
+			first = offset
+		}
+	}
+	if missing == 0 {
+		return nil
+	}
+	return fmt.Errorf(
+		"test made %d fewer calls than recording %s, starting with %s (#%d)\n\n"+
+			"%s",
+		missing, s.recordingName, s.expected[first].Typ.String(), first, s.regenerateHint())
+}
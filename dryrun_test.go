@@ -0,0 +1,76 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package copyist
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestVerifyMode tests that recording in verify mode checks new records against
+// the existing recording, without saving them.
+func TestVerifyMode(t *testing.T) {
+	*recordFlag = true
+	visitedRecording = true
+	defer func() { *recordFlag = false }()
+
+	source := &memorySource{}
+	recordQueries := func(queries ...string) *session {
+		s := newSession(source, "TestVerifyMode")
+		c := &proxyConn{driver: &proxyDriver{driverName: "fake"}, session: s}
+		s.OnDriverOpen(c.driver)
+		s.AddRecord(c, &record{Typ: DriverOpen, Args: recordArgs{nil}})
+		for _, query := range queries {
+			s.AddRecord(c, &record{Typ: ConnExec, Args: recordArgs{query, nil}})
+		}
+		return s
+	}
+
+	s := recordQueries("SELECT 1", "SELECT 2")
+	s.Close()
+	saved := string(source.data)
+
+	*verifyFlag = true
+	defer func() { *verifyFlag = false }()
+
+	s = recordQueries("SELECT 1", "SELECT 2")
+	require.Nil(t, s.verificationErr)
+	require.NoError(t, s.checkVerified())
+
+	s = recordQueries("SELECT 1", "SELECT 3", "SELECT 4")
+	require.EqualError(t, s.verificationErr,
+		"recorded call to ConnExec does not match record #2 of recording TestVerifyMode\n\n"+
+			"--- expected\n"+
+			"+++ actual\n"+
+			"-ConnExec\t2:\"SELECT 2\"\t1:nil\n"+
+			"+ConnExec\t2:\"SELECT 3\"\t1:nil\n\n"+
+			"Do you need to regenerate the recording with the -record flag?")
+	require.Equal(t, 2, s.verificationErr.Index)
+
+	s = recordQueries("SELECT 1", "SELECT 2", "SELECT 3")
+	require.EqualError(t, s.verificationErr, "too many calls to ConnExec\n\n"+
+		"Do you need to regenerate the recording with the -record flag?")
+
+	s = recordQueries("SELECT 1")
+	require.Nil(t, s.verificationErr)
+	require.EqualError(t, s.checkVerified(),
+		"test made 1 fewer calls than recording TestVerifyMode, starting with ConnExec (#2)\n\n"+
+			"Do you need to regenerate the recording with the -record flag?")
+
+	// The recording is not overwritten.
+	s.Close()
+	require.Equal(t, saved, string(source.data))
+}
@@ -0,0 +1,222 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package copyist
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// encryptedMagic begins every encrypted recording file. It distinguishes them
+// from plaintext recording files, which can never begin with it.
+const encryptedMagic = "copyist-aes-gcm\n"
+
+// EncryptionKeyCallback types a function that returns the AES key (16, 24 or
+// 32 bytes long) used to encrypt recording files, for example by fetching it
+// from a key management service.
+type EncryptionKeyCallback func() ([]byte, error)
+
+// encryptionKey is the callback set by SetEncryptionKey, or nil if it has not
+// been set.
+var encryptionKey EncryptionKeyCallback
+
+// SetEncryptionKey sets the callback function that returns the key used to
+// encrypt and decrypt recording files, for teams whose recorded data cannot be
+// stored in plaintext. Once a key is set, recordings are encrypted with
+// AES-GCM when they are written, and transparently decrypted when they are
+// played back. Existing plaintext recording files can still be played back, and
+// are encrypted the next time that they are written. If SetEncryptionKey is
+// not called, then the base64-encoded key in the COPYIST_ENCRYPTION_KEY
+// environment variable is used instead, if it is defined. Calling
+// SetEncryptionKey with nil restores the default behavior.
+//
+// Since encrypted recording files must be rewritten in full, re-recording a
+// test does not append its recording to the end of the file.
+func SetEncryptionKey(callback EncryptionKeyCallback) {
+	encryptionKey = callback
+}
+
+// getEncryptionKey returns the key returned by the callback set by
+// SetEncryptionKey, or else the key in the COPYIST_ENCRYPTION_KEY environment
+// variable. It returns nil if neither is set.
+func getEncryptionKey() ([]byte, error) {
+	if encryptionKey != nil {
+		return encryptionKey()
+	}
+	if env := os.Getenv("COPYIST_ENCRYPTION_KEY"); env != "" {
+		key, err := base64.StdEncoding.DecodeString(env)
+		if err != nil {
+			return nil, fmt.Errorf("COPYIST_ENCRYPTION_KEY is not valid base64: %v", err)
+		}
+		return key, nil
+	}
+	return nil, nil
+}
+
+// encryptedSource is a Source that encrypts the recording file of another
+// Source. See NewEncryptedSource for more details.
+type encryptedSource struct {
+	source Source
+	aead   cipher.AEAD
+}
+
+var _ lockableSource = encryptedSource{}
+
+// NewEncryptedSource returns a Source that encrypts the data written to the
+// given Source with AES-GCM, using the given key, which must be 16, 24 or 32
+// bytes long. Data read from the given Source is decrypted, unless it is not
+// encrypted, in which case it is returned as-is. Sessions opened by Open and
+// its variants use an encrypted source if a key was set by SetEncryptionKey,
+// so NewEncryptedSource is only needed by tools that read or write recording
+// files directly.
+func NewEncryptedSource(source Source, key []byte) (Source, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	encrypted := encryptedSource{source: source, aead: aead}
+	if _, ok := source.(sidecarSource); ok {
+		return encryptedSidecarSource{encrypted}, nil
+	}
+	return encrypted, nil
+}
+
+// encryptSource returns a Source that encrypts the given Source with the given
+// key. If the given Source is a layered source, then each of its layers is
+// encrypted instead, so that each layer is decrypted before the layers are
+// merged, and so that sessions can still find the layer to write to.
+func encryptSource(source Source, key []byte) (Source, error) {
+	layered, ok := source.(*layeredSource)
+	if !ok {
+		return NewEncryptedSource(source, key)
+	}
+
+	writeTo, err := encryptSource(layered.writeTo, key)
+	if err != nil {
+		return nil, err
+	}
+	layers := make([]Source, len(layered.layers))
+	for i, layer := range layered.layers {
+		if layer == layered.writeTo {
+			layers[i] = writeTo
+			continue
+		}
+		if layers[i], err = encryptSource(layer, key); err != nil {
+			return nil, err
+		}
+	}
+	return &layeredSource{layers: layers, writeTo: writeTo}, nil
+}
+
+// ReadAll implements Source.
+func (s encryptedSource) ReadAll() ([]byte, error) {
+	data, err := s.source.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	return s.open(data)
+}
+
+// WriteAll implements Source.
+func (s encryptedSource) WriteAll(data []byte) error {
+	sealed, err := s.seal(data)
+	if err != nil {
+		return err
+	}
+	return s.source.WriteAll(sealed)
+}
+
+// open decrypts the given data, unless it is not encrypted, in which case it is
+// returned as-is.
+func (s encryptedSource) open(data []byte) ([]byte, error) {
+	if !isEncrypted(data) {
+		return data, nil
+	}
+
+	data = data[len(encryptedMagic):]
+	nonceSize := s.aead.NonceSize()
+	if len(data) < nonceSize {
+		return nil, errors.New("encrypted recording file is truncated")
+	}
+	plaintext, err := s.aead.Open(nil, data[:nonceSize], data[nonceSize:], []byte(encryptedMagic))
+	if err != nil {
+		return nil, fmt.Errorf("recording file cannot be decrypted with this key: %v", err)
+	}
+	return plaintext, nil
+}
+
+// seal encrypts the given data, prefixed by encryptedMagic and a random nonce.
+func (s encryptedSource) seal(data []byte) ([]byte, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, len(encryptedMagic)+len(nonce)+len(data)+s.aead.Overhead())
+	out = append(out, encryptedMagic...)
+	out = append(out, nonce...)
+	return s.aead.Seal(out, nonce, data, []byte(encryptedMagic)), nil
+}
+
+// Lock implements lockableSource, by locking the underlying Source if it can
+// be locked.
+func (s encryptedSource) Lock() (unlock func(), err error) {
+	if ls, ok := s.source.(lockableSource); ok {
+		return ls.Lock()
+	}
+	return func() {}, nil
+}
+
+// encryptedSidecarSource is an encryptedSource whose underlying Source stores
+// large values in sidecar files. The sidecar files are encrypted as well.
+type encryptedSidecarSource struct {
+	encryptedSource
+}
+
+var _ sidecarSource = encryptedSidecarSource{}
+
+// ReadSidecar implements sidecarSource.
+func (s encryptedSidecarSource) ReadSidecar(name string) ([]byte, error) {
+	data, err := s.source.(sidecarSource).ReadSidecar(name)
+	if err != nil {
+		return nil, err
+	}
+	return s.open(data)
+}
+
+// WriteSidecar implements sidecarSource.
+func (s encryptedSidecarSource) WriteSidecar(name string, data []byte) error {
+	sealed, err := s.seal(data)
+	if err != nil {
+		return err
+	}
+	return s.source.(sidecarSource).WriteSidecar(name, sealed)
+}
+
+// isEncrypted returns true if the given recording file data is encrypted.
+func isEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(encryptedMagic))
+}
@@ -0,0 +1,167 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package copyist
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestEncryptedSource tests that encrypted sources encrypt what they write,
+// and decrypt what they read, as well as reading plaintext as-is.
+func TestEncryptedSource(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	plaintext := []byte("1=DriverOpen\t1:nil\n\n\"TestFoo\"=1\n")
+
+	mem := &memorySource{data: plaintext}
+	source, err := NewEncryptedSource(mem, key)
+	require.NoError(t, err)
+	data, err := source.ReadAll()
+	require.NoError(t, err)
+	require.Equal(t, plaintext, data)
+
+	require.NoError(t, source.WriteAll(plaintext))
+	require.True(t, isEncrypted(mem.data))
+	require.False(t, bytes.Contains(mem.data, []byte("DriverOpen")))
+	data, err = source.ReadAll()
+	require.NoError(t, err)
+	require.Equal(t, plaintext, data)
+
+	// Decrypt with the wrong key.
+	wrong, err := NewEncryptedSource(mem, bytes.Repeat([]byte{2}, 32))
+	require.NoError(t, err)
+	_, err = wrong.ReadAll()
+	require.Error(t, err)
+	require.True(t, strings.HasPrefix(err.Error(), "recording file cannot be decrypted with this key"))
+
+	_, err = NewEncryptedSource(mem, []byte("short"))
+	require.Error(t, err)
+}
+
+// TestSetEncryptionKey tests that sessions encrypt their recordings when an
+// encryption key is set, and cannot play them back without it.
+func TestSetEncryptionKey(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 16)
+	SetEncryptionKey(func() ([]byte, error) { return key, nil })
+	defer SetEncryptionKey(nil)
+
+	*recordFlag = true
+	visitedRecording = true
+	defer func() { *recordFlag = false }()
+
+	source := &memorySource{}
+	s := newSession(source, "TestSetEncryptionKey")
+	c := &proxyConn{driver: &proxyDriver{driverName: "fake"}, session: s}
+	s.AddRecord(c, &record{Typ: DriverOpen, Args: recordArgs{nil}})
+	s.AddRecord(c, &record{Typ: ConnExec, Args: recordArgs{"DELETE FROM customers", nil}})
+	s.Close()
+	require.True(t, isEncrypted(source.data))
+
+	// Play back the recording.
+	*recordFlag = false
+	s = newSession(source, "TestSetEncryptionKey")
+	s.OnDriverOpen(c.driver)
+	c = &proxyConn{driver: c.driver, session: s}
+	_, err := s.VerifyRecord(c, DriverOpen)
+	require.NoError(t, err)
+	_, err = s.VerifyRecordWithStringArg(c, ConnExec, "DELETE FROM customers")
+	require.NoError(t, err)
+
+	// Parse the recording without the key.
+	SetEncryptionKey(nil)
+	err = newRecordingSource(source).Parse()
+	require.EqualError(t, err, "recording file is encrypted, but no encryption key is set")
+}
+
+// TestEncryptedLayers tests that each layer of a layered source is encrypted
+// separately when an encryption key is set, and that recordings are only
+// written to the layer being written to, with their large values stored in
+// encrypted sidecar files.
+func TestEncryptedLayers(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 16)
+	SetEncryptionKey(func() ([]byte, error) { return key, nil })
+	defer SetEncryptionKey(nil)
+	SetSidecarThreshold(16)
+	defer SetSidecarThreshold(0)
+
+	dir := t.TempDir()
+	local := NewFileSource(filepath.Join(dir, "local.copyist"))
+	shared := NewFileSource(filepath.Join(dir, "shared.copyist"))
+	encryptedShared, err := NewEncryptedSource(shared, key)
+	require.NoError(t, err)
+	require.NoError(t, encryptedShared.WriteAll([]byte(`
+1=DriverOpen	1:nil
+2=ConnExec	2:"DELETE FROM customers"	1:nil
+
+"TestShared"=1,2
+`)))
+
+	*recordFlag = true
+	visitedRecording = true
+	defer func() { *recordFlag = false }()
+
+	big := bytes.Repeat([]byte{0, 1, 2, 3}, 8)
+	s := newSession(NewLayeredSource(local, local, shared), "TestLocal")
+	c := &proxyConn{driver: &proxyDriver{driverName: "fake"}, session: s}
+	s.AddRecord(c, &record{Typ: DriverOpen, Args: recordArgs{nil}})
+	s.AddRecord(c, &record{Typ: RowsNext, Args: recordArgs{[]driver.Value{big}, nil}})
+	s.Close()
+
+	// The local layer is encrypted, and does not contain the shared recording.
+	data, err := os.ReadFile(filepath.Join(dir, "local.copyist"))
+	require.NoError(t, err)
+	require.True(t, isEncrypted(data))
+	localSource := newRecordingSource(local)
+	SetEncryptionKey(nil)
+	require.Error(t, localSource.Parse())
+	SetEncryptionKey(func() ([]byte, error) { return key, nil })
+	encryptedLocal, err := NewEncryptedSource(local, key)
+	require.NoError(t, err)
+	localSource = newRecordingSource(encryptedLocal)
+	require.NoError(t, localSource.Parse())
+	require.Nil(t, localSource.GetRecording("TestShared"))
+	require.Len(t, localSource.GetRecording("TestLocal"), 2)
+
+	// The sidecar file is encrypted.
+	entries, err := os.ReadDir(filepath.Join(dir, "local.sidecar"))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	data, err = os.ReadFile(filepath.Join(dir, "local.sidecar", entries[0].Name()))
+	require.NoError(t, err)
+	require.True(t, isEncrypted(data))
+
+	// Play back the recordings from both layers.
+	*recordFlag = false
+	for _, name := range []string{"TestLocal", "TestShared"} {
+		s = newSession(NewLayeredSource(local, local, shared), name)
+		require.NoError(t, s.recordingSource.ParseCached())
+		rec := s.recordingSource.GetRecording(name)
+		require.Len(t, rec, 2)
+		if name == "TestLocal" {
+			require.Equal(t, []driver.Value{big}, rec[1].Args[0])
+		}
+	}
+
+	// Encrypted files are parsed with the cache.
+	pathName, ok := sourcePathName(encryptedLocal)
+	require.True(t, ok)
+	require.Equal(t, filepath.Join(dir, "local.copyist"), pathName)
+}
@@ -0,0 +1,155 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package copyist
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// explainPrefix is set by SetExplain.
+var explainPrefix string
+
+// SetExplain captures the execution plan of each distinct query made while
+// recording, by running the query prefixed by the given statement (e.g.
+// "EXPLAIN" for PostgreSQL, CockroachDB and MySQL, or "EXPLAIN QUERY PLAN" for
+// SQLite) against the database. Plans are attached to the recording as
+// metadata, which can be read with RecordingFile.Plans, giving teams a history
+// of plan changes alongside their recordings. They are not used during
+// playback. Only SELECT, INSERT, UPDATE, DELETE and WITH statements that
+// succeed are explained, and a query's plan is not captured if explaining it
+// fails. Calling SetExplain with an empty string disables plan capture, which
+// is the default.
+func SetExplain(prefix string) {
+	explainPrefix = prefix
+}
+
+// explainableVerbs are the first words of the statements that can be
+// explained.
+var explainableVerbs = []string{"SELECT", "INSERT", "UPDATE", "DELETE", "WITH"}
+
+// explain captures the plan of the given query, executed with the given
+// arguments by the given connection, if plan capture is enabled and the
+// query's plan has not yet been captured by this session. It must only be
+// called while recording, and while the wrapped connection is not busy reading
+// the rows of another query.
+func (s *session) explain(c *proxyConn, query string, args []driver.NamedValue) {
+	if explainPrefix == "" || !isExplainable(query) {
+		return
+	}
+	s.mu.Lock()
+	_, ok := s.plans[query]
+	s.mu.Unlock()
+	if ok {
+		return
+	}
+
+	queryer, ok := c.conn.(driver.QueryerContext)
+	if !ok {
+		return
+	}
+	rows, err := queryer.QueryContext(context.Background(), explainPrefix+" "+query, args)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	var lines []string
+	dest := make([]driver.Value, len(rows.Columns()))
+	for {
+		if err := rows.Next(dest); err != nil {
+			if err != io.EOF {
+				return
+			}
+			break
+		}
+		cols := make([]string, len(dest))
+		for i, val := range dest {
+			if b, ok := val.([]byte); ok {
+				val = string(b)
+			}
+			cols[i] = fmt.Sprint(val)
+		}
+		lines = append(lines, strings.Join(cols, "\t"))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.plans == nil {
+		s.plans = make(map[string]string)
+	}
+	s.plans[query] = strings.Join(lines, "\n")
+}
+
+// isExplainable returns true if the given query is a statement that can be
+// explained.
+func isExplainable(query string) bool {
+	fields := strings.Fields(query)
+	if len(fields) == 0 {
+		return false
+	}
+	for _, verb := range explainableVerbs {
+		if strings.EqualFold(fields[0], verb) {
+			return true
+		}
+	}
+	return false
+}
+
+// formatPlans formats the given plans, keyed by query, as a list of quoted
+// strings that alternate between each query and its plan, sorted by query:
+//
+//	["SELECT 1","Result  (cost=0.00..0.01 rows=1 width=4)"]
+func formatPlans(plans map[string]string) string {
+	queries := make([]string, 0, len(plans))
+	for query := range plans {
+		queries = append(queries, query)
+	}
+	sort.Strings(queries)
+
+	var b strings.Builder
+	b.WriteByte('[')
+	for i, query := range queries {
+		if i != 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(strconv.Quote(query))
+		b.WriteByte(',')
+		b.WriteString(strconv.Quote(plans[query]))
+	}
+	b.WriteByte(']')
+	return b.String()
+}
+
+// parsePlans parses a list of plans in the format produced by formatPlans.
+func parsePlans(s string) (map[string]string, error) {
+	strs, err := parseQueries(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(strs)%2 != 0 {
+		return nil, fmt.Errorf("plans must alternate between queries and plans: %s", s)
+	}
+	plans := make(map[string]string, len(strs)/2)
+	for i := 0; i < len(strs); i += 2 {
+		plans[strs[i]] = strs[i+1]
+	}
+	return plans, nil
+}
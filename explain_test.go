@@ -0,0 +1,97 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package copyist
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// explainConn is a fake driver connection that returns a plan for EXPLAIN
+// statements, and empty rows for any other query.
+type explainConn struct {
+	driver.Conn
+	queries []string
+}
+
+func (c *explainConn) QueryContext(
+	ctx context.Context, query string, args []driver.NamedValue,
+) (driver.Rows, error) {
+	c.queries = append(c.queries, query)
+	if strings.Contains(query, "missing") {
+		return nil, errors.New("relation does not exist")
+	}
+	if strings.HasPrefix(query, "EXPLAIN ") {
+		return &fakeRows{cols: []string{"QUERY PLAN"}, rows: [][]driver.Value{
+			{"Index Scan using customers_pkey on customers"},
+			{[]byte("  Index Cond: (id = $1)")},
+		}}, nil
+	}
+	return &fakeRows{cols: []string{"name"}}, nil
+}
+
+// TestExplain tests that the plan of each distinct query is captured when
+// recording, if SetExplain is enabled.
+func TestExplain(t *testing.T) {
+	s := newSession(&memorySource{}, "TestExplain")
+	conn := &explainConn{}
+	c := &proxyConn{driver: &proxyDriver{driverName: "fake"}, session: s, conn: conn}
+
+	*recordFlag = true
+	visitedRecording = true
+	defer func() { *recordFlag = false }()
+
+	query := func(sql string) {
+		args := []driver.NamedValue{{Ordinal: 1, Value: int64(1)}}
+		rows, err := c.QueryContext(context.Background(), sql, args)
+		if err != nil {
+			return
+		}
+		require.NoError(t, rows.Close())
+	}
+
+	// Plans are not captured by default.
+	query("SELECT name FROM customers WHERE id = $1")
+	require.Nil(t, s.plans)
+
+	SetExplain("EXPLAIN")
+	defer SetExplain("")
+	query("SELECT name FROM customers WHERE id = $1")
+	query("SELECT name FROM customers WHERE id = $1")
+	query("SELECT name FROM missing")
+	query("SET application_name = 'test'")
+	require.Equal(t, []string{
+		"SELECT name FROM customers WHERE id = $1",
+		"SELECT name FROM customers WHERE id = $1",
+		"EXPLAIN SELECT name FROM customers WHERE id = $1",
+		"SELECT name FROM customers WHERE id = $1",
+		"SELECT name FROM missing",
+		"SET application_name = 'test'",
+	}, conn.queries)
+
+	const plan = "Index Scan using customers_pkey on customers\n  Index Cond: (id = $1)"
+	require.Equal(t, map[string]string{"SELECT name FROM customers WHERE id = $1": plan}, s.plans)
+
+	// Plans are attached to the recording as metadata.
+	formatted := s.recordingMetadata()[plansMetadataKey]
+	plans, err := parsePlans(formatted)
+	require.NoError(t, err)
+	require.Equal(t, s.plans, plans)
+}
@@ -3,12 +3,15 @@ module github.com/cockroachdb/copyist
 go 1.16
 
 require (
+	github.com/cespare/xxhash/v2 v2.3.0
 	github.com/fortytw2/leaktest v1.3.0
+	github.com/go-sql-driver/mysql v1.5.0
 	github.com/jackc/pgconn v1.10.0
 	github.com/jackc/pgproto3/v2 v2.1.1
 	github.com/jackc/pgx/v4 v4.13.0
 	github.com/jmoiron/sqlx v1.3.4
 	github.com/lib/pq v1.10.2
+	github.com/mattn/go-sqlite3 v1.14.6
 	github.com/pkg/errors v0.8.1
 	github.com/stretchr/testify v1.7.0
 )
@@ -0,0 +1,190 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package linediff computes line-by-line differences between two texts. It is
+// shared by the copyist package, which reports how playback or recordings
+// differ from existing recordings, and by the copyist command.
+package linediff
+
+// These are the operations that make up a diff.
+const (
+	// Equal is the operation of a line that is in both texts.
+	Equal = ' '
+
+	// Delete is the operation of a line that is only in the old text.
+	Delete = '-'
+
+	// Insert is the operation of a line that is only in the new text.
+	Insert = '+'
+)
+
+// Line is one line of a diff.
+type Line struct {
+	// Op is the operation of the line: Equal, Delete or Insert.
+	Op byte
+
+	// Text is the line itself.
+	Text string
+}
+
+// Lines returns the shortest edit script that transforms the old lines into the
+// new lines. It uses the linear space variant of Myers' algorithm, so that it
+// needs O((N+M)D) time and O(N+M) space, where D is the number of lines that
+// differ. Unlike computing a full table of longest common subsequences, this
+// stays cheap for long texts that differ in only a few lines.
+func Lines(oldLines, newLines []string) []Line {
+	var d differ
+	d.diff(oldLines, newLines)
+	return d.lines
+}
+
+// differ accumulates the lines of a diff.
+type differ struct {
+	lines []Line
+}
+
+// add appends the given lines to the diff, with the given operation.
+func (d *differ) add(op byte, lines []string) {
+	for _, line := range lines {
+		d.lines = append(d.lines, Line{Op: op, Text: line})
+	}
+}
+
+// diff appends the diff of a and b.
+func (d *differ) diff(a, b []string) {
+	// Lines that the texts start or end with are unchanged.
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix &&
+		a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	d.add(Equal, a[:prefix])
+
+	midA, midB := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	switch {
+	case len(midA) == 0:
+		d.add(Insert, midB)
+	case len(midB) == 0:
+		d.add(Delete, midA)
+	default:
+		if x, y, ok := middle(midA, midB); ok {
+			d.diff(midA[:x], midB[:y])
+			d.diff(midA[x:], midB[y:])
+		} else {
+			d.add(Delete, midA)
+			d.add(Insert, midB)
+		}
+	}
+
+	d.add(Equal, a[len(a)-suffix:])
+}
+
+// middle finds a point (x, y) on a shortest edit path from the start of a and b
+// to their end, by searching forward from the start and backward from the end
+// at the same time until the searches overlap. The diff of a and b is then the
+// diff of a[:x] and b[:y], followed by the diff of a[x:] and b[y:]. It returns
+// false if the texts have no lines in common. This is the bisection step of
+// Myers' linear space algorithm.
+func middle(a, b []string) (x, y int, ok bool) {
+	n, m := len(a), len(b)
+	maxD := (n + m + 1) / 2
+	offset := maxD + 1
+	length := 2*maxD + 3
+
+	// forward[offset+k] is the furthest x reached by the forward search on
+	// diagonal k (where y = x-k), and backward[offset+k] is the furthest x
+	// reached by the backward search on diagonal k, measured from the end.
+	forward := make([]int, length)
+	backward := make([]int, length)
+	for i := range forward {
+		forward[i] = -1
+		backward[i] = -1
+	}
+	forward[offset+1] = 0
+	backward[offset+1] = 0
+
+	// If the difference in length is odd, then the searches overlap during a
+	// forward step. Otherwise, they overlap during a backward step.
+	delta := n - m
+	front := delta%2 != 0
+
+	// Diagonals that run off the edge of the texts no longer need searching.
+	var forwardStart, forwardEnd, backwardStart, backwardEnd int
+	for d := 0; d < maxD; d++ {
+		for k := -d + forwardStart; k <= d-forwardEnd; k += 2 {
+			i := offset + k
+			var x int
+			if k == -d || (k != d && forward[i-1] < forward[i+1]) {
+				x = forward[i+1]
+			} else {
+				x = forward[i-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			forward[i] = x
+
+			switch {
+			case x > n:
+				forwardEnd += 2
+			case y > m:
+				forwardStart += 2
+			case front:
+				j := offset + delta - k
+				if j >= 0 && j < length && backward[j] != -1 && x >= n-backward[j] {
+					return x, y, true
+				}
+			}
+		}
+
+		for k := -d + backwardStart; k <= d-backwardEnd; k += 2 {
+			i := offset + k
+			var x int
+			if k == -d || (k != d && backward[i-1] < backward[i+1]) {
+				x = backward[i+1]
+			} else {
+				x = backward[i-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[n-x-1] == b[m-y-1] {
+				x++
+				y++
+			}
+			backward[i] = x
+
+			switch {
+			case x > n:
+				backwardEnd += 2
+			case y > m:
+				backwardStart += 2
+			case !front:
+				j := offset + delta - k
+				if j >= 0 && j < length && forward[j] != -1 {
+					forwardX := forward[j]
+					forwardY := offset + forwardX - j
+					if forwardX >= n-x {
+						return forwardX, forwardY, true
+					}
+				}
+			}
+		}
+	}
+	return 0, 0, false
+}
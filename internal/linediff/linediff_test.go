@@ -0,0 +1,113 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package linediff
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestLines tests diffs of some simple texts.
+func TestLines(t *testing.T) {
+	require.Nil(t, Lines(nil, nil))
+	require.Equal(t, []Line{{Delete, "SELECT 1"}, {Insert, "SELECT 2"}},
+		Lines([]string{"SELECT 1"}, []string{"SELECT 2"}))
+	require.Equal(t, []Line{{Equal, "a"}, {Delete, "b"}, {Equal, "c"}, {Insert, "d"}},
+		Lines([]string{"a", "b", "c"}, []string{"a", "c", "d"}))
+}
+
+// TestLinesRandom tests that the diffs of random texts transform the old text
+// into the new text, and are as short as possible.
+func TestLinesRandom(t *testing.T) {
+	rng := rand.New(rand.NewSource(0))
+	randomLines := func() []string {
+		lines := make([]string, rng.Intn(20))
+		for i := range lines {
+			lines[i] = fmt.Sprint(rng.Intn(4))
+		}
+		return lines
+	}
+
+	for i := 0; i < 1000; i++ {
+		a, b := randomLines(), randomLines()
+		var oldLines, newLines []string
+		changed := 0
+		for _, line := range Lines(a, b) {
+			if line.Op != Insert {
+				oldLines = append(oldLines, line.Text)
+			}
+			if line.Op != Delete {
+				newLines = append(newLines, line.Text)
+			}
+			if line.Op != Equal {
+				changed++
+			}
+		}
+		require.Equal(t, len(a), len(oldLines))
+		require.Equal(t, len(b), len(newLines))
+		if len(a) != 0 {
+			require.Equal(t, a, oldLines)
+		}
+		if len(b) != 0 {
+			require.Equal(t, b, newLines)
+		}
+		require.Equal(t, len(a)+len(b)-2*lcsLength(a, b), changed, "%q %q", a, b)
+	}
+}
+
+// TestLinesLarge tests that long texts that differ in a few lines are diffed
+// quickly.
+func TestLinesLarge(t *testing.T) {
+	const n = 1000000
+	a := make([]string, n)
+	b := make([]string, n)
+	for i := range a {
+		a[i] = fmt.Sprint(i)
+		b[i] = a[i]
+	}
+	b[10] = "changed"
+	b[n/2] = "changed"
+
+	changed := 0
+	for _, line := range Lines(a, b) {
+		if line.Op != Equal {
+			changed++
+		}
+	}
+	require.Equal(t, 4, changed)
+}
+
+// lcsLength returns the length of the longest common subsequence of a and b.
+func lcsLength(a, b []string) int {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	return lcs[0][0]
+}
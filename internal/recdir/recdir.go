@@ -0,0 +1,58 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package recdir locates the directories that hold copyist recording files. It
+// is shared by the copyist package, which reads and writes the recording files,
+// and by the copyist command, which finds them in order to delete or prune them.
+package recdir
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// PackageDir returns the directory that holds the recording files of the test
+// package in the given directory. This is the package's testdata directory,
+// unless a recording directory is given, in which case it is the subdirectory
+// of the recording directory having the package's path relative to the root of
+// its module (e.g. "a/store"). That keeps the recordings of packages with the
+// same name in different parts of the module apart. If the module root cannot
+// be found, then the last element of the package's directory is used instead.
+func PackageDir(pkgDir, recordingDir string) string {
+	if recordingDir == "" {
+		return filepath.Join(pkgDir, "testdata")
+	}
+	rel := filepath.Base(pkgDir)
+	if root := ModuleRoot(pkgDir); root != "" {
+		if r, err := filepath.Rel(root, pkgDir); err == nil {
+			rel = r
+		}
+	}
+	return filepath.Join(recordingDir, rel)
+}
+
+// ModuleRoot returns the closest directory that contains the given directory
+// and a go.mod file, or the empty string if there is none.
+func ModuleRoot(dir string) string {
+	for {
+		if _, err := os.Stat(filepath.Join(dir, "go.mod")); err == nil {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
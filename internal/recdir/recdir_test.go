@@ -0,0 +1,40 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package recdir
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestPackageDir tests that packages with the same name in different parts of
+// a module get their own recording directories.
+func TestPackageDir(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(root, "go.mod"), []byte("module m\n"), 0644))
+	storeA := filepath.Join(root, "a", "store")
+	storeB := filepath.Join(root, "b", "store")
+
+	require.Equal(t, filepath.Join(storeA, "testdata"), PackageDir(storeA, ""))
+	require.Equal(t, filepath.FromSlash("/artifacts/a/store"),
+		PackageDir(storeA, filepath.FromSlash("/artifacts")))
+	require.Equal(t, filepath.FromSlash("/artifacts/b/store"),
+		PackageDir(storeB, filepath.FromSlash("/artifacts")))
+	require.Equal(t, filepath.FromSlash("/artifacts"),
+		PackageDir(root, filepath.FromSlash("/artifacts")))
+}
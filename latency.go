@@ -0,0 +1,89 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package copyist
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// recordDurations is set by SetRecordDurations.
+var recordDurations bool
+
+// latencyScale is set by SetLatencyScale.
+var latencyScale float64
+
+// SetRecordDurations determines whether the elapsed time of each driver call is
+// saved in recordings made from now on. Durations are saved in the recording's
+// metadata, so recordings made without them can still be played back. They are
+// off by default, since they change every time a recording is regenerated,
+// which makes recording files harder to review.
+func SetRecordDurations(record bool) {
+	recordDurations = record
+}
+
+// SetLatencyScale simulates the latency of the database during playback, so
+// that tests that exercise timeouts, context cancellation and other
+// latency-sensitive code behave more realistically than when calls return
+// instantly. Each call that is played back sleeps for its recorded duration,
+// multiplied by the given scale. For example, a scale of 1 sleeps for as long
+// as the call took while recording, and a scale of 0.1 sleeps for a tenth as
+// long. Only recordings made with SetRecordDurations enabled have durations.
+// Calling SetLatencyScale with zero disables latency simulation, which is the
+// default.
+func SetLatencyScale(scale float64) {
+	latencyScale = scale
+}
+
+// simulateLatency sleeps for the recorded duration of the record at the given
+// offset within the recording, multiplied by the latency scale.
+func (s *session) simulateLatency(offset int) {
+	if latencyScale == 0 || offset >= len(s.durations) {
+		return
+	}
+	if d := time.Duration(float64(s.durations[offset]) * latencyScale); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// formatDurations formats the given durations as a space-separated list of
+// microseconds, like:
+//
+//	1520 35 0 412
+func formatDurations(durations []time.Duration) string {
+	var b strings.Builder
+	for i, d := range durations {
+		if i != 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(strconv.FormatInt(d.Microseconds(), 10))
+	}
+	return b.String()
+}
+
+// parseDurations parses a list of durations formatted by formatDurations.
+func parseDurations(s string) ([]time.Duration, error) {
+	fields := strings.Fields(s)
+	durations := make([]time.Duration, len(fields))
+	for i, field := range fields {
+		micros, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		durations[i] = time.Duration(micros) * time.Microsecond
+	}
+	return durations, nil
+}
@@ -0,0 +1,78 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package copyist
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestRecordDurations tests that the duration of each call is recorded when
+// SetRecordDurations is enabled.
+func TestRecordDurations(t *testing.T) {
+	s := newSession(&memorySource{}, "TestRecordDurations")
+	c := &proxyConn{driver: &proxyDriver{driverName: "fake"}, session: s}
+
+	unlock := s.SerializeCall(c)
+	time.Sleep(5 * time.Millisecond)
+	s.AddRecord(c, &record{Typ: ConnExec, Args: recordArgs{"SELECT 1", nil}})
+	unlock()
+
+	require.Len(t, s.durations, 1)
+	require.GreaterOrEqual(t, int64(s.durations[0]), int64(5*time.Millisecond))
+	require.NotContains(t, s.recordingMetadata(), durationsMetadataKey)
+
+	SetRecordDurations(true)
+	defer SetRecordDurations(false)
+	require.Equal(t, formatDurations(s.durations), s.recordingMetadata()[durationsMetadataKey])
+}
+
+// TestLatencyScale tests that calls sleep for their scaled, recorded duration
+// during playback.
+func TestLatencyScale(t *testing.T) {
+	s := newSession(&memorySource{}, "TestLatencyScale")
+	s.recording = recording{
+		{Typ: ConnExec, Args: recordArgs{"SELECT 1", nil}},
+		{Typ: ConnExec, Args: recordArgs{"SELECT 2", nil}},
+	}
+	s.streams = map[streamKey]*recordStream{{}: {records: s.recording}}
+	s.durations = []time.Duration{0, 40 * time.Millisecond}
+	c := &proxyConn{driver: &proxyDriver{driverName: "fake"}, session: s}
+
+	SetLatencyScale(0.5)
+	defer SetLatencyScale(0)
+
+	start := time.Now()
+	_, err := s.VerifyRecordWithStringArg(c, ConnExec, "SELECT 1")
+	require.NoError(t, err)
+	_, err = s.VerifyRecordWithStringArg(c, ConnExec, "SELECT 2")
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, int64(time.Since(start)), int64(20*time.Millisecond))
+}
+
+// TestFormatDurations tests formatting and parsing the durations metadata.
+func TestFormatDurations(t *testing.T) {
+	durations := []time.Duration{1520 * time.Microsecond, 0, 3 * time.Second}
+	formatted := formatDurations(durations)
+	require.Equal(t, "1520 0 3000000", formatted)
+	parsed, err := parseDurations(formatted)
+	require.NoError(t, err)
+	require.Equal(t, durations, parsed)
+
+	_, err = parseDurations("12 abc")
+	require.Error(t, err)
+}
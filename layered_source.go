@@ -0,0 +1,94 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package copyist
+
+import "os"
+
+// writeSourcer is implemented by Sources that write recordings to a different
+// Source than the one they read them from. When a session saves its recording,
+// only recordings that already exist in the write Source are preserved
+// alongside it.
+type writeSourcer interface {
+	WriteSource() Source
+}
+
+// layeredSource is a Source that composes a list of other Sources. See
+// NewLayeredSource for more details.
+type layeredSource struct {
+	// layers is the list of sources to read from, in order of precedence.
+	layers []Source
+
+	// writeTo is the source to which new recordings are written.
+	writeTo Source
+}
+
+var _ writeSourcer = (*layeredSource)(nil)
+
+// NewLayeredSource returns a Source that reads recordings from each of the
+// given layers, searched in order. If a recording of the same name exists in
+// more than one layer, then the recording in the earliest layer takes
+// precedence. Layers that do not exist are skipped. New recordings are written
+// to the writeTo source, which does not need to be one of the layers, though it
+// typically is the first. For example, local testdata recordings can override a
+// shared set of baseline recordings:
+//
+//	local := copyist.NewFileSource("testdata/mystuff_test.copyist")
+//	shared := copyist.NewFileSource("/shared/recordings/mystuff_test.copyist")
+//	source := copyist.NewLayeredSource(local, local, shared)
+func NewLayeredSource(writeTo Source, layers ...Source) Source {
+	return &layeredSource{layers: layers, writeTo: writeTo}
+}
+
+// ReadAll implements Source. It merges the recordings from all layers into a
+// single recording file.
+func (s *layeredSource) ReadAll() ([]byte, error) {
+	merged := newRecordingSource(&memorySource{})
+	found := false
+	for _, layer := range s.layers {
+		recordingSource := newRecordingSource(layer)
+		if err := recordingSource.Parse(); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+
+		if !found {
+			merged.recordDecls = recordingSource.recordDecls
+			merged.recordingDecls = recordingSource.recordingDecls
+			merged.metadata = recordingSource.metadata
+			found = true
+			continue
+		}
+		merged.Merge(recordingSource)
+	}
+
+	if !found {
+		return nil, os.ErrNotExist
+	}
+
+	merged.WriteRecording()
+	return merged.source.ReadAll()
+}
+
+// WriteAll implements Source. It writes to the writeTo source.
+func (s *layeredSource) WriteAll(data []byte) error {
+	return s.writeTo.WriteAll(data)
+}
+
+// WriteSource returns the Source to which new recordings are written.
+func (s *layeredSource) WriteSource() Source {
+	return s.writeTo
+}
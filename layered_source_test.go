@@ -0,0 +1,64 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package copyist
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestLayeredSource tests that recordings in earlier layers take precedence
+// over recordings in later layers, and that missing layers are skipped.
+func TestLayeredSource(t *testing.T) {
+	local := &memorySource{data: []byte(`
+1=DriverOpen	1:nil
+2=ConnQuery	2:"SELECT 'local'"	1:nil
+
+"TestShared"=1,2
+`)}
+	shared := &memorySource{data: []byte(`
+1=DriverOpen	1:nil
+2=ConnQuery	2:"SELECT 'shared'"	1:nil
+3=ConnExec	2:"DELETE FROM customers"	1:nil
+
+"TestShared"=1,2
+"TestOnlyShared"=1,3
+`)}
+	missing := NewFileSource(filepath.Join(t.TempDir(), "missing.copyist"))
+
+	source := NewLayeredSource(local, local, missing, shared)
+	recordingSource := newRecordingSource(source)
+	require.NoError(t, recordingSource.Parse())
+
+	rec := recordingSource.GetRecording("TestShared")
+	require.Len(t, rec, 2)
+	require.Equal(t, "SELECT 'local'", rec[1].Args[0])
+
+	rec = recordingSource.GetRecording("TestOnlyShared")
+	require.Len(t, rec, 2)
+	require.Equal(t, ConnExec, rec[1].Typ)
+
+	// Writes only go to the local source.
+	require.Equal(t, local, source.(writeSourcer).WriteSource())
+	require.NoError(t, source.WriteAll([]byte("written")))
+	require.Equal(t, "written", string(local.data))
+
+	// No layers exist.
+	_, err := NewLayeredSource(missing, missing).ReadAll()
+	require.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,211 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package copyist
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// LintRule flags SQL statements that match a bad pattern, such as selecting
+// every column of a table with "SELECT *". See SetLintRules and LintQuery.
+type LintRule struct {
+	// Name is a short, unique name for the rule (e.g. "select-star").
+	Name string
+
+	// Description explains why statements that match the rule are bad.
+	Description string
+
+	// Match returns true if the given SQL statement violates the rule.
+	Match func(query string) bool
+}
+
+// SelectStarRule flags statements that select every column of a table.
+var SelectStarRule = LintRule{
+	Name: "select-star",
+	Description: "selects every column with *, which fetches columns that the application " +
+		"does not use, and breaks when columns are added or reordered",
+	Match: func(query string) bool {
+		return selectStarRegexp.MatchString(lintText(query))
+	},
+}
+
+// MissingLimitRule flags statements that select every row of a table, since
+// they have neither a WHERE nor a LIMIT clause.
+var MissingLimitRule = LintRule{
+	Name: "missing-limit",
+	Description: "selects every row of a table without a WHERE or LIMIT clause, which " +
+		"gets slower as the table grows",
+	Match: func(query string) bool {
+		text := lintText(query)
+		if !strings.HasPrefix(text, "SELECT ") {
+			return false
+		}
+		from := strings.Index(text, " FROM ")
+		if from == -1 || strings.Contains(text[:from], "(") {
+			// Selecting expressions, such as aggregates, returns one row.
+			return false
+		}
+		return !unboundedExemptRegexp.MatchString(text)
+	},
+}
+
+// CrossJoinRule flags statements that join tables without any join condition,
+// which returns every combination of their rows.
+var CrossJoinRule = LintRule{
+	Name: "cross-join",
+	Description: "joins tables without a join condition, which returns every " +
+		"combination of their rows",
+	Match: func(query string) bool {
+		text := lintText(query)
+		if crossJoinRegexp.MatchString(text) {
+			return true
+		}
+		return commaJoinRegexp.MatchString(text) && !strings.Contains(text, " WHERE ")
+	},
+}
+
+var (
+	selectStarRegexp      = regexp.MustCompile(`(?:\bSELECT (?:DISTINCT )?|, ?)(?:\w+\.)?\*(?: |,|$)`)
+	unboundedExemptRegexp = regexp.MustCompile(`\b(?:WHERE|LIMIT|FETCH|TOP|GROUP BY)\b`)
+	crossJoinRegexp       = regexp.MustCompile(`\bCROSS JOIN\b`)
+	commaJoinRegexp       = regexp.MustCompile(`\bFROM \w+(?: (?:AS )?\w+)? ?, ?\w+`)
+)
+
+// DefaultLintRules returns the rules that are checked by default: select-star,
+// missing-limit and cross-join.
+func DefaultLintRules() []LintRule {
+	return []LintRule{SelectStarRule, MissingLimitRule, CrossJoinRule}
+}
+
+// NewLintRule returns a rule that flags SQL statements that match the given
+// regular expression. Statements are matched as they were executed, so the
+// expression may need to be case-insensitive, e.g.:
+//
+//	rule, err := copyist.NewLintRule("no-sleep", "sleeps in the database", `(?i)\bpg_sleep\(`)
+func NewLintRule(name, description, pattern string) (LintRule, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return LintRule{}, err
+	}
+	return LintRule{Name: name, Description: description, Match: re.MatchString}, nil
+}
+
+// LintQuery returns the rules in the given list that the given SQL statement
+// violates.
+func LintQuery(query string, rules []LintRule) []LintRule {
+	var violated []LintRule
+	for _, rule := range rules {
+		if rule.Match(query) {
+			violated = append(violated, rule)
+		}
+	}
+	return violated
+}
+
+// lintRules is set by SetLintRules.
+var lintRules []LintRule
+
+// SetLintRules checks the SQL statements executed by each test against the
+// given rules, failing the test if any of them are violated. This turns
+// recordings into a cheap query-quality gate. For example:
+//
+//	copyist.SetLintRules(copyist.DefaultLintRules()...)
+//
+// Statements are checked when each session is finished, both when recording
+// and during playback. Calling SetLintRules with no rules disables checking,
+// which is the default.
+func SetLintRules(rules ...LintRule) {
+	lintRules = rules
+}
+
+// checkLint returns an error if any SQL statement executed by this session's
+// recording violates the rules set by SetLintRules.
+func (s *session) checkLint() error {
+	if len(lintRules) == 0 {
+		return nil
+	}
+
+	seen := make(map[string]bool)
+	var violations []string
+	for _, rec := range s.recording {
+		query, ok := recordQueryText(rec)
+		if !ok || seen[query] {
+			continue
+		}
+		seen[query] = true
+		for _, rule := range LintQuery(query, lintRules) {
+			violations = append(violations,
+				fmt.Sprintf("  %s: %s\n    %s", rule.Name, rule.Description,
+					strings.Join(strings.Fields(query), " ")))
+		}
+	}
+	if len(violations) == 0 {
+		return nil
+	}
+	sort.Strings(violations)
+	return fmt.Errorf("recording %s has queries that violate lint rules:\n%s",
+		s.recordingName, strings.Join(violations, "\n"))
+}
+
+// recordQueryText returns the SQL text of the given record, if it has one.
+// Records for prepared statements don't include their SQL text, but the record
+// that prepared them does.
+func recordQueryText(rec *record) (string, bool) {
+	switch rec.Typ {
+	case ConnExec, ConnPrepare, ConnQuery:
+		query, ok := rec.Args[0].(string)
+		return query, ok
+	}
+	return "", false
+}
+
+// lintText returns the given SQL statement in a form that is easy to match
+// against lint rules: comments are removed, string literals are emptied, runs
+// of whitespace are collapsed to single spaces, and the statement is converted
+// to upper case.
+func lintText(query string) string {
+	var b strings.Builder
+	for i := 0; i < len(query); i++ {
+		switch {
+		case query[i] == '\'':
+			// Empty string literal, in which quotes are escaped by doubling
+			// them.
+			b.WriteString("''")
+			for i++; i < len(query); i++ {
+				if query[i] == '\'' {
+					if i+1 < len(query) && query[i+1] == '\'' {
+						i++
+						continue
+					}
+					break
+				}
+			}
+
+		case strings.HasPrefix(query[i:], "--"):
+			// Line comment.
+			for i < len(query) && query[i] != '\n' {
+				i++
+			}
+			b.WriteByte(' ')
+
+		default:
+			b.WriteByte(query[i])
+		}
+	}
+	return strings.ToUpper(strings.Join(strings.Fields(b.String()), " "))
+}
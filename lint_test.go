@@ -0,0 +1,79 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package copyist
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestLintRules tests the default lint rules.
+func TestLintRules(t *testing.T) {
+	testCases := []struct {
+		query    string
+		expected []string
+	}{
+		{query: "SELECT id, name FROM customers WHERE id = $1", expected: nil},
+		{query: "SELECT * FROM customers WHERE id = $1", expected: []string{"select-star"}},
+		{query: "select c.* from customers c where id = 1", expected: []string{"select-star"}},
+		{query: "SELECT count(*) FROM customers", expected: nil},
+		{query: "SELECT a, b * 2 FROM t LIMIT 10", expected: nil},
+		{query: "SELECT id, name\nFROM customers", expected: []string{"missing-limit"}},
+		{query: "SELECT id FROM customers ORDER BY id LIMIT 10", expected: nil},
+		{query: "SELECT id FROM customers -- WHERE id = 1", expected: []string{"missing-limit"}},
+		{query: "SELECT name FROM t WHERE name = 'SELECT * FROM t'", expected: nil},
+		{query: "SELECT a.id FROM a CROSS JOIN b WHERE a.id = 1", expected: []string{"cross-join"}},
+		{query: "SELECT a.id FROM a, b LIMIT 1", expected: []string{"cross-join"}},
+		{query: "SELECT a.id FROM a, b WHERE a.id = b.id", expected: nil},
+		{query: "INSERT INTO customers VALUES ($1)", expected: nil},
+	}
+	for _, tc := range testCases {
+		var names []string
+		for _, rule := range LintQuery(tc.query, DefaultLintRules()) {
+			names = append(names, rule.Name)
+		}
+		require.Equal(t, tc.expected, names, tc.query)
+	}
+}
+
+// TestNewLintRule tests lint rules that match regular expressions.
+func TestNewLintRule(t *testing.T) {
+	rule, err := NewLintRule("no-sleep", "sleeps in the database", `(?i)\bpg_sleep\(`)
+	require.NoError(t, err)
+	require.True(t, rule.Match("SELECT PG_SLEEP(1)"))
+	require.False(t, rule.Match("SELECT 1"))
+
+	_, err = NewLintRule("bad", "bad pattern", `(`)
+	require.Error(t, err)
+}
+
+// TestCheckLint tests that queries executed by a session are checked against
+// the lint rules.
+func TestCheckLint(t *testing.T) {
+	s := newSession(&memorySource{}, "TestCheckLint")
+	s.recording = recording{
+		{Typ: ConnQuery, Args: recordArgs{"SELECT *\n  FROM customers WHERE id = $1", nil}},
+		{Typ: ConnQuery, Args: recordArgs{"SELECT *\n  FROM customers WHERE id = $1", nil}},
+		{Typ: ConnExec, Args: recordArgs{"DELETE FROM customers", nil}},
+	}
+	require.NoError(t, s.checkLint())
+
+	SetLintRules(SelectStarRule)
+	defer SetLintRules()
+	require.EqualError(t, s.checkLint(), "recording TestCheckLint has queries that violate lint rules:\n"+
+		"  select-star: "+SelectStarRule.Description+"\n"+
+		"    SELECT * FROM customers WHERE id = $1")
+}
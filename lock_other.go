@@ -0,0 +1,80 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+//go:build !darwin && !dragonfly && !freebsd && !illumos && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!illumos,!linux,!netbsd,!openbsd
+
+package copyist
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// lockFile acquires a lock by exclusively creating the file with the given
+// name, and blocks until the lock is available. The file records the process
+// ID and host name of the lock holder, since flock is not supported on this
+// platform. The lock is never broken automatically, since another process could
+// break it at the same time and both would then hold it. Instead, if the holder
+// is a process on this host that is no longer running, an error is returned
+// asking for the lock file to be removed. The returned function removes the lock
+// file.
+func lockFile(lockName string) (unlock func(), err error) {
+	host, _ := os.Hostname()
+	holder := fmt.Sprintf("%d %s", os.Getpid(), host)
+	for {
+		file, err := os.OpenFile(lockName, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0666)
+		if err == nil {
+			_, err = file.WriteString(holder)
+			if closeErr := file.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				os.Remove(lockName)
+				return nil, err
+			}
+			return func() { os.Remove(lockName) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+
+		if data, err := os.ReadFile(lockName); err == nil {
+			fields := strings.SplitN(string(data), " ", 2)
+			if len(fields) == 2 && fields[1] == host {
+				if pid, err := strconv.Atoi(fields[0]); err == nil && !processExists(pid) {
+					return nil, fmt.Errorf(
+						"recording file is locked by process %d, which is no longer running; "+
+							"remove %s if no other process is using it", pid, lockName)
+				}
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// processExists returns false if it can determine that no process with the
+// given ID is running on this host.
+func processExists(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	return !errors.Is(process.Signal(syscall.Signal(0)), os.ErrProcessDone)
+}
@@ -0,0 +1,72 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+//go:build darwin || dragonfly || freebsd || illumos || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd illumos linux netbsd openbsd
+
+package copyist
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile acquires an exclusive flock on the file with the given name,
+// creating it if necessary, and blocks until the lock is available. Since the
+// operating system releases the lock when its holder exits, a lock abandoned by
+// a crashed process never needs to be broken. The returned function removes the
+// lock file and then releases the lock.
+func lockFile(lockName string) (unlock func(), err error) {
+	for {
+		file, err := os.OpenFile(lockName, os.O_CREATE|os.O_RDWR, 0666)
+		if err != nil {
+			return nil, err
+		}
+		if err := flock(file, syscall.LOCK_EX); err != nil {
+			file.Close()
+			return nil, &os.PathError{Op: "flock", Path: lockName, Err: err}
+		}
+
+		// The previous holder removes the lock file before releasing the lock,
+		// so the file that was locked may no longer be the one at lockName. In
+		// that case, try again with the new file.
+		lockedInfo, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		if info, err := os.Stat(lockName); err != nil || !os.SameFile(info, lockedInfo) {
+			file.Close()
+			if err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+			continue
+		}
+
+		return func() {
+			os.Remove(lockName)
+			file.Close()
+		}, nil
+	}
+}
+
+// flock calls syscall.Flock on the given file, retrying if it is interrupted.
+func flock(file *os.File, how int) error {
+	for {
+		err := syscall.Flock(int(file.Fd()), how)
+		if err != syscall.EINTR {
+			return err
+		}
+	}
+}
@@ -0,0 +1,40 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+//go:build darwin || dragonfly || freebsd || illumos || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd illumos linux netbsd openbsd
+
+package copyist
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestLockFileAbandoned tests that a lock file left behind by a process that
+// exited without unlocking it does not prevent the lock from being acquired.
+func TestLockFileAbandoned(t *testing.T) {
+	lockName := filepath.Join(t.TempDir(), "abandoned.copyist.lock")
+	require.NoError(t, os.WriteFile(lockName, nil, 0666))
+
+	unlock, err := lockFile(lockName)
+	require.NoError(t, err)
+	unlock()
+
+	_, err = os.Stat(lockName)
+	require.True(t, os.IsNotExist(err))
+}
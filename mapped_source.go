@@ -0,0 +1,108 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package copyist
+
+import (
+	"os"
+	"sync"
+)
+
+// mappedFileSource is a fileSource that memory-maps the recording file rather
+// than reading it. See NewMappedFileSource for more details.
+type mappedFileSource struct {
+	fileSource
+}
+
+var _ lockableSource = mappedFileSource{}
+
+// fileMapping is the memory-mapped contents of a recording file, along with the
+// file attributes used to detect whether it has changed since it was mapped.
+type fileMapping struct {
+	info os.FileInfo
+	data []byte
+}
+
+// mappedFiles caches the mapping of each recording file read by a
+// mappedFileSource, keyed by path, so that a recording file is only mapped once
+// per version, rather than every time it is read.
+var mappedFiles struct {
+	sync.Mutex
+	files map[string]*fileMapping
+}
+
+// NewMappedFileSource returns a Source that is like the Source returned by
+// NewFileSource, except that it memory-maps the recording file rather than
+// copying its contents into memory. When playing back a recording, only the
+// parts of the file used by that recording are copied out of the mapping. This
+// is much faster and uses much less memory for very large recording files:
+//
+//	source := copyist.NewMappedFileSource("testdata/huge_test.copyist")
+//	defer copyist.OpenSource(t, source, t.Name()).Close()
+//
+// Each recording file is mapped once, and the mapping is reused until the file
+// is replaced or appended to, which are the only ways in which copyist changes
+// a recording file. Since the data read from the old mapping is still valid
+// until then, it is only released when the changed file is next read. Other
+// programs must not modify a recording file in place while it is mapped. On
+// platforms that do not support memory-mapped files, the recording file is
+// read instead.
+func NewMappedFileSource(pathName string) Source {
+	return mappedFileSource{fileSource{PathName: pathName}}
+}
+
+// ReadAll implements Source. The returned data must not be modified.
+func (s mappedFileSource) ReadAll() ([]byte, error) {
+	file, err := os.Open(s.PathName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	mappedFiles.Lock()
+	defer mappedFiles.Unlock()
+
+	mapping, ok := mappedFiles.files[s.PathName]
+	if ok {
+		if os.SameFile(mapping.info, info) && mapping.info.ModTime().Equal(info.ModTime()) &&
+			mapping.info.Size() == info.Size() {
+			return mapping.data, nil
+		}
+
+		// The file has been replaced or appended to since it was mapped, so
+		// release the old mapping.
+		delete(mappedFiles.files, s.PathName)
+		if err := unmapFile(mapping.data); err != nil {
+			return nil, err
+		}
+	}
+
+	if info.Size() == 0 {
+		return nil, nil
+	}
+	data, err := mapFile(file, int(info.Size()))
+	if err != nil {
+		return nil, err
+	}
+	if mappedFiles.files == nil {
+		mappedFiles.files = make(map[string]*fileMapping)
+	}
+	mappedFiles.files[s.PathName] = &fileMapping{info: info, data: data}
+	return data, nil
+}
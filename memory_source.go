@@ -0,0 +1,91 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package copyist
+
+import "io"
+
+// memorySource is a Source that keeps the recording file contents in memory
+// rather than persisting them.
+type memorySource struct {
+	data []byte
+}
+
+// NewMemorySource returns a Source that reads the given recording file contents
+// from memory. Recordings written to the Source replace those contents in
+// memory, rather than being persisted. This is useful for playing back
+// recordings that are stored in constants:
+//
+//	source := copyist.NewMemorySource([]byte(recording))
+//	defer copyist.OpenSource(t, source, t.Name()).Close()
+func NewMemorySource(data []byte) Source {
+	return &memorySource{data: data}
+}
+
+// ReadAll implements Source.
+func (s *memorySource) ReadAll() ([]byte, error) {
+	return s.data, nil
+}
+
+// WriteAll implements Source.
+func (s *memorySource) WriteAll(data []byte) error {
+	s.data = append([]byte(nil), data...)
+	return nil
+}
+
+// readWriteSource is a Source that reads and writes recording file contents
+// using an io.ReadWriter. Since reading drains the io.ReadWriter, the contents
+// are buffered by the first call to ReadAll, and later calls return the
+// buffered contents.
+type readWriteSource struct {
+	rw   io.ReadWriter
+	read bool
+	data []byte
+}
+
+// NewReadWriteSource returns a Source that reads recording file contents from
+// the given io.ReadWriter, and writes recordings to it. The first call to
+// ReadAll reads until EOF, and later calls return the same contents, or the
+// contents last written by WriteAll. WriteAll writes the entire recording file
+// in one call to Write. For example, recordings can be captured in memory using
+// a bytes.Buffer:
+//
+//	var buf bytes.Buffer
+//	closer := copyist.OpenSource(t, copyist.NewReadWriteSource(&buf), t.Name())
+func NewReadWriteSource(rw io.ReadWriter) Source {
+	return &readWriteSource{rw: rw}
+}
+
+// ReadAll implements Source.
+func (s *readWriteSource) ReadAll() ([]byte, error) {
+	if !s.read {
+		data, err := io.ReadAll(s.rw)
+		if err != nil {
+			return nil, err
+		}
+		s.read = true
+		s.data = data
+	}
+	return append([]byte(nil), s.data...), nil
+}
+
+// WriteAll implements Source.
+func (s *readWriteSource) WriteAll(data []byte) error {
+	if _, err := s.rw.Write(data); err != nil {
+		return err
+	}
+	s.read = true
+	s.data = append([]byte(nil), data...)
+	return nil
+}
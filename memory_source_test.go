@@ -0,0 +1,51 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package copyist
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestReadWriteSource tests that a ReadWriteSource returns the same contents
+// from every call to ReadAll, even though reading drains its io.ReadWriter.
+func TestReadWriteSource(t *testing.T) {
+	buf := bytes.NewBufferString("1=DriverOpen\t1:nil\n")
+	source := NewReadWriteSource(buf)
+
+	data, err := source.ReadAll()
+	require.NoError(t, err)
+	require.Equal(t, "1=DriverOpen\t1:nil\n", string(data))
+	require.Zero(t, buf.Len())
+
+	data, err = source.ReadAll()
+	require.NoError(t, err)
+	require.Equal(t, "1=DriverOpen\t1:nil\n", string(data))
+
+	// The returned contents are a copy, so modifying them has no effect.
+	data[0] = '2'
+	data, err = source.ReadAll()
+	require.NoError(t, err)
+	require.Equal(t, "1=DriverOpen\t1:nil\n", string(data))
+
+	// Contents written to the source are returned by later reads.
+	require.NoError(t, source.WriteAll([]byte("2=ConnPrepare\t2:\"SELECT 1\"\n")))
+	require.Equal(t, "2=ConnPrepare\t2:\"SELECT 1\"\n", buf.String())
+	data, err = source.ReadAll()
+	require.NoError(t, err)
+	require.Equal(t, "2=ConnPrepare\t2:\"SELECT 1\"\n", string(data))
+}
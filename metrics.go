@@ -0,0 +1,73 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package copyist
+
+import (
+	"expvar"
+	"sync/atomic"
+)
+
+// Metrics are cumulative counters that describe the activity of the copyist
+// sessions in this process. They are also published via expvar as the
+// "copyist" variable, so that they can be monitored along with other expvar
+// variables (e.g. at /debug/vars). Large recordings and mismatches during
+// playback are early signs that recordings need attention.
+type Metrics struct {
+	// SessionsOpened is the number of recording and playback sessions that
+	// have been opened.
+	SessionsOpened int64
+
+	// RecordsRecorded is the number of calls to driver methods that have been
+	// recorded.
+	RecordsRecorded int64
+
+	// RecordsPlayedBack is the number of recorded calls that have been played
+	// back.
+	RecordsPlayedBack int64
+
+	// Mismatches is the number of calls during playback that did not match
+	// the recording.
+	Mismatches int64
+
+	// RecordingsWritten is the number of recordings that have been written to
+	// their sources.
+	RecordingsWritten int64
+
+	// BytesWritten is the number of bytes that have been written to sources in
+	// order to save recordings.
+	BytesWritten int64
+}
+
+// metrics stores the current values of the copyist metrics. They are updated
+// atomically, since sessions may run concurrently (see OpenParallel).
+var metrics Metrics
+
+func init() {
+	expvar.Publish("copyist", expvar.Func(func() interface{} {
+		return ReadMetrics()
+	}))
+}
+
+// ReadMetrics returns the current values of the copyist metrics.
+func ReadMetrics() Metrics {
+	return Metrics{
+		SessionsOpened:    atomic.LoadInt64(&metrics.SessionsOpened),
+		RecordsRecorded:   atomic.LoadInt64(&metrics.RecordsRecorded),
+		RecordsPlayedBack: atomic.LoadInt64(&metrics.RecordsPlayedBack),
+		Mismatches:        atomic.LoadInt64(&metrics.Mismatches),
+		RecordingsWritten: atomic.LoadInt64(&metrics.RecordingsWritten),
+		BytesWritten:      atomic.LoadInt64(&metrics.BytesWritten),
+	}
+}
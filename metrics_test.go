@@ -0,0 +1,67 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package copyist
+
+import (
+	"encoding/json"
+	"expvar"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestMetrics tests that sessions update the metrics, and that the metrics are
+// published via expvar.
+func TestMetrics(t *testing.T) {
+	before := ReadMetrics()
+
+	// Record a session.
+	*recordFlag = true
+	visitedRecording = true
+	defer func() { *recordFlag = false }()
+
+	source := &memorySource{}
+	s := newSession(source, "TestMetrics")
+	c := &proxyConn{driver: &proxyDriver{driverName: "fake"}, session: s}
+	s.AddRecord(c, &record{Typ: DriverOpen, Args: recordArgs{nil}})
+	s.AddRecord(c, &record{Typ: ConnExec, Args: recordArgs{"DELETE FROM customers", nil}})
+	s.Close()
+
+	after := ReadMetrics()
+	require.Equal(t, int64(1), after.SessionsOpened-before.SessionsOpened)
+	require.Equal(t, int64(2), after.RecordsRecorded-before.RecordsRecorded)
+	require.Equal(t, int64(1), after.RecordingsWritten-before.RecordingsWritten)
+	require.Equal(t, int64(len(source.data)), after.BytesWritten-before.BytesWritten)
+
+	// Play back the session, with a mismatched call.
+	*recordFlag = false
+	before = after
+	s = newSession(source, "TestMetrics")
+	s.OnDriverOpen(c.driver)
+	c = &proxyConn{driver: c.driver, session: s}
+	_, err := s.VerifyRecord(c, DriverOpen)
+	require.NoError(t, err)
+	_, err = s.VerifyRecordWithStringArg(c, ConnExec, "DELETE FROM orders")
+	require.Error(t, err)
+
+	after = ReadMetrics()
+	require.Equal(t, int64(1), after.SessionsOpened-before.SessionsOpened)
+	require.Equal(t, int64(2), after.RecordsPlayedBack-before.RecordsPlayedBack)
+	require.Equal(t, int64(1), after.Mismatches-before.Mismatches)
+
+	var published Metrics
+	require.NoError(t, json.Unmarshal([]byte(expvar.Get("copyist").String()), &published))
+	require.Equal(t, after, published)
+}
@@ -0,0 +1,235 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package copyist
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"regexp"
+)
+
+// Migration transforms the records of an existing recording, so that it
+// reflects a small change to the database schema or to the application's
+// queries without the test having to be re-recorded. A migration is called once
+// for each connection in the recording, with the records that the connection
+// made, in order. It modifies the records in place, and returns true if it
+// changed any of them. Records cannot be added or removed.
+type Migration func(records []Record) bool
+
+// Migrate applies the given migrations, in order, to the recording having the
+// given name. It returns true if any of the migrations changed the recording.
+// The change is not persisted until Write is called.
+func (f *RecordingFile) Migrate(recordingName string, migrations ...Migration) (bool, error) {
+	rec, err := f.getRecording(recordingName)
+	if err != nil {
+		return false, err
+	}
+
+	keys := make([]streamKey, len(rec))
+	if streams := f.Metadata(recordingName)[streamsMetadataKey]; streams != "" {
+		keys, err = parseStreams(streams, len(rec))
+		if err != nil {
+			return false, fmt.Errorf("error parsing streams of recording %q: %v", recordingName, err)
+		}
+	}
+
+	// Group the records by the connection that made them, so that each
+	// migration sees the queries and results of one connection at a time.
+	var order []streamKey
+	streams := make(map[streamKey][]int)
+	for i, key := range keys {
+		if _, ok := streams[key]; !ok {
+			order = append(order, key)
+		}
+		streams[key] = append(streams[key], i)
+	}
+
+	changed := false
+	newRec := make(recording, len(rec))
+	for _, key := range order {
+		indexes := streams[key]
+
+		// Copy each record, since records can be shared with other recordings
+		// in the same file, which are not being migrated.
+		records := make([]Record, len(indexes))
+		for j, i := range indexes {
+			records[j] = Record{Type: rec[i].Typ.String(), Args: copyMigrationArgs(rec[i].Args)}
+		}
+		for _, migration := range migrations {
+			if migration(records) {
+				changed = true
+			}
+		}
+
+		for j, i := range indexes {
+			typ, ok := strToRecType[records[j].Type]
+			if !ok {
+				return false, fmt.Errorf("record type %v is not recognized", records[j].Type)
+			}
+			newRec[i] = &record{Typ: typ, Args: records[j].Args}
+		}
+	}
+
+	if changed {
+		f.recordingSource.AddRecording(recordingName, newRec)
+	}
+	return changed, nil
+}
+
+// copyMigrationArgs returns a copy of the given record arguments that can be
+// modified by migrations. Columns and rows are copied as well, since
+// migrations modify their elements.
+func copyMigrationArgs(args recordArgs) []interface{} {
+	newArgs := make([]interface{}, len(args))
+	for i, arg := range args {
+		switch t := arg.(type) {
+		case []string:
+			newArgs[i] = append([]string(nil), t...)
+		case []driver.Value:
+			newArgs[i] = append([]driver.Value(nil), t...)
+		default:
+			newArgs[i] = arg
+		}
+	}
+	return newArgs
+}
+
+// ReplaceQuery returns a Migration that replaces the SQL text of recorded
+// queries, statements and prepared statements that are exactly equal to
+// oldQuery with newQuery. It is typically used along with AddColumn or
+// RenameColumn, when the application's query changes along with the schema.
+func ReplaceQuery(oldQuery, newQuery string) Migration {
+	return func(records []Record) bool {
+		changed := false
+		for i := range records {
+			rec := &records[i]
+			switch rec.Type {
+			case "ConnExec", "ConnQuery", "ConnPrepare":
+				if query, ok := rec.Args[0].(string); ok && query == oldQuery {
+					rec.Args[0] = newQuery
+					changed = true
+				}
+			}
+		}
+		return changed
+	}
+}
+
+// RenameColumn returns a Migration that renames result columns named oldName
+// to newName, in the results of queries that match the given regular
+// expression. If query is nil, then the columns are renamed in the results of
+// every query.
+func RenameColumn(query *regexp.Regexp, oldName, newName string) Migration {
+	return func(records []Record) bool {
+		changed := false
+		forEachResult(records, query, func(rec *Record) {
+			if rec.Type != "RowsColumns" {
+				return
+			}
+			cols, _ := rec.Args[0].([]string)
+			for i := range cols {
+				if cols[i] == oldName {
+					cols[i] = newName
+					changed = true
+				}
+			}
+		})
+		return changed
+	}
+}
+
+// AddColumn returns a Migration that adds a result column having the given name
+// to the results of queries that match the given regular expression, after
+// their existing columns. Each row of the results is given the value of the
+// new column, which is typically the column's default value. If query is nil,
+// then the column is added to the results of every query.
+//
+// Note that the SQL text of the recorded queries is not changed. If the
+// application now selects the new column explicitly, also apply ReplaceQuery
+// before AddColumn, and match the new SQL text.
+func AddColumn(query *regexp.Regexp, name string, value driver.Value) Migration {
+	return func(records []Record) bool {
+		changed := false
+		adding := false
+		forEachResult(records, query, func(rec *Record) {
+			switch rec.Type {
+			case "RowsColumns":
+				cols, _ := rec.Args[0].([]string)
+				rec.Args[0] = append(cols, name)
+				adding = true
+				changed = true
+
+			case "RowsNext":
+				// Only add the value to rows whose columns were added to,
+				// and not to rows that end the results with an error.
+				row, ok := rec.Args[0].([]driver.Value)
+				if adding && ok && rec.Args[1] == nil {
+					rec.Args[0] = append(row, value)
+				}
+
+			case "RowsNextResultSet":
+				// The next result set has its own columns.
+				adding = false
+			}
+		})
+		return changed
+	}
+}
+
+// forEachResult calls the given function for each RowsColumns, RowsNext and
+// RowsNextResultSet record in the given records that returns the results of
+// a query that matches the given regular expression. If query is nil, then the
+// function is called for the results of every query. Records are attributed to
+// the query that was most recently executed, as database/sql reads the
+// results of one query at a time on each connection.
+func forEachResult(records []Record, query *regexp.Regexp, fn func(rec *Record)) {
+	stmts := make(map[int]string)
+	lastPrepared := ""
+	matches := query == nil
+	for i := range records {
+		rec := &records[i]
+		switch rec.Type {
+		case "ConnPrepare":
+			lastPrepared, _ = rec.Args[0].(string)
+			if len(rec.Args) > 2 {
+				if id, ok := rec.Args[2].(int); ok {
+					stmts[id] = lastPrepared
+				}
+			}
+
+		case "ConnQuery":
+			text, _ := rec.Args[0].(string)
+			matches = query == nil || query.MatchString(text)
+
+		case "StmtQuery":
+			// Recordings made before statements had IDs use the query of the
+			// last prepared statement.
+			text := lastPrepared
+			if len(rec.Args) > 2 {
+				if id, ok := rec.Args[2].(int); ok {
+					if stmtQuery, ok := stmts[id]; ok {
+						text = stmtQuery
+					}
+				}
+			}
+			matches = query == nil || query.MatchString(text)
+
+		case "RowsColumns", "RowsNext", "RowsNextResultSet":
+			if matches {
+				fn(rec)
+			}
+		}
+	}
+}
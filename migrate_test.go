@@ -0,0 +1,92 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package copyist
+
+import (
+	"database/sql/driver"
+	"errors"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestMigrate tests that migrations rename and add columns in the results of
+// matching queries, attributing each result to the query of its own
+// connection, and without changing other recordings that share records.
+func TestMigrate(t *testing.T) {
+	source := NewMemorySource([]byte(`
+1=DriverOpen	1:nil
+2=ConnQuery	2:"SELECT id, name FROM users"	1:nil
+3=ConnQuery	2:"SELECT id FROM orders"	1:nil
+4=RowsColumns	9:["id","name"]
+5=RowsNext	11:[4:1,2:"Andy"]	1:nil
+6=RowsColumns	9:["id"]
+7=RowsNext	11:[4:2]	1:nil
+8=RowsNext	11:[]	7:"EOF"
+9=ConnPrepare	2:"SELECT name FROM users WHERE id = $1"	1:nil	3:1
+10=StmtQuery	1:nil	3:1	3:1
+11=RowsColumns	9:["name"]
+12=RowsNext	11:[2:"Andy"]	1:nil
+
+"TestMigrate"=1,1,2,3,4,5,6,7,8,9,10,11,12
+"TestShared"=1,2,4,5,8
+"TestUnchanged"=1,3,6,7,8
+"TestMigrate"@streams="pq"#1*1 "pq"#2*1 "pq"#1*1 "pq"#2*1 "pq"#1*2 "pq"#2*3 "pq"#1*4
+`))
+	file, err := ReadRecordingFile(source)
+	require.NoError(t, err)
+
+	users := regexp.MustCompile(`FROM users`)
+	migrations := []Migration{
+		ReplaceQuery("SELECT id, name FROM users", "SELECT id, full_name, email FROM users"),
+		RenameColumn(users, "name", "full_name"),
+		AddColumn(users, "email", nil),
+	}
+	for _, name := range []string{"TestMigrate", "TestUnchanged"} {
+		changed, err := file.Migrate(name, migrations...)
+		require.NoError(t, err)
+		require.Equal(t, name == "TestMigrate", changed)
+	}
+	_, err = file.Migrate("TestMissing", migrations...)
+	require.EqualError(t, err, "no recording exists with this name: TestMissing")
+	require.NoError(t, file.Write())
+
+	file, err = ReadRecordingFile(source)
+	require.NoError(t, err)
+	records, err := file.Recording("TestMigrate")
+	require.NoError(t, err)
+	require.Equal(t, []Record{
+		{Type: "DriverOpen", Args: []interface{}{nil}},
+		{Type: "DriverOpen", Args: []interface{}{nil}},
+		{Type: "ConnQuery", Args: []interface{}{"SELECT id, full_name, email FROM users", nil}},
+		{Type: "ConnQuery", Args: []interface{}{"SELECT id FROM orders", nil}},
+		{Type: "RowsColumns", Args: []interface{}{[]string{"id", "full_name", "email"}}},
+		{Type: "RowsNext", Args: []interface{}{[]driver.Value{int64(1), "Andy", nil}, nil}},
+		{Type: "RowsColumns", Args: []interface{}{[]string{"id"}}},
+		{Type: "RowsNext", Args: []interface{}{[]driver.Value{int64(2)}, nil}},
+		{Type: "RowsNext", Args: []interface{}{[]driver.Value{}, errors.New("EOF")}},
+		{Type: "ConnPrepare", Args: []interface{}{"SELECT name FROM users WHERE id = $1", nil, 1}},
+		{Type: "StmtQuery", Args: []interface{}{nil, 1, 1}},
+		{Type: "RowsColumns", Args: []interface{}{[]string{"full_name", "email"}}},
+		{Type: "RowsNext", Args: []interface{}{[]driver.Value{"Andy", nil}, nil}},
+	}, records)
+
+	// Recordings that share records with the migrated recording are unchanged.
+	records, err = file.Recording("TestShared")
+	require.NoError(t, err)
+	require.Equal(t, []string{"id", "name"}, records[2].Args[0])
+	require.Equal(t, []driver.Value{int64(1), "Andy"}, records[3].Args[0])
+}
@@ -0,0 +1,160 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package copyist
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/cockroachdb/copyist/internal/linediff"
+)
+
+// MismatchError is the error returned by copyist's driver during playback when
+// the application makes a call that does not match the recording. It is also
+// reported to the test when the session is closed. Test helpers can use
+// errors.As to inspect the details of the mismatch:
+//
+//	var mismatch *copyist.MismatchError
+//	if errors.As(err, &mismatch) {
+//	  fmt.Println(mismatch.Call, mismatch.Expected)
+//	}
+type MismatchError struct {
+	// RecordingName is the name of the recording that was being played back.
+	RecordingName string
+
+	// Index is the offset of the expected record within the recording, or -1
+	// if the recording had no more records to play back.
+	Index int
+
+	// Expected is the recorded call that the application was expected to make,
+	// or nil if the recording had no more records to play back.
+	Expected *Record
+
+	// Call is the name of the driver method that the application actually
+	// called (e.g. "ConnQuery").
+	Call string
+
+	// Args are the arguments of the actual call that did not match the
+	// recording, such as the SQL text of a query, or nil if the call itself
+	// was unexpected.
+	Args []interface{}
+
+	// err is the error that describes the mismatch, along with the stack
+	// trace of the call.
+	err error
+}
+
+// Error returns a description of the mismatch.
+func (e *MismatchError) Error() string {
+	return e.err.Error()
+}
+
+// Format implements fmt.Formatter, so that formatting the error with "%+v"
+// includes the stack trace of the mismatched call.
+func (e *MismatchError) Format(f fmt.State, verb rune) {
+	if formatter, ok := e.err.(fmt.Formatter); ok {
+		formatter.Format(f, verb)
+		return
+	}
+	io.WriteString(f, e.Error())
+}
+
+// exportRecord returns the exported form of the given record.
+func exportRecord(rec *record) *Record {
+	return &Record{Type: rec.Typ.String(), Args: rec.Args}
+}
+
+// mismatchContextRecords is the number of records before and after a
+// mismatched record that are shown when playback fails.
+const mismatchContextRecords = 3
+
+// recordContext describes where the given position falls within the session's
+// recording, along with the records that surround it, so that playback
+// mismatches can be understood without hunting through the recording file. For
+// example:
+//
+//	at record #4 of 9 in recording "TestQuery", after playing back 3 records:
+//	     #1  ConnQuery "SELECT name FROM customers"
+//	     #2  RowsColumns
+//	     #3  RowsNext
+//	  >  #4  ConnQuery "SELECT id FROM customers"
+//	     #5  RowsColumns
+//
+// Only records in the same stream are shown, since records made by other
+// connections may have been interleaved differently.
+func (s *session) recordContext(pos recordPos) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stream, index := pos.stream, pos.index
+
+	played := 0
+	for _, other := range s.streams {
+		played += other.index
+	}
+
+	var b strings.Builder
+	if index < len(stream.records) {
+		fmt.Fprintf(&b, "at record #%d of %d in recording %q, after playing back %d records:\n",
+			stream.offset(index), len(s.recording), s.recordingName, played)
+	} else {
+		fmt.Fprintf(&b, "at end of recording %q, after playing back %d of %d records:\n",
+			s.recordingName, played, len(s.recording))
+	}
+
+	start := index - mismatchContextRecords
+	if start < 0 {
+		start = 0
+	}
+	end := index + mismatchContextRecords + 1
+	if end > len(stream.records) {
+		end = len(stream.records)
+	}
+	for i := start; i < end; i++ {
+		marker := "   "
+		if i == index {
+			marker = "  >"
+		}
+		rec := stream.records[i]
+		fmt.Fprintf(&b, "%s  #%-3d %s", marker, stream.offset(i), rec.Typ.String())
+		if query, ok := recordQuery(rec); ok {
+			fmt.Fprintf(&b, " %q", query)
+		}
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// unifiedDiff returns a line-by-line diff of the expected and actual text,
+// in the style of the unified diff format. Lines that are only in the expected
+// text are prefixed with "-", lines that are only in the actual text are
+// prefixed with "+", and lines that are in both are prefixed with a space.
+func unifiedDiff(expected, actual string) string {
+	return formatDiff(linediff.Lines(strings.Split(expected, "\n"), strings.Split(actual, "\n")))
+}
+
+// formatDiff formats the given diff in the style of the unified diff format, as
+// described by unifiedDiff.
+func formatDiff(lines []linediff.Line) string {
+	var sb strings.Builder
+	sb.WriteString("--- expected\n+++ actual\n")
+	for _, line := range lines {
+		sb.WriteByte(line.Op)
+		sb.WriteString(line.Text)
+		sb.WriteByte('\n')
+	}
+	return sb.String()
+}
@@ -0,0 +1,101 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package copyist
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestMismatchDiagnostics tests that playback mismatches describe the
+// difference, the surrounding records, and the progress through the recording.
+func TestMismatchDiagnostics(t *testing.T) {
+	s := newSession(&memorySource{}, "TestMismatch")
+	s.recording = recording{
+		{Typ: DriverOpen, Args: recordArgs{nil}},
+		{Typ: ConnQuery, Args: recordArgs{"SELECT name\nFROM customers", nil}},
+		{Typ: RowsColumns, Args: recordArgs{[]string{"name"}}},
+		{Typ: ConnQuery, Args: recordArgs{"SELECT id\nFROM customers\nWHERE id = 1", nil}},
+		{Typ: RowsColumns, Args: recordArgs{[]string{"id"}}},
+	}
+	s.streams = map[streamKey]*recordStream{{}: {records: s.recording}}
+	c := &proxyConn{driver: &proxyDriver{driverName: "fake"}, session: s}
+
+	_, err := s.VerifyRecord(c, DriverOpen)
+	require.NoError(t, err)
+	_, err = s.VerifyRecordWithStringArg(c, ConnQuery, "SELECT name\nFROM customers")
+	require.NoError(t, err)
+
+	_, err = s.VerifyRecord(c, ConnQuery)
+	require.EqualError(t, err, "unexpected call to ConnQuery, expected call to RowsColumns\n\n"+
+		"at record #2 of 5 in recording \"TestMismatch\", after playing back 2 records:\n"+
+		"     #0   DriverOpen\n"+
+		"     #1   ConnQuery \"SELECT name FROM customers\"\n"+
+		"  >  #2   RowsColumns\n"+
+		"     #3   ConnQuery \"SELECT id FROM customers WHERE id = 1\"\n"+
+		"     #4   RowsColumns\n"+
+		"\nDo you need to regenerate the recording with the -record flag?")
+
+	_, err = s.VerifyRecord(c, RowsColumns)
+	require.NoError(t, err)
+	_, err = s.VerifyRecordWithStringArg(c, ConnQuery, "SELECT id\nFROM customers\nWHERE id = 2")
+	require.EqualError(t, err, "mismatched argument to ConnQuery\n\n"+
+		"--- expected\n"+
+		"+++ actual\n"+
+		" SELECT id\n"+
+		" FROM customers\n"+
+		"-WHERE id = 1\n"+
+		"+WHERE id = 2\n"+
+		"\n"+
+		"at record #3 of 5 in recording \"TestMismatch\", after playing back 4 records:\n"+
+		"     #0   DriverOpen\n"+
+		"     #1   ConnQuery \"SELECT name FROM customers\"\n"+
+		"     #2   RowsColumns\n"+
+		"  >  #3   ConnQuery \"SELECT id FROM customers WHERE id = 1\"\n"+
+		"     #4   RowsColumns\n"+
+		"\nDo you need to regenerate the recording with the -record flag?")
+
+	var mismatch *MismatchError
+	require.True(t, errors.As(err, &mismatch))
+	require.Equal(t, "TestMismatch", mismatch.RecordingName)
+	require.Equal(t, 3, mismatch.Index)
+	require.Equal(t, &Record{
+		Type: "ConnQuery",
+		Args: []interface{}{"SELECT id\nFROM customers\nWHERE id = 1", nil},
+	}, mismatch.Expected)
+	require.Equal(t, "ConnQuery", mismatch.Call)
+	require.Equal(t, []interface{}{"SELECT id\nFROM customers\nWHERE id = 2"}, mismatch.Args)
+
+	_, err = s.VerifyRecord(c, RowsColumns)
+	require.NoError(t, err)
+	_, err = s.VerifyRecord(c, TxCommit)
+	require.True(t, errors.As(err, &mismatch))
+	require.Equal(t, -1, mismatch.Index)
+	require.Nil(t, mismatch.Expected)
+	require.Equal(t, "TxCommit", mismatch.Call)
+
+	// The first mismatch is reported when the session is finished.
+	require.Contains(t, s.verificationErr.Error(), "unexpected call to ConnQuery")
+}
+
+// TestUnifiedDiff tests the line-by-line diff of expected and actual text.
+func TestUnifiedDiff(t *testing.T) {
+	require.Equal(t, "--- expected\n+++ actual\n-SELECT 1\n+SELECT 2\n",
+		unifiedDiff("SELECT 1", "SELECT 2"))
+	require.Equal(t, "--- expected\n+++ actual\n a\n-b\n c\n+d\n",
+		unifiedDiff("a\nb\nc", "a\nc\nd"))
+}
@@ -0,0 +1,167 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package copyist
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// hasOrderBy returns true if the given query contains an ORDER BY clause. It
+// is a simple textual check, so it can be fooled by ORDER BY clauses that only
+// apply to a sub-query.
+func hasOrderBy(query string) bool {
+	return strings.Contains(strings.Join(strings.Fields(strings.ToUpper(query)), " "), "ORDER BY")
+}
+
+// queryResult is the list of rows returned by one execution of a query. Each
+// row is formatted as it would be in a recording file.
+type queryResult struct {
+	query string
+	rows  []string
+}
+
+// queryResults returns the result of each query executed in the given stream
+// of records, in order.
+func queryResults(stream recording) []queryResult {
+	var results []queryResult
+	stmts := make(map[int]string)
+	lastPrepared := ""
+	current := -1
+	for _, rec := range stream {
+		switch rec.Typ {
+		case ConnPrepare:
+			lastPrepared = rec.Args[0].(string)
+			if len(rec.Args) > 2 {
+				stmts[rec.Args[2].(int)] = lastPrepared
+			}
+
+		case ConnQuery:
+			results = append(results, queryResult{query: rec.Args[0].(string)})
+			current = len(results) - 1
+
+		case StmtQuery:
+			// Recordings made before statements had IDs use the query of the
+			// last prepared statement.
+			query := lastPrepared
+			if len(rec.Args) > 2 {
+				if stmtQuery, ok := stmts[rec.Args[2].(int)]; ok {
+					query = stmtQuery
+				}
+			}
+			results = append(results, queryResult{query: query})
+			current = len(results) - 1
+
+		case RowsNext:
+			if current != -1 && rec.Args[1] == nil {
+				results[current].rows = append(results[current].rows, formatValueWithType(rec.Args[0]))
+			}
+		}
+	}
+	return results
+}
+
+// reorderedQueries returns the queries that returned the same rows in a
+// different order in the previous and next streams of a recording. Queries are
+// matched up in the order they were executed by each stream, until the streams
+// execute different queries.
+func reorderedQueries(prev, next map[streamKey]*recordStream) []string {
+	var queries []string
+	for key, nextStream := range next {
+		prevStream, ok := prev[key]
+		if !ok {
+			continue
+		}
+
+		prevResults := queryResults(prevStream.records)
+		nextResults := queryResults(nextStream.records)
+		for i := 0; i < len(prevResults) && i < len(nextResults); i++ {
+			if prevResults[i].query != nextResults[i].query {
+				break
+			}
+			if isReordered(prevResults[i].rows, nextResults[i].rows) {
+				queries = append(queries, nextResults[i].query)
+			}
+		}
+	}
+	return queries
+}
+
+// isReordered returns true if the given lists of rows contain the same rows,
+// but in a different order.
+func isReordered(prev, next []string) bool {
+	if len(prev) != len(next) {
+		return false
+	}
+
+	same := true
+	counts := make(map[string]int, len(prev))
+	for i := range prev {
+		if prev[i] != next[i] {
+			same = false
+		}
+		counts[prev[i]]++
+		counts[next[i]]--
+	}
+	if same {
+		return false
+	}
+	for _, count := range counts {
+		if count != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// formatQueries formats the given queries as a sorted list of quoted strings,
+// like:
+//
+//	["SELECT * FROM customers","SELECT * FROM orders"]
+func formatQueries(queries map[string]bool) string {
+	sorted := make([]string, 0, len(queries))
+	for query := range queries {
+		sorted = append(sorted, query)
+	}
+	sort.Strings(sorted)
+
+	var b strings.Builder
+	b.WriteByte('[')
+	for i, query := range sorted {
+		if i != 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(strconv.Quote(query))
+	}
+	b.WriteByte(']')
+	return b.String()
+}
+
+// parseQueries parses a list of queries in the format produced by
+// formatQueries.
+func parseQueries(s string) ([]string, error) {
+	queries, err := parseSlice(s)
+	if err != nil {
+		return nil, err
+	}
+	for i := range queries {
+		queries[i], err = strconv.Unquote(queries[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return queries, nil
+}
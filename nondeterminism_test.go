@@ -0,0 +1,89 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package copyist
+
+import (
+	"database/sql/driver"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHasOrderBy(t *testing.T) {
+	require.True(t, hasOrderBy("SELECT * FROM customers ORDER BY id"))
+	require.True(t, hasOrderBy("select * from customers order\n  by id"))
+	require.False(t, hasOrderBy("SELECT * FROM customers"))
+	require.False(t, hasOrderBy("SELECT * FROM orders_by_customer"))
+}
+
+// TestNondeterministicQueries tests that queries are flagged when they return
+// multiple rows without an ORDER BY clause, or when they return rows in a
+// different order than the previous recording.
+func TestNondeterministicQueries(t *testing.T) {
+	*recordFlag = true
+	visitedRecording = true
+	defer func() { *recordFlag = false }()
+
+	source := &memorySource{data: []byte(`
+1=DriverOpen	1:nil
+2=ConnQuery	2:"SELECT name FROM customers ORDER BY city"	1:nil
+3=RowsNext	11:[2:"Andy"]	1:nil
+4=RowsNext	11:[2:"Jay"]	1:nil
+5=RowsNext	11:[]	7:"EOF"
+
+"TestNondeterministicQueries"=1,2,3,4,5
+`)}
+
+	s := newSession(source, "TestNondeterministicQueries")
+	c := &proxyConn{driver: &proxyDriver{driverName: "fake"}, session: s}
+	query := func(query string, names ...string) {
+		s.AddRecord(c, &record{Typ: ConnQuery, Args: recordArgs{query, nil}})
+		rows := &proxyRows{conn: c, query: query, rows: &fakeRows{cols: []string{"name"}}}
+		for _, name := range names {
+			rows.rows.(*fakeRows).rows = append(rows.rows.(*fakeRows).rows, []driver.Value{name})
+		}
+		dest := make([]driver.Value, 1)
+		for rows.Next(dest) != io.EOF {
+		}
+	}
+
+	s.AddRecord(c, &record{Typ: DriverOpen, Args: recordArgs{nil}})
+	query("SELECT name FROM customers ORDER BY city", "Jay", "Andy")
+	query("SELECT name FROM customers WHERE id=1", "Andy")
+	query("SELECT name FROM customers", "Andy", "Jay")
+	s.Close()
+
+	require.Equal(t, map[string]bool{
+		"SELECT name FROM customers ORDER BY city": true,
+		"SELECT name FROM customers":               true,
+	}, s.nondeterministic)
+
+	file, err := ReadRecordingFile(source)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"SELECT name FROM customers",
+		"SELECT name FROM customers ORDER BY city",
+	}, file.NondeterministicQueries("TestNondeterministicQueries"))
+}
+
+func TestIsReordered(t *testing.T) {
+	require.False(t, isReordered(nil, nil))
+	require.False(t, isReordered([]string{"a", "b"}, []string{"a", "b"}))
+	require.True(t, isReordered([]string{"a", "b"}, []string{"b", "a"}))
+	require.False(t, isReordered([]string{"a", "b"}, []string{"b", "c"}))
+	require.False(t, isReordered([]string{"a", "a", "b"}, []string{"a", "b", "b"}))
+	require.False(t, isReordered([]string{"a"}, []string{"a", "b"}))
+}
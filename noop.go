@@ -0,0 +1,60 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package copyist
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"sync"
+)
+
+// noopDriver is the driver registered by Register in no-op mode. It opens
+// connections with the wrapped driver, without recording them.
+type noopDriver struct {
+	// driverName is the name of the wrapped driver.
+	driverName string
+
+	// once fetches the wrapped driver the first time that a connection is
+	// opened, and wrapped is the driver that it fetches, or err is the error
+	// that was returned when fetching it.
+	once    sync.Once
+	wrapped driver.Driver
+	err     error
+}
+
+// Open opens a connection using the wrapped driver.
+func (d *noopDriver) Open(name string) (driver.Conn, error) {
+	d.once.Do(func() {
+		// Open the database in order to get the sql.Driver object to wrap.
+		var db *sql.DB
+		db, d.err = sql.Open(d.driverName, name)
+		if d.err == nil {
+			d.wrapped = db.Driver()
+			db.Close()
+		}
+	})
+	if d.err != nil {
+		return nil, d.err
+	}
+	return d.wrapped.Open(name)
+}
+
+// noopCloser is the io.Closer returned by the Open functions in no-op mode.
+type noopCloser struct{}
+
+// Close does nothing.
+func (noopCloser) Close() error {
+	return nil
+}
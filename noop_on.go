@@ -0,0 +1,31 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+//go:build copyist_noop
+// +build copyist_noop
+
+package copyist
+
+// noopMode is true if copyist was built with the "copyist_noop" build tag. In
+// that mode, copyist does not define the "record" flag, and its drivers and
+// sessions are passthrough no-ops that never record or play back calls. This
+// allows shared helper packages that import copyist to be linked into
+// production binaries, built with:
+//
+//	go build -tags copyist_noop ./...
+//
+// Since noopMode is a constant, the compiler removes the calls to the recording
+// and playback machinery from the entry points, so that the linker can leave it
+// out of the binary.
+const noopMode = true
@@ -0,0 +1,74 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package copyist
+
+import "strings"
+
+// normalizeLiterals is set by SetNormalizeLiterals.
+var normalizeLiterals bool
+
+// SetNormalizeLiterals determines whether the literals in SQL text are ignored
+// when matching calls against a recording during playback. If normalize is
+// true, then string and numeric literals in both the recorded and the actual
+// SQL are replaced by "?", and runs of whitespace are collapsed, before they
+// are compared. This way, inconsequential changes to literals (e.g. a different
+// date in a WHERE clause, or a renamed test fixture) do not force recordings to
+// be regenerated. Placeholders like $1 are not replaced. Recordings still store
+// the original SQL text, so that it can be used for debugging, and mismatches
+// still show it. Normalization is disabled by default.
+func SetNormalizeLiterals(normalize bool) {
+	normalizeLiterals = normalize
+}
+
+// stringArgMatches returns true if the recorded string argument of a record of
+// the given type matches the actual argument. Arguments of records that are
+// made by executing SQL text are matched using queriesMatch.
+func stringArgMatches(typ recordType, recorded, actual string) bool {
+	switch typ {
+	case ConnExec, ConnQuery, ConnPrepare:
+		return queriesMatch(recorded, actual)
+	}
+	return recorded == actual
+}
+
+// queriesMatch returns true if the recorded SQL text matches the actual SQL
+// text, ignoring differences in literals if SetNormalizeLiterals is enabled.
+func queriesMatch(recorded, actual string) bool {
+	if recorded == actual {
+		return true
+	}
+	if !normalizeLiterals {
+		return false
+	}
+	return normalizeQuery(recorded) == normalizeQuery(actual)
+}
+
+// normalizeQuery returns the given query with its string and numeric literals
+// replaced by "?", and its runs of whitespace collapsed to single spaces. For
+// example:
+//
+//	SELECT name FROM customers WHERE created > '2021-06-01' LIMIT 10
+//
+// is normalized to:
+//
+//	SELECT name FROM customers WHERE created > ? LIMIT ?
+func normalizeQuery(query string) string {
+	return replaceLiterals(strings.Join(strings.Fields(query), " "), func(lit, prefix string) string {
+		if lit[0] == '\'' || isDigit(lit[0]) {
+			return "?"
+		}
+		return lit
+	})
+}
@@ -0,0 +1,55 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package copyist
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestNormalizeLiterals tests that literals are ignored when matching SQL text
+// during playback, if SetNormalizeLiterals is enabled.
+func TestNormalizeLiterals(t *testing.T) {
+	s := newSession(&memorySource{}, "TestNormalizeLiterals")
+	s.recording = recording{
+		{Typ: ConnQuery, Args: recordArgs{"SELECT name FROM customers WHERE id = 1", nil}},
+		{Typ: ConnQuery, Args: recordArgs{"SELECT name FROM customers WHERE id = 1", nil}},
+	}
+	s.streams = map[streamKey]*recordStream{{}: {records: s.recording}}
+	c := &proxyConn{driver: &proxyDriver{driverName: "fake"}, session: s}
+
+	// Literals must match by default.
+	_, err := s.VerifyRecordWithStringArg(c, ConnQuery, "SELECT name FROM customers WHERE id = 2")
+	require.Error(t, err)
+
+	SetNormalizeLiterals(true)
+	defer SetNormalizeLiterals(false)
+	s.streams = map[streamKey]*recordStream{{}: {records: s.recording}}
+	rec, err := s.VerifyRecordWithStringArg(c, ConnQuery, "SELECT  name FROM customers\nWHERE id = 2")
+	require.NoError(t, err)
+	require.Equal(t, "SELECT name FROM customers WHERE id = 1", rec.Args[0])
+
+	// Placeholders are not literals.
+	_, err = s.VerifyRecordWithStringArg(c, ConnQuery, "SELECT name FROM customers WHERE id = $1")
+	require.Error(t, err)
+}
+
+// TestNormalizeQuery tests replacing the literals in SQL text.
+func TestNormalizeQuery(t *testing.T) {
+	require.Equal(t, "SELECT a FROM t WHERE b = ? AND c > ? AND d = $1 LIMIT ?",
+		normalizeQuery("SELECT a FROM t WHERE b = 'it''s' AND c > 1.5 AND d = $1 LIMIT 10"))
+	require.Equal(t, "SELECT t1.a FROM t1", normalizeQuery("SELECT t1.a\n\tFROM t1"))
+}
@@ -0,0 +1,74 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package copyist
+
+// NoticeCallback types a function that handles a notice or warning message sent
+// by the database server, such as a PostgreSQL NOTICE or WARNING.
+type NoticeCallback func(notice error)
+
+// noticeHandler is the callback set by SetNoticeHandler, or nil if it has not
+// been set.
+var noticeHandler NoticeCallback
+
+// SetNoticeHandler sets the callback function that handles notices passed to
+// Notice. While recording, each notice is passed to the callback as soon as it
+// is received. During playback, notices are passed to the callback at the same
+// point in the sequence of driver calls as they were received when recording,
+// so that code that reacts to notices can be tested. Calling SetNoticeHandler
+// with nil discards notices.
+func SetNoticeHandler(callback NoticeCallback) {
+	noticeHandler = callback
+}
+
+// Notice records a notice or warning message sent by the database server, and
+// passes it to the callback set by SetNoticeHandler. Drivers don't report
+// notices through the database/sql interface, so Notice must be called by the
+// driver's own notice handler. For example, with lib/pq:
+//
+//	copyist.SetNoticeHandler(handleNotice)
+//	connector = pq.ConnectorWithNoticeHandler(connector, func(notice *pq.Error) {
+//	  copyist.Notice(notice)
+//	})
+//
+// With pgx, call Notice from pgconn.Config.OnNotice, converting the
+// *pgconn.Notice to a *pgconn.PgError. Notices are recorded on the stream of
+// the connection that most recently called the driver, so notices received by
+// connections that call the driver concurrently may be attributed to the wrong
+// connection. During playback, the driver does not send notices, so Notice is
+// not called.
+func Notice(notice error) {
+	if s := currentSession; s != nil && IsRecording() {
+		s.mu.Lock()
+		c := s.lastConn
+		s.mu.Unlock()
+		if c != nil {
+			s.AddRecord(c, &record{Typ: ConnNotice, Args: recordArgs{notice}})
+		}
+	}
+	if noticeHandler != nil {
+		noticeHandler(notice)
+	}
+}
+
+// handleNotices passes the given notices, which were played back, to the
+// callback set by SetNoticeHandler.
+func handleNotices(notices []error) {
+	if noticeHandler == nil {
+		return
+	}
+	for _, notice := range notices {
+		noticeHandler(notice)
+	}
+}
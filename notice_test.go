@@ -0,0 +1,72 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package copyist
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/require"
+)
+
+// TestNotice tests that notices are recorded on the stream of the connection
+// that received them, and are passed to the notice handler during playback
+// before the call that received them.
+func TestNotice(t *testing.T) {
+	var handled []error
+	SetNoticeHandler(func(notice error) { handled = append(handled, notice) })
+	defer SetNoticeHandler(nil)
+
+	// Record.
+	s := newSession(&memorySource{}, "TestNotice")
+	currentSession = s
+	defer func() { currentSession = nil }()
+	c := &proxyConn{driver: &proxyDriver{driverName: "fake"}, session: s, id: 1}
+
+	*recordFlag = true
+	visitedRecording = true
+	notice := &pq.Error{Severity: "NOTICE", Code: "00000", Message: "table does not exist, skipping"}
+	func() {
+		defer func() { *recordFlag = false }()
+		unlock := s.SerializeCall(c)
+		Notice(notice)
+		s.AddRecord(c, &record{Typ: ConnExec, Args: recordArgs{"DROP TABLE IF EXISTS t", nil}})
+		unlock()
+	}()
+	require.Equal(t, []error{notice}, handled)
+	require.Equal(t, ConnNotice, s.recording[0].Typ)
+	require.Equal(t, ConnExec, s.recording[1].Typ)
+
+	// Play back, binding the connection to its stream even though the stream
+	// starts with a notice.
+	handled = nil
+	s.streams = map[streamKey]*recordStream{
+		{driverName: "fake", connID: 1}: {records: s.recording},
+		{driverName: "fake", connID: 2}: {records: recording{
+			{Typ: ConnExec, Args: recordArgs{"SELECT 1", nil}},
+		}},
+	}
+	c = &proxyConn{driver: &proxyDriver{driverName: "fake"}, session: s}
+	_, err := s.VerifyRecordWithStringArg(c, ConnExec, "DROP TABLE IF EXISTS t")
+	require.NoError(t, err)
+	require.Equal(t, []error{notice}, handled)
+
+	// Notices are passed to the handler, but not recorded, during playback.
+	other := errors.New("other notice")
+	Notice(other)
+	require.Equal(t, []error{notice, other}, handled)
+	require.Len(t, s.recording, 2)
+}
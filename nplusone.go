@@ -0,0 +1,183 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package copyist
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// nPlusOneThreshold is set by SetNPlusOneThreshold.
+var nPlusOneThreshold = 10
+
+// failOnNPlusOne is set by SetFailOnNPlusOne.
+var failOnNPlusOne bool
+
+// SetNPlusOneThreshold sets the number of times that a test must execute
+// queries having the same shape, differing only in a single argument, before
+// they are reported as a likely N+1 query pattern. Such patterns usually come
+// from code that executes a query for each row returned by another query, such
+// as an ORM that lazily loads each row's associations, and can often be
+// replaced by a single query with a join or an IN clause. The default threshold
+// is 10. Calling SetNPlusOneThreshold with zero disables detection.
+func SetNPlusOneThreshold(n int) {
+	nPlusOneThreshold = n
+}
+
+// SetFailOnNPlusOne determines what happens when a session detects a likely
+// N+1 query pattern (see SetNPlusOneThreshold). By default, a warning is logged
+// via testing.T.Logf. If fail is true, then the test fails instead.
+func SetFailOnNPlusOne(fail bool) {
+	failOnNPlusOne = fail
+}
+
+// checkNPlusOne returns an error if this session's recording executes queries
+// having the same shape, with a single varying argument, at least as many times
+// as the N+1 threshold.
+func (s *session) checkNPlusOne() error {
+	if nPlusOneThreshold == 0 {
+		return nil
+	}
+
+	counts := make(map[string]int)
+	for _, result := range queryResults(s.recording) {
+		if shape, ok := queryShape(result.query); ok {
+			counts[shape]++
+		}
+	}
+
+	var shapes []string
+	for shape, n := range counts {
+		if n >= nPlusOneThreshold {
+			shapes = append(shapes, shape)
+		}
+	}
+	if len(shapes) == 0 {
+		return nil
+	}
+	sort.Strings(shapes)
+
+	var b strings.Builder
+	for _, shape := range shapes {
+		fmt.Fprintf(&b, "\n  %d executions of: %s", counts[shape], shape)
+	}
+	return fmt.Errorf(
+		"recording %s has likely N+1 queries, which are executed once for each "+
+			"row of another query:%s\n\n"+
+			"Can you fetch the rows with a single query, using a join or an IN clause?",
+		s.recordingName, b.String())
+}
+
+// queryShape returns the given SELECT query with its literals and placeholders
+// replaced by "?", and its runs of whitespace collapsed to single spaces. It
+// returns false if the query is not a SELECT query, or if it does not have
+// exactly one literal or placeholder, since those are the queries that are
+// executed once for each ID returned by another query. Numeric literals in
+// LIMIT and OFFSET clauses are not replaced. For example:
+//
+//	SELECT name FROM customers WHERE id = $1
+//	SELECT name FROM customers WHERE id = 42
+//
+// both have the shape:
+//
+//	SELECT name FROM customers WHERE id = ?
+func queryShape(query string) (string, bool) {
+	fields := strings.Fields(query)
+	if len(fields) == 0 || !strings.EqualFold(fields[0], "SELECT") {
+		return "", false
+	}
+
+	params := 0
+	shape := replaceLiterals(strings.Join(fields, " "), func(lit, prefix string) string {
+		// Row limits and offsets are part of the shape.
+		if isDigit(lit[0]) {
+			prefix = strings.TrimRight(prefix, " ")
+			if hasSuffixFold(prefix, "LIMIT") || hasSuffixFold(prefix, "OFFSET") {
+				return lit
+			}
+		}
+		params++
+		return "?"
+	})
+	return shape, params == 1
+}
+
+// replaceLiterals calls the given function for each string literal, numeric
+// literal and placeholder (like $1, ? or @p1) in the given query, and replaces
+// it with the string that the function returns. The function is passed the
+// text of the literal or placeholder, along with the text of the query that
+// precedes it.
+func replaceLiterals(query string, replace func(lit, prefix string) string) string {
+	var b strings.Builder
+	for i := 0; i < len(query); {
+		ch := query[i]
+		start := i
+		switch {
+		case ch == '\'':
+			// String literal, in which quotes are escaped by doubling them.
+			i++
+			for i < len(query) {
+				if query[i] == '\'' {
+					if i+1 < len(query) && query[i+1] == '\'' {
+						i += 2
+						continue
+					}
+					break
+				}
+				i++
+			}
+			if i < len(query) {
+				i++
+			}
+
+		case ch == '$' || ch == '?' || (ch == '@' && i+1 < len(query) && isIdentChar(query[i+1])):
+			// Placeholder like $1, ?, or @p1.
+			i++
+			for i < len(query) && isIdentChar(query[i]) {
+				i++
+			}
+
+		case isDigit(ch) && (i == 0 || !isIdentChar(query[i-1])):
+			// Numeric literal.
+			for i < len(query) && (isDigit(query[i]) || query[i] == '.') {
+				i++
+			}
+
+		default:
+			b.WriteByte(ch)
+			i++
+			continue
+		}
+		b.WriteString(replace(query[start:i], query[:start]))
+	}
+	return b.String()
+}
+
+// hasSuffixFold returns true if s ends with the given suffix, ignoring case.
+func hasSuffixFold(s, suffix string) bool {
+	return len(s) >= len(suffix) && strings.EqualFold(s[len(s)-len(suffix):], suffix)
+}
+
+// isDigit returns true if the given character is a decimal digit.
+func isDigit(ch byte) bool {
+	return ch >= '0' && ch <= '9'
+}
+
+// isIdentChar returns true if the given character can be part of a SQL
+// identifier.
+func isIdentChar(ch byte) bool {
+	return ch == '_' || isDigit(ch) || (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z')
+}
@@ -0,0 +1,75 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package copyist
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestCheckNPlusOne tests that queries executed once for each row of another
+// query are reported.
+func TestCheckNPlusOne(t *testing.T) {
+	s := newSession(&memorySource{}, "TestCheckNPlusOne")
+	s.recording = recording{
+		{Typ: ConnQuery, Args: recordArgs{"SELECT id FROM customers", nil}},
+		{Typ: ConnPrepare, Args: recordArgs{"SELECT * FROM orders WHERE customer_id = $1", nil, 1}},
+	}
+	for i := 0; i < 3; i++ {
+		s.recording = append(s.recording,
+			&record{Typ: StmtQuery, Args: recordArgs{nil, 1, 1}},
+			&record{Typ: ConnQuery, Args: recordArgs{fmt.Sprintf("SELECT name FROM items WHERE id = %d LIMIT 1", i), nil}},
+			&record{Typ: ConnQuery, Args: recordArgs{"SELECT count(*) FROM items", nil}},
+		)
+	}
+
+	SetNPlusOneThreshold(3)
+	defer SetNPlusOneThreshold(10)
+	require.EqualError(t, s.checkNPlusOne(), "recording TestCheckNPlusOne has likely N+1 "+
+		"queries, which are executed once for each row of another query:\n"+
+		"  3 executions of: SELECT * FROM orders WHERE customer_id = ?\n"+
+		"  3 executions of: SELECT name FROM items WHERE id = ? LIMIT 1\n\n"+
+		"Can you fetch the rows with a single query, using a join or an IN clause?")
+
+	SetNPlusOneThreshold(4)
+	require.NoError(t, s.checkNPlusOne())
+
+	SetNPlusOneThreshold(0)
+	require.NoError(t, s.checkNPlusOne())
+}
+
+// TestQueryShape tests replacing the literals and placeholders of queries.
+func TestQueryShape(t *testing.T) {
+	testCases := []struct {
+		query string
+		shape string
+		ok    bool
+	}{
+		{query: "SELECT name FROM customers WHERE id = $1", shape: "SELECT name FROM customers WHERE id = ?", ok: true},
+		{query: "select name\n  from t1 where id=42", shape: "select name from t1 where id=?", ok: true},
+		{query: "SELECT * FROM t WHERE name = 'O''Brien'", shape: "SELECT * FROM t WHERE name = ?", ok: true},
+		{query: "SELECT * FROM t WHERE id = @p1 LIMIT 10 OFFSET 20", shape: "SELECT * FROM t WHERE id = ? LIMIT 10 OFFSET 20", ok: true},
+		{query: "SELECT * FROM t WHERE a = ? AND b = ?", shape: "SELECT * FROM t WHERE a = ? AND b = ?", ok: false},
+		{query: "SELECT * FROM t", shape: "SELECT * FROM t", ok: false},
+		{query: "DELETE FROM t WHERE id = $1", shape: "", ok: false},
+	}
+	for _, tc := range testCases {
+		shape, ok := queryShape(tc.query)
+		require.Equal(t, tc.shape, shape, tc.query)
+		require.Equal(t, tc.ok, ok, tc.query)
+	}
+}
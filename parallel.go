@@ -0,0 +1,164 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package copyist
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// parallelSessionPrefix is the prefix of data source names that identify the
+// parallel session to which connections belong. See
+// ParallelSession.DataSourceName.
+const parallelSessionPrefix = "copyist:"
+
+// parallelSessions tracks the sessions opened by OpenParallel that have not yet
+// been closed, keyed by ID.
+var parallelSessions struct {
+	sync.Mutex
+	lastID   int
+	sessions map[int]*session
+}
+
+// parallelRecordMu serializes parallel sessions while recording, since the
+// calls that they make to the database could otherwise conflict with one
+// another.
+var parallelRecordMu sync.Mutex
+
+// ParallelSession is a recording or playback session opened by OpenParallel.
+type ParallelSession struct {
+	t       testingT
+	id      int
+	session *session
+}
+
+// OpenParallel is a variant of OpenSource that can be called by parallel tests.
+// Rather than replacing the single global session used by Open, it begins a
+// session that is only used by connections opened with the data source name
+// returned by ParallelSession.DataSourceName. This allows several parallel
+// sub-tests to play back the same recording concurrently, each with its own
+// independent position in the recording. For example, table-driven sub-tests
+// that make the same database calls can share a single recording:
+//
+//	for _, tc := range testCases {
+//	  tc := tc
+//	  t.Run(tc.name, func(t *testing.T) {
+//	    t.Parallel()
+//	    source := copyist.NewFileSource("testdata/mystuff_test.copyist")
+//	    s := copyist.OpenParallel(t, source, "TestMyStuff/shared")
+//	    defer s.Close()
+//	    db, _ := sql.Open("copyist_postgres", s.DataSourceName(dataSourceName))
+//	    ...
+//	  })
+//	}
+//
+// When recording, parallel sessions are made one at a time, since concurrent
+// sessions could conflict with one another in the database. Each session
+// replaces the recording made by the previous one.
+func OpenParallel(t testingT, source Source, recordingName string) *ParallelSession {
+	if noopMode {
+		return &ParallelSession{t: t}
+	}
+	if registered == nil {
+		panic(errors.New("Register was not called"))
+	}
+
+	s := newSession(source, qualifyRecordingName(recordingName))
+	skipIfMissing(t, s)
+
+	if IsRecording() {
+		parallelRecordMu.Lock()
+	}
+
+	parallelSessions.Lock()
+	defer parallelSessions.Unlock()
+	if parallelSessions.sessions == nil {
+		parallelSessions.sessions = make(map[int]*session)
+	}
+	parallelSessions.lastID++
+	id := parallelSessions.lastID
+	parallelSessions.sessions[id] = s
+	return &ParallelSession{t: t, id: id, session: s}
+}
+
+// DataSourceName returns a data source name that opens connections which
+// belong to this session, using the given data source name of the wrapped
+// driver. The returned name should be passed to sql.Open, along with the name
+// of the copyist driver.
+func (p *ParallelSession) DataSourceName(dataSourceName string) string {
+	if noopMode {
+		return dataSourceName
+	}
+	return fmt.Sprintf("%s%d:%s", parallelSessionPrefix, p.id, dataSourceName)
+}
+
+// Close ends this session. Like the io.Closer returned by Open, it must be
+// deferred, so that session errors are converted into test failures.
+func (p *ParallelSession) Close() error {
+	if noopMode {
+		return nil
+	}
+
+	r := recover()
+
+	parallelSessions.Lock()
+	delete(parallelSessions.sessions, p.id)
+	parallelSessions.Unlock()
+
+	if IsRecording() {
+		defer parallelRecordMu.Unlock()
+	}
+	p.session.Finish(p.t, r)
+	return nil
+}
+
+// findSession returns the session to which a connection opened with the given
+// data source name belongs, along with the data source name to pass to the
+// wrapped driver. If the name was returned by ParallelSession.DataSourceName,
+// then the connection belongs to that parallel session. Otherwise, it belongs
+// to the current session, which is nil if no session is open.
+func findSession(dataSourceName string) (*session, string) {
+	if !strings.HasPrefix(dataSourceName, parallelSessionPrefix) {
+		return currentSession, dataSourceName
+	}
+
+	rest := dataSourceName[len(parallelSessionPrefix):]
+	colon := strings.IndexByte(rest, ':')
+	if colon == -1 {
+		return currentSession, dataSourceName
+	}
+	id, err := strconv.Atoi(rest[:colon])
+	if err != nil {
+		return currentSession, dataSourceName
+	}
+
+	parallelSessions.Lock()
+	defer parallelSessions.Unlock()
+	s, ok := parallelSessions.sessions[id]
+	if !ok {
+		panic(fmt.Errorf("copyist parallel session %d is closed", id))
+	}
+	return s, rest[colon+1:]
+}
+
+// openParallelSessions returns the number of parallel sessions that are open.
+func openParallelSessions() int {
+	parallelSessions.Lock()
+	defer parallelSessions.Unlock()
+	return len(parallelSessions.sessions)
+}
@@ -0,0 +1,84 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package copyist
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestOpenParallel tests that parallel sub-tests can play back the same
+// recording concurrently.
+func TestOpenParallel(t *testing.T) {
+	// Enter playback mode.
+	*recordFlag = false
+	visitedRecording = true
+
+	registered = nil
+	Register("postgres13")
+
+	source := NewFileSource(filepath.Join(t.TempDir(), "parallel.copyist"))
+	require.NoError(t, source.WriteAll([]byte(`
+1=DriverOpen	1:nil
+2=ConnQuery	2:"SELECT name FROM customers"	1:nil
+3=RowsColumns	9:["name"]
+4=RowsNext	11:[2:"Andy"]	1:nil
+
+"TestOpenParallel/shared"=1,2,3,4
+`)))
+
+	t.Run("group", func(t *testing.T) {
+		for i := 0; i < 8; i++ {
+			t.Run(fmt.Sprintf("sub%d", i), func(t *testing.T) {
+				t.Parallel()
+				s := OpenParallel(t, source, "TestOpenParallel/shared")
+				defer s.Close()
+				require.True(t, IsOpen())
+
+				db, err := sql.Open("copyist_postgres13", s.DataSourceName(""))
+				require.NoError(t, err)
+				defer db.Close()
+
+				var name string
+				require.NoError(t, db.QueryRow("SELECT name FROM customers").Scan(&name))
+				require.Equal(t, "Andy", name)
+			})
+		}
+	})
+	require.False(t, IsOpen())
+
+	// A parallel session only plays back calls made by its own connections.
+	m := &mockTestingT{T: t}
+	s := OpenParallel(m, source, "TestOpenParallel/shared")
+	db, err := sql.Open("copyist_postgres13", s.DataSourceName(""))
+	require.NoError(t, err)
+	var name string
+	require.NoError(t, db.QueryRow("SELECT name FROM customers").Scan(&name))
+	require.Equal(t, "Andy", name)
+	require.NoError(t, db.Close())
+	require.NoError(t, s.Close())
+	require.Equal(t, "", m.buf.String())
+
+	// Connections can't be opened once the session is closed.
+	db, err = sql.Open("copyist_postgres13", s.DataSourceName(""))
+	require.NoError(t, err)
+	require.PanicsWithError(t, fmt.Sprintf("copyist parallel session %d is closed", s.id), func() {
+		db.Ping()
+	})
+}
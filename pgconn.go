@@ -0,0 +1,380 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package copyist
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pgConnDriverName is the name of the proxy driver that records and plays back
+// connections made by the pgconn package. See RegisterPgConn.
+const pgConnDriverName = "pgconn"
+
+// RegisterPgConn constructs a proxy driver that records and plays back the
+// connections made by the pgconn package, which is used by pgx's native API
+// (e.g. pgx.Connect and pgxpool) rather than by the `sql` package. Like
+// Register, it must be called before copyist.Open can be called, typically in
+// an init() method. Connections are only recorded or played back if their
+// configuration is passed to ConfigurePgConn in the copyistpgx package.
+//
+// Note that RegisterPgConn can only be called once; subsequent attempts will
+// fail with an error.
+func RegisterPgConn() {
+	if noopMode {
+		return
+	}
+	if registered == nil {
+		registered = make(map[string]*proxyDriver)
+	} else if _, ok := registered[pgConnDriverName]; ok {
+		panic(errors.New("RegisterPgConn called twice"))
+	}
+	registered[pgConnDriverName] = &proxyDriver{driverName: pgConnDriverName}
+}
+
+// DialFunc is the type of function that pgconn uses to connect to the server.
+// It has the same signature as pgconn.DialFunc.
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// WrapPgConnDial returns a function that dials connections using the given
+// function, so that the messages exchanged over them are recorded or played
+// back by the current copyist session. It is called by ConfigurePgConn in the
+// copyistpgx package, which also adjusts the rest of the pgconn configuration:
+//
+//	func TestMyStuff(t *testing.T) {
+//	  defer copyist.Open(t).Close()
+//
+//	  config, _ := pgxpool.ParseConfig("postgresql://root@localhost")
+//	  copyistpgx.ConfigurePgConn(&config.ConnConfig.Config)
+//	  pool, _ := pgxpool.ConnectConfig(ctx, config)
+//	  defer pool.Close()
+//	  ...
+//	}
+//
+// copyist records the messages that are exchanged with the server, rather than
+// calls to driver methods. During playback, the messages sent by pgconn are
+// verified against the recording, and the messages received from the server
+// are played back. Only the types of the sent messages are verified, along with
+// the text of queries.
+func WrapPgConnDial(dial DialFunc) DialFunc {
+	if noopMode {
+		return dial
+	}
+	d := registered[pgConnDriverName]
+	if d == nil {
+		panic(errors.New("RegisterPgConn was not called"))
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return d.dialPgConn(ctx, dial, network, addr)
+	}
+}
+
+// dialPgConn returns a new network connection to the server at the given
+// address. When recording, it uses the given dial function to connect to the
+// server, and records the result as a DriverOpen call.
+func (d *proxyDriver) dialPgConn(
+	ctx context.Context, dial DialFunc, network, addr string,
+) (net.Conn, error) {
+	s := currentSession
+	if s == nil {
+		panic(errors.New("copyist.Open was never called"))
+	}
+	s.OnDriverOpen(d)
+
+	c := &pgConn{proxy: proxyConn{driver: d, name: addr, session: s}, network: network}
+	if IsRecording() {
+		defer s.SerializeCall(&c.proxy)()
+		c.proxy.id = s.nextConnID()
+		var err error
+		c.conn, err = dial(ctx, network, addr)
+		s.AddRecord(&c.proxy, &record{Typ: DriverOpen, Args: recordArgs{err}})
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+
+	rec, err := s.VerifyRecord(&c.proxy, DriverOpen)
+	if err != nil {
+		return nil, err
+	}
+	err, _ = rec.Args[0].(error)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// pgConn records and plays back the messages that pgconn exchanges with the
+// server over a network connection.
+type pgConn struct {
+	// proxy identifies the session and the stream of records to which this
+	// connection's messages belong.
+	proxy proxyConn
+
+	// conn is the wrapped "real" network connection. It is nil if in playback
+	// mode.
+	conn net.Conn
+
+	// network is the name of the network that was dialed (e.g. "tcp").
+	network string
+
+	// started is true once the startup message, which is the only message sent
+	// without a type, has been written.
+	started bool
+
+	// unread is the part of the last PgConnReceive record that has not yet been
+	// read during playback.
+	unread []byte
+
+	// unreadErr is the error of the last PgConnReceive record. It is returned
+	// during playback along with the last of its unread data.
+	unreadErr error
+}
+
+var _ net.Conn = (*pgConn)(nil)
+
+// Read reads data that was received from the server.
+func (c *pgConn) Read(b []byte) (int, error) {
+	if IsRecording() {
+		defer c.proxy.session.SerializeCall(&c.proxy)()
+		n, err := c.conn.Read(b)
+		c.proxy.session.AddRecord(&c.proxy,
+			&record{Typ: PgConnReceive, Args: recordArgs{append([]byte(nil), b[:n]...), err}})
+		return n, err
+	}
+
+	if len(c.unread) == 0 {
+		rec, err := c.proxy.session.VerifyRecord(&c.proxy, PgConnReceive)
+		if err != nil {
+			return 0, err
+		}
+		c.unread = rec.Args[0].([]byte)
+		c.unreadErr, _ = rec.Args[1].(error)
+		if len(c.unread) == 0 {
+			return 0, c.unreadErr
+		}
+	}
+	n := copy(b, c.unread)
+	c.unread = c.unread[n:]
+	if len(c.unread) == 0 {
+		return n, c.unreadErr
+	}
+	return n, nil
+}
+
+// Write writes messages that are sent to the server.
+func (c *pgConn) Write(b []byte) (int, error) {
+	messages := formatFrontendMessages(b, !c.started)
+	c.started = true
+
+	if IsRecording() {
+		defer c.proxy.session.SerializeCall(&c.proxy)()
+		n, err := c.conn.Write(b)
+		c.proxy.session.AddRecord(&c.proxy,
+			&record{Typ: PgConnSend, Args: recordArgs{messages, err}})
+		return n, err
+	}
+
+	rec, err := c.proxy.session.VerifyRecordWithStringArg(&c.proxy, PgConnSend, messages)
+	if err != nil {
+		return 0, err
+	}
+	err, _ = rec.Args[1].(error)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close closes the connection.
+func (c *pgConn) Close() error {
+	if IsRecording() {
+		return c.conn.Close()
+	}
+	return nil
+}
+
+// LocalAddr returns the local network address.
+func (c *pgConn) LocalAddr() net.Addr {
+	if IsRecording() {
+		return c.conn.LocalAddr()
+	}
+	return pgAddr{network: c.network}
+}
+
+// RemoteAddr returns the remote network address.
+func (c *pgConn) RemoteAddr() net.Addr {
+	if IsRecording() {
+		return c.conn.RemoteAddr()
+	}
+	return pgAddr{network: c.network, addr: c.proxy.name}
+}
+
+// SetDeadline sets the read and write deadlines of the connection. It has no
+// effect during playback, since reads and writes never block.
+func (c *pgConn) SetDeadline(t time.Time) error {
+	if IsRecording() {
+		return c.conn.SetDeadline(t)
+	}
+	return nil
+}
+
+// SetReadDeadline sets the read deadline of the connection. It has no effect
+// during playback, since reads never block.
+func (c *pgConn) SetReadDeadline(t time.Time) error {
+	if IsRecording() {
+		return c.conn.SetReadDeadline(t)
+	}
+	return nil
+}
+
+// SetWriteDeadline sets the write deadline of the connection. It has no effect
+// during playback, since writes never block.
+func (c *pgConn) SetWriteDeadline(t time.Time) error {
+	if IsRecording() {
+		return c.conn.SetWriteDeadline(t)
+	}
+	return nil
+}
+
+// pgAddr is the network address of a connection during playback.
+type pgAddr struct {
+	network string
+	addr    string
+}
+
+// Network implements net.Addr.
+func (a pgAddr) Network() string { return a.network }
+
+// String implements net.Addr.
+func (a pgAddr) String() string { return a.addr }
+
+// formatFrontendMessages returns a description of the messages in the given
+// data, which pgconn sends to the server in a single write. The description
+// contains the type of each message, along with the text of queries, but
+// leaves out other contents such as passwords and query arguments. If untyped
+// is true, then the data starts with a message that has no type byte, such as
+// the startup message. For example:
+//
+//	Parse "SELECT name FROM customers WHERE id=$1" Describe Sync
+func formatFrontendMessages(data []byte, untyped bool) string {
+	var b strings.Builder
+	for len(data) > 0 {
+		if b.Len() != 0 {
+			b.WriteByte(' ')
+		}
+
+		if untyped {
+			untyped = false
+			if len(data) < 8 {
+				b.WriteString("Unknown")
+				break
+			}
+			n := int(binary.BigEndian.Uint32(data))
+			switch code := binary.BigEndian.Uint32(data[4:]); code {
+			case 196608: // Protocol version 3.0.
+				b.WriteString("StartupMessage")
+			case 80877102:
+				b.WriteString("CancelRequest")
+			case 80877103:
+				b.WriteString("SSLRequest")
+			default:
+				fmt.Fprintf(&b, "Request(%d)", code)
+			}
+			if n < 8 || n > len(data) {
+				break
+			}
+			data = data[n:]
+			continue
+		}
+
+		if len(data) < 5 {
+			b.WriteString("Unknown")
+			break
+		}
+		typ := data[0]
+		n := int(binary.BigEndian.Uint32(data[1:])) + 1
+		if n < 5 || n > len(data) {
+			fmt.Fprintf(&b, "Unknown(%q)", typ)
+			break
+		}
+		body := data[5:n]
+		data = data[n:]
+
+		switch typ {
+		case 'Q':
+			// The body of a Query message is the query string.
+			if query, _, ok := readCString(body); ok {
+				b.WriteString("Query ")
+				b.WriteString(strconv.Quote(query))
+				continue
+			}
+		case 'P':
+			// The body of a Parse message starts with the name of the prepared
+			// statement, followed by the query string.
+			if _, rest, ok := readCString(body); ok {
+				if query, _, ok := readCString(rest); ok {
+					b.WriteString("Parse ")
+					b.WriteString(strconv.Quote(query))
+					continue
+				}
+			}
+		}
+		if name, ok := frontendMessageNames[typ]; ok {
+			b.WriteString(name)
+		} else {
+			fmt.Fprintf(&b, "Unknown(%q)", typ)
+		}
+	}
+	return b.String()
+}
+
+// frontendMessageNames maps the type byte of each typed message that can be
+// sent to the server to its name.
+var frontendMessageNames = map[byte]string{
+	'B': "Bind",
+	'C': "Close",
+	'D': "Describe",
+	'E': "Execute",
+	'F': "FunctionCall",
+	'H': "Flush",
+	'P': "Parse",
+	'Q': "Query",
+	'S': "Sync",
+	'X': "Terminate",
+	'c': "CopyDone",
+	'd': "CopyData",
+	'f': "CopyFail",
+	'p': "PasswordMessage",
+}
+
+// readCString reads a null-terminated string from the start of the given
+// message body, returning it along with the rest of the body. It returns false
+// if the body does not contain a null terminator.
+func readCString(body []byte) (s string, rest []byte, ok bool) {
+	n := bytes.IndexByte(body, 0)
+	if n == -1 {
+		return "", nil, false
+	}
+	return string(body[:n]), body[n+1:], true
+}
@@ -0,0 +1,196 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package copyist
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgproto3/v2"
+	"github.com/stretchr/testify/require"
+)
+
+// TestPgConn tests that connections dialed by WrapPgConnDial record the
+// messages exchanged with a server, and play them back without connecting to
+// it.
+func TestPgConn(t *testing.T) {
+	registered = nil
+	RegisterPgConn()
+	source := &memorySource{}
+
+	run := func(dial pgconn.DialFunc) {
+		config, err := pgconn.ParseConfig("postgresql://root@localhost:26257/defaultdb")
+		require.NoError(t, err)
+		config.TLSConfig = nil
+		config.Fallbacks = nil
+		config.DialFunc = pgconn.DialFunc(WrapPgConnDial(DialFunc(dial)))
+
+		m := &mockTestingT{T: t}
+		closer := OpenSource(m, source, "TestPgConn")
+
+		ctx := context.Background()
+		conn, err := pgconn.ConnectConfig(ctx, config)
+		require.NoError(t, err)
+		res := conn.ExecParams(ctx, "SELECT name FROM customers WHERE id=$1",
+			[][]byte{[]byte("1")}, nil, nil, nil).Read()
+		require.NoError(t, res.Err)
+		require.Equal(t, [][][]byte{{[]byte("Andy")}}, res.Rows)
+		require.NoError(t, conn.Close(ctx))
+
+		require.NoError(t, closer.Close())
+		require.Equal(t, "", m.buf.String())
+	}
+
+	// Record the messages exchanged with a fake server.
+	*recordFlag = true
+	visitedRecording = true
+	defer func() { *recordFlag = false }()
+	run(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		client, server := net.Pipe()
+		go serveFakePg(server)
+		return client, nil
+	})
+	require.Contains(t, string(source.data),
+		`=PgConnSend	2:"Parse \"SELECT name FROM customers WHERE id=$1\" Bind Describe Execute Sync"	1:nil`)
+
+	// Play back the messages without connecting to the server.
+	*recordFlag = false
+	run(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return nil, errors.New("server should not be dialed during playback")
+	})
+}
+
+// TestPgConnReadError tests that an error received together with data from the
+// server is played back along with the last of that data, even if it is read in
+// smaller chunks than it was received.
+func TestPgConnReadError(t *testing.T) {
+	registered = nil
+	RegisterPgConn()
+	source := &memorySource{}
+
+	open := func(dial DialFunc) (net.Conn, *mockTestingT, io.Closer) {
+		m := &mockTestingT{T: t}
+		closer := OpenSource(m, source, "TestPgConnReadError")
+		conn, err := WrapPgConnDial(dial)(context.Background(), "tcp", "localhost:26257")
+		require.NoError(t, err)
+		return conn, m, closer
+	}
+
+	// Record the data and the error, received in a single read.
+	*recordFlag = true
+	visitedRecording = true
+	defer func() { *recordFlag = false }()
+	conn, m, closer := open(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return &errConn{data: []byte("abcde"), err: errors.New("connection reset")}, nil
+	})
+	b := make([]byte, 8)
+	n, err := conn.Read(b)
+	require.EqualError(t, err, "connection reset")
+	require.Equal(t, "abcde", string(b[:n]))
+	require.NoError(t, closer.Close())
+	require.Equal(t, "", m.buf.String())
+
+	// Play them back in two reads.
+	*recordFlag = false
+	conn, m, closer = open(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return nil, errors.New("server should not be dialed during playback")
+	})
+	b = make([]byte, 3)
+	n, err = conn.Read(b)
+	require.NoError(t, err)
+	require.Equal(t, "abc", string(b[:n]))
+	n, err = conn.Read(b)
+	require.EqualError(t, err, "connection reset")
+	require.Equal(t, "de", string(b[:n]))
+	require.NoError(t, closer.Close())
+	require.Equal(t, "", m.buf.String())
+}
+
+// errConn is a net.Conn that returns all of its data along with an error when
+// it is read, like a connection that the server resets after sending a message.
+type errConn struct {
+	net.Conn
+	data []byte
+	err  error
+}
+
+// Read implements net.Conn.
+func (c *errConn) Read(b []byte) (int, error) {
+	return copy(b, c.data), c.err
+}
+
+// TestFormatFrontendMessages tests the descriptions of messages sent to the
+// server.
+func TestFormatFrontendMessages(t *testing.T) {
+	startup := (&pgproto3.StartupMessage{
+		ProtocolVersion: pgproto3.ProtocolVersionNumber,
+		Parameters:      map[string]string{"user": "root"},
+	}).Encode(nil)
+	require.Equal(t, "StartupMessage", formatFrontendMessages(startup, true))
+
+	var data []byte
+	data = (&pgproto3.PasswordMessage{Password: "secret"}).Encode(data)
+	require.Equal(t, "PasswordMessage", formatFrontendMessages(data, false))
+
+	data = (&pgproto3.Query{String: "SELECT 1"}).Encode(nil)
+	data = (&pgproto3.Bind{}).Encode(data)
+	data = (&pgproto3.Execute{}).Encode(data)
+	data = (&pgproto3.Sync{}).Encode(data)
+	require.Equal(t, `Query "SELECT 1" Bind Execute Sync`, formatFrontendMessages(data, false))
+
+	require.Equal(t, "Unknown('Z')", formatFrontendMessages([]byte("Z\x00\x00\x00\x04"), false))
+	require.Equal(t, "Unknown", formatFrontendMessages([]byte("Q"), false))
+}
+
+// serveFakePg serves a single connection as a fake Postgres server, which
+// returns a single row to any query.
+func serveFakePg(conn net.Conn) {
+	defer conn.Close()
+	backend := pgproto3.NewBackend(pgproto3.NewChunkReader(conn), conn)
+	if _, err := backend.ReceiveStartupMessage(); err != nil {
+		return
+	}
+	backend.Send(&pgproto3.AuthenticationOk{})
+	backend.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+
+	for {
+		msg, err := backend.Receive()
+		if err != nil {
+			return
+		}
+		switch msg.(type) {
+		case *pgproto3.Describe:
+			backend.Send(&pgproto3.ParameterDescription{ParameterOIDs: []uint32{20}})
+			backend.Send(&pgproto3.RowDescription{Fields: []pgproto3.FieldDescription{
+				{Name: []byte("name"), DataTypeOID: 25, DataTypeSize: -1, TypeModifier: -1},
+			}})
+		case *pgproto3.Bind:
+			backend.Send(&pgproto3.BindComplete{})
+		case *pgproto3.Execute:
+			backend.Send(&pgproto3.DataRow{Values: [][]byte{[]byte("Andy")}})
+			backend.Send(&pgproto3.CommandComplete{CommandTag: []byte("SELECT 1")})
+		case *pgproto3.Parse:
+			backend.Send(&pgproto3.ParseComplete{})
+		case *pgproto3.Sync:
+			backend.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+		case *pgproto3.Terminate:
+			return
+		}
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package copyist
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// parsedFile is the parsed contents of a recording file on disk, along with the
+// file attributes used to detect whether it has changed since it was parsed.
+type parsedFile struct {
+	modTime        time.Time
+	size           int64
+	recordDecls    map[int]string
+	recordingDecls map[string]string
+	metadata       map[string]map[string]string
+	data           []byte
+	recordIndex    []int
+}
+
+// parsedFiles caches the parsed contents of recording files, keyed by path, so
+// that a recording file shared by many tests is only parsed once per test
+// binary, rather than once per test.
+var parsedFiles struct {
+	sync.Mutex
+	files map[string]*parsedFile
+}
+
+// ParseCached is like ParseIndex, except that if the source is a recording file
+// on disk that has already been parsed, and has not been modified since, then
+// the previously parsed contents are reused, and shared with other
+// recordingSources.
+func (f *recordingSource) ParseCached() error {
+	pathName, ok := sourcePathName(f.source)
+	if !ok {
+		return f.ParseIndex()
+	}
+
+	info, err := os.Stat(pathName)
+	if err != nil {
+		return err
+	}
+
+	parsedFiles.Lock()
+	defer parsedFiles.Unlock()
+
+	parsed, ok := parsedFiles.files[pathName]
+	if !ok || !parsed.modTime.Equal(info.ModTime()) || parsed.size != info.Size() {
+		if err := f.ParseIndex(); err != nil {
+			return err
+		}
+		if parsedFiles.files == nil {
+			parsedFiles.files = make(map[string]*parsedFile)
+		}
+		parsedFiles.files[pathName] = &parsedFile{
+			modTime:        info.ModTime(),
+			size:           info.Size(),
+			recordDecls:    f.recordDecls,
+			recordingDecls: f.recordingDecls,
+			metadata:       f.metadata,
+			data:           f.data,
+			recordIndex:    f.recordIndex,
+		}
+		return nil
+	}
+
+	f.recordDecls = parsed.recordDecls
+	f.recordingDecls = parsed.recordingDecls
+	f.metadata = parsed.metadata
+	f.data = parsed.data
+	f.recordIndex = parsed.recordIndex
+	return nil
+}
+
+// sourcePathName returns the path of the recording file on disk that the given
+// source reads, or false if it does not read a single file on disk. Encrypted
+// files are identified by their path as well, since they are decrypted before
+// they are parsed.
+func sourcePathName(source Source) (string, bool) {
+	switch s := source.(type) {
+	case fileSource:
+		return s.PathName, true
+	case mappedFileSource:
+		return s.PathName, true
+	case encryptedSource:
+		return sourcePathName(s.source)
+	case encryptedSidecarSource:
+		return sourcePathName(s.source)
+	}
+	return "", false
+}
@@ -0,0 +1,372 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package copyist
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RecordingFile provides access to the recordings in a copyist recording file.
+// It is intended for use by tools that inspect or maintain recording files,
+// such as the copyist command, rather than by tests.
+type RecordingFile struct {
+	recordingSource *recordingSource
+}
+
+// Record is one recorded call to a driver method, as exposed by RecordingFile.
+type Record struct {
+	// Type is the name of the driver method that was called (e.g. "ConnQuery").
+	Type string
+
+	// Args are the driver method arguments and/or return values that were
+	// recorded, in the same order as in the recording file.
+	Args []interface{}
+}
+
+// String returns the record in the recording file format, like:
+//
+//	ConnQuery	2:"SELECT 1"	1:nil
+func (r Record) String() string {
+	var buf strings.Builder
+	buf.WriteString(r.Type)
+	for _, arg := range r.Args {
+		buf.WriteByte('\t')
+		buf.WriteString(formatValueWithType(arg))
+	}
+	return buf.String()
+}
+
+// ParseValue parses a value in the recording file format, like:
+//
+//	2:"SELECT 1"
+//
+// It is the inverse of the formatting used by Record.String for each argument.
+func ParseValue(s string) (interface{}, error) {
+	return parseValueWithType(s)
+}
+
+// ReadRecordingFile reads and parses the recording file in the given source.
+func ReadRecordingFile(source Source) (*RecordingFile, error) {
+	recordingSource := newRecordingSource(source)
+	if err := recordingSource.Parse(); err != nil {
+		return nil, err
+	}
+	return &RecordingFile{recordingSource: recordingSource}, nil
+}
+
+// RecordingNames returns the names of all recordings in the file, in sorted
+// order.
+func (f *RecordingFile) RecordingNames() []string {
+	names := make([]string, 0, len(f.recordingSource.recordingDecls))
+	for name := range f.recordingSource.recordingDecls {
+		names = append(names, name)
+	}
+	for name := range f.recordingSource.addRecordings {
+		if _, ok := f.recordingSource.recordingDecls[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Recording returns the list of records in the recording having the given
+// name. It returns an error if there is no such recording, or if any of its
+// records cannot be parsed.
+func (f *RecordingFile) Recording(recordingName string) (records []Record, err error) {
+	recording, err := f.getRecording(recordingName)
+	if err != nil {
+		return nil, err
+	}
+
+	records = make([]Record, len(recording))
+	for i, rec := range recording {
+		records[i] = Record{Type: rec.Typ.String(), Args: rec.Args}
+	}
+	return records, nil
+}
+
+// RecordingLines returns the records in the recording having the given name,
+// each formatted in the recording file format, like Record.String. It returns
+// an error if there is no such recording, or if any of its records cannot be
+// parsed.
+func (f *RecordingFile) RecordingLines(recordingName string) ([]string, error) {
+	recording, err := f.getRecording(recordingName)
+	if err != nil {
+		return nil, err
+	}
+	return formatRecords(recording), nil
+}
+
+// formatRecords formats each of the given records in the recording file format.
+func formatRecords(records recording) []string {
+	lines := make([]string, len(records))
+	for i, rec := range records {
+		lines[i] = exportRecord(rec).String()
+	}
+	return lines
+}
+
+// getRecording returns the recording having the given name, including any
+// changes made by SetRecording.
+func (f *RecordingFile) getRecording(recordingName string) (rec recording, err error) {
+	defer catchSessionError(&err)
+	rec, ok := f.recordingSource.addRecordings[recordingName]
+	if !ok {
+		if _, ok := f.recordingSource.recordingDecls[recordingName]; !ok {
+			return nil, fmt.Errorf("no recording exists with this name: %v", recordingName)
+		}
+		rec = f.recordingSource.GetRecording(recordingName)
+	}
+	return rec, nil
+}
+
+// Validate checks that every record declaration in the file can be parsed and
+// that every recording only references record declarations that exist. It
+// returns an error for each problem that is found, or nil if there are none.
+func (f *RecordingFile) Validate() []error {
+	var errs []error
+
+	recordNums := make([]int, 0, len(f.recordingSource.recordDecls))
+	for num := range f.recordingSource.recordDecls {
+		recordNums = append(recordNums, num)
+	}
+	sort.Ints(recordNums)
+	for _, num := range recordNums {
+		if _, err := f.parseRecord(num); err != nil {
+			errs = append(errs, fmt.Errorf("record %d: %v", num+1, err))
+		}
+	}
+
+	for _, name := range f.RecordingNames() {
+		decl, ok := f.recordingSource.recordingDecls[name]
+		if !ok {
+			// Recording was added by SetRecording, so it's already parsed.
+			continue
+		}
+		nums, err := f.parseRecordingDecl(decl)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("recording %q: %v", name, err))
+			continue
+		}
+		for _, num := range nums {
+			if _, ok := f.recordingSource.recordDecls[num]; !ok {
+				errs = append(errs, fmt.Errorf(
+					"recording %q: record with number %d does not exist", name, num+1))
+			}
+		}
+	}
+	return errs
+}
+
+// parseRecord parses the record declaration having the given 0-based number,
+// returning an error rather than panicking if it cannot be parsed.
+func (f *RecordingFile) parseRecord(num int) (rec *record, err error) {
+	defer catchSessionError(&err)
+	return f.recordingSource.parseRecord(num), nil
+}
+
+// parseRecordingDecl parses the given recording declaration, returning an
+// error rather than panicking if it cannot be parsed.
+func (f *RecordingFile) parseRecordingDecl(decl string) (nums []int, err error) {
+	defer catchSessionError(&err)
+	return f.recordingSource.parseRecordingDecl(decl), nil
+}
+
+// Metadata returns the metadata attached to the recording having the given
+// name, such as the time at which it was made, or nil if there is none. The
+// returned map must not be modified.
+func (f *RecordingFile) Metadata(recordingName string) map[string]string {
+	return f.recordingSource.GetMetadata(recordingName)
+}
+
+// SetMetadata replaces the metadata attached to the recording having the given
+// name. The change is not persisted until Write is called.
+func (f *RecordingFile) SetMetadata(recordingName string, metadata map[string]string) {
+	f.recordingSource.SetMetadata(recordingName, metadata)
+}
+
+// CreatedAt returns the time at which the recording having the given name was
+// made, or the zero time if it is not known (e.g. because the recording was
+// made by an older version of copyist).
+func (f *RecordingFile) CreatedAt(recordingName string) time.Time {
+	created, err := time.Parse(time.RFC3339, f.Metadata(recordingName)[createdMetadataKey])
+	if err != nil {
+		return time.Time{}
+	}
+	return created
+}
+
+// MaxAge returns the maximum age of the recording having the given name, as set
+// by SetMaxAge when it was made, or zero if it has no maximum age.
+func (f *RecordingFile) MaxAge(recordingName string) time.Duration {
+	d, err := time.ParseDuration(f.Metadata(recordingName)[maxAgeMetadataKey])
+	if err != nil {
+		return 0
+	}
+	return d
+}
+
+// Durations returns the elapsed time of the driver call that made each record
+// in the recording having the given name, in the same order as its records, or
+// nil if the recording was made without SetRecordDurations enabled.
+func (f *RecordingFile) Durations(recordingName string) []time.Duration {
+	durations, err := parseDurations(f.Metadata(recordingName)[durationsMetadataKey])
+	if err != nil || len(durations) == 0 {
+		return nil
+	}
+	return durations
+}
+
+// Plans returns the execution plan of each distinct query in the recording
+// having the given name, keyed by query, or nil if the recording was made
+// without SetExplain enabled.
+func (f *RecordingFile) Plans(recordingName string) map[string]string {
+	plans, err := parsePlans(f.Metadata(recordingName)[plansMetadataKey])
+	if err != nil {
+		return nil
+	}
+	return plans
+}
+
+// Schema returns the fingerprint of the database schema when the recording
+// having the given name was made, or the empty string if the recording was
+// made without SetSchemaQuery enabled. See SchemaFingerprint.
+func (f *RecordingFile) Schema(recordingName string) string {
+	return f.Metadata(recordingName)[schemaMetadataKey]
+}
+
+// NondeterministicQueries returns the queries in the recording having the given
+// name that may return rows in a nondeterministic order, because they returned
+// multiple rows without an ORDER BY clause, or because they returned rows in a
+// different order than the previous time the recording was made. Recordings
+// with such queries are likely to change when they are regenerated.
+func (f *RecordingFile) NondeterministicQueries(recordingName string) []string {
+	queries, err := parseQueries(f.Metadata(recordingName)[nondeterministicMetadataKey])
+	if err != nil {
+		return nil
+	}
+	return queries
+}
+
+// RecordDrivers returns the name of the driver that made each record in the
+// recording having the given name, in the same order as its records. It returns
+// nil if the recording has no streams metadata, because it was made by a single
+// connection, or by an older version of copyist.
+func (f *RecordingFile) RecordDrivers(recordingName string) []string {
+	streams := f.Metadata(recordingName)[streamsMetadataKey]
+	if streams == "" {
+		return nil
+	}
+	recording, err := f.getRecording(recordingName)
+	if err != nil {
+		return nil
+	}
+	keys, err := parseStreams(streams, len(recording))
+	if err != nil {
+		return nil
+	}
+	drivers := make([]string, len(keys))
+	for i, key := range keys {
+		drivers[i] = key.driverName
+	}
+	return drivers
+}
+
+// SetRecording adds or replaces the recording having the given name, so that it
+// is made up of the given list of records. The change is not persisted until
+// Write is called.
+func (f *RecordingFile) SetRecording(recordingName string, records []Record) error {
+	recording := make(recording, len(records))
+	for i, rec := range records {
+		typ, ok := strToRecType[rec.Type]
+		if !ok {
+			return fmt.Errorf("record type %v is not recognized", rec.Type)
+		}
+		recording[i] = &record{Typ: typ, Args: rec.Args}
+	}
+	f.recordingSource.AddRecording(recordingName, recording)
+	return nil
+}
+
+// DeleteRecording removes the recording having the given name from the file.
+// The change is not persisted until Write is called.
+func (f *RecordingFile) DeleteRecording(recordingName string) {
+	f.recordingSource.DeleteRecording(recordingName)
+}
+
+// RenameRecordings renames recordings in the file according to the given map
+// from old names to new names, along with their metadata. Recordings are
+// renamed all at once, so names can be swapped or chained. Renamed recordings
+// keep referring to the same record declarations, including those that are
+// shared with other recordings. It returns an error if an old name does not
+// exist, if two recordings would have the same new name, or if a new name is
+// already used by a recording that is not renamed. The change is not
+// persisted until Write is called.
+func (f *RecordingFile) RenameRecordings(renames map[string]string) error {
+	exists := make(map[string]bool)
+	for _, name := range f.RecordingNames() {
+		exists[name] = true
+	}
+
+	oldNames := make([]string, 0, len(renames))
+	for oldName := range renames {
+		oldNames = append(oldNames, oldName)
+	}
+	sort.Strings(oldNames)
+
+	renamedTo := make(map[string]string, len(renames))
+	for _, oldName := range oldNames {
+		newName := renames[oldName]
+		if !exists[oldName] {
+			return fmt.Errorf("no recording exists with this name: %v", oldName)
+		}
+		if other, ok := renamedTo[newName]; ok {
+			return fmt.Errorf("recordings %q and %q cannot both be renamed to %q",
+				other, oldName, newName)
+		}
+		if _, renamed := renames[newName]; exists[newName] && !renamed {
+			return fmt.Errorf("cannot rename %q to %q, since a recording with that name "+
+				"already exists", oldName, newName)
+		}
+		renamedTo[newName] = oldName
+	}
+
+	f.recordingSource.RenameRecordings(renames)
+	return nil
+}
+
+// Write persists the recording file to its source. Only record declarations
+// that are used by at least one recording are written.
+func (f *RecordingFile) Write() (err error) {
+	defer catchSessionError(&err)
+	f.recordingSource.WriteRecording()
+	return nil
+}
+
+// catchSessionError recovers from a sessionError panic, and stores it in the
+// given error. Other panics are re-raised.
+func catchSessionError(err *error) {
+	if r := recover(); r != nil {
+		sessionErr, ok := r.(*sessionError)
+		if !ok {
+			panic(r)
+		}
+		*err = sessionErr.error
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package copyist
+
+import (
+	"database/sql/driver"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestRecordingFile tests reading, changing and writing recordings using the
+// RecordingFile API.
+func TestRecordingFile(t *testing.T) {
+	source := NewMemorySource([]byte(`
+1=DriverOpen	1:nil
+2=ConnQuery	2:"SELECT 1"	1:nil
+3=RowsNext	11:[4:1]	1:nil
+
+"TestQuery"=1,2,3
+"TestOpen"=1
+`))
+	file, err := ReadRecordingFile(source)
+	require.NoError(t, err)
+	require.Equal(t, []string{"TestOpen", "TestQuery"}, file.RecordingNames())
+	require.Empty(t, file.Validate())
+
+	records, err := file.Recording("TestQuery")
+	require.NoError(t, err)
+	require.Equal(t, []Record{
+		{Type: "DriverOpen", Args: []interface{}{nil}},
+		{Type: "ConnQuery", Args: []interface{}{"SELECT 1", nil}},
+		{Type: "RowsNext", Args: []interface{}{[]driver.Value{int64(1)}, nil}},
+	}, records)
+	require.Equal(t, `ConnQuery	2:"SELECT 1"	1:nil`, records[1].String())
+	val, err := ParseValue(`2:"SELECT 1"`)
+	require.NoError(t, err)
+	require.Equal(t, records[1].Args[0], val)
+
+	_, err = file.Recording("TestMissing")
+	require.EqualError(t, err, "no recording exists with this name: TestMissing")
+
+	// Change, add and delete recordings.
+	records[2].Args[0] = []driver.Value{int64(2)}
+	require.NoError(t, file.SetRecording("TestQuery", records))
+	require.NoError(t, file.SetRecording("TestAdded", records[:1]))
+	require.EqualError(t, file.SetRecording("TestBad", []Record{{Type: "Foo"}}),
+		"record type Foo is not recognized")
+	file.DeleteRecording("TestOpen")
+	require.NoError(t, file.Write())
+
+	file, err = ReadRecordingFile(source)
+	require.NoError(t, err)
+	require.Equal(t, []string{"TestAdded", "TestQuery"}, file.RecordingNames())
+	records, err = file.Recording("TestQuery")
+	require.NoError(t, err)
+	require.Equal(t, []driver.Value{int64(2)}, records[2].Args[0])
+}
+
+// TestRenameRecordings tests renaming recordings using the RecordingFile API.
+func TestRenameRecordings(t *testing.T) {
+	source := NewMemorySource([]byte(`1=DriverOpen	1:nil
+2=ConnQuery	2:"SELECT 1"	1:nil
+
+"TestA"=1,2
+"TestB"=1
+"TestC"=2
+"TestA"@created=2021-01-01T00:00:00Z
+`))
+	file, err := ReadRecordingFile(source)
+	require.NoError(t, err)
+
+	require.EqualError(t, file.RenameRecordings(map[string]string{"TestMissing": "TestD"}),
+		"no recording exists with this name: TestMissing")
+	require.EqualError(t, file.RenameRecordings(map[string]string{"TestA": "TestC"}),
+		`cannot rename "TestA" to "TestC", since a recording with that name already exists`)
+	require.EqualError(t, file.RenameRecordings(map[string]string{"TestA": "TestD", "TestB": "TestD"}),
+		`recordings "TestA" and "TestB" cannot both be renamed to "TestD"`)
+
+	// Names can be swapped, and the recordings keep sharing their records.
+	require.NoError(t, file.RenameRecordings(map[string]string{"TestA": "TestB", "TestB": "TestA"}))
+	require.NoError(t, file.Write())
+	data, err := source.ReadAll()
+	require.NoError(t, err)
+	require.Equal(t, `1=DriverOpen	1:nil
+2=ConnQuery	2:"SELECT 1"	1:nil
+
+"TestA"=1
+"TestB"=1,2
+"TestB"@created=2021-01-01T00:00:00Z
+"TestC"=2
+`, string(data))
+}
@@ -17,14 +17,17 @@ package copyist
 import (
 	"bufio"
 	"bytes"
-	"crypto/md5"
 	"errors"
 	"fmt"
-	"hash"
+	"io"
 	"os"
-	"path"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+
+	"github.com/cespare/xxhash/v2"
 )
 
 // Source represents a persistent copyist recording source, generally a file on
@@ -39,6 +42,31 @@ type Source interface {
 	WriteAll([]byte) error
 }
 
+// lockableSource is implemented by Sources that can be locked in order to
+// prevent concurrent writers from interleaving updates to the same underlying
+// resource. A session holds the lock while it reads existing recordings and
+// writes the updated recordings back.
+type lockableSource interface {
+	Lock() (unlock func(), err error)
+}
+
+// streamingSource is implemented by Sources that can write a recording file
+// incrementally, rather than needing all of it to be buffered in memory first.
+type streamingSource interface {
+	// WriteStream calls write with a writer to which the recording file is
+	// written. If write returns an error, then the underlying resource is left
+	// unchanged.
+	WriteStream(write func(w io.Writer) error) error
+}
+
+// appendableSource is implemented by Sources that can append to the end of the
+// underlying resource, rather than needing to rewrite all of it.
+type appendableSource interface {
+	// Append appends the given data to the underlying resource, which must
+	// already exist.
+	Append(data []byte) error
+}
+
 // fileSource is a Source that references a file on disk.
 type fileSource struct {
 	// PathName is the location of the copyist recording file (can be relative
@@ -46,6 +74,13 @@ type fileSource struct {
 	PathName string
 }
 
+// NewFileSource returns a Source that reads and writes the copyist recording
+// file at the given path, which can be relative or absolute. This is the kind
+// of Source used by Open and OpenNamed.
+func NewFileSource(pathName string) Source {
+	return fileSource{PathName: pathName}
+}
+
 // ReadAll implements Source.
 func (s fileSource) ReadAll() ([]byte, error) {
 	return os.ReadFile(s.PathName)
@@ -53,18 +88,140 @@ func (s fileSource) ReadAll() ([]byte, error) {
 
 // WriteAll implements Source.
 func (s fileSource) WriteAll(data []byte) error {
+	return s.WriteStream(func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// WriteStream implements streamingSource.
+func (s fileSource) WriteStream(write func(w io.Writer) error) error {
 	// Ensure directory exists.
-	dirName := path.Dir(s.PathName)
+	dirName := filepath.Dir(s.PathName)
 	if _, err := os.Stat(dirName); os.IsNotExist(err) {
 		if err := os.MkdirAll(dirName, 0777); err != nil {
 			return err
 		}
 	}
-	return os.WriteFile(s.PathName, data, 0777)
+
+	// Write to a temporary file and then rename it over the recording file, so
+	// that concurrent readers never see a partially written file.
+	file, err := os.CreateTemp(dirName, filepath.Base(s.PathName)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tempName := file.Name()
+
+	// CreateTemp creates the file so that only its owner can read it, so keep
+	// the mode of the existing recording file instead.
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(s.PathName); err == nil {
+		mode = info.Mode().Perm()
+	}
+	err = file.Chmod(mode)
+	if err == nil {
+		bw := bufio.NewWriter(file)
+		err = write(bw)
+		if err == nil {
+			err = bw.Flush()
+		}
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tempName, s.PathName)
+	}
+	if err != nil {
+		os.Remove(tempName)
+		return err
+	}
+	return nil
+}
+
+// Append implements appendableSource.
+func (s fileSource) Append(data []byte) error {
+	file, err := os.OpenFile(s.PathName, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Lock implements lockableSource. It acquires an advisory lock on a lock file
+// alongside the recording file. This prevents test packages that are run
+// concurrently (e.g. go test -p N) from overwriting each other's recordings when
+// they share a recording file.
+func (s fileSource) Lock() (unlock func(), err error) {
+	// Ensure directory exists.
+	dirName := filepath.Dir(s.PathName)
+	if _, err := os.Stat(dirName); os.IsNotExist(err) {
+		if err := os.MkdirAll(dirName, 0777); err != nil {
+			return nil, err
+		}
+	}
+
+	return lockFile(s.PathName + ".lock")
 }
 
-// hashValue is an MD5 hash type (16 bytes).
-type hashValue [md5.Size]byte
+// These are the keys of metadata that copyist attaches to each recording.
+const (
+	// createdMetadataKey is the key of the time at which the recording was
+	// made, in RFC 3339 format.
+	createdMetadataKey = "created"
+
+	// maxAgeMetadataKey is the key of the maximum age of the recording, in
+	// time.Duration format, after which it should be regenerated.
+	maxAgeMetadataKey = "max-age"
+
+	// fingerprintMetadataKey is the key of the fingerprint of the test that
+	// made the recording. See SetFingerprint.
+	fingerprintMetadataKey = "fingerprint"
+
+	// streamsMetadataKey is the key of the driver that made each record in
+	// the recording, if the recording was made by more than one driver. See
+	// formatStreams.
+	streamsMetadataKey = "streams"
+
+	// goroutinesMetadataKey is the key of the goroutine that made each record
+	// in the recording, if calls were serialized while recording and more than
+	// one goroutine made them. See SetSerializeCalls.
+	goroutinesMetadataKey = "goroutines"
+
+	// nondeterministicMetadataKey is the key of the list of queries in the
+	// recording that may return rows in a nondeterministic order. See
+	// formatQueries.
+	nondeterministicMetadataKey = "nondeterministic"
+
+	// durationsMetadataKey is the key of the elapsed time of the driver call
+	// that made each record in the recording, in microseconds. See
+	// SetRecordDurations.
+	durationsMetadataKey = "durations"
+
+	// plansMetadataKey is the key of the execution plan of each distinct query
+	// in the recording. See SetExplain and formatPlans.
+	plansMetadataKey = "plans"
+
+	// schemaMetadataKey is the key of the fingerprint of the database schema
+	// when the recording was made. See SetSchemaQuery.
+	schemaMetadataKey = "schema"
+)
+
+// hashValue is the 64-bit xxhash of a record declaration, which is used to find
+// duplicate record declarations.
+type hashValue uint64
+
+// bufferPool pools the byte slices used to format record declarations, so that
+// they can be reused across recordingSources.
+var bufferPool = sync.Pool{New: func() interface{} { return new([]byte) }}
+
+// writerPool pools the buffered writers used to write recording files, so that
+// they can be reused across recordingSources.
+var writerPool = sync.Pool{New: func() interface{} { return bufio.NewWriterSize(nil, 64*1024) }}
 
 // recordingSource is the in-memory representation for a copyist recording file.
 // recordingSource parses the file and stores its contents in data structures
@@ -82,6 +239,7 @@ type hashValue [md5.Size]byte
 //   7=RowsNext	11:[]	7:EOF
 //
 //   "github.com/cockroachdb/copyist/pqtest_test.TestQuery"=1,2,3,4,5,6,7
+//   "github.com/cockroachdb/copyist/pqtest_test.TestQuery"@created=2021-06-01T12:00:00Z
 //
 // The first section is a numbered list of tab-delimited copyist record
 // declaration. Each record declaration represents a call to a driver method,
@@ -92,7 +250,14 @@ type hashValue [md5.Size]byte
 // The second section is a mapping from a test recording name to the list of
 // record numbers from the first section that make up that recording. It is
 // common for multiple recording declarations to share one or more records,
-// since driver calls are often quite redundant across tests.
+// since driver calls are often quite redundant across tests. Each recording
+// declaration can be followed by metadata lines that attach key/value pairs to
+// the recording, such as the time at which it was made.
+//
+// New recordings can be appended to the end of the file as further record and
+// recording declaration sections (see AppendRecording). If a recording
+// declaration is repeated, then the last declaration of that name, along with
+// its metadata, supersedes the others.
 type recordingSource struct {
 	source Source
 
@@ -106,13 +271,35 @@ type recordingSource struct {
 	// right of the equal sign (e.g. "1,2,3").
 	recordingDecls map[string]string
 
+	// metadata is a map of the metadata attached to each recording, keyed by
+	// recording name and then by metadata key.
+	metadata map[string]map[string]string
+
+	// data is the contents of the recording file, if it was parsed by
+	// ParseIndex. Otherwise, it is nil.
+	data []byte
+
+	// recordIndex is the offset in data of each record declaration, indexed by
+	// the number of the declaration, if the recording file was parsed by
+	// ParseIndex. A zero offset means that there is no such declaration.
+	recordIndex []int
+
+	// superseded is the number of recording declarations in the recording file
+	// that were superseded by later recording declarations of the same name.
+	superseded int
+
+	// appendable is true if the recording file was successfully parsed, and
+	// new recordings can be appended to it. See AppendRecording.
+	appendable bool
+
 	// addRecordings tracks any recordings added via calls to AddRecording.
 	// Recordings are keyed by recording name. These are accumulated here until
 	// WriteRecordingFile is called.
 	addRecordings map[string]recording
 
-	// md5Hasher is a reusable MD5 hasher.
-	md5Hasher hash.Hash
+	// bytesWritten is the number of bytes written to the source by calls to
+	// WriteRecording and AppendRecording.
+	bytesWritten int64
 
 	// scratch is a reusable bytes buffer.
 	scratch bytes.Buffer
@@ -122,7 +309,7 @@ type recordingSource struct {
 // source. Parse can be called to add recordings from an existing file, or
 // AddRecording to add new recordings.
 func newRecordingSource(source Source) *recordingSource {
-	return &recordingSource{source: source, md5Hasher: md5.New()}
+	return &recordingSource{source: source}
 }
 
 // GetRecording returns the recording from the copyist recording file having the
@@ -156,167 +343,520 @@ func (f *recordingSource) AddRecording(recordingName string, newRecording record
 	f.addRecordings[recordingName] = newRecording
 }
 
+// DeleteRecording removes the recording having the given name from the
+// in-memory file, including any recording of that name added by AddRecording.
+// Once WriteRecording is called, the recording will no longer be on disk.
+func (f *recordingSource) DeleteRecording(recordingName string) {
+	delete(f.recordingDecls, recordingName)
+	delete(f.addRecordings, recordingName)
+	delete(f.metadata, recordingName)
+}
+
+// RenameRecordings renames recordings in the in-memory file, along with their
+// metadata, according to the given map from old names to new names. Renamed
+// recordings keep their existing record declarations, so records that are
+// shared with other recordings are not duplicated. The caller must ensure that
+// the new names do not conflict with one another or with recordings that are
+// not renamed.
+func (f *recordingSource) RenameRecordings(renames map[string]string) {
+	recordingDecls := make(map[string]string, len(renames))
+	addRecordings := make(map[string]recording, len(renames))
+	metadata := make(map[string]map[string]string, len(renames))
+	for oldName, newName := range renames {
+		if decl, ok := f.recordingDecls[oldName]; ok {
+			recordingDecls[newName] = decl
+			delete(f.recordingDecls, oldName)
+		}
+		if rec, ok := f.addRecordings[oldName]; ok {
+			addRecordings[newName] = rec
+			delete(f.addRecordings, oldName)
+		}
+		if md, ok := f.metadata[oldName]; ok {
+			metadata[newName] = md
+			delete(f.metadata, oldName)
+		}
+	}
+
+	for name, decl := range recordingDecls {
+		if f.recordingDecls == nil {
+			f.recordingDecls = make(map[string]string)
+		}
+		f.recordingDecls[name] = decl
+	}
+	for name, rec := range addRecordings {
+		f.AddRecording(name, rec)
+	}
+	for name, md := range metadata {
+		f.SetMetadata(name, md)
+	}
+}
+
+// GetMetadata returns the metadata attached to the recording having the given
+// name, or nil if there is none.
+func (f *recordingSource) GetMetadata(recordingName string) map[string]string {
+	return f.metadata[recordingName]
+}
+
+// SetMetadata replaces the metadata attached to the recording having the given
+// name. Once WriteRecording is called, the metadata will be written to disk
+// along with the recording. The metadata is copied, so that later changes to
+// the given map, or to the metadata of another source that it came from, do not
+// affect this source.
+func (f *recordingSource) SetMetadata(recordingName string, metadata map[string]string) {
+	if f.metadata == nil {
+		f.metadata = make(map[string]map[string]string)
+	}
+	if len(metadata) == 0 {
+		delete(f.metadata, recordingName)
+		return
+	}
+	copied := make(map[string]string, len(metadata))
+	for key, val := range metadata {
+		copied[key] = val
+	}
+	f.metadata[recordingName] = copied
+}
+
 // WriteRecording writes all recordings to the recording file in the copyist
 // recording file format. All recordings buffered in memory will be written,
 // with any recordings added by AddRecording overriding existing recordings.
 // Only record declarations that are used by the written set of recordings will
-// be written to disk.
+// be written to disk. If the source supports it, the recording file is streamed
+// to the source rather than buffered in memory, so that there is no limit on
+// the size of the recordings that can be written.
 func (f *recordingSource) WriteRecording() {
-	// Accumulate records and recordings that need to be written to disk.
-	outRecordDecls := make([]string, 0, len(f.recordingDecls)+len(f.addRecordings))
+	var err error
+	if ss, ok := f.source.(streamingSource); ok {
+		err = ss.WriteStream(func(w io.Writer) error {
+			cw := &countingWriter{w: w}
+			err := f.writeRecording(cw)
+			f.bytesWritten += cw.n
+			return err
+		})
+	} else {
+		var buf bytes.Buffer
+		if err = f.writeRecording(&buf); err == nil {
+			err = f.source.WriteAll(buf.Bytes())
+			f.bytesWritten += int64(buf.Len())
+		}
+	}
+	if err != nil {
+		panicf("%+v", err)
+	}
+}
+
+// writeRecording writes all recordings to the given writer in the copyist
+// recording file format. See WriteRecording for more details.
+func (f *recordingSource) writeRecording(w io.Writer) error {
+	bw := writerPool.Get().(*bufio.Writer)
+	bw.Reset(w)
+	defer func() {
+		bw.Reset(nil)
+		writerPool.Put(bw)
+	}()
+
+	buf := bufferPool.Get().(*[]byte)
+	defer bufferPool.Put(buf)
+
 	outRecordingDecls := make(map[string]string)
 	hashToNumMap := make(map[hashValue]int)
 
-	// addRecordDecl ensures that only unique record declarations are added to
-	// outRecordDecls. It returns the unique record number assigned to the
-	// given record declaration.
-	addRecordDecl := func(recordDecl string) int {
-		if len(recordDecl) > MaxRecordingSize {
-			panicf("recording exceeds copyist.MaxRecordingSize and cannot be written")
+	// addRecordDecl ensures that only unique record declarations are written.
+	// It returns the unique record number assigned to the record declaration
+	// having the given hash, and true if the number is new, in which case the
+	// caller must write the record declaration. Record declarations are
+	// numbered in the order in which they are first used, so they can be
+	// written as soon as they are added.
+	addRecordDecl := func(hashVal hashValue) (int, bool) {
+		if num, ok := hashToNumMap[hashVal]; ok {
+			return num, false
 		}
-
-		hashVal := f.hashStr(recordDecl)
-		num, ok := hashToNumMap[hashVal]
-		if !ok {
-			num = len(outRecordDecls)
-			hashToNumMap[hashVal] = num
-			outRecordDecls = append(outRecordDecls, recordDecl)
-		}
-		return num
+		num := len(hashToNumMap)
+		hashToNumMap[hashVal] = num
+		bw.WriteString(strconv.Itoa(num + 1))
+		bw.WriteByte('=')
+		return num, true
 	}
 
-	// formatRecording constructs a comma-delimited list of record numbers.
-	formatRecording := func(recordNums []int) string {
-		f.scratch.Reset()
-		for i, num := range recordNums {
-			if i != 0 {
-				f.scratch.WriteByte(',')
-			}
-			f.scratch.WriteString(strconv.Itoa(num + 1))
+	// Visit recordings in sorted order, so that the recording file is always
+	// written the same way, regardless of map iteration order. This minimizes
+	// churn in recording files when they are regenerated.
+	recordingNames := make([]string, 0, len(f.recordingDecls)+len(f.addRecordings))
+	for recordingName := range f.recordingDecls {
+		// Skip past recording declarations that are being replaced.
+		if _, ok := f.addRecordings[recordingName]; !ok {
+			recordingNames = append(recordingNames, recordingName)
 		}
-		return f.scratch.String()
 	}
-
-	// Add set of existing recording and record declarations to the output
-	// data structures, as long as they were not overridden by added recordings.
-	for recordingName, recordingDecl := range f.recordingDecls {
-		// Skip past recording declarations that are being replaced.
-		if _, ok := f.addRecordings[recordingName]; ok {
+	for recordingName := range f.addRecordings {
+		recordingNames = append(recordingNames, recordingName)
+	}
+	sort.Strings(recordingNames)
+
+	for _, recordingName := range recordingNames {
+		// Add set of new recording and record declarations to the output data
+		// structures.
+		if recording, ok := f.addRecordings[recordingName]; ok {
+			newRecordNums := make([]int, len(recording))
+			for i, record := range recording {
+				*buf = appendRecord((*buf)[:0], f.offloadRecord(record))
+				num, isNew := addRecordDecl(hashValue(xxhash.Sum64(*buf)))
+				if isNew {
+					bw.Write(append(*buf, '\n'))
+				}
+				newRecordNums[i] = num
+			}
+			outRecordingDecls[recordingName] = f.formatRecordingDecl(newRecordNums)
 			continue
 		}
 
-		// Add all record declarations used by this recording declaration.
-		// Record declarations may be renumbered, so rebuild the recording
-		// declaration to reflect the new numbers.
-		oldRecordNums := f.parseRecordingDecl(recordingDecl)
+		// Add all record declarations used by this existing recording
+		// declaration. Record declarations may be renumbered, so rebuild the
+		// recording declaration to reflect the new numbers.
+		oldRecordNums := f.parseRecordingDecl(f.recordingDecls[recordingName])
 		newRecordNums := make([]int, len(oldRecordNums))
 		for i, num := range oldRecordNums {
-			recordDecl, ok := f.recordDecls[num]
+			recordDecl, ok := f.recordDecl(num)
 			if !ok {
 				panicf("record with number %d must exist", num)
 			}
-			newRecordNums[i] = addRecordDecl(recordDecl)
+			num, isNew := addRecordDecl(hashValue(xxhash.Sum64String(recordDecl)))
+			if isNew {
+				bw.WriteString(recordDecl)
+				bw.WriteByte('\n')
+			}
+			newRecordNums[i] = num
 		}
 
 		// Create new recording declaration represented as a string.
-		outRecordingDecls[recordingName] = formatRecording(newRecordNums)
+		outRecordingDecls[recordingName] = f.formatRecordingDecl(newRecordNums)
+	}
+
+	// Write the recording declarations after the record declarations.
+	bw.WriteByte('\n')
+	for _, recordingName := range recordingNames {
+		bw.WriteString(strconv.Quote(recordingName))
+		bw.WriteByte('=')
+		bw.WriteString(outRecordingDecls[recordingName])
+		bw.WriteByte('\n')
+		bw.WriteString(f.formatMetadata(recordingName))
 	}
 
-	// Add set of new recording and record declarations to the output data
-	// structures.
-	for recordingName, recording := range f.addRecordings {
+	return bw.Flush()
+}
+
+// AppendRecording appends the recordings added by AddRecording, along with
+// their metadata, to the end of the recording file, rather than rewriting the
+// entire file as WriteRecording does. This is much faster for large recording
+// files, but leaves behind any recordings that are superseded by the appended
+// recordings. Therefore, AppendRecording returns false without appending if
+// superseded recordings would outnumber the other recordings in the file, so
+// that the caller can compact the file by calling WriteRecording instead. It
+// also returns false if the recording file was not successfully parsed, or if
+// its source does not support appending.
+func (f *recordingSource) AppendRecording() bool {
+	as, ok := f.source.(appendableSource)
+	if !ok || !f.appendable || f.recordIndex != nil {
+		return false
+	}
+
+	superseded := f.superseded
+	for recordingName := range f.addRecordings {
+		if _, ok := f.recordingDecls[recordingName]; ok {
+			superseded++
+		}
+	}
+	if superseded > len(f.recordingDecls) {
+		return false
+	}
+
+	// Number appended record declarations after the largest existing number.
+	nextNum := 0
+	for num := range f.recordDecls {
+		if num >= nextNum {
+			nextNum = num + 1
+		}
+	}
+
+	recordingNames := make([]string, 0, len(f.addRecordings))
+	for recordingName := range f.addRecordings {
+		recordingNames = append(recordingNames, recordingName)
+	}
+	sort.Strings(recordingNames)
+
+	// Only de-duplicate the appended record declarations among themselves, as
+	// hashing the existing record declarations is what appending avoids.
+	var records, recordings bytes.Buffer
+	buf := bufferPool.Get().(*[]byte)
+	defer bufferPool.Put(buf)
+	hashToNumMap := make(map[hashValue]int)
+	for _, recordingName := range recordingNames {
+		recording := f.addRecordings[recordingName]
 		newRecordNums := make([]int, len(recording))
 		for i, record := range recording {
-			newRecordNums[i] = addRecordDecl(f.formatRecord(record))
+			*buf = appendRecord((*buf)[:0], f.offloadRecord(record))
+			hashVal := hashValue(xxhash.Sum64(*buf))
+			num, ok := hashToNumMap[hashVal]
+			if !ok {
+				num = nextNum
+				nextNum++
+				hashToNumMap[hashVal] = num
+				records.WriteString(strconv.Itoa(num + 1))
+				records.WriteByte('=')
+				records.Write(*buf)
+				records.WriteByte('\n')
+			}
+			newRecordNums[i] = num
 		}
-		outRecordingDecls[recordingName] = formatRecording(newRecordNums)
+
+		recordings.WriteString(strconv.Quote(recordingName))
+		recordings.WriteByte('=')
+		recordings.WriteString(f.formatRecordingDecl(newRecordNums))
+		recordings.WriteByte('\n')
+		recordings.WriteString(f.formatMetadata(recordingName))
 	}
 
-	// Write the record declarations to the buffer.
-	f.scratch.Reset()
-	for num, recordDecl := range outRecordDecls {
-		f.scratch.WriteString(strconv.Itoa(num + 1))
-		f.scratch.WriteByte('=')
-		f.scratch.WriteString(recordDecl)
-		f.scratch.WriteByte('\n')
+	// Append both sections with a single write, so that they are not
+	// interleaved with any other appends.
+	records.WriteByte('\n')
+	records.Write(recordings.Bytes())
+	if err := as.Append(records.Bytes()); err != nil {
+		panicf("%+v", err)
 	}
+	f.bytesWritten += int64(records.Len())
+	return true
+}
 
-	// Write the recording declarations to the buffer.
-	f.scratch.WriteByte('\n')
-	for recordingName, recordingDecl := range outRecordingDecls {
+// formatMetadata returns the metadata lines for the recording having the given
+// name, in sorted key order, in a format like:
+//
+//	"TestQuery"@created=2021-06-01T12:00:00Z
+func (f *recordingSource) formatMetadata(recordingName string) string {
+	metadata := f.metadata[recordingName]
+	keys := make([]string, 0, len(metadata))
+	for key := range metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	f.scratch.Reset()
+	for _, key := range keys {
 		f.scratch.WriteString(strconv.Quote(recordingName))
+		f.scratch.WriteByte('@')
+		f.scratch.WriteString(key)
 		f.scratch.WriteByte('=')
-		f.scratch.WriteString(recordingDecl)
+		f.scratch.WriteString(scrubDSN(metadata[key]))
 		f.scratch.WriteByte('\n')
 	}
-
-	if err := f.source.WriteAll(f.scratch.Bytes()); err != nil {
-		panicf("%+v", err)
-	}
+	return f.scratch.String()
 }
 
 // Parse reads the copyist recording file and extracts recording and record
 // declarations from it, and stores them in in-memory data structures for
 // convenient and performant access.
 func (f *recordingSource) Parse() error {
-	recordDecls := make(map[int]string)
+	return f.parse(false /* lazy */)
+}
+
+// ParseIndex is like Parse, except that it does not extract record declarations
+// from the recording file. Instead, it builds an index of where each record
+// declaration is located in the file, and only extracts the record declarations
+// used by recordings returned by GetRecording. This is much cheaper for large
+// recording files, of which a test typically uses only a small part. Only
+// GetRecording and GetMetadata can be called on a recordingSource that was
+// parsed in this way; it is only suitable for playing back recordings.
+func (f *recordingSource) ParseIndex() error {
+	return f.parse(true /* lazy */)
+}
+
+// parse implements Parse and ParseIndex.
+func (f *recordingSource) parse(lazy bool) error {
+	var recordDecls map[int]string
+	var recordIndex []int
+	if !lazy {
+		recordDecls = make(map[int]string)
+	}
 	recordingDecls := make(map[string]string)
+	metadata := make(map[string]map[string]string)
+	superseded := 0
 
 	data, err := f.source.ReadAll()
 	if err != nil {
 		return err
 	}
+	if isEncrypted(data) {
+		return errors.New("recording file is encrypted, but no encryption key is set")
+	}
 
-	scanner := bufio.NewScanner(bytes.NewReader(data))
-	scanner.Buffer(nil, MaxRecordingSize)
-	for scanner.Scan() {
-		text := scanner.Text()
-		if len(text) == 0 {
+	for offset := 0; offset < len(data); {
+		// Split the data into lines, dropping any trailing carriage return.
+		lineOffset := offset
+		line := data[offset:]
+		if end := bytes.IndexByte(line, '\n'); end != -1 {
+			line = line[:end]
+			offset += end + 1
+		} else {
+			offset = len(data)
+		}
+		line = bytes.TrimSuffix(line, []byte{'\r'})
+		if len(line) == 0 {
 			continue
 		}
 
-		if text[0] != '"' {
+		if line[0] != '"' {
 			// Split the line on the first equal sign:
 			//   1=DriverOpen 3:nil
-			index := strings.Index(text, "=")
+			index := bytes.IndexByte(line, '=')
 			if index == -1 {
-				return fmt.Errorf("expected equals: %s", text)
+				return fmt.Errorf("expected equals: %s", line)
 			}
 
-			recordNum, err := strconv.Atoi(text[:index])
-			if err != nil {
-				return fmt.Errorf("expected record number: %s", text)
+			recordNum, err := strconv.Atoi(string(line[:index]))
+			if err != nil || recordNum < 1 {
+				return fmt.Errorf("expected record number: %s", line)
+			}
+
+			if !lazy {
+				recordDecls[recordNum-1] = string(line[index+1:])
+				continue
 			}
 
-			recordDecls[recordNum-1] = text[index+1:]
+			// Remember the offset of the record declaration, so that it can
+			// be extracted later if it is used.
+			for len(recordIndex) < recordNum {
+				recordIndex = append(recordIndex, 0)
+			}
+			recordIndex[recordNum-1] = lineOffset + index + 1
 		} else {
-			// Split the line on the last equal sign:
-			//   "some:name":1,2,3,4
-			index := strings.LastIndex(text, "=")
-			if index == -1 {
+			// Split the line after the quoted recording name:
+			//   "some:name"=1,2,3,4
+			//   "some:name"@created=2021-06-01T12:00:00Z
+			text := string(line)
+			index := quotedPrefixLen(text)
+			if index == -1 || index == len(text) {
 				return fmt.Errorf("expected equals: %s", text)
 			}
 			recordingName, err := strconv.Unquote(text[:index])
 			if err != nil {
 				return err
 			}
-			recordingDecl := text[index+1:]
-			recordingDecls[recordingName] = recordingDecl
-		}
-	}
 
-	if err := scanner.Err(); err != nil {
-		if err == bufio.ErrTooLong {
-			err = errors.New("recording exceeds copyist.MaxRecordingSize and cannot be read")
+			switch text[index] {
+			case '=':
+				// Later recording declarations of the same name supersede
+				// earlier ones, along with their metadata.
+				if _, ok := recordingDecls[recordingName]; ok {
+					superseded++
+					delete(metadata, recordingName)
+				}
+				recordingDecls[recordingName] = text[index+1:]
+
+			case '@':
+				// Split the metadata on the first equal sign.
+				keyValue := text[index+1:]
+				equals := strings.Index(keyValue, "=")
+				if equals == -1 {
+					return fmt.Errorf("expected equals: %s", text)
+				}
+				if metadata[recordingName] == nil {
+					metadata[recordingName] = make(map[string]string)
+				}
+				metadata[recordingName][keyValue[:equals]] = keyValue[equals+1:]
+
+			default:
+				return fmt.Errorf("expected equals: %s", text)
+			}
 		}
-		return err
 	}
 
 	f.recordDecls = recordDecls
 	f.recordingDecls = recordingDecls
+	f.metadata = metadata
+	f.superseded = superseded
+	f.appendable = len(data) == 0 || data[len(data)-1] == '\n'
+	f.data = nil
+	f.recordIndex = nil
+	if lazy {
+		f.data = data
+		f.recordIndex = recordIndex
+	}
 	return nil
 }
 
+// recordDecl returns the record declaration having the given number, or false
+// if there is no such record declaration. If the recording file was parsed by
+// ParseIndex, then the record declaration is extracted from the file data.
+func (f *recordingSource) recordDecl(recordNum int) (string, bool) {
+	if f.recordIndex == nil {
+		recordDecl, ok := f.recordDecls[recordNum]
+		return recordDecl, ok
+	}
+
+	if recordNum < 0 || recordNum >= len(f.recordIndex) || f.recordIndex[recordNum] == 0 {
+		return "", false
+	}
+	line := f.data[f.recordIndex[recordNum]:]
+	if end := bytes.IndexByte(line, '\n'); end != -1 {
+		line = line[:end]
+	}
+	return string(bytes.TrimSuffix(line, []byte{'\r'})), true
+}
+
+// quotedPrefixLen returns the length of the double-quoted string at the start
+// of the given text, including its quotes, or -1 if the quoted string is not
+// terminated.
+func quotedPrefixLen(text string) int {
+	for i := 1; i < len(text); i++ {
+		switch text[i] {
+		case '\\':
+			// Skip past the escaped character.
+			i++
+		case '"':
+			return i + 1
+		}
+	}
+	return -1
+}
+
+// Merge adds to this recordingSource any recordings from the other source that
+// do not already exist in this source. Recordings that exist in both sources
+// are left unchanged, so this source takes precedence. Both sources must have
+// been parsed.
+func (f *recordingSource) Merge(other *recordingSource) {
+	// Append merged record declarations after the largest existing number.
+	nextNum := 0
+	for num := range f.recordDecls {
+		if num >= nextNum {
+			nextNum = num + 1
+		}
+	}
+
+	for recordingName, recordingDecl := range other.recordingDecls {
+		if _, ok := f.recordingDecls[recordingName]; ok {
+			continue
+		}
+
+		// Copy the record declarations used by the other recording, giving
+		// them new numbers. Duplicates will be removed when the recording file
+		// is written.
+		oldRecordNums := other.parseRecordingDecl(recordingDecl)
+		newRecordNums := make([]int, len(oldRecordNums))
+		for i, num := range oldRecordNums {
+			recordDecl, ok := other.recordDecls[num]
+			if !ok {
+				panicf("record with number %d must exist", num)
+			}
+			f.recordDecls[nextNum] = recordDecl
+			newRecordNums[i] = nextNum
+			nextNum++
+		}
+		f.recordingDecls[recordingName] = f.formatRecordingDecl(newRecordNums)
+		if metadata, ok := other.metadata[recordingName]; ok {
+			f.SetMetadata(recordingName, metadata)
+		}
+	}
+}
+
 // parseRecordingDecl parses a recording declaration value in a format similar
 // to "1,2,3,4" and returns the resulting list of 0-based record numbers.
 func (f *recordingSource) parseRecordingDecl(decl string) []int {
@@ -334,24 +874,36 @@ func (f *recordingSource) parseRecordingDecl(decl string) []int {
 	return nums
 }
 
-// formatRecord returns the given copyist record as a string in a format like:
-//
-//   ConnPrepare 2:"SELECT COUNT(*) FROM customers"	1:nil
-//
-func (f *recordingSource) formatRecord(record *record) string {
+// formatRecordingDecl constructs a recording declaration value from the given
+// list of 0-based record numbers, in a format similar to "1,2,3,4".
+func (f *recordingSource) formatRecordingDecl(recordNums []int) string {
 	f.scratch.Reset()
-	f.scratch.WriteString(record.Typ.String())
-	for _, arg := range record.Args {
-		f.scratch.WriteByte('\t')
-		f.scratch.WriteString(formatValueWithType(arg))
+	for i, num := range recordNums {
+		if i != 0 {
+			f.scratch.WriteByte(',')
+		}
+		f.scratch.WriteString(strconv.Itoa(num + 1))
 	}
 	return f.scratch.String()
 }
 
+// appendRecord appends the given copyist record to the given byte slice in a
+// format like the following, and returns the extended slice:
+//
+//	ConnPrepare	2:"SELECT COUNT(*) FROM customers"	1:nil
+func appendRecord(b []byte, record *record) []byte {
+	b = append(b, record.Typ.String()...)
+	for _, arg := range record.Args {
+		b = append(b, '\t')
+		b = appendValueWithType(b, arg)
+	}
+	return b
+}
+
 // parseRecord instantiates the copyist record declaration identified by the
 // given number in the copyist recording file.
 func (f *recordingSource) parseRecord(recordNum int) *record {
-	r, ok := f.recordDecls[recordNum]
+	r, ok := f.recordDecl(recordNum)
 	if !ok {
 		panicf("record with number %d must exist", recordNum)
 	}
@@ -372,19 +924,24 @@ func (f *recordingSource) parseRecord(recordNum int) *record {
 		if err != nil {
 			panicf("error parsing %s: %v", fields[i], err)
 		}
+		if val, err = f.loadValue(val); err != nil {
+			panicf("%v", err)
+		}
 		rec.Args = append(rec.Args, val)
 	}
 	return rec
 }
 
-// hashStr returns the MD5 hash of the given string.
-func (f *recordingSource) hashStr(s string) hashValue {
-	f.scratch.Reset()
-	f.scratch.WriteString(s)
-	f.md5Hasher.Reset()
-	f.md5Hasher.Write(f.scratch.Bytes())
+// countingWriter is an io.Writer that counts the bytes written to the wrapped
+// writer.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
 
-	var val hashValue
-	copy(val[:], f.md5Hasher.Sum(nil))
-	return val
+// Write implements io.Writer.
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
 }
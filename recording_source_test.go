@@ -0,0 +1,405 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package copyist
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestFileSourceLocking tests that concurrent writers of the same recording
+// file don't lose each other's recordings when they hold the file lock.
+func TestFileSourceLocking(t *testing.T) {
+	source := NewFileSource(filepath.Join(t.TempDir(), "testdata", "locking.copyist"))
+
+	const writers = 10
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			unlock, err := source.(lockableSource).Lock()
+			require.NoError(t, err)
+			defer unlock()
+
+			recordingSource := newRecordingSource(source)
+			_ = recordingSource.Parse()
+			recordingSource.AddRecording(fmt.Sprintf("Test%d", i), recording{
+				{Typ: DriverOpen, Args: recordArgs{nil}},
+			})
+			recordingSource.WriteRecording()
+		}(i)
+	}
+	wg.Wait()
+
+	recordingSource := newRecordingSource(source)
+	require.NoError(t, recordingSource.Parse())
+	require.Len(t, recordingSource.recordingDecls, writers)
+}
+
+// TestFileSourceLockBlocks tests that Lock blocks until the current holder of
+// the lock releases it.
+func TestFileSourceLockBlocks(t *testing.T) {
+	source := NewFileSource(filepath.Join(t.TempDir(), "blocks.copyist"))
+	unlock, err := source.(lockableSource).Lock()
+	require.NoError(t, err)
+
+	locked := make(chan struct{})
+	go func() {
+		unlock, err := source.(lockableSource).Lock()
+		require.NoError(t, err)
+		unlock()
+		close(locked)
+	}()
+
+	select {
+	case <-locked:
+		t.Fatal("lock was acquired while it was held")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	<-locked
+}
+
+// TestFileSourceConcurrentWrites tests that concurrent writers of the same
+// recording file don't interfere with each other's temporary files, even when
+// they don't hold the file lock.
+func TestFileSourceConcurrentWrites(t *testing.T) {
+	pathName := filepath.Join(t.TempDir(), "writes.copyist")
+	source := NewFileSource(pathName)
+
+	const writers = 10
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			require.NoError(t, source.WriteAll([]byte(strings.Repeat(fmt.Sprint(i), 1000))))
+		}(i)
+	}
+	wg.Wait()
+
+	data, err := source.ReadAll()
+	require.NoError(t, err)
+	require.Len(t, data, 1000)
+	require.Equal(t, strings.Repeat(string(data[:1]), 1000), string(data))
+
+	// No temporary files are left behind.
+	matches, err := filepath.Glob(pathName + ".*")
+	require.NoError(t, err)
+	require.Empty(t, matches)
+}
+
+// TestRecordingMetadata tests that metadata attached to recordings survives
+// being parsed and written back, and is dropped along with its recording.
+func TestRecordingMetadata(t *testing.T) {
+	source := &memorySource{data: []byte(`1=DriverOpen	1:nil
+
+"Test\"Quoted\"=Name"=1
+"Test\"Quoted\"=Name"@created=2021-06-01T12:00:00Z
+"Test\"Quoted\"=Name"@max-age=24h0m0s
+"TestDeleted"=1
+"TestDeleted"@created=2021-06-01T12:00:00Z
+"TestPlain"=1
+`)}
+	recordingSource := newRecordingSource(source)
+	require.NoError(t, recordingSource.Parse())
+	require.Equal(t, map[string]string{
+		createdMetadataKey: "2021-06-01T12:00:00Z",
+		maxAgeMetadataKey:  "24h0m0s",
+	}, recordingSource.GetMetadata(`Test"Quoted"=Name`))
+	require.Nil(t, recordingSource.GetMetadata("TestPlain"))
+
+	recordingSource.DeleteRecording("TestDeleted")
+	recordingSource.SetMetadata("TestPlain", map[string]string{"fingerprint": "abc"})
+	recordingSource.WriteRecording()
+	require.Equal(t, `1=DriverOpen	1:nil
+
+"Test\"Quoted\"=Name"=1
+"Test\"Quoted\"=Name"@created=2021-06-01T12:00:00Z
+"Test\"Quoted\"=Name"@max-age=24h0m0s
+"TestPlain"=1
+"TestPlain"@fingerprint=abc
+`, string(source.data))
+
+	// Merged metadata is copied from the other source, so changes to it in one
+	// source don't affect the other.
+	merged := newRecordingSource(&memorySource{})
+	require.NoError(t, merged.Parse())
+	merged.Merge(recordingSource)
+	merged.GetMetadata("TestPlain")["fingerprint"] = "def"
+	require.Equal(t, "abc", recordingSource.GetMetadata("TestPlain")["fingerprint"])
+
+	// Metadata must have an equal sign.
+	source = &memorySource{data: []byte(`"TestPlain"@created` + "\n")}
+	require.EqualError(t, newRecordingSource(source).Parse(),
+		`expected equals: "TestPlain"@created`)
+}
+
+// TestParseCached tests that recording files are only parsed again once they
+// have been modified.
+func TestParseCached(t *testing.T) {
+	pathName := filepath.Join(t.TempDir(), "cached.copyist")
+	writeFile := func(data string, modTime time.Time) {
+		require.NoError(t, os.WriteFile(pathName, []byte(data), 0666))
+		require.NoError(t, os.Chtimes(pathName, modTime, modTime))
+	}
+	parse := func() *recordingSource {
+		recordingSource := newRecordingSource(NewFileSource(pathName))
+		require.NoError(t, recordingSource.ParseCached())
+		return recordingSource
+	}
+
+	modTime := time.Now().Add(-time.Hour)
+	writeFile("1=DriverOpen\t1:nil\n\n\"TestOne\"=1\n", modTime)
+	require.NotNil(t, parse().GetRecording("TestOne"))
+
+	// Same modification time and size, so the cached file is used.
+	writeFile("1=DriverOpen\t1:nil\n\n\"TestTwo\"=1\n", modTime)
+	require.NotNil(t, parse().GetRecording("TestOne"))
+
+	// Modified file is parsed again.
+	writeFile("1=DriverOpen\t1:nil\n\n\"TestTwo\"=1\n", modTime.Add(time.Second))
+	recordingSource := parse()
+	require.Nil(t, recordingSource.GetRecording("TestOne"))
+	require.NotNil(t, recordingSource.GetRecording("TestTwo"))
+
+	// Missing file is not cached.
+	require.NoError(t, os.Remove(pathName))
+	err := newRecordingSource(NewFileSource(pathName)).ParseCached()
+	require.True(t, os.IsNotExist(err))
+}
+
+// TestParseIndex tests that recordings are extracted on demand from a recording
+// file that was parsed by ParseIndex.
+func TestParseIndex(t *testing.T) {
+	data := []byte("1=DriverOpen\t1:nil\r\n" +
+		"2=ConnQuery\t2:\"SELECT 1\"\t1:nil\n" +
+		"3=ConnExec\t2:\"DELETE FROM customers\"\t1:nil\n" +
+		"\n" +
+		"\"TestQuery\"=1,2\n" +
+		"\"TestQuery\"@created=2021-06-01T12:00:00Z\n" +
+		"\"TestMissing\"=1,5")
+
+	eager := newRecordingSource(&memorySource{data: data})
+	require.NoError(t, eager.Parse())
+	lazy := newRecordingSource(&memorySource{data: data})
+	require.NoError(t, lazy.ParseIndex())
+	require.Nil(t, lazy.recordDecls)
+
+	require.Equal(t, eager.GetRecording("TestQuery"), lazy.GetRecording("TestQuery"))
+	require.Equal(t, eager.GetMetadata("TestQuery"), lazy.GetMetadata("TestQuery"))
+	require.Nil(t, lazy.GetRecording("TestUnknown"))
+	require.PanicsWithError(t, "record with number 4 must exist",
+		func() { lazy.GetRecording("TestMissing") })
+
+	// Record numbers must be positive.
+	source := &memorySource{data: []byte("0=DriverOpen\t1:nil\n")}
+	require.EqualError(t, newRecordingSource(source).ParseIndex(),
+		"expected record number: 0=DriverOpen\t1:nil")
+}
+
+// TestMappedFileSource tests reading and writing recordings using a
+// memory-mapped recording file.
+func TestMappedFileSource(t *testing.T) {
+	pathName := filepath.Join(t.TempDir(), "mapped.copyist")
+	source := NewMappedFileSource(pathName)
+	_, err := source.ReadAll()
+	require.True(t, os.IsNotExist(err))
+
+	recordingSource := newRecordingSource(source)
+	recordingSource.AddRecording("TestMapped", recording{
+		{Typ: DriverOpen, Args: recordArgs{nil}},
+		{Typ: ConnExec, Args: recordArgs{"DELETE FROM customers", nil}},
+	})
+	recordingSource.WriteRecording()
+
+	recordingSource = newRecordingSource(source)
+	require.NoError(t, recordingSource.ParseCached())
+	rec := recordingSource.GetRecording("TestMapped")
+	require.Len(t, rec, 2)
+	require.Equal(t, "DELETE FROM customers", rec[1].Args[0])
+
+	// Empty files can be read.
+	require.NoError(t, os.WriteFile(pathName, nil, 0666))
+	data, err := source.ReadAll()
+	require.NoError(t, err)
+	require.Empty(t, data)
+}
+
+// TestMappedFileSourceReuse tests that a recording file is only mapped once,
+// until it is replaced or appended to.
+func TestMappedFileSourceReuse(t *testing.T) {
+	pathName := filepath.Join(t.TempDir(), "reuse.copyist")
+	source := NewMappedFileSource(pathName)
+	require.NoError(t, source.WriteAll([]byte("original\n")))
+
+	data, err := source.ReadAll()
+	require.NoError(t, err)
+	data2, err := source.ReadAll()
+	require.NoError(t, err)
+	require.Equal(t, "original\n", string(data2))
+	require.True(t, &data[0] == &data2[0])
+
+	// Appending to the file maps it again.
+	require.NoError(t, source.(appendableSource).Append([]byte("appended\n")))
+	data, err = source.ReadAll()
+	require.NoError(t, err)
+	require.Equal(t, "original\nappended\n", string(data))
+
+	// Replacing the file maps it again.
+	require.NoError(t, source.WriteAll([]byte("replaced\n")))
+	data, err = source.ReadAll()
+	require.NoError(t, err)
+	require.Equal(t, "replaced\n", string(data))
+
+	mappedFiles.Lock()
+	defer mappedFiles.Unlock()
+	require.Equal(t, data, mappedFiles.files[pathName].data)
+}
+
+// TestFileSourceWriteStream tests that a recording file is only replaced once
+// it has been completely written.
+func TestFileSourceWriteStream(t *testing.T) {
+	dirName := t.TempDir()
+	pathName := filepath.Join(dirName, "stream.copyist")
+	source := NewFileSource(pathName).(streamingSource)
+	require.NoError(t, source.WriteStream(func(w io.Writer) error {
+		_, err := io.WriteString(w, "original")
+		return err
+	}))
+
+	require.EqualError(t, source.WriteStream(func(w io.Writer) error {
+		io.WriteString(w, "partial")
+		return errors.New("write failed")
+	}), "write failed")
+	data, err := os.ReadFile(pathName)
+	require.NoError(t, err)
+	require.Equal(t, "original", string(data))
+
+	// The temporary file was removed.
+	entries, err := os.ReadDir(dirName)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+}
+
+// TestParseLongRecord tests that there is no limit on the length of a record
+// declaration that can be parsed.
+func TestParseLongRecord(t *testing.T) {
+	longString := strings.Repeat("long string ", 1024*1024)
+	source := &memorySource{}
+	recordingSource := newRecordingSource(source)
+	recordingSource.AddRecording("TestLong", recording{
+		{Typ: ConnQuery, Args: recordArgs{longString, nil}},
+	})
+	recordingSource.WriteRecording()
+
+	recordingSource = newRecordingSource(source)
+	require.NoError(t, recordingSource.Parse())
+	require.Equal(t, longString, recordingSource.GetRecording("TestLong")[0].Args[0])
+}
+
+// TestAppendRecording tests that new recordings are appended to the recording
+// file until superseded recordings outnumber the others.
+func TestAppendRecording(t *testing.T) {
+	pathName := filepath.Join(t.TempDir(), "append.copyist")
+	require.NoError(t, os.WriteFile(pathName, []byte(`1=DriverOpen	1:nil
+
+"TestOne"=1
+"TestOne"@max-age=24h0m0s
+"TestTwo"=1
+`), 0666))
+
+	record := func(query string) bool {
+		recordingSource := newRecordingSource(NewFileSource(pathName))
+		require.NoError(t, recordingSource.Parse())
+		recordingSource.AddRecording("TestOne", recording{
+			{Typ: DriverOpen, Args: recordArgs{nil}},
+			{Typ: ConnQuery, Args: recordArgs{query, nil}},
+			{Typ: DriverOpen, Args: recordArgs{nil}},
+		})
+		recordingSource.SetMetadata("TestOne", map[string]string{
+			createdMetadataKey: "2021-06-01T12:00:00Z",
+		})
+		return recordingSource.AppendRecording()
+	}
+
+	require.True(t, record("SELECT 1"))
+	data, err := os.ReadFile(pathName)
+	require.NoError(t, err)
+	require.Equal(t, `1=DriverOpen	1:nil
+
+"TestOne"=1
+"TestOne"@max-age=24h0m0s
+"TestTwo"=1
+2=DriverOpen	1:nil
+3=ConnQuery	2:"SELECT 1"	1:nil
+
+"TestOne"=2,3,2
+"TestOne"@created=2021-06-01T12:00:00Z
+`, string(data))
+
+	// The appended recording supersedes the original, along with its metadata.
+	recordingSource := newRecordingSource(NewFileSource(pathName))
+	require.NoError(t, recordingSource.Parse())
+	require.Len(t, recordingSource.GetRecording("TestOne"), 3)
+	require.Equal(t, map[string]string{createdMetadataKey: "2021-06-01T12:00:00Z"},
+		recordingSource.GetMetadata("TestOne"))
+	require.Equal(t, 1, recordingSource.superseded)
+
+	// Superseded recordings would outnumber the others after another append.
+	require.True(t, record("SELECT 2"))
+	require.False(t, record("SELECT 3"))
+
+	// Files that don't exist can't be appended to.
+	recordingSource = newRecordingSource(NewFileSource(pathName + ".missing"))
+	require.Error(t, recordingSource.Parse())
+	recordingSource.AddRecording("TestOne", recording{})
+	require.False(t, recordingSource.AppendRecording())
+}
+
+// BenchmarkWriteRecording measures the cost of writing a recording file that
+// has many large records, some of which are duplicates.
+func BenchmarkWriteRecording(b *testing.B) {
+	rec := make(recording, 0, 2000)
+	for i := 0; i < cap(rec); i++ {
+		row := make([]driver.Value, 10)
+		for j := range row {
+			row[j] = fmt.Sprintf("value %d of row %d", j, i%1000)
+		}
+		rec = append(rec, &record{Typ: RowsNext, Args: recordArgs{row, nil}})
+	}
+
+	recordingSource := newRecordingSource(&memorySource{})
+	recordingSource.AddRecording("BenchmarkWriteRecording", rec)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := recordingSource.writeRecording(io.Discard); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -22,7 +22,10 @@ package copyist
 type recordType int32
 
 // This is a list of the event types, which correspond 1:1 with SQL driver
-// methods.
+// methods. The exceptions are ConnRaw, which corresponds to a call to
+// copyist.Raw, the PgConn types, which correspond to messages exchanged by
+// connections configured by copyistpgx.ConfigurePgConn, and ConnNotice, which
+// corresponds to a call to copyist.Notice.
 const (
 	_ recordType = iota
 	DriverOpen
@@ -39,7 +42,12 @@ const (
 	ResultRowsAffected
 	RowsColumns
 	RowsNext
-	_lastRecord = RowsNext
+	ConnRaw
+	PgConnSend
+	PgConnReceive
+	ConnNotice
+	RowsNextResultSet
+	_lastRecord = RowsNextResultSet
 )
 
 // strToRecType maps to a recordType value from its string representation.
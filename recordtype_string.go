@@ -22,11 +22,16 @@ func _() {
 	_ = x[ResultRowsAffected-12]
 	_ = x[RowsColumns-13]
 	_ = x[RowsNext-14]
+	_ = x[ConnRaw-15]
+	_ = x[PgConnSend-16]
+	_ = x[PgConnReceive-17]
+	_ = x[ConnNotice-18]
+	_ = x[RowsNextResultSet-19]
 }
 
-const _recordType_name = "DriverOpenConnExecConnPrepareConnQueryConnBeginStmtNumInputStmtExecStmtQueryTxCommitTxRollbackResultLastInsertIdResultRowsAffectedRowsColumnsRowsNext"
+const _recordType_name = "DriverOpenConnExecConnPrepareConnQueryConnBeginStmtNumInputStmtExecStmtQueryTxCommitTxRollbackResultLastInsertIdResultRowsAffectedRowsColumnsRowsNextConnRawPgConnSendPgConnReceiveConnNoticeRowsNextResultSet"
 
-var _recordType_index = [...]uint8{0, 10, 18, 29, 38, 47, 59, 67, 76, 84, 94, 112, 130, 141, 149}
+var _recordType_index = [...]uint8{0, 10, 18, 29, 38, 47, 59, 67, 76, 84, 94, 112, 130, 141, 149, 156, 166, 179, 189, 206}
 
 func (i recordType) String() string {
 	i -= 1
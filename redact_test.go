@@ -0,0 +1,57 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package copyist
+
+import (
+	"database/sql/driver"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestRedactor tests that the redactor replaces the values that are recorded,
+// but not the values that are returned to the application.
+func TestRedactor(t *testing.T) {
+	var types []string
+	SetRedactor(func(recordType string, args []interface{}) []interface{} {
+		types = append(types, recordType)
+		if row, ok := args[0].([]driver.Value); ok && len(row) == 2 {
+			row[1] = "redacted"
+		}
+		return args
+	})
+	defer SetRedactor(nil)
+
+	s := newSession(&memorySource{}, "TestRedactor")
+	c := &proxyConn{driver: &proxyDriver{driverName: "fake"}, session: s}
+
+	*recordFlag = true
+	visitedRecording = true
+	defer func() { *recordFlag = false }()
+
+	rows := &proxyRows{conn: c, rows: &fakeRows{
+		cols: []string{"id", "password"},
+		rows: [][]driver.Value{{int64(1), "hunter2"}},
+	}}
+	dest := make([]driver.Value, 2)
+	require.NoError(t, rows.Next(dest))
+	require.Equal(t, []driver.Value{int64(1), "hunter2"}, dest)
+	require.Equal(t, io.EOF, rows.Next(dest))
+
+	require.Equal(t, []string{"RowsNext", "RowsNext"}, types)
+	require.Len(t, s.recording, 2)
+	require.Equal(t, []driver.Value{int64(1), "redacted"}, s.recording[0].Args[0])
+}
@@ -0,0 +1,84 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package copyist
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/cockroachdb/copyist/internal/recdir"
+)
+
+// regenerateHint returns the advice given to the user when a recording no
+// longer matches its test. If the test that made the recording is known, then
+// it gives the exact command that regenerates just that recording.
+func (s *session) regenerateHint() string {
+	if s.rerun == "" {
+		return "Do you need to regenerate the recording with the -record flag?"
+	}
+	return "Do you need to regenerate the recording? Run:\n\n\t" + s.rerun
+}
+
+// rerunCommand returns the command that re-runs just the test having the given
+// name in the given test file, in recording mode, like:
+//
+//	COPYIST_VARIANT=pg13 go test ./store -run '^TestQuery$/^subtest$' -record
+//
+// The package path is relative to the root of the module that contains the test
+// file, so the command is meant to be run from there. If the module root cannot
+// be found, then the package's absolute directory is used instead. Environment
+// variables that copyist reads are included if they affect the recording's name
+// or location.
+func rerunCommand(testFileName, testName string) string {
+	dir := filepath.Dir(testFileName)
+	pkg := dir
+	if root := recdir.ModuleRoot(dir); root != "" {
+		if rel, err := filepath.Rel(root, dir); err == nil {
+			pkg = "./" + filepath.ToSlash(rel)
+			if rel == "." {
+				pkg = "."
+			}
+		}
+	}
+
+	parts := strings.Split(testName, "/")
+	for i := range parts {
+		parts[i] = "^" + regexp.QuoteMeta(parts[i]) + "$"
+	}
+
+	var b strings.Builder
+	for _, name := range []string{"COPYIST_VARIANT", "COPYIST_RECORDING_DIR"} {
+		if val := os.Getenv(name); val != "" {
+			b.WriteString(name + "=" + shellQuote(val) + " ")
+		}
+	}
+	b.WriteString("go test " + shellQuote(pkg) + " -run " + shellQuote(strings.Join(parts, "/")))
+	b.WriteString(" -record")
+	return b.String()
+}
+
+// shellQuote quotes the given string for use as a single shell argument, if it
+// contains any characters that are special to the shell.
+func shellQuote(s string) string {
+	if s != "" && strings.IndexFunc(s, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' ||
+			strings.ContainsRune("-_./=:@", r))
+	}) == -1 {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
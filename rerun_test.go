@@ -0,0 +1,42 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package copyist
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestRerunCommand tests building the command that regenerates a recording.
+func TestRerunCommand(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(root, "go.mod"), []byte("module m\n"), 0666))
+	testFile := filepath.Join(root, "store", "store_test.go")
+
+	require.Equal(t, "go test ./store -run '^TestQuery$' -record",
+		rerunCommand(testFile, "TestQuery"))
+	require.Equal(t, "go test ./store -run '^TestQuery$/^it'\\''s_a_test$' -record",
+		rerunCommand(testFile, "TestQuery/it's_a_test"))
+	require.Equal(t, "go test . -run '^FuzzParse$' -record",
+		rerunCommand(filepath.Join(root, "parse_test.go"), "FuzzParse"))
+
+	os.Setenv("COPYIST_VARIANT", "pg13")
+	defer os.Unsetenv("COPYIST_VARIANT")
+	require.Equal(t, "COPYIST_VARIANT=pg13 go test ./store -run '^TestQuery$' -record",
+		rerunCommand(testFile, "TestQuery"))
+}
@@ -21,6 +21,9 @@ type proxyResult struct {
 	// Result is the result of a query execution.
 	driver.Result
 
+	// conn is the connection that returned this result.
+	conn *proxyConn
+
 	res driver.Result
 }
 
@@ -29,12 +32,14 @@ type proxyResult struct {
 // key.
 func (r *proxyResult) LastInsertId() (int64, error) {
 	if IsRecording() {
+		defer r.conn.session.SerializeCall(r.conn)()
 		id, err := r.res.LastInsertId()
-		currentSession.AddRecord(&record{Typ: ResultLastInsertId, Args: recordArgs{id, err}})
+		r.conn.session.AddRecord(r.conn,
+			&record{Typ: ResultLastInsertId, Args: recordArgs{id, err}})
 		return id, err
 	}
 
-	rec, err := currentSession.VerifyRecord(ResultLastInsertId)
+	rec, err := r.conn.session.VerifyRecord(r.conn, ResultLastInsertId)
 	if err != nil {
 		return 0, err
 	}
@@ -49,12 +54,14 @@ func (r *proxyResult) LastInsertId() (int64, error) {
 // query.
 func (r *proxyResult) RowsAffected() (int64, error) {
 	if IsRecording() {
+		defer r.conn.session.SerializeCall(r.conn)()
 		affected, err := r.res.RowsAffected()
-		currentSession.AddRecord(&record{Typ: ResultRowsAffected, Args: recordArgs{affected, err}})
+		r.conn.session.AddRecord(r.conn,
+			&record{Typ: ResultRowsAffected, Args: recordArgs{affected, err}})
 		return affected, err
 	}
 
-	rec, err := currentSession.VerifyRecord(ResultRowsAffected)
+	rec, err := r.conn.session.VerifyRecord(r.conn, ResultRowsAffected)
 	if err != nil {
 		return 0, err
 	}
@@ -64,3 +71,26 @@ func (r *proxyResult) RowsAffected() (int64, error) {
 	}
 	return rec.Args[0].(int64), nil
 }
+
+// sentinelResult returns the given result if it is one of the results that the
+// driver package defines, driver.RowsAffected or driver.ResultNoRows, or nil if
+// it is not. Their methods always return the same values and errors, so rather
+// than recording calls to their methods, the result itself is recorded along
+// with the call that returned it, and is played back as the very same result.
+func sentinelResult(res driver.Result) driver.Result {
+	if _, ok := res.(driver.RowsAffected); ok || res == driver.ResultNoRows {
+		return res
+	}
+	return nil
+}
+
+// recordedResult returns the sentinel result that was recorded as the argument
+// at the given index of the given record, or nil if there is none. See
+// sentinelResult.
+func recordedResult(rec *record, index int) driver.Result {
+	if len(rec.Args) <= index {
+		return nil
+	}
+	res, _ := rec.Args[index].(driver.Result)
+	return res
+}
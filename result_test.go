@@ -0,0 +1,103 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package copyist
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// sentinelDriver is a fake driver that opens sentinelConn connections.
+type sentinelDriver struct{}
+
+func (sentinelDriver) Open(name string) (driver.Conn, error) {
+	return &sentinelConn{}, nil
+}
+
+// sentinelConn is a fake driver connection that returns driver.ResultNoRows for
+// DDL statements, and driver.RowsAffected for other statements.
+type sentinelConn struct {
+	driver.Conn
+}
+
+func (c *sentinelConn) ExecContext(
+	ctx context.Context, query string, args []driver.NamedValue,
+) (driver.Result, error) {
+	if strings.HasPrefix(query, "CREATE") {
+		return driver.ResultNoRows, nil
+	}
+	return driver.RowsAffected(3), nil
+}
+
+func (c *sentinelConn) Close() error {
+	return nil
+}
+
+// TestSentinelResults tests that the results defined by the driver package are
+// recorded along with the call that returned them, and are played back with
+// the same values and errors.
+func TestSentinelResults(t *testing.T) {
+	sql.Register("postgres20", sentinelDriver{})
+	registered = nil
+	defer func() { registered = nil }()
+	Register("postgres20")
+
+	source := &memorySource{}
+	run := func() {
+		m := &mockTestingT{T: t}
+		closer := OpenSource(m, source, "TestSentinelResults")
+		db, err := sql.Open("copyist_postgres20", "")
+		require.NoError(t, err)
+
+		res, err := db.Exec("CREATE TABLE customers (id INT)")
+		require.NoError(t, err)
+		_, err = res.LastInsertId()
+		require.EqualError(t, err, "no LastInsertId available after DDL statement")
+		_, err = res.RowsAffected()
+		require.EqualError(t, err, "no RowsAffected available after DDL statement")
+
+		res, err = db.Exec("DELETE FROM customers")
+		require.NoError(t, err)
+		_, err = res.LastInsertId()
+		require.EqualError(t, err, "LastInsertId is not supported by this driver")
+		for i := 0; i < 2; i++ {
+			affected, err := res.RowsAffected()
+			require.NoError(t, err)
+			require.Equal(t, int64(3), affected)
+		}
+
+		require.NoError(t, db.Close())
+		require.NoError(t, closer.Close())
+		require.Equal(t, "", m.buf.String())
+	}
+
+	// Record, without recording calls to the results' methods.
+	*recordFlag = true
+	visitedRecording = true
+	run()
+	*recordFlag = false
+	require.Contains(t, string(source.data),
+		"2=ConnExec\t2:\"CREATE TABLE customers (id INT)\"\t1:nil\t26:ResultNoRows\n"+
+			"3=ConnExec\t2:\"DELETE FROM customers\"\t1:nil\t25:3\n")
+	require.Contains(t, string(source.data), `"TestSentinelResults"=1,2,3`+"\n")
+
+	// Play back.
+	run()
+}
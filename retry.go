@@ -0,0 +1,158 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package copyist
+
+import (
+	"errors"
+	"fmt"
+)
+
+// These are the statements that crdb.ExecuteTx and similar CockroachDB client
+// retry loops use to retry a transaction. The transaction is retried from the
+// savepoint whenever releasing the savepoint fails with a retryable (40001)
+// error.
+const (
+	crdbSavepointQuery = "SAVEPOINT cockroach_restart"
+	crdbReleaseQuery   = "RELEASE SAVEPOINT cockroach_restart"
+	crdbRollbackQuery  = "ROLLBACK TO SAVEPOINT cockroach_restart"
+)
+
+// SimulateRetry rewrites the recording having the given name so that one of its
+// transactions fails once with the given retryable error, and then succeeds
+// when it is retried. This allows the retry loop of crdb.ExecuteTx (or similar
+// code) to be covered in playback without being able to reliably trigger a
+// retry against a real database. The retry error is typically a *pq.Error or
+// *pgconn.PgError with code 40001, depending on the driver, in which case the
+// copyistpq or copyistpgx package must be imported in order to record it.
+//
+// The transaction is identified by its position in the recording, starting at
+// 1 for the first transaction that was begun. It must use the CockroachDB
+// retry protocol, which means that it executes "SAVEPOINT cockroach_restart"
+// and later "RELEASE SAVEPOINT cockroach_restart". The rewritten recording
+// fails the release with the retry error, expects "ROLLBACK TO SAVEPOINT
+// cockroach_restart", and then replays the transaction's records between the
+// savepoint and its release a second time. The change is not persisted until
+// Write is called.
+func (f *RecordingFile) SimulateRetry(recordingName string, tx int, retryErr error) error {
+	if retryErr == nil {
+		return errors.New("retry error cannot be nil")
+	}
+	rec, err := f.getRecording(recordingName)
+	if err != nil {
+		return err
+	}
+	metadata := f.Metadata(recordingName)
+	if metadata[goroutinesMetadataKey] != "" {
+		return fmt.Errorf("recording %q was made with serialized calls, "+
+			"which cannot be rewritten", recordingName)
+	}
+
+	keys := make([]streamKey, len(rec))
+	if streams := metadata[streamsMetadataKey]; streams != "" {
+		keys, err = parseStreams(streams, len(rec))
+		if err != nil {
+			return fmt.Errorf("error parsing streams of recording %q: %v", recordingName, err)
+		}
+	}
+
+	begin := findNthRecord(rec, ConnBegin, tx)
+	if begin == -1 {
+		return fmt.Errorf("recording %q does not have transaction %d", recordingName, tx)
+	}
+
+	// Find the savepoint and its release, ignoring records made by other
+	// connections, and stopping at the end of the transaction.
+	savepoint, release := -1, -1
+	var body []int
+scan:
+	for i := begin + 1; i < len(rec) && release == -1; i++ {
+		if keys[i] != keys[begin] {
+			continue
+		}
+		switch {
+		case rec[i].Typ == TxCommit || rec[i].Typ == TxRollback || rec[i].Typ == ConnBegin:
+			break scan
+		case savepoint == -1:
+			if isExec(rec[i], crdbSavepointQuery) {
+				savepoint = i
+			}
+		case isExec(rec[i], crdbReleaseQuery):
+			release = i
+		default:
+			body = append(body, i)
+		}
+	}
+	if savepoint == -1 || release == -1 {
+		return fmt.Errorf("transaction %d in recording %q does not use the CockroachDB "+
+			"retry protocol (%s ... %s)", tx, recordingName, crdbSavepointQuery, crdbReleaseQuery)
+	}
+
+	// Fail the release, roll back to the savepoint, and then repeat the body of
+	// the transaction, before the original release.
+	newRec := make(recording, 0, len(rec)+len(body)+2)
+	newKeys := make([]streamKey, 0, cap(newRec))
+	newRec = append(newRec, rec[:release]...)
+	newKeys = append(newKeys, keys[:release]...)
+	newRec = append(newRec,
+		&record{Typ: ConnExec, Args: recordArgs{crdbReleaseQuery, retryErr}},
+		&record{Typ: ConnExec, Args: recordArgs{crdbRollbackQuery, nil}})
+	newKeys = append(newKeys, keys[release], keys[release])
+	for _, i := range body {
+		// Copy each record, since records are identified by pointer.
+		newRec = append(newRec, &record{Typ: rec[i].Typ, Args: rec[i].Args})
+		newKeys = append(newKeys, keys[i])
+	}
+	newRec = append(newRec, rec[release:]...)
+	newKeys = append(newKeys, keys[release:]...)
+	f.recordingSource.AddRecording(recordingName, newRec)
+
+	// The durations of the original records no longer line up with the new
+	// records, so drop them.
+	newMetadata := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		newMetadata[k] = v
+	}
+	delete(newMetadata, durationsMetadataKey)
+	delete(newMetadata, streamsMetadataKey)
+	if metadata[streamsMetadataKey] != "" {
+		newMetadata[streamsMetadataKey] = formatStreams(newKeys)
+	}
+	f.SetMetadata(recordingName, newMetadata)
+	return nil
+}
+
+// findNthRecord returns the index of the nth record of the given type in the
+// given recording, starting at 1, or -1 if there is no such record.
+func findNthRecord(rec recording, typ recordType, n int) int {
+	for i := range rec {
+		if rec[i].Typ == typ {
+			n--
+			if n == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// isExec returns true if the given record is a successful ConnExec of the
+// given query.
+func isExec(rec *record, query string) bool {
+	if rec.Typ != ConnExec || len(rec.Args) < 2 {
+		return false
+	}
+	q, _ := rec.Args[0].(string)
+	return q == query && rec.Args[1] == nil
+}
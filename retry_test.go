@@ -0,0 +1,90 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package copyist
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestSimulateRetry tests rewriting a recording so that a transaction fails
+// once with a retryable error.
+func TestSimulateRetry(t *testing.T) {
+	source := NewMemorySource([]byte(`
+1=DriverOpen	1:nil
+2=ConnBegin	1:nil
+3=ConnExec	2:"SAVEPOINT cockroach_restart"	1:nil
+4=ConnExec	2:"UPDATE accounts SET balance = 0"	1:nil
+5=ConnExec	2:"RELEASE SAVEPOINT cockroach_restart"	1:nil
+6=TxCommit	1:nil
+7=ConnQuery	2:"SELECT 1"	1:nil
+
+"TestRetry"=1,2,3,4,5,6,2,3,4,5,6
+"TestNoSavepoint"=1,2,4,6
+"TestStreams"=1,2,3,7,4,5,6
+"TestRetry"@durations=1 2 3 4 5 6 7 8 9 10 11
+"TestStreams"@streams="pq"#1*3 "pq"#2*1 "pq"#1*3
+`))
+	file, err := ReadRecordingFile(source)
+	require.NoError(t, err)
+
+	retryErr := errors.New("restart transaction")
+	require.NoError(t, file.SimulateRetry("TestRetry", 2, retryErr))
+	require.NoError(t, file.SimulateRetry("TestStreams", 1, retryErr))
+	require.NoError(t, file.Write())
+
+	file, err = ReadRecordingFile(source)
+	require.NoError(t, err)
+	require.Empty(t, file.Validate())
+
+	records, err := file.Recording("TestRetry")
+	require.NoError(t, err)
+	var types []string
+	for _, rec := range records {
+		types = append(types, rec.Type)
+	}
+	require.Equal(t, []string{
+		"DriverOpen",
+		"ConnBegin", "ConnExec", "ConnExec", "ConnExec", "TxCommit",
+		"ConnBegin", "ConnExec", "ConnExec",
+		"ConnExec", "ConnExec", "ConnExec",
+		"ConnExec", "TxCommit",
+	}, types)
+	require.Equal(t, "RELEASE SAVEPOINT cockroach_restart", records[9].Args[0])
+	require.EqualError(t, records[9].Args[1].(error), "restart transaction")
+	require.Equal(t, "ROLLBACK TO SAVEPOINT cockroach_restart", records[10].Args[0])
+	require.Nil(t, records[10].Args[1])
+	require.Equal(t, "UPDATE accounts SET balance = 0", records[11].Args[0])
+	require.Equal(t, "RELEASE SAVEPOINT cockroach_restart", records[12].Args[0])
+	require.Nil(t, records[12].Args[1])
+	require.Nil(t, file.Durations("TestRetry"))
+
+	// Records made by other connections are not repeated.
+	records, err = file.Recording("TestStreams")
+	require.NoError(t, err)
+	require.Len(t, records, 10)
+	require.Equal(t, "SELECT 1", records[3].Args[0])
+	require.Equal(t, `"pq"#1*3 "pq"#2*1 "pq"#1*6`, file.Metadata("TestStreams")[streamsMetadataKey])
+
+	require.EqualError(t, file.SimulateRetry("TestRetry", 3, retryErr),
+		`recording "TestRetry" does not have transaction 3`)
+	require.EqualError(t, file.SimulateRetry("TestNoSavepoint", 1, retryErr),
+		`transaction 1 in recording "TestNoSavepoint" does not use the CockroachDB retry `+
+			`protocol (SAVEPOINT cockroach_restart ... RELEASE SAVEPOINT cockroach_restart)`)
+	require.EqualError(t, file.SimulateRetry("TestMissing", 1, retryErr),
+		"no recording exists with this name: TestMissing")
+}
@@ -14,13 +14,40 @@
 
 package copyist
 
-import "database/sql/driver"
+import (
+	"database/sql/driver"
+	"io"
+)
 
 // proxyRows records and plays back calls to driver.Rows methods.
 type proxyRows struct {
 	// Rows is an iterator over an executed query's results.
 	driver.Rows
 
+	// conn is the connection that returned these rows.
+	conn *proxyConn
+
+	// query is the text of the query that returned these rows, and rowCount
+	// is the number of rows returned so far. They are used only during
+	// recording mode, to detect queries that may return rows in a
+	// nondeterministic order.
+	query    string
+	rowCount int
+
+	// args are the arguments of the query that returned these rows. They are
+	// used only during recording mode, to explain the query once its rows
+	// are closed. See SetExplain.
+	args []driver.NamedValue
+
+	// volatile is the indexes of the columns whose values are volatile,
+	// transformers is the transformer of each column (or nil if its values are
+	// not transformed), and checkedColumns is true once they have been
+	// determined. They are used only during recording mode. See
+	// SetVolatileColumns and SetTransformer.
+	volatile       []int
+	transformers   []Transformer
+	checkedColumns bool
+
 	rows driver.Rows
 }
 
@@ -30,12 +57,14 @@ type proxyRows struct {
 // string should be returned for that entry.
 func (r *proxyRows) Columns() []string {
 	if IsRecording() {
+		defer r.conn.session.SerializeCall(r.conn)()
 		cols := r.rows.Columns()
-		currentSession.AddRecord(&record{Typ: RowsColumns, Args: recordArgs{cols}})
+		r.conn.session.AddRecord(r.conn,
+			&record{Typ: RowsColumns, Args: recordArgs{cols}})
 		return cols
 	}
 
-	rec, err := currentSession.VerifyRecord(RowsColumns)
+	rec, err := r.conn.session.VerifyRecord(r.conn, RowsColumns)
 	if err != nil {
 		panic(err)
 	}
@@ -45,7 +74,11 @@ func (r *proxyRows) Columns() []string {
 // Close closes the rows iterator.
 func (r *proxyRows) Close() error {
 	if IsRecording() {
-		return r.rows.Close()
+		err := r.rows.Close()
+		if err == nil && r.query != "" {
+			r.conn.session.explain(r.conn, r.query, r.args)
+		}
+		return err
 	}
 	return nil
 }
@@ -61,6 +94,7 @@ func (r *proxyRows) Close() error {
 // a buffer held in dest.
 func (r *proxyRows) Next(dest []driver.Value) error {
 	if IsRecording() {
+		defer r.conn.session.SerializeCall(r.conn)()
 		var destCopy []driver.Value
 		err := r.rows.Next(dest)
 		if err == nil {
@@ -68,12 +102,35 @@ func (r *proxyRows) Next(dest []driver.Value) error {
 			for i := range dest {
 				destCopy[i] = deepCopyValue(dest[i])
 			}
+
+			if !r.checkedColumns {
+				cols := r.rows.Columns()
+				r.volatile = volatileIndexes(cols)
+				r.transformers = columnTransformers(cols)
+				r.checkedColumns = true
+			}
+			for i, transform := range r.transformers {
+				if transform != nil {
+					destCopy[i] = transform(destCopy[i])
+				}
+			}
+			for _, i := range r.volatile {
+				destCopy[i] = stampVolatile(dest[i])
+			}
+
+			// Rows are returned in an arbitrary order unless the query sorts
+			// them, so flag queries that return multiple rows without sorting.
+			r.rowCount++
+			if r.rowCount == 2 && !hasOrderBy(r.query) {
+				r.conn.session.FlagNondeterministic(r.query)
+			}
 		}
-		currentSession.AddRecord(&record{Typ: RowsNext, Args: recordArgs{destCopy, err}})
+		r.conn.session.AddRecord(r.conn,
+			&record{Typ: RowsNext, Args: recordArgs{destCopy, err}})
 		return err
 	}
 
-	rec, err := currentSession.VerifyRecord(RowsNext)
+	rec, err := r.conn.session.VerifyRecord(r.conn, RowsNext)
 	if err != nil {
 		return err
 	}
@@ -83,5 +140,56 @@ func (r *proxyRows) Next(dest []driver.Value) error {
 	}
 	vals := rec.Args[0].([]driver.Value)
 	copy(dest, vals)
+	for i := range dest {
+		if placeholder, ok := dest[i].(volatilePlaceholder); ok {
+			dest[i] = placeholder.Value()
+		}
+	}
 	return nil
 }
+
+// HasNextResultSet is called at the end of the current result set and
+// reports whether there is another result set after the current one.
+//
+// HasNextResultSet is not recorded, since database/sql calls it each time the
+// rows of a result set are exhausted. Instead, during playback it returns true
+// if the next recorded call on the connection is to NextResultSet.
+func (r *proxyRows) HasNextResultSet() bool {
+	if IsRecording() {
+		if rs, ok := r.rows.(driver.RowsNextResultSet); ok {
+			return rs.HasNextResultSet()
+		}
+		return false
+	}
+
+	return r.conn.session.PeekRecord(r.conn, RowsNextResultSet)
+}
+
+// NextResultSet advances the driver to the next result set even
+// if there are remaining rows in the current result set.
+//
+// NextResultSet should return io.EOF when there are no more result sets.
+func (r *proxyRows) NextResultSet() error {
+	if IsRecording() {
+		defer r.conn.session.SerializeCall(r.conn)()
+		err := io.EOF
+		if rs, ok := r.rows.(driver.RowsNextResultSet); ok {
+			err = rs.NextResultSet()
+		}
+		if err == nil {
+			// Each result set has its own columns.
+			r.checkedColumns = false
+			r.rowCount = 0
+		}
+		r.conn.session.AddRecord(r.conn,
+			&record{Typ: RowsNextResultSet, Args: recordArgs{err}})
+		return err
+	}
+
+	rec, err := r.conn.session.VerifyRecord(r.conn, RowsNextResultSet)
+	if err != nil {
+		return err
+	}
+	err, _ = rec.Args[0].(error)
+	return err
+}
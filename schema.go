@@ -0,0 +1,143 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package copyist
+
+import (
+	"context"
+	"crypto/md5"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// schemaQuery is set by SetSchemaQuery.
+var schemaQuery string
+
+// SetSchemaQuery captures a fingerprint of the database schema when each
+// recording is made, by hashing the rows returned by the given query, which is
+// run on the first connection that the session opens. The query should return
+// a description of the schema in a deterministic order, like:
+//
+//	SELECT table_name, column_name, data_type
+//	FROM information_schema.columns
+//	WHERE table_schema = 'public'
+//	ORDER BY table_name, column_name
+//
+// The fingerprint is attached to the recording as metadata. When a recording
+// is made, copyist warns about other recordings in the same file that were made
+// against a different schema, since they may no longer reflect reality. The
+// "copyist schema" command compares the fingerprints in recording files with a
+// live database. Calling SetSchemaQuery with an empty string disables schema
+// fingerprints, which is the default.
+func SetSchemaQuery(query string) {
+	schemaQuery = query
+}
+
+// SchemaFingerprint runs the given query on the given connection, and returns
+// a hash of the rows that it returns, as a hex string. It is used to detect
+// when the schema of a database has changed since recordings were made. See
+// SetSchemaQuery.
+func SchemaFingerprint(conn driver.Conn, query string) (string, error) {
+	queryer, ok := conn.(driver.QueryerContext)
+	if !ok {
+		return "", errors.New("connection does not support queries")
+	}
+	rows, err := queryer.QueryContext(context.Background(), query, nil)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	hash := md5.New()
+	dest := make([]driver.Value, len(rows.Columns()))
+	for {
+		if err := rows.Next(dest); err != nil {
+			if err != io.EOF {
+				return "", err
+			}
+			break
+		}
+		cols := make([]string, len(dest))
+		for i, val := range dest {
+			if b, ok := val.([]byte); ok {
+				val = string(b)
+			}
+			cols[i] = fmt.Sprint(val)
+		}
+		io.WriteString(hash, strings.Join(cols, "\t")+"\n")
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
+
+// captureSchema captures the schema fingerprint of the database that the
+// given connection is connected to, if schema fingerprints are enabled and it
+// has not yet been captured by this session. It must only be called while
+// recording.
+func (s *session) captureSchema(c *proxyConn) {
+	if schemaQuery == "" {
+		return
+	}
+	s.mu.Lock()
+	captured := s.schemaCaptured
+	s.schemaCaptured = true
+	s.mu.Unlock()
+	if captured {
+		return
+	}
+
+	// Failing to capture the fingerprint must not fail the test, so the
+	// recording is made without one, and the error is reported as a warning.
+	schema, err := SchemaFingerprint(c.conn, schemaQuery)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.schema, s.schemaErr = schema, err
+}
+
+// checkSchema returns an error that lists the other recordings in the session's
+// recording file that were made against a different schema than this session's
+// recording, if recording with schema fingerprints enabled.
+func (s *session) checkSchema() error {
+	if !IsRecording() {
+		return nil
+	}
+	if s.schemaErr != nil {
+		return fmt.Errorf("error capturing schema fingerprint of recording %s: %v",
+			s.recordingName, s.schemaErr)
+	}
+	if s.schema == "" {
+		return nil
+	}
+
+	if err := s.recordingSource.Parse(); err != nil {
+		return nil
+	}
+	var stale []string
+	for name, metadata := range s.recordingSource.metadata {
+		schema := metadata[schemaMetadataKey]
+		if name != s.recordingName && schema != "" && schema != s.schema {
+			stale = append(stale, name)
+		}
+	}
+	if len(stale) == 0 {
+		return nil
+	}
+	sort.Strings(stale)
+	return fmt.Errorf("the database schema has changed since recordings %s were made, "+
+		"so they may no longer reflect reality\n\n"+
+		"Do you need to regenerate them with the -record flag?", strings.Join(stale, ", "))
+}
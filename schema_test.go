@@ -0,0 +1,92 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package copyist
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// schemaConn is a fake driver connection that returns the given columns of the
+// schema.
+type schemaConn struct {
+	driver.Conn
+	columns [][]driver.Value
+}
+
+func (c *schemaConn) QueryContext(
+	ctx context.Context, query string, args []driver.NamedValue,
+) (driver.Rows, error) {
+	if c.columns == nil {
+		return nil, errors.New("permission denied")
+	}
+	return &fakeRows{cols: []string{"table_name", "column_name"}, rows: c.columns}, nil
+}
+
+// TestSchemaFingerprint tests that the schema fingerprint is captured while
+// recording, and that other recordings made against a different schema are
+// reported.
+func TestSchemaFingerprint(t *testing.T) {
+	*recordFlag = true
+	visitedRecording = true
+	defer func() { *recordFlag = false }()
+
+	SetSchemaQuery("SELECT table_name, column_name FROM information_schema.columns")
+	defer SetSchemaQuery("")
+
+	source := &memorySource{}
+	recordSchema := func(name string, columns ...driver.Value) *session {
+		s := newSession(source, name)
+		conn := &schemaConn{columns: [][]driver.Value{columns}}
+		c := &proxyConn{driver: &proxyDriver{driverName: "fake"}, session: s, conn: conn}
+		s.AddRecord(c, &record{Typ: DriverOpen, Args: recordArgs{nil}})
+		s.captureSchema(c)
+		return s
+	}
+
+	s := recordSchema("TestOld", "customers", "name")
+	require.NoError(t, s.checkSchema())
+	s.Close()
+	oldSchema := s.schema
+	require.Len(t, oldSchema, 32)
+
+	// The same schema has the same fingerprint, even as bytes.
+	s = recordSchema("TestSame", []byte("customers"), "name")
+	require.Equal(t, oldSchema, s.schema)
+	require.NoError(t, s.checkSchema())
+
+	s = recordSchema("TestNew", "customers", "email")
+	require.NotEqual(t, oldSchema, s.schema)
+	require.EqualError(t, s.checkSchema(), "the database schema has changed since recordings "+
+		"TestOld were made, so they may no longer reflect reality\n\n"+
+		"Do you need to regenerate them with the -record flag?")
+	s.Close()
+
+	file, err := ReadRecordingFile(source)
+	require.NoError(t, err)
+	require.Equal(t, oldSchema, file.Schema("TestOld"))
+	require.NotEqual(t, oldSchema, file.Schema("TestNew"))
+
+	// Errors are reported as warnings.
+	s = newSession(source, "TestError")
+	c := &proxyConn{driver: &proxyDriver{driverName: "fake"}, session: s, conn: &schemaConn{}}
+	s.captureSchema(c)
+	require.EqualError(t, s.checkSchema(),
+		"error capturing schema fingerprint of recording TestError: permission denied")
+}
@@ -15,8 +15,16 @@
 package copyist
 
 import (
+	"bytes"
 	"fmt"
 	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -24,13 +32,82 @@ import (
 // session is state used during copyist recording and playback to track progress
 // of any currently open session.
 type session struct {
+	// mu synchronizes access to the session's records and streams, since
+	// connections may make calls concurrently from different goroutines.
+	mu sync.Mutex
+
 	// recording stores the calls made to registered drivers used in the current
 	// sessions so that the calls can be played back later.
 	recording recording
 
-	// index is the current offset into the recording slice. It is used only
-	// during playback mode.
-	index int
+	// streamKeys identifies the stream of each record in the recording. It is
+	// used only during recording mode.
+	streamKeys []streamKey
+
+	// streams splits the recording into a separate stream of records for each
+	// driver and connection that made them. Each connection plays back its own
+	// stream, so that calls made by different drivers and connections can be
+	// interleaved differently than they were when recording. If the recording
+	// was made by a single connection, or before copyist recorded streams, then
+	// all records are in one stream with an empty key, which is shared by all
+	// connections. It is used during playback mode, and while recording in
+	// verify mode.
+	streams map[streamKey]*recordStream
+
+	// callMu serializes driver calls while recording, if enabled by
+	// SetSerializeCalls.
+	callMu sync.Mutex
+
+	// goroutines numbers the goroutine that made each record in the
+	// recording, in order of each goroutine's first record. It is used only
+	// during recording mode, if calls are serialized.
+	goroutines []int
+
+	// goroutineNums maps the ID of each goroutine that made records to its
+	// number in goroutines.
+	goroutineNums map[uint64]int
+
+	// durations is the elapsed time of the driver call that made each record in
+	// the recording. While recording, it is saved in the recording's metadata
+	// if SetRecordDurations is enabled. During playback, it is used to simulate
+	// latency if SetLatencyScale is set, and is nil otherwise.
+	durations []time.Duration
+
+	// lastConn is the connection that most recently called the wrapped driver.
+	// Notices are attributed to it. It is used only during recording mode.
+	lastConn *proxyConn
+
+	// plans is the execution plan of each distinct query made while recording,
+	// keyed by query. It is used only during recording mode, if SetExplain is
+	// enabled.
+	plans map[string]string
+
+	// schema is the fingerprint of the database schema, schemaErr is the error
+	// that prevented it from being captured, if any, and schemaCaptured is
+	// true once capture has been attempted. They are used only during
+	// recording mode, if SetSchemaQuery is enabled.
+	schema         string
+	schemaErr      error
+	schemaCaptured bool
+
+	// nondeterministic is the set of queries that may have returned rows in a
+	// nondeterministic order, because they returned multiple rows without an
+	// ORDER BY clause, or because they returned rows in a different order than
+	// when the recording was last made. It is used only during recording mode.
+	nondeterministic map[string]bool
+
+	// ordered is true if the recording was made with serialized calls, in
+	// which case calls are played back in the same order as when recording.
+	// It is used only during playback mode.
+	ordered bool
+
+	// consumed is true for each record in the recording that has been played
+	// back, and position is the offset of the first record that has not.
+	// turn is signaled each time position advances. They are used only when
+	// ordered is true.
+	consumed []bool
+	position int
+	turn     *sync.Cond
 
 	// recordingSource is the in-memory representation for the copyist recordingSource being read or
 	// written by this session.
@@ -42,9 +119,94 @@ type session struct {
 	// isInit is set to true once this session has been initialized.
 	isInit bool
 
-	// verificationErr is the first sessionError encountered when replaying
+	// initDrivers is the set of drivers whose own sessionInit callbacks have
+	// been invoked by this session. See WithSessionInit.
+	initDrivers map[*proxyDriver]bool
+
+	// fingerprint identifies the version of the test that is using this
+	// session, or is empty if it is not known. See SetFingerprint.
+	fingerprint string
+
+	// rerun is the command that regenerates the recording, or is empty if the
+	// test that made the recording is not known. See rerunCommand.
+	rerun string
+
+	// connCount is the number of connections that have been opened during
+	// this session. It is used to assign each connection an ID when recording.
+	connCount int
+
+	// stmtCount is the number of statements that have been prepared during
+	// this session. It is used to assign each prepared statement an ID when
+	// recording.
+	stmtCount int
+
+	// expected is the existing recording that new records are checked against
+	// while recording in verify mode. See isVerifying.
+	expected recording
+
+	// vars are the template variables that are bound for this session. While
+	// recording, their values are replaced by placeholders, and during
+	// playback, placeholders are replaced by their values. See OpenWithVars.
+	vars []templateVar
+
+	// verificationErr is the first MismatchError encountered when replaying
 	// this session for better error reporting later on.
-	verificationErr *sessionError
+	verificationErr *MismatchError
+}
+
+// streamKey identifies a stream of records in a recording. Records made by a
+// connection are keyed by the name of its driver and by its ID. DriverOpen
+// records, which are made before the connection exists, are keyed by the name
+// of the driver alone, with a zero connection ID.
+type streamKey struct {
+	driverName string
+	connID     int
+}
+
+// recordStream is a sequence of records that is played back in order, along
+// with the current offset into it.
+type recordStream struct {
+	records recording
+	index   int
+
+	// offsets is the offset of each record within the entire recording. It is
+	// nil if the stream contains the entire recording.
+	offsets []int
+
+	// bound is true once a connection has been bound to this stream during
+	// playback. Each stream is played back by at most one connection.
+	bound bool
+}
+
+// offset returns the offset within the entire recording of the stream's record
+// at the given index.
+func (s *recordStream) offset(index int) int {
+	if s.offsets == nil {
+		return index
+	}
+	return s.offsets[index]
+}
+
+// nextCall returns the next record in the stream that was made by a driver
+// call, skipping any notices, or nil if there is none.
+func (s *recordStream) nextCall() *record {
+	for i := s.index; i < len(s.records); i++ {
+		if s.records[i].Typ != ConnNotice {
+			return s.records[i]
+		}
+	}
+	return nil
+}
+
+// recordPos is the position of a record within a stream.
+type recordPos struct {
+	stream *recordStream
+	index  int
+}
+
+// offset returns the offset of the record within the entire recording.
+func (p recordPos) offset() int {
+	return p.stream.offset(p.index)
 }
 
 // currentSession is a global instance of session that tracks state for the
@@ -52,17 +214,33 @@ type session struct {
 var currentSession *session
 
 // IsOpen is true if a recording or playback session is currently in progress.
-// That is, Open or OpenNamed has been called, but Close has not yet been
-// called. This is useful when some tests use copyist and some don't, and
-// testing utility code wants to automatically determine whether to open a
+// That is, Open, OpenNamed or OpenParallel has been called, but Close has not
+// yet been called. This is useful when some tests use copyist and some don't,
+// and testing utility code wants to automatically determine whether to open a
 // connection using the copyist driver or the "real" driver.
 func IsOpen() bool {
-	return currentSession != nil
+	return currentSession != nil || openParallelSessions() != 0
 }
 
 // newSession creates a new recording or playback session. The session will
 // read or write a new recording of the given name in the given source.
 func newSession(source Source, recordingName string) *session {
+	// If the source stores each recording separately, then only read and write
+	// the part of it that stores this session's recording.
+	if rs, ok := source.(recordingSourcer); ok {
+		source = rs.RecordingSource(recordingName)
+	}
+
+	// Encrypt the recording file if an encryption key has been set.
+	key, err := getEncryptionKey()
+	if err == nil && key != nil {
+		source, err = encryptSource(source, key)
+	}
+	if err != nil {
+		panic(fmt.Errorf("encryption key: %v", err))
+	}
+
+	atomic.AddInt64(&metrics.SessionsOpened, 1)
 	return &session{
 		recording:       recording{},
 		recordingSource: newRecordingSource(source),
@@ -74,9 +252,35 @@ func newSession(source Source, recordingName string) *session {
 // by the golang `sql` package to open a new connection. OnDriverOpen performs
 // initialization steps for the session and for the driver.
 func (s *session) OnDriverOpen(driver *proxyDriver) {
+	// Invoke the sessionInit callbacks once the session's lock is released,
+	// since they may open connections with a copyist driver, which calls
+	// OnDriverOpen again.
+	for _, callback := range s.initialize(driver) {
+		callback()
+	}
+}
+
+// initialize performs the initialization steps for the session and for the driver,
+// and returns the sessionInit callbacks that need to be invoked. The session and
+// driver are marked as initialized before the callbacks are invoked, so that
+// connections opened by the callbacks do not invoke them again.
+func (s *session) initialize(driver *proxyDriver) (callbacks []func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Invoke the driver's own sessionInit callback the first time that the
+	// driver is opened by this session, when recording.
+	if driver.sessionInit != nil && !s.initDrivers[driver] && IsRecording() {
+		if s.initDrivers == nil {
+			s.initDrivers = make(map[*proxyDriver]bool)
+		}
+		s.initDrivers[driver] = true
+		callbacks = append(callbacks, driver.sessionInit)
+	}
+
 	// If session has already been initialized, then no-op.
 	if s.isInit {
-		return
+		return callbacks
 	}
 	s.isInit = true
 
@@ -85,11 +289,16 @@ func (s *session) OnDriverOpen(driver *proxyDriver) {
 		// when recording, to give the callback a chance to set the database in
 		// a clean, well-known state.
 		if sessionInit != nil {
-			sessionInit()
+			callbacks = append(callbacks, sessionInit)
+		}
+
+		if isVerifying() {
+			s.loadExpected()
 		}
 	} else {
-		// Need to play back a recording file, so parse it now.
-		if err := s.recordingSource.Parse(); err != nil && !os.IsNotExist(err) {
+		// Need to play back a recording file, so parse it now. Recording
+		// files shared by many tests are only parsed once.
+		if err := s.recordingSource.ParseCached(); err != nil && !os.IsNotExist(err) {
 			panicf("error parsing recording file: %v", err)
 		}
 
@@ -98,67 +307,555 @@ func (s *session) OnDriverOpen(driver *proxyDriver) {
 		if s.recording == nil {
 			panicf("no recording exists with this name: %v", s.recordingName)
 		}
+		if len(s.vars) != 0 {
+			s.recording = bindRecording(s.recording, s.vars)
+		}
+
+		metadata := s.recordingSource.GetMetadata(s.recordingName)
+		if timeTravel {
+			if age := recordingAge(metadata); age > 0 {
+				s.recording = shiftTimes(s.recording, age)
+			}
+		}
+		streams, err := splitStreams(s.recording, metadata[streamsMetadataKey])
+		if err != nil {
+			panicf("error parsing streams of recording %s: %v", s.recordingName, err)
+		}
+		s.streams = streams
+
+		if latencyScale != 0 {
+			s.durations, err = parseDurations(metadata[durationsMetadataKey])
+			if err != nil {
+				panicf("error parsing durations of recording %s: %v", s.recordingName, err)
+			}
+		}
+
+		if metadata[goroutinesMetadataKey] != "" {
+			s.ordered = true
+			s.consumed = make([]bool, len(s.recording))
+			s.turn = sync.NewCond(&s.mu)
+		}
 	}
 
 	// Clear any connections left over from previous sessions so that they don't
 	// cause non-deterministic behavior for this test.
 	clearPooledConnections()
+	return callbacks
 }
 
-// AddRecord adds a record to the current recording.
-func (s *session) AddRecord(rec *record) {
+// AddRecord adds a record made by the given connection to the current
+// recording.
+func (s *session) AddRecord(c *proxyConn, rec *record) {
+	if isVerifying() {
+		// Runs after the lock is released.
+		defer s.verifyRecorded(c, rec)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if redactor != nil {
+		args := append([]interface{}(nil), rec.Args...)
+		rec.Args = redactor(rec.Typ.String(), args)
+	}
+	if len(s.vars) != 0 {
+		rec.Args = templateArgs(rec.Args, s.vars)
+	}
+
+	key := streamKey{driverName: c.driver.driverName}
+	if rec.Typ != DriverOpen {
+		key.connID = c.id
+	}
 	s.recording = append(s.recording, rec)
+	s.streamKeys = append(s.streamKeys, key)
+	if !c.callStart.IsZero() {
+		s.durations = append(s.durations, time.Since(c.callStart))
+	} else {
+		s.durations = append(s.durations, 0)
+	}
+	atomic.AddInt64(&metrics.RecordsRecorded, 1)
+	logRecord(s.recordingName, "recorded", len(s.recording)-1, rec)
+
+	if serializeCalls {
+		id := goroutineID()
+		num, ok := s.goroutineNums[id]
+		if !ok {
+			if s.goroutineNums == nil {
+				s.goroutineNums = make(map[uint64]int)
+			}
+			num = len(s.goroutineNums) + 1
+			s.goroutineNums[id] = num
+		}
+		s.goroutines = append(s.goroutines, num)
+	}
+}
+
+// FlagNondeterministic flags the given query as one that may return rows in a
+// nondeterministic order.
+func (s *session) FlagNondeterministic(query string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.nondeterministic == nil {
+		s.nondeterministic = make(map[string]bool)
+	}
+	s.nondeterministic[query] = true
+}
+
+// SerializeCall locks the session's call mutex if calls are serialized while
+// recording (see SetSerializeCalls), and returns a function that unlocks it.
+// Proxy methods hold the lock while they call the wrapped driver and record the
+// call. It also notes the time at which the given connection's call began, so
+// that AddRecord can record its duration.
+func (s *session) SerializeCall(c *proxyConn) (unlock func()) {
+	s.mu.Lock()
+	s.lastConn = c
+	s.mu.Unlock()
+
+	if !serializeCalls {
+		c.callStart = time.Now()
+		return func() {}
+	}
+	s.callMu.Lock()
+	c.callStart = time.Now()
+	return s.callMu.Unlock
+}
+
+// nextConnID returns the ID to assign to a connection opened while recording.
+func (s *session) nextConnID() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.connCount++
+	return s.connCount
+}
+
+// nextStmtID returns the ID to assign to a statement prepared while recording.
+func (s *session) nextStmtID() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stmtCount++
+	return s.stmtCount
+}
+
+// VerifyRecordWithStringArg returns the next record in the given connection's
+// stream, failing with a nice error if no such record exists, or if its first
+// argument does not match the given string.
+func (s *session) VerifyRecordWithStringArg(
+	c *proxyConn, recordTyp recordType, arg string,
+) (*record, error) {
+	rec, pos, err := s.verifyRecord(c, recordTyp, func(rec *record) bool {
+		return rec.Typ == recordTyp && stringArgMatches(recordTyp, rec.Args[0].(string), arg)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !stringArgMatches(recordTyp, rec.Args[0].(string), arg) {
+		mismatch := &MismatchError{
+			Index:    pos.offset(),
+			Expected: exportRecord(rec),
+			Call:     recordTyp.String(),
+			Args:     []interface{}{arg},
+		}
+		return nil, s.mismatchErr(mismatch,
+			"mismatched argument to %s\n\n%s\n%s\n"+
+				"%s",
+			recordTyp.String(), unifiedDiff(rec.Args[0].(string), arg),
+			s.recordContext(pos), s.regenerateHint())
+	}
+	return rec, nil
 }
 
-// VerifyRecordWithStringArg returns one of the records in this session's
-// recording, failing with a nice error if no such record exists, or if its
-// first argument does not match the given string.
-func (s *session) VerifyRecordWithStringArg(recordTyp recordType, arg string) (*record, error) {
-	rec, err := s.VerifyRecord(recordTyp)
+// VerifyRecordWithArgCount returns the next record in the stream of the
+// connection that prepared the given statement, failing with a nice error if
+// no such record exists, or if its second argument, which is the number of
+// arguments that were passed to the recorded driver method, does not match the
+// given count. Records made before copyist recorded the number of arguments are
+// not checked.
+//
+// If the statement's NumInput returned -1, then the sql package did not check
+// the number of arguments against the number of placeholders, so this is the
+// only check that is made during playback.
+func (s *session) VerifyRecordWithArgCount(
+	stmt *proxyStmt, recordTyp recordType, count int,
+) (*record, error) {
+	rec, pos, err := s.verifyRecord(stmt.conn, recordTyp, func(rec *record) bool {
+		return rec.Typ == recordTyp
+	})
 	if err != nil {
 		return nil, err
 	}
-	if rec.Args[0].(string) != arg {
-		return nil, s.sessionErr(
-			"mismatched argument to %s, expected %s, got %s\n\n"+
-				"Do you need to regenerate the recording with the -record flag?",
-			recordTyp.String(), rec.Args[0].(string), arg)
+	if len(rec.Args) > 1 && rec.Args[1].(int) != count {
+		mismatch := &MismatchError{
+			Index:    pos.offset(),
+			Expected: exportRecord(rec),
+			Call:     recordTyp.String(),
+			Args:     []interface{}{count},
+		}
+		var unknown string
+		if stmt.unknownInputs {
+			unknown = "The driver does not know the number of placeholders in the query, " +
+				"so the number of arguments is checked against the recording.\n\n"
+		}
+		return nil, s.mismatchErr(mismatch,
+			"mismatched argument count to %s, expected %d, got %d\n\n"+
+				"%s%s",
+			recordTyp.String(), rec.Args[1].(int), count, unknown, s.regenerateHint())
 	}
 	return rec, nil
 }
 
-// VerifyRecord returns one of the records in this session's recording, failing
-// with a nice error if no such record exists.
-func (s *session) VerifyRecord(recordTyp recordType) (*record, error) {
-	if s.index >= len(s.recording) {
-		return nil, s.sessionErr(
-			"too many calls to %s\n\n"+
-				"Do you need to regenerate the recording with the -record flag?", recordTyp.String())
+// VerifyRecordWithStmt returns the next record in the stream of the connection
+// that prepared the given statement, failing with a nice error if no such record exists, or if its
+// argument at the given index, which is the ID of the prepared statement that
+// made the record, does not match the ID of the given statement. This detects
+// prepared statements that are used in a different order than they were when
+// recording, such as by a statement cache. Records made before copyist recorded
+// statement IDs are not checked.
+func (s *session) VerifyRecordWithStmt(
+	recordTyp recordType, index int, stmt *proxyStmt,
+) (*record, error) {
+	rec, err := s.VerifyRecord(stmt.conn, recordTyp)
+	if err != nil {
+		return nil, err
 	}
-	rec := s.recording[s.index]
-	if rec.Typ != recordTyp {
-		return nil, s.sessionErr(
-			"unexpected call to %s\n\n"+
-				"Do you need to regenerate the recording with the -record flag?", recordTyp.String())
+	if err := s.verifyStmtID(rec, index, stmt); err != nil {
+		return nil, err
 	}
-	s.index++
 	return rec, nil
 }
 
+// verifyStmtID returns an error if the given record's argument at the given
+// index does not match the ID of the given statement. See VerifyRecordWithStmt.
+func (s *session) verifyStmtID(rec *record, index int, stmt *proxyStmt) error {
+	if len(rec.Args) <= index || stmt.id == 0 {
+		return nil
+	}
+	if id := rec.Args[index].(int); id != stmt.id {
+		mismatch := &MismatchError{
+			Index:    s.recordIndex(rec),
+			Expected: exportRecord(rec),
+			Call:     rec.Typ.String(),
+			Args:     []interface{}{stmt.id},
+		}
+		return s.mismatchErr(mismatch,
+			"mismatched statement in call to %s, expected statement %d, got statement %d (%s)\n\n"+
+				"%s",
+			rec.Typ.String(), id, stmt.id, stmt.query, s.regenerateHint())
+	}
+	return nil
+}
+
+// VerifyRecord returns the next record in the given connection's stream,
+// failing with a nice error if no such record exists.
+func (s *session) VerifyRecord(c *proxyConn, recordTyp recordType) (*record, error) {
+	rec, _, err := s.verifyRecord(c, recordTyp, func(rec *record) bool {
+		return rec.Typ == recordTyp
+	})
+	return rec, err
+}
+
+// PeekRecord returns true if the next record in the given connection's stream,
+// not counting notices, has the given type. Unlike VerifyRecord, it does not
+// advance past the record, or fail if the record has a different type.
+func (s *session) PeekRecord(c *proxyConn, recordTyp recordType) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stream := s.stream(c, recordTyp, func(rec *record) bool {
+		return rec.Typ == recordTyp
+	})
+	rec := stream.nextCall()
+	return rec != nil && rec.Typ == recordTyp
+}
+
+// verifyRecord returns the next record in the given connection's stream. If
+// the connection is not yet bound to a stream, then it is bound to a stream
+// whose next record matches, if there is one. See stream. The position of the
+// record is also returned, so that callers can describe where a mismatch
+// occurred.
+func (s *session) verifyRecord(
+	c *proxyConn, recordTyp recordType, match func(rec *record) bool,
+) (*record, recordPos, error) {
+	rec, pos, notices, ok := s.nextRecord(c, recordTyp, match)
+	handleNotices(notices)
+	if ok {
+		s.simulateLatency(pos.offset())
+	}
+	if rec == nil {
+		mismatch := &MismatchError{Index: -1, Call: recordTyp.String()}
+		return nil, pos, s.mismatchErr(mismatch,
+			"too many calls to %s\n\n%s", recordTyp.String(), s.regenerateHint())
+	}
+	if !ok {
+		mismatch := &MismatchError{
+			Index:    pos.offset(),
+			Expected: exportRecord(rec),
+			Call:     recordTyp.String(),
+		}
+		return nil, pos, s.mismatchErr(mismatch,
+			"unexpected call to %s, expected call to %s\n\n%s\n"+
+				"%s",
+			recordTyp.String(), rec.Typ.String(), s.recordContext(pos), s.regenerateHint())
+	}
+	return rec, pos, nil
+}
+
+// nextRecord returns the next record in the given connection's stream, and
+// advances past it if it has the given type. It returns nil if there are no
+// more records in the stream, or false if the record has a different type.
+// The position of the record is also returned. Any notices that were recorded
+// before the record are advanced past and returned, so that they can be passed
+// to the notice handler. See Notice.
+func (s *session) nextRecord(
+	c *proxyConn, recordTyp recordType, match func(rec *record) bool,
+) (rec *record, pos recordPos, notices []error, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stream := s.stream(c, recordTyp, match)
+	for {
+		if s.ordered {
+			s.waitTurn(stream)
+		}
+		pos = recordPos{stream: stream, index: stream.index}
+		if stream.index >= len(stream.records) {
+			return nil, pos, notices, false
+		}
+		rec = stream.records[stream.index]
+		if rec.Typ != ConnNotice {
+			break
+		}
+		notice, _ := rec.Args[0].(error)
+		notices = append(notices, notice)
+		s.consume(stream)
+	}
+	if rec.Typ != recordTyp {
+		return rec, pos, notices, false
+	}
+	s.consume(stream)
+	return rec, pos, notices, true
+}
+
+// consume advances past the next record in the given stream.
+func (s *session) consume(stream *recordStream) {
+	if s.ordered && stream.offsets != nil {
+		s.consumed[stream.offsets[stream.index]] = true
+		for s.position < len(s.consumed) && s.consumed[s.position] {
+			s.position++
+		}
+		s.turn.Broadcast()
+	}
+	logRecord(s.recordingName, "played back", stream.offset(stream.index), stream.records[stream.index])
+	stream.index++
+	atomic.AddInt64(&metrics.RecordsPlayedBack, 1)
+}
+
+// orderedWaitTimeout is the maximum time that a call waits for its turn when a
+// recording made with serialized calls is played back. If the application
+// doesn't make the calls that were recorded before it, then the call gives up
+// waiting and is played back out of order.
+const orderedWaitTimeout = time.Second
+
+// waitTurn waits until every record before the next record in the given stream
+// has been played back, or until orderedWaitTimeout expires. It must be called
+// with s.mu held.
+func (s *session) waitTurn(stream *recordStream) {
+	deadline := time.Now().Add(orderedWaitTimeout)
+	for stream.index < len(stream.offsets) && stream.offsets[stream.index] > s.position {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			// Give up on the records before this one, so that later calls
+			// don't need to wait for them as well.
+			s.position = stream.offsets[stream.index]
+			return
+		}
+		timer := time.AfterFunc(remaining, s.turn.Broadcast)
+		s.turn.Wait()
+		timer.Stop()
+	}
+}
+
+// stream returns the stream of records that the given connection plays back.
+// If the recording only has a single stream, then it is shared by all
+// connections. DriverOpen records are played back from the driver's stream.
+// Otherwise, the first time a connection makes a call, it is bound to one of
+// the streams recorded for its driver's connections that is not yet bound. The
+// connection may not be opened in the same order as when recording, so the
+// first stream whose next record matches the call is chosen. If there is no
+// such stream, then the connection is bound to an empty stream.
+func (s *session) stream(
+	c *proxyConn, recordTyp recordType, match func(rec *record) bool,
+) *recordStream {
+	if stream, ok := s.streams[streamKey{}]; ok {
+		return stream
+	}
+
+	driverKey := streamKey{driverName: c.driver.driverName}
+	if recordTyp == DriverOpen {
+		return s.getStream(driverKey)
+	}
+	if c.stream != nil {
+		return c.stream
+	}
+
+	var unbound []streamKey
+	hasConnStreams := false
+	for key, stream := range s.streams {
+		if key.driverName != driverKey.driverName || key.connID == 0 {
+			continue
+		}
+		hasConnStreams = true
+		if !stream.bound {
+			unbound = append(unbound, key)
+		}
+	}
+	if !hasConnStreams {
+		// Recordings made before copyist recorded connection IDs have a
+		// single stream for each driver, which all of its connections share.
+		c.stream = s.getStream(driverKey)
+		return c.stream
+	}
+
+	c.stream = &recordStream{}
+	sort.Slice(unbound, func(i, j int) bool { return unbound[i].connID < unbound[j].connID })
+	for _, key := range unbound {
+		stream := s.streams[key]
+		if rec := stream.nextCall(); rec != nil && match(rec) {
+			c.stream = stream
+			break
+		}
+	}
+	c.stream.bound = true
+	return c.stream
+}
+
+// getStream returns the stream having the given key, or an empty stream if
+// the recording has no such stream.
+func (s *session) getStream(key streamKey) *recordStream {
+	stream, ok := s.streams[key]
+	if !ok {
+		stream = &recordStream{}
+		if s.streams == nil {
+			s.streams = make(map[streamKey]*recordStream)
+		}
+		s.streams[key] = stream
+	}
+	return stream
+}
+
+// Finish reports any errors that occurred during this session to the given
+// test, and then closes the session. The given value is the result of calling
+// recover() in the deferred call that finishes the session, so that panics
+// caused by session errors can be converted into test failures.
+func (s *session) Finish(t testingT, r interface{}) {
+	// Convert sessionError and MismatchError panics into fatal test errors.
+	switch r.(type) {
+	case nil:
+	case *sessionError, *MismatchError:
+		t.Fatalf("%v\n", r)
+	default:
+		panic(r)
+	}
+
+	if s.verificationErr != nil {
+		t.Fatalf("%+v\n", s.verificationErr)
+	}
+
+	if err := s.checkFingerprint(); err != nil {
+		if failOnStaleRecording {
+			t.Fatalf("%v\n", err)
+		} else if logger, ok := t.(testingLogger); ok {
+			logger.Logf("%v", err)
+		}
+	}
+
+	if err := s.checkUnconsumed(); err != nil {
+		if failOnUnconsumedRecords {
+			t.Fatalf("%v\n", err)
+		} else if logger, ok := t.(testingLogger); ok {
+			logger.Logf("%v", err)
+		}
+	}
+
+	if err := s.checkNPlusOne(); err != nil {
+		if failOnNPlusOne {
+			t.Fatalf("%v\n", err)
+		} else if logger, ok := t.(testingLogger); ok {
+			logger.Logf("%v", err)
+		}
+	}
+
+	if err := s.checkSchema(); err != nil {
+		if logger, ok := t.(testingLogger); ok {
+			logger.Logf("%v", err)
+		}
+	}
+
+	if err := s.checkLint(); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	if err := s.checkDrift(); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	if err := s.checkVerified(); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	s.Close()
+
+	if len(s.nondeterministic) != 0 {
+		if logger, ok := t.(testingLogger); ok {
+			logger.Logf("recording %s has queries that may return rows in a nondeterministic "+
+				"order, which are likely to change when the recording is regenerated: %s\n\n"+
+				"Can you add an ORDER BY clause to them?",
+				s.recordingName, formatQueries(s.nondeterministic))
+		}
+	}
+}
+
 // Close ends this session, writing any recording file and clearing state.
 func (s *session) Close() {
-	// Only create a recording file if records exist.
-	if IsRecording() && len(s.recording) != 0 {
+	// Only create a recording file if records exist. In diff and verify modes,
+	// the recording is compared with the existing recording instead.
+	if IsRecording() && !isDiffing() && !isVerifying() && len(s.recording) != 0 {
+		// If the source writes to a different place than it reads from (e.g.
+		// a layered source), then only preserve recordings that already exist
+		// in the place being written to.
+		recordingSource := s.recordingSource
+		if ws, ok := recordingSource.source.(writeSourcer); ok {
+			recordingSource = newRecordingSource(ws.WriteSource())
+		}
+
+		// Lock the source, if possible, so that concurrent sessions in other
+		// processes don't interleave their writes with this session's.
+		if ls, ok := recordingSource.source.(lockableSource); ok {
+			unlock, err := ls.Lock()
+			if err != nil {
+				panicf("error locking recording file: %v", err)
+			}
+			defer unlock()
+		}
+
 		// If no recording file exists, or there is parse error, then ignore the
 		// error and create a new file. Parse errors can happen when there's a
 		// Git merge conflict, and it's convenient to just silently regenerate
 		// the file.
-		_ = s.recordingSource.Parse()
+		_ = recordingSource.Parse()
+
+		// Flag queries that returned rows in a different order than they did
+		// in the previous recording, if there is one.
+		s.flagReorderedQueries(recordingSource)
 
-		// Add the recording to the in-memory file and then write the file to
-		// disk.
-		s.recordingSource.AddRecording(s.recordingName, s.recording)
-		s.recordingSource.WriteRecording()
+		// Add the recording to the in-memory file and then append it to the
+		// file on disk. If that's not possible, or the file needs to be
+		// compacted, then rewrite the entire file instead.
+		recordingSource.AddRecording(s.recordingName, s.recording)
+		recordingSource.SetMetadata(s.recordingName, s.recordingMetadata())
+		if !recordingSource.AppendRecording() {
+			recordingSource.WriteRecording()
+		}
+		atomic.AddInt64(&metrics.RecordingsWritten, 1)
+		atomic.AddInt64(&metrics.BytesWritten, recordingSource.bytesWritten)
 	}
 
 	// Clear any connections pooled during the recording process so that they
@@ -166,12 +863,298 @@ func (s *session) Close() {
 	clearPooledConnections()
 }
 
-func (s *session) sessionErr(format string, args ...interface{}) error {
-	err := &sessionError{errors.Errorf(format, args...)}
+// flagReorderedQueries flags the queries that returned the same rows in a
+// different order than they did in the previous recording of the same name in
+// the given source.
+func (s *session) flagReorderedQueries(recordingSource *recordingSource) {
+	prev := recordingSource.GetRecording(s.recordingName)
+	if prev == nil {
+		return
+	}
+	prevMetadata := recordingSource.GetMetadata(s.recordingName)
+	prevStreams, err := splitStreams(prev, prevMetadata[streamsMetadataKey])
+	if err != nil {
+		return
+	}
+	nextStreams, err := splitStreams(s.recording, formatStreams(s.streamKeys))
+	if err != nil {
+		return
+	}
+	for _, query := range reorderedQueries(prevStreams, nextStreams) {
+		s.FlagNondeterministic(query)
+	}
+}
+
+// recordingMetadata returns the metadata to attach to the recording made by
+// this session.
+func (s *session) recordingMetadata() map[string]string {
+	metadata := map[string]string{
+		createdMetadataKey: time.Now().UTC().Format(time.RFC3339),
+	}
+	if maxAge != 0 {
+		metadata[maxAgeMetadataKey] = maxAge.String()
+	}
+	if s.fingerprint != "" {
+		metadata[fingerprintMetadataKey] = s.fingerprint
+	}
+	if streams := formatStreams(s.streamKeys); streams != "" {
+		metadata[streamsMetadataKey] = streams
+	}
+	if goroutines := formatGoroutines(s.goroutines); goroutines != "" {
+		metadata[goroutinesMetadataKey] = goroutines
+	}
+	if recordDurations {
+		metadata[durationsMetadataKey] = formatDurations(s.durations)
+	}
+	if len(s.plans) != 0 {
+		metadata[plansMetadataKey] = formatPlans(s.plans)
+	}
+	if s.schema != "" {
+		metadata[schemaMetadataKey] = s.schema
+	}
+	if len(s.nondeterministic) != 0 {
+		metadata[nondeterministicMetadataKey] = formatQueries(s.nondeterministic)
+	}
+	return metadata
+}
+
+// formatStreams returns the stream of each record in a recording, in a
+// run-length encoded format like:
+//
+//	"postgres"*1 "postgres"#1*4 "pgx"*1 "pgx"#2*4 "postgres"#1*4
+//
+// Each run gives the name of the driver, followed by the ID of the connection,
+// if any, followed by the number of records. If all records were made by the
+// same connection, then formatStreams returns the empty string, since there is
+// only one stream.
+func formatStreams(keys []streamKey) string {
+	driverNames := make(map[string]bool)
+	connIDs := make(map[int]bool)
+	var b strings.Builder
+	for i := 0; i < len(keys); {
+		j := i + 1
+		for j < len(keys) && keys[j] == keys[i] {
+			j++
+		}
+		if i != 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(strconv.Quote(keys[i].driverName))
+		if keys[i].connID != 0 {
+			b.WriteByte('#')
+			b.WriteString(strconv.Itoa(keys[i].connID))
+			connIDs[keys[i].connID] = true
+		}
+		b.WriteByte('*')
+		b.WriteString(strconv.Itoa(j - i))
+		driverNames[keys[i].driverName] = true
+		i = j
+	}
+	if len(driverNames) < 2 && len(connIDs) < 2 {
+		return ""
+	}
+	return b.String()
+}
+
+// formatGoroutines returns the goroutine that made each record in a recording,
+// in a run-length encoded format like:
+//
+//	1*3 2*1 1*2
+//
+// Goroutines are numbered in order of their first record. If all records were
+// made by the same goroutine, then formatGoroutines returns the empty string.
+func formatGoroutines(goroutines []int) string {
+	var b strings.Builder
+	multiple := false
+	for i := 0; i < len(goroutines); {
+		j := i + 1
+		for j < len(goroutines) && goroutines[j] == goroutines[i] {
+			j++
+		}
+		if i != 0 {
+			b.WriteByte(' ')
+			multiple = true
+		}
+		b.WriteString(strconv.Itoa(goroutines[i]))
+		b.WriteByte('*')
+		b.WriteString(strconv.Itoa(j - i))
+		i = j
+	}
+	if !multiple {
+		return ""
+	}
+	return b.String()
+}
+
+// goroutineID returns the runtime ID of the calling goroutine, which is parsed
+// from the first line of its stack trace, like:
+//
+//	goroutine 18 [running]:
+func goroutineID() uint64 {
+	var buf [64]byte
+	stack := buf[:runtime.Stack(buf[:], false)]
+	stack = bytes.TrimPrefix(stack, []byte("goroutine "))
+	if i := bytes.IndexByte(stack, ' '); i != -1 {
+		stack = stack[:i]
+	}
+	id, _ := strconv.ParseUint(string(stack), 10, 64)
+	return id
+}
+
+// splitStreams splits the given recording into its streams, according to the
+// run-length encoded stream keys produced by formatStreams. If there are no
+// stream keys, then all records are returned in a single stream with an empty
+// key.
+func splitStreams(rec recording, keys string) (map[streamKey]*recordStream, error) {
+	if keys == "" {
+		return map[streamKey]*recordStream{{}: {records: rec}}, nil
+	}
+
+	recKeys, err := parseStreams(keys, len(rec))
+	if err != nil {
+		return nil, err
+	}
+	streams := make(map[streamKey]*recordStream)
+	for i, key := range recKeys {
+		stream, ok := streams[key]
+		if !ok {
+			stream = &recordStream{}
+			streams[key] = stream
+		}
+		stream.records = append(stream.records, rec[i])
+		stream.offsets = append(stream.offsets, i)
+	}
+	return streams, nil
+}
+
+// parseStreams parses the stream key of each record in a recording having the
+// given number of records, in the format produced by formatStreams.
+func parseStreams(keys string, count int) ([]streamKey, error) {
+	var recKeys []streamKey
+	for rest := keys; rest != ""; rest = strings.TrimLeft(rest, " ") {
+		if rest[0] != '"' {
+			return nil, fmt.Errorf("expected quoted driver name: %s", rest)
+		}
+		quoteLen := quotedPrefixLen(rest)
+		if quoteLen == -1 {
+			return nil, fmt.Errorf("unterminated string: %s", rest)
+		}
+		var key streamKey
+		var err error
+		key.driverName, err = strconv.Unquote(rest[:quoteLen])
+		if err != nil {
+			return nil, fmt.Errorf("expected quoted driver name: %s", rest)
+		}
+		rest = rest[quoteLen:]
+
+		end := strings.IndexByte(rest, ' ')
+		if end == -1 {
+			end = len(rest)
+		}
+		run := rest[:end]
+		rest = rest[end:]
+
+		star := strings.IndexByte(run, '*')
+		if star == -1 {
+			return nil, fmt.Errorf("expected record count for driver %q", key.driverName)
+		}
+		if strings.HasPrefix(run, "#") {
+			key.connID, err = strconv.Atoi(run[1:star])
+			if err != nil || key.connID < 1 {
+				return nil, fmt.Errorf("invalid connection ID: %s", run)
+			}
+		} else if star != 0 {
+			return nil, fmt.Errorf("expected record count for driver %q", key.driverName)
+		}
+		n, err := strconv.Atoi(run[star+1:])
+		if err != nil || n < 1 || len(recKeys)+n > count {
+			return nil, fmt.Errorf("invalid record count: %s", run)
+		}
+		for i := 0; i < n; i++ {
+			recKeys = append(recKeys, key)
+		}
+	}
+	if len(recKeys) != count {
+		return nil, fmt.Errorf("expected %d records, got %d", count, len(recKeys))
+	}
+	return recKeys, nil
+}
+
+// checkFingerprint returns an error if this session played back a recording
+// that was made by a different version of the test, according to the
+// fingerprints of the test and the recording. Recordings without fingerprints
+// are assumed to be up-to-date.
+func (s *session) checkFingerprint() error {
+	if IsRecording() || s.fingerprint == "" {
+		return nil
+	}
+
+	recorded := s.recordingSource.GetMetadata(s.recordingName)[fingerprintMetadataKey]
+	if recorded == "" || recorded == s.fingerprint {
+		return nil
+	}
+	return fmt.Errorf(
+		"test has changed since recording %s was made\n\n%s",
+		s.recordingName, s.regenerateHint())
+}
+
+// checkUnconsumed returns an error if this session played back a recording
+// that has records which were never played back, meaning that the recording is
+// longer than the test that it backs.
+func (s *session) checkUnconsumed() error {
+	if IsRecording() {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	unconsumed := 0
+	first := -1
+	for _, stream := range s.streams {
+		if stream.index >= len(stream.records) {
+			continue
+		}
+		unconsumed += len(stream.records) - stream.index
+		if offset := stream.offset(stream.index); first == -1 || offset < first {
+			first = offset
+		}
+	}
+	if unconsumed == 0 {
+		return nil
+	}
+	return fmt.Errorf(
+		"recording %s has %d records that were never played back, starting with %s (#%d)\n\n"+
+			"%s",
+		s.recordingName, unconsumed, s.recording[first].Typ.String(), first, s.regenerateHint())
+}
+
+// mismatchErr completes the given MismatchError with the given message, and
+// returns it. The first mismatch in the session is reported to the test when
+// the session is finished, even if the application ignores the error.
+func (s *session) mismatchErr(
+	mismatch *MismatchError, format string, args ...interface{},
+) error {
+	mismatch.RecordingName = s.recordingName
+	mismatch.err = errors.Errorf(format, args...)
+	atomic.AddInt64(&metrics.Mismatches, 1)
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	if s.verificationErr == nil {
-		s.verificationErr = err
+		s.verificationErr = mismatch
+	}
+	return mismatch
+}
+
+// recordIndex returns the offset of the given record within the session's
+// recording, or -1 if it is not part of the recording.
+func (s *session) recordIndex(rec *record) int {
+	for i := range s.recording {
+		if s.recording[i] == rec {
+			return i
+		}
 	}
-	return err
+	return -1
 }
 
 func panicf(format string, args ...interface{}) error {
@@ -0,0 +1,188 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package copyist
+
+import (
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// sidecarSource is implemented by Sources that can store large values in
+// sidecar files, separately from the recording file. See SetSidecarThreshold.
+type sidecarSource interface {
+	// ReadSidecar returns the contents of the sidecar file having the given
+	// name.
+	ReadSidecar(name string) ([]byte, error)
+
+	// WriteSidecar writes the sidecar file having the given name, if it does
+	// not already exist.
+	WriteSidecar(name string, data []byte) error
+}
+
+// sidecarRef is a reference to a byte slice value that is stored in a sidecar
+// file. It is the name of the sidecar file, which is the hex-encoded SHA-256
+// hash of the value.
+type sidecarRef string
+
+// sidecarDir returns the directory in which the sidecar files of this
+// recording file are stored. It is named after the recording file, with a
+// ".sidecar" extension rather than ".copyist".
+func (s fileSource) sidecarDir() string {
+	return strings.TrimSuffix(s.PathName, filepath.Ext(s.PathName)) + ".sidecar"
+}
+
+// ReadSidecar implements sidecarSource.
+func (s fileSource) ReadSidecar(name string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(s.sidecarDir(), name))
+}
+
+// WriteSidecar implements sidecarSource. Since sidecar files are named after
+// the hash of their contents, an existing sidecar file is never rewritten.
+func (s fileSource) WriteSidecar(name string, data []byte) error {
+	pathName := filepath.Join(s.sidecarDir(), name)
+	if _, err := os.Stat(pathName); err == nil {
+		return nil
+	}
+	return fileSource{PathName: pathName}.WriteAll(data)
+}
+
+// ReadSidecar implements sidecarSource. It reads the sidecar file from the
+// first layer that has it.
+func (s *layeredSource) ReadSidecar(name string) ([]byte, error) {
+	for _, layer := range s.layers {
+		if ss, ok := layer.(sidecarSource); ok {
+			data, err := ss.ReadSidecar(name)
+			if os.IsNotExist(err) {
+				continue
+			}
+			return data, err
+		}
+	}
+	return nil, os.ErrNotExist
+}
+
+// WriteSidecar implements sidecarSource. It writes the sidecar file to the
+// writeTo source.
+func (s *layeredSource) WriteSidecar(name string, data []byte) error {
+	ss, ok := s.writeTo.(sidecarSource)
+	if !ok {
+		return fmt.Errorf("source does not support sidecar files")
+	}
+	return ss.WriteSidecar(name, data)
+}
+
+// offloadRecord returns the given record with any byte slice values that are
+// larger than the sidecar threshold written to sidecar files, and replaced by
+// references to those files. If there are no such values, or the source does
+// not support sidecar files, then the record is returned unchanged.
+func (f *recordingSource) offloadRecord(rec *record) *record {
+	ss, ok := f.source.(sidecarSource)
+	if !ok || sidecarThreshold == 0 {
+		return rec
+	}
+
+	large := false
+	for _, arg := range rec.Args {
+		if hasLargeValue(arg) {
+			large = true
+			break
+		}
+	}
+	if !large {
+		return rec
+	}
+
+	offloaded := &record{Typ: rec.Typ, Args: make(recordArgs, len(rec.Args))}
+	for i, arg := range rec.Args {
+		offloaded.Args[i] = offloadValue(ss, arg)
+	}
+	return offloaded
+}
+
+// offloadValue writes the given value to a sidecar file and returns a reference
+// to it, if it is a byte slice that is larger than the sidecar threshold.
+// Values nested in slices are offloaded in the same way.
+func offloadValue(ss sidecarSource, val interface{}) interface{} {
+	switch t := val.(type) {
+	case []byte:
+		if len(t) <= sidecarThreshold {
+			return t
+		}
+		hash := sha256.Sum256(t)
+		name := hex.EncodeToString(hash[:])
+		if err := ss.WriteSidecar(name, t); err != nil {
+			panicf("error writing sidecar file: %v", err)
+		}
+		return sidecarRef(name)
+
+	case []driver.Value:
+		offloaded := make([]driver.Value, len(t))
+		for i := range t {
+			offloaded[i] = offloadValue(ss, t[i])
+		}
+		return offloaded
+	}
+	return val
+}
+
+// hasLargeValue returns true if the given value is a byte slice that is larger
+// than the sidecar threshold, or is a slice that contains one.
+func hasLargeValue(val interface{}) bool {
+	switch t := val.(type) {
+	case []byte:
+		return len(t) > sidecarThreshold
+	case []driver.Value:
+		for i := range t {
+			if hasLargeValue(t[i]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// loadValue returns the given value, with any references to sidecar files
+// replaced by the contents of those files. Values nested in slices are loaded
+// in the same way.
+func (f *recordingSource) loadValue(val interface{}) (interface{}, error) {
+	switch t := val.(type) {
+	case sidecarRef:
+		ss, ok := f.source.(sidecarSource)
+		if !ok {
+			return nil, fmt.Errorf("source does not support sidecar files")
+		}
+		data, err := ss.ReadSidecar(string(t))
+		if err != nil {
+			return nil, fmt.Errorf("error reading sidecar file: %v", err)
+		}
+		return data, nil
+
+	case []driver.Value:
+		for i := range t {
+			loaded, err := f.loadValue(t[i])
+			if err != nil {
+				return nil, err
+			}
+			t[i] = loaded
+		}
+		return t, nil
+	}
+	return val, nil
+}
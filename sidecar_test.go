@@ -0,0 +1,72 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package copyist
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestSidecar tests that byte slice values larger than the sidecar threshold
+// are stored in sidecar files, and are loaded from them during playback.
+func TestSidecar(t *testing.T) {
+	SetSidecarThreshold(16)
+	defer SetSidecarThreshold(0)
+
+	pathName := filepath.Join(t.TempDir(), "sidecar_test.copyist")
+	big := bytes.Repeat([]byte{0, 1, 2, 3}, 8)
+	rec := recording{
+		{Typ: RowsNext, Args: recordArgs{[]driver.Value{[]byte("small"), big}, nil}},
+		{Typ: RowsNext, Args: recordArgs{[]driver.Value{[]byte("small"), big}, nil}},
+	}
+
+	recordingSource := newRecordingSource(NewFileSource(pathName))
+	recordingSource.AddRecording("TestSidecar", rec)
+	recordingSource.WriteRecording()
+
+	// The big value is stored once, in the sidecar directory.
+	data, err := os.ReadFile(pathName)
+	require.NoError(t, err)
+	require.False(t, strings.Contains(string(data), "AAECAwABAgMAAQIDAAECAw"))
+	require.True(t, strings.Contains(string(data), "12:"))
+	entries, err := os.ReadDir(strings.TrimSuffix(pathName, ".copyist") + ".sidecar")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	// The big value is loaded from the sidecar file.
+	recordingSource = newRecordingSource(NewFileSource(pathName))
+	require.NoError(t, recordingSource.Parse())
+	require.Equal(t, rec, recordingSource.GetRecording("TestSidecar"))
+
+	// Layered sources load sidecar files from their layers.
+	missing := NewFileSource(filepath.Join(t.TempDir(), "missing.copyist"))
+	layered := NewLayeredSource(missing, missing, NewFileSource(pathName))
+	recordingSource = newRecordingSource(layered)
+	require.NoError(t, recordingSource.Parse())
+	require.Equal(t, rec, recordingSource.GetRecording("TestSidecar"))
+
+	// Sources without sidecar files fail to load the value.
+	recordingSource = newRecordingSource(&memorySource{data: data})
+	require.NoError(t, recordingSource.Parse())
+	require.PanicsWithError(t, "source does not support sidecar files", func() {
+		recordingSource.GetRecording("TestSidecar")
+	})
+}
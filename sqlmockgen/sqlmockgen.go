@@ -0,0 +1,313 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package sqlmockgen converts copyist recordings into Go code that sets the
+// expectations of a go-sqlmock mock (github.com/DATA-DOG/go-sqlmock). This
+// allows unit tests that use sqlmock to return realistic data that was
+// recorded from a real database.
+package sqlmockgen
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"fmt"
+	"go/format"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/cockroachdb/copyist"
+)
+
+// Generate returns Go source code for a file in the given package, which
+// declares a function for each of the recordings of the given names in the
+// given recording file. If no names are given, then a function is declared for
+// every recording in the file. Each function sets the recorded calls as the
+// expectations of the sqlmock mock that is passed to it, in the order in which
+// they were recorded. For example, the function generated for the
+// "TestQueryName" recording is used like this:
+//
+//	db, mock, _ := sqlmock.New()
+//	expectTestQueryName(mock)
+//
+// Queries are matched by sqlmock's default regular expression matcher, so they
+// are quoted in the generated code in order to match exactly. Query arguments
+// are not recorded by copyist, so they are not expected either.
+func Generate(file *copyist.RecordingFile, pkgName string, recordingNames ...string) ([]byte, error) {
+	if len(recordingNames) == 0 {
+		recordingNames = file.RecordingNames()
+	}
+
+	g := &generator{}
+	for _, name := range recordingNames {
+		records, err := file.Recording(name)
+		if err != nil {
+			return nil, err
+		}
+		if err := g.generateRecording(name, records); err != nil {
+			return nil, fmt.Errorf("recording %q: %v", name, err)
+		}
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by \"copyist sqlmock\"; DO NOT EDIT.\n\n")
+	fmt.Fprintf(&buf, "package %s\n\n", pkgName)
+	fmt.Fprintf(&buf, "import (\n")
+	if g.usesErrors {
+		fmt.Fprintf(&buf, "\t\"errors\"\n")
+	}
+	if g.usesTime {
+		fmt.Fprintf(&buf, "\t\"time\"\n")
+	}
+	fmt.Fprintf(&buf, "\n\t\"github.com/DATA-DOG/go-sqlmock\"\n)\n")
+	buf.Write(g.buf.Bytes())
+	return format.Source(buf.Bytes())
+}
+
+// generator accumulates the code generated for a list of recordings.
+type generator struct {
+	buf bytes.Buffer
+
+	// usesErrors is true if the generated code uses the errors package.
+	usesErrors bool
+
+	// usesTime is true if the generated code uses the time package.
+	usesTime bool
+}
+
+// expectation is a call that is expected by the mock, along with the results
+// that the mock returns.
+type expectation struct {
+	// method is the sqlmock method that sets the expectation (e.g.
+	// "ExpectQuery").
+	method string
+
+	// query is the query that is expected, or empty if the method does not
+	// expect a query.
+	query string
+
+	// err is the error that is returned by the call, or nil if it succeeds.
+	err error
+
+	// Results of ExpectExec.
+	lastInsertID, rowsAffected int64
+
+	// Results of ExpectQuery.
+	columns []string
+	rows    [][]driver.Value
+	rowErr  error
+}
+
+// generateRecording generates a function that sets the expectations of the
+// given recording.
+func (g *generator) generateRecording(name string, records []copyist.Record) error {
+	var expectations []*expectation
+	var lastExec, lastQuery *expectation
+	stmtQueries := make(map[int]string)
+	lastStmtQuery := ""
+
+	for _, rec := range records {
+		switch rec.Type {
+		case "DriverOpen", "StmtNumInput":
+			// Opening connections and checking the number of statement inputs
+			// are not expected by sqlmock.
+
+		case "ConnExec", "ConnQuery", "ConnPrepare":
+			query := rec.Args[0].(string)
+			exp := &expectation{query: query, err: recordErr(rec.Args[1])}
+			switch rec.Type {
+			case "ConnExec":
+				exp.method = "ExpectExec"
+				lastExec = exp
+			case "ConnQuery":
+				exp.method = "ExpectQuery"
+				lastQuery = exp
+			case "ConnPrepare":
+				exp.method = "ExpectPrepare"
+				if len(rec.Args) > 2 {
+					stmtQueries[rec.Args[2].(int)] = query
+				}
+				lastStmtQuery = query
+			}
+			expectations = append(expectations, exp)
+
+		case "StmtExec", "StmtQuery":
+			// Statements made before copyist recorded statement IDs always
+			// belong to the last prepared statement.
+			query := lastStmtQuery
+			if len(rec.Args) > 2 {
+				query = stmtQueries[rec.Args[2].(int)]
+			}
+			exp := &expectation{query: query, err: recordErr(rec.Args[0])}
+			if rec.Type == "StmtExec" {
+				exp.method = "ExpectExec"
+				lastExec = exp
+			} else {
+				exp.method = "ExpectQuery"
+				lastQuery = exp
+			}
+			expectations = append(expectations, exp)
+
+		case "ConnBegin", "TxCommit", "TxRollback":
+			method := map[string]string{
+				"ConnBegin":  "ExpectBegin",
+				"TxCommit":   "ExpectCommit",
+				"TxRollback": "ExpectRollback",
+			}[rec.Type]
+			expectations = append(expectations, &expectation{method: method, err: recordErr(rec.Args[0])})
+
+		case "ResultLastInsertId", "ResultRowsAffected":
+			if lastExec == nil {
+				continue
+			}
+			if rec.Type == "ResultLastInsertId" {
+				lastExec.lastInsertID = rec.Args[0].(int64)
+			} else {
+				lastExec.rowsAffected = rec.Args[0].(int64)
+			}
+
+		case "RowsColumns":
+			if lastQuery != nil {
+				lastQuery.columns = rec.Args[0].([]string)
+			}
+
+		case "RowsNext":
+			if lastQuery == nil {
+				continue
+			}
+			err := recordErr(rec.Args[1])
+			if err == io.EOF {
+				continue
+			}
+			if err != nil {
+				lastQuery.rowErr = err
+				continue
+			}
+			lastQuery.rows = append(lastQuery.rows, rec.Args[0].([]driver.Value))
+
+		default:
+			return fmt.Errorf("%s records cannot be converted to sqlmock expectations", rec.Type)
+		}
+	}
+
+	fmt.Fprintf(&g.buf, "\n// %s sets the expectations of the %q copyist recording.\n",
+		funcName(name), name)
+	fmt.Fprintf(&g.buf, "func %s(mock sqlmock.Sqlmock) {\n", funcName(name))
+	for _, exp := range expectations {
+		if err := g.generateExpectation(exp); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(&g.buf, "}\n")
+	return nil
+}
+
+// generateExpectation generates a statement that sets the given expectation.
+func (g *generator) generateExpectation(exp *expectation) error {
+	if exp.query != "" {
+		fmt.Fprintf(&g.buf, "\tmock.%s(%s)", exp.method, strconv.Quote(regexp.QuoteMeta(exp.query)))
+	} else {
+		fmt.Fprintf(&g.buf, "\tmock.%s()", exp.method)
+	}
+
+	if exp.err != nil {
+		g.usesErrors = true
+		fmt.Fprintf(&g.buf, ".WillReturnError(errors.New(%s))\n", strconv.Quote(exp.err.Error()))
+		return nil
+	}
+
+	switch exp.method {
+	case "ExpectExec":
+		fmt.Fprintf(&g.buf, ".WillReturnResult(sqlmock.NewResult(%d, %d))",
+			exp.lastInsertID, exp.rowsAffected)
+
+	case "ExpectQuery":
+		fmt.Fprintf(&g.buf, ".WillReturnRows(\n\t\tsqlmock.NewRows(%#v)", exp.columns)
+		for _, row := range exp.rows {
+			fmt.Fprintf(&g.buf, ".\n\t\t\tAddRow(")
+			for i, val := range row {
+				if i != 0 {
+					fmt.Fprintf(&g.buf, ", ")
+				}
+				lit, err := g.valueLiteral(val)
+				if err != nil {
+					return err
+				}
+				g.buf.WriteString(lit)
+			}
+			fmt.Fprintf(&g.buf, ")")
+		}
+		if exp.rowErr != nil {
+			g.usesErrors = true
+			fmt.Fprintf(&g.buf, ".\n\t\t\tRowError(%d, errors.New(%s))",
+				len(exp.rows), strconv.Quote(exp.rowErr.Error()))
+		}
+		fmt.Fprintf(&g.buf, ")")
+	}
+	fmt.Fprintf(&g.buf, "\n")
+	return nil
+}
+
+// valueLiteral returns a Go literal for the given value that was returned by a
+// driver.
+func (g *generator) valueLiteral(val driver.Value) (string, error) {
+	switch t := val.(type) {
+	case nil:
+		return "nil", nil
+	case int64:
+		return fmt.Sprintf("int64(%d)", t), nil
+	case float64:
+		return fmt.Sprintf("float64(%s)", strconv.FormatFloat(t, 'g', -1, 64)), nil
+	case bool:
+		return strconv.FormatBool(t), nil
+	case string:
+		return strconv.Quote(t), nil
+	case []byte:
+		return fmt.Sprintf("[]byte(%s)", strconv.Quote(string(t))), nil
+	case time.Time:
+		g.usesTime = true
+		loc := "time.UTC"
+		if name, offset := t.Zone(); t.Location() != time.UTC {
+			loc = fmt.Sprintf("time.FixedZone(%q, %d)", name, offset)
+		}
+		return fmt.Sprintf("time.Date(%d, %d, %d, %d, %d, %d, %d, %s)",
+			t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), loc), nil
+	}
+	return "", fmt.Errorf("values of type %T cannot be converted to sqlmock rows", val)
+}
+
+// recordErr returns the given record argument as an error, or nil if it is not
+// an error.
+func recordErr(arg interface{}) error {
+	err, _ := arg.(error)
+	return err
+}
+
+// funcName returns the name of the function generated for the recording of
+// the given name, like "expectTestQuery_sub_test" for "TestQuery/sub test".
+func funcName(recordingName string) string {
+	var b strings.Builder
+	b.WriteString("expect")
+	for _, r := range recordingName {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(r)
+		} else {
+			b.WriteRune('_')
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,74 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package sqlmockgen
+
+import (
+	"testing"
+
+	"github.com/cockroachdb/copyist"
+	"github.com/stretchr/testify/require"
+)
+
+// TestGenerate tests that recordings are converted into sqlmock expectations.
+func TestGenerate(t *testing.T) {
+	file, err := copyist.ReadRecordingFile(copyist.NewMemorySource([]byte(`
+1=DriverOpen	1:nil
+2=ConnQuery	2:"SELECT name, created FROM customers WHERE id=$1"	1:nil
+3=RowsColumns	9:["name","created"]
+4=RowsNext	11:[2:"Andy",8:2021-02-03T04:05:06Z]	1:nil
+5=RowsNext	11:[]	7:"EOF"
+6=ConnBegin	1:nil
+7=ConnPrepare	2:"UPDATE customers SET name=$1"	1:nil	3:1
+8=StmtNumInput	3:1	3:1
+9=StmtExec	1:nil	3:1	3:1
+10=ResultRowsAffected	4:3	1:nil
+11=TxCommit	7:"commit failed"
+12=ConnRaw	1:nil
+
+"TestQuery/sub test"=1,2,3,4,5,6,7,8,9,10,11
+"TestRaw"=1,12
+`)))
+	require.NoError(t, err)
+
+	src, err := Generate(file, "store", "TestQuery/sub test")
+	require.NoError(t, err)
+	require.Equal(t, `// Code generated by "copyist sqlmock"; DO NOT EDIT.
+
+package store
+
+import (
+	"errors"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// expectTestQuery_sub_test sets the expectations of the "TestQuery/sub test" copyist recording.
+func expectTestQuery_sub_test(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery("SELECT name, created FROM customers WHERE id=\\$1").WillReturnRows(
+		sqlmock.NewRows([]string{"name", "created"}).
+			AddRow("Andy", time.Date(2021, 2, 3, 4, 5, 6, 0, time.UTC)))
+	mock.ExpectBegin()
+	mock.ExpectPrepare("UPDATE customers SET name=\\$1")
+	mock.ExpectExec("UPDATE customers SET name=\\$1").WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectCommit().WillReturnError(errors.New("commit failed"))
+}
+`, string(src))
+
+	// Records that sqlmock cannot expect are rejected.
+	_, err = Generate(file, "store")
+	require.EqualError(t, err,
+		`recording "TestRaw": ConnRaw records cannot be converted to sqlmock expectations`)
+}
@@ -26,6 +26,24 @@ type proxyStmt struct {
 	// used by multiple goroutines concurrently.
 	driver.Stmt
 
+	// conn is the connection that prepared this statement.
+	conn *proxyConn
+
+	// id uniquely identifies this statement among the statements prepared by
+	// the session, or is zero if the statement was prepared by a recording
+	// that did not identify statements.
+	id int
+
+	// query is the query text that was prepared.
+	query string
+
+	// unknownInputs is true if NumInput returned -1, because the driver does
+	// not know the number of placeholders in the query. In that case, the sql
+	// package does not check the number of arguments passed to Exec or Query,
+	// so during playback, it is checked against the number of arguments that
+	// were passed when recording instead.
+	unknownInputs bool
+
 	stmt driver.Stmt
 }
 
@@ -51,16 +69,21 @@ func (s *proxyStmt) Close() error {
 // will not sanity check Exec or Query argument counts.
 func (s *proxyStmt) NumInput() int {
 	if IsRecording() {
+		defer s.conn.session.SerializeCall(s.conn)()
 		num := s.stmt.NumInput()
-		currentSession.AddRecord(&record{Typ: StmtNumInput, Args: recordArgs{num}})
+		s.conn.session.AddRecord(s.conn,
+			&record{Typ: StmtNumInput, Args: recordArgs{num, s.id}})
+		s.unknownInputs = num == -1
 		return num
 	}
 
-	rec, err := currentSession.VerifyRecord(StmtNumInput)
+	rec, err := s.conn.session.VerifyRecordWithStmt(StmtNumInput, 1, s)
 	if err != nil {
 		panic(err)
 	}
-	return rec.Args[0].(int)
+	num := rec.Args[0].(int)
+	s.unknownInputs = num == -1
+	return num
 }
 
 // Exec executes a query that doesn't return rows, such
@@ -79,6 +102,7 @@ func (s *proxyStmt) ExecContext(
 	ctx context.Context, args []driver.NamedValue,
 ) (driver.Result, error) {
 	if IsRecording() {
+		defer s.conn.session.SerializeCall(s.conn)()
 		var res driver.Result
 		var err error
 		if execCtx, ok := s.stmt.(driver.StmtExecContext); ok {
@@ -92,22 +116,37 @@ func (s *proxyStmt) ExecContext(
 			res, err = s.stmt.Exec(vals)
 		}
 
-		currentSession.AddRecord(&record{Typ: StmtExec, Args: recordArgs{err}})
+		recArgs := recordArgs{err, len(args), s.id}
+		sentinel := sentinelResult(res)
+		if sentinel != nil {
+			recArgs = append(recArgs, sentinel)
+		}
+		s.conn.session.AddRecord(s.conn, &record{Typ: StmtExec, Args: recArgs})
 		if err != nil {
-			return nil, err
+			return nil, s.conn.markBad(err)
+		}
+		s.conn.session.explain(s.conn, s.query, args)
+		if sentinel != nil {
+			return sentinel, nil
 		}
-		return &proxyResult{res: res}, nil
+		return &proxyResult{conn: s.conn, res: res}, nil
 	}
 
-	rec, err := currentSession.VerifyRecord(StmtExec)
+	rec, err := s.conn.session.VerifyRecordWithArgCount(s, StmtExec, len(args))
 	if err != nil {
 		return nil, err
 	}
+	if err := s.conn.session.verifyStmtID(rec, 2, s); err != nil {
+		return nil, err
+	}
 	err, _ = rec.Args[0].(error)
 	if err != nil {
-		return nil, err
+		return nil, s.conn.markBad(err)
+	}
+	if sentinel := recordedResult(rec, 3); sentinel != nil {
+		return sentinel, nil
 	}
-	return &proxyResult{}, nil
+	return &proxyResult{conn: s.conn}, nil
 }
 
 // Query executes a query that may return rows, such as a
@@ -126,6 +165,7 @@ func (s *proxyStmt) QueryContext(
 	ctx context.Context, args []driver.NamedValue,
 ) (driver.Rows, error) {
 	if IsRecording() {
+		defer s.conn.session.SerializeCall(s.conn)()
 		var rows driver.Rows
 		var err error
 		if stmtCtx, ok := s.stmt.(driver.StmtQueryContext); ok {
@@ -139,22 +179,26 @@ func (s *proxyStmt) QueryContext(
 			rows, err = s.stmt.Query(vals)
 		}
 
-		currentSession.AddRecord(&record{Typ: StmtQuery, Args: recordArgs{err}})
+		s.conn.session.AddRecord(s.conn,
+			&record{Typ: StmtQuery, Args: recordArgs{err, len(args), s.id}})
 		if err != nil {
-			return nil, err
+			return nil, s.conn.markBad(err)
 		}
-		return &proxyRows{rows: rows}, nil
+		return &proxyRows{conn: s.conn, rows: rows, query: s.query, args: args}, nil
 	}
 
-	rec, err := currentSession.VerifyRecord(StmtQuery)
+	rec, err := s.conn.session.VerifyRecordWithArgCount(s, StmtQuery, len(args))
 	if err != nil {
 		return nil, err
 	}
+	if err := s.conn.session.verifyStmtID(rec, 2, s); err != nil {
+		return nil, err
+	}
 	err, _ = rec.Args[0].(error)
 	if err != nil {
-		return nil, err
+		return nil, s.conn.markBad(err)
 	}
-	return &proxyRows{}, nil
+	return &proxyRows{conn: s.conn}, nil
 }
 
 func namedValueToValue(named []driver.NamedValue) ([]driver.Value, error) {
@@ -0,0 +1,128 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package suiteutil integrates copyist with testify suites.
+package suiteutil
+
+import (
+	"database/sql"
+	"io"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/cockroachdb/copyist"
+	"github.com/stretchr/testify/suite"
+)
+
+// Suite is a testify suite mixin that opens a copyist session before each test
+// in the suite, and closes it after the test completes. It also opens a
+// database using the copyist driver for each test, which the test can access
+// via the DB field. Embed Suite in a test suite, and set the name of the
+// wrapped driver and the data source name before running the suite:
+//
+//	type StoreSuite struct {
+//	  suiteutil.Suite
+//	}
+//
+//	func TestStore(t *testing.T) {
+//	  suite.Run(t, &StoreSuite{Suite: suiteutil.Suite{
+//	    DriverName:     "postgres",
+//	    DataSourceName: "postgresql://root@localhost",
+//	  }})
+//	}
+//
+//	func (s *StoreSuite) TestQueryName() {
+//	  rows, err := s.DB.Query("SELECT name FROM customers")
+//	  ...
+//	}
+//
+// Each test is recorded under its full name (e.g. "TestStore/TestQueryName"),
+// in the recording file of the test file that runs the suite. Suites that
+// define their own SetupSuite, SetupTest or TearDownTest methods must call the
+// corresponding methods of Suite.
+type Suite struct {
+	suite.Suite
+
+	// DriverName is the name of the driver that is wrapped by the copyist
+	// driver (e.g. "postgres"). copyist.Register must already have been called
+	// for it.
+	DriverName string
+
+	// DataSourceName is passed to sql.Open when opening DB.
+	DataSourceName string
+
+	// DB is the database that is opened for the current test, using the
+	// copyist driver.
+	DB *sql.DB
+
+	// testFileName is the name of the test file that runs the suite.
+	testFileName string
+
+	// closer closes the copyist session of the current test.
+	closer io.Closer
+}
+
+// SetupSuite finds the test file that runs the suite. It must be called before
+// the tests of the suite are run, from the goroutine of the test that runs the
+// suite, since the tests themselves run in separate goroutines.
+func (s *Suite) SetupSuite() {
+	s.testFileName = findTestFile()
+}
+
+// SetupTest opens a copyist session and a database for the current test.
+func (s *Suite) SetupTest() {
+	if s.testFileName == "" {
+		panic("suiteutil.Suite.SetupSuite was not called")
+	}
+	s.closer = copyist.OpenForFile(s.T(), s.testFileName)
+
+	db, err := sql.Open("copyist_"+s.DriverName, s.DataSourceName)
+	s.Require().NoError(err)
+	s.DB = db
+}
+
+// TearDownTest closes the database and the copyist session of the current
+// test.
+func (s *Suite) TearDownTest() {
+	if s.DB != nil {
+		s.DB.Close()
+		s.DB = nil
+	}
+	if s.closer != nil {
+		s.closer.Close()
+		s.closer = nil
+	}
+}
+
+// findTestFile searches the call stack for the test file that runs the suite,
+// returning the name of the last file on the stack that ends in "_test.go".
+func findTestFile() string {
+	pcs := make([]uintptr, 20)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(2, pcs)])
+	var lastTestFilename string
+	for {
+		frame, more := frames.Next()
+		if strings.HasSuffix(frame.File, "_test.go") {
+			lastTestFilename = filepath.FromSlash(frame.File)
+		}
+		if !more {
+			break
+		}
+	}
+	if lastTestFilename == "" {
+		panic("suite was not run from a test file")
+	}
+	return lastTestFilename
+}
@@ -0,0 +1,190 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package copyist
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// templateVarRegexp matches a template variable placeholder, like
+// "{{.UserID}}", and captures the name of the variable.
+var templateVarRegexp = regexp.MustCompile(`\{\{\.([A-Za-z_][A-Za-z0-9_]*)\}\}`)
+
+// templateVar is a template variable that is bound to a value. See
+// OpenWithVars.
+type templateVar struct {
+	// name is the name of the variable, like "UserID".
+	name string
+
+	// value is the value of the variable, converted to a driver.Value.
+	value driver.Value
+}
+
+// placeholder returns the text that replaces the variable's value in
+// recordings, like "{{.UserID}}".
+func (v templateVar) placeholder() string {
+	return "{{." + v.name + "}}"
+}
+
+// newTemplateVars converts the given variables to template variables, sorted
+// so that longer string values are replaced before shorter ones, since they
+// may contain them. It panics if a variable has an invalid name or a value that
+// cannot be a driver.Value.
+func newTemplateVars(vars map[string]interface{}) []templateVar {
+	templateVars := make([]templateVar, 0, len(vars))
+	for name, val := range vars {
+		v := templateVar{name: name}
+		if v.placeholder() != templateVarRegexp.FindString(v.placeholder()) {
+			panic(fmt.Errorf("template variable name %q is not a valid identifier", name))
+		}
+		var err error
+		v.value, err = driver.DefaultParameterConverter.ConvertValue(val)
+		if err != nil {
+			panic(fmt.Errorf("template variable %s: %v", name, err))
+		}
+		switch t := v.value.(type) {
+		case string:
+			if t == "" {
+				panic(fmt.Errorf("template variable %s cannot be empty", name))
+			}
+		case int64, float64, bool:
+		default:
+			panic(fmt.Errorf("template variable %s has unsupported type %T", name, val))
+		}
+		templateVars = append(templateVars, v)
+	}
+	sort.Slice(templateVars, func(i, j int) bool {
+		iLen, jLen := len(fmt.Sprint(templateVars[i].value)), len(fmt.Sprint(templateVars[j].value))
+		if iLen != jLen {
+			return iLen > jLen
+		}
+		return templateVars[i].name < templateVars[j].name
+	})
+	return templateVars
+}
+
+// templateArgs returns a copy of the given record arguments, in which the
+// values of the given variables are replaced by their placeholders. Values of
+// string variables are replaced wherever they occur within strings, such as
+// query text. Values of other variables are only replaced in rows, where they
+// must match a value exactly.
+func templateArgs(args recordArgs, vars []templateVar) recordArgs {
+	newArgs := make(recordArgs, len(args))
+	for i, arg := range args {
+		switch t := arg.(type) {
+		case string:
+			newArgs[i] = templateString(t, vars)
+		case []driver.Value:
+			vals := make([]driver.Value, len(t))
+			for j, val := range t {
+				vals[j] = templateValue(val, vars)
+			}
+			newArgs[i] = vals
+		default:
+			newArgs[i] = arg
+		}
+	}
+	return newArgs
+}
+
+// templateValue returns the placeholder of the variable whose value is equal to
+// the given value, or the value itself (with any string variables replaced) if
+// there is no such variable.
+func templateValue(val driver.Value, vars []templateVar) driver.Value {
+	switch t := val.(type) {
+	case string:
+		return templateString(t, vars)
+	case int64, float64, bool:
+		for _, v := range vars {
+			if v.value == val {
+				return v.placeholder()
+			}
+		}
+	}
+	return val
+}
+
+// templateString replaces the values of string variables in the given string
+// with their placeholders.
+func templateString(s string, vars []templateVar) string {
+	for _, v := range vars {
+		if str, ok := v.value.(string); ok {
+			s = strings.Replace(s, str, v.placeholder(), -1)
+		}
+	}
+	return s
+}
+
+// bindRecording returns a copy of the given recording, in which placeholders
+// are replaced by the values of the variables they name. Placeholders of
+// variables that are not bound are left unchanged.
+func bindRecording(rec recording, vars []templateVar) recording {
+	bound := make(recording, len(rec))
+	for i, r := range rec {
+		newArgs := make(recordArgs, len(r.Args))
+		for j, arg := range r.Args {
+			switch t := arg.(type) {
+			case string:
+				newArgs[j] = bindString(t, vars)
+			case []driver.Value:
+				vals := make([]driver.Value, len(t))
+				for k, val := range t {
+					vals[k] = bindValue(val, vars)
+				}
+				newArgs[j] = vals
+			default:
+				newArgs[j] = arg
+			}
+		}
+		bound[i] = &record{Typ: r.Typ, Args: newArgs}
+	}
+	return bound
+}
+
+// bindValue returns the value of the variable named by the given value if it
+// is a placeholder, or else the value itself, with any placeholders within it
+// replaced.
+func bindValue(val driver.Value, vars []templateVar) driver.Value {
+	s, ok := val.(string)
+	if !ok {
+		return val
+	}
+	for _, v := range vars {
+		if s == v.placeholder() {
+			return v.value
+		}
+	}
+	return bindString(s, vars)
+}
+
+// bindString replaces the placeholders within the given string with the values
+// of the variables they name.
+func bindString(s string, vars []templateVar) string {
+	if !strings.Contains(s, "{{.") {
+		return s
+	}
+	return templateVarRegexp.ReplaceAllStringFunc(s, func(placeholder string) string {
+		for _, v := range vars {
+			if placeholder == v.placeholder() {
+				return fmt.Sprint(v.value)
+			}
+		}
+		return placeholder
+	})
+}
@@ -0,0 +1,75 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package copyist
+
+import (
+	"database/sql/driver"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestTemplateVars tests that the values of template variables are replaced by
+// placeholders while recording, and that placeholders are replaced by the
+// values bound during playback.
+func TestTemplateVars(t *testing.T) {
+	*recordFlag = true
+	visitedRecording = true
+	defer func() { *recordFlag = false }()
+
+	source := &memorySource{}
+	s := newSession(source, "TestTemplateVars")
+	s.vars = newTemplateVars(map[string]interface{}{"UserID": 42, "Name": "alice"})
+	c := &proxyConn{driver: &proxyDriver{driverName: "fake"}, session: s}
+	s.AddRecord(c, &record{Typ: DriverOpen, Args: recordArgs{nil}})
+	s.AddRecord(c, &record{Typ: ConnQuery,
+		Args: recordArgs{"SELECT id FROM users WHERE name = 'alice'", nil}})
+	s.AddRecord(c, &record{Typ: RowsNext,
+		Args: recordArgs{[]driver.Value{int64(42), "alice@example.com", int64(7)}, nil}})
+	s.Close()
+	require.Contains(t, string(source.data), `"SELECT id FROM users WHERE name = '{{.Name}}'"`)
+	require.Contains(t, string(source.data), `[2:"{{.UserID}}",2:"{{.Name}}@example.com",4:7]`)
+
+	// Play back the recording with different values.
+	*recordFlag = false
+	s = newSession(source, "TestTemplateVars")
+	s.vars = newTemplateVars(map[string]interface{}{"UserID": 43, "Name": "bob"})
+	s.OnDriverOpen(c.driver)
+	c = &proxyConn{driver: c.driver, session: s}
+	_, err := s.VerifyRecord(c, DriverOpen)
+	require.NoError(t, err)
+	_, err = s.VerifyRecordWithStringArg(c, ConnQuery, "SELECT id FROM users WHERE name = 'bob'")
+	require.NoError(t, err)
+	rec, err := s.VerifyRecord(c, RowsNext)
+	require.NoError(t, err)
+	require.Equal(t, []driver.Value{int64(43), "bob@example.com", int64(7)}, rec.Args[0])
+}
+
+// TestNewTemplateVars tests validating template variables.
+func TestNewTemplateVars(t *testing.T) {
+	vars := newTemplateVars(map[string]interface{}{"A": "ab", "B": "abc", "C": 1})
+	require.Equal(t, []templateVar{{"B", "abc"}, {"A", "ab"}, {"C", int64(1)}}, vars)
+	require.Equal(t, "{{.B}} {{.A}}", templateString("abc ab", vars))
+
+	require.PanicsWithError(t, `template variable name "user-id" is not a valid identifier`, func() {
+		newTemplateVars(map[string]interface{}{"user-id": 1})
+	})
+	require.PanicsWithError(t, "template variable Name cannot be empty", func() {
+		newTemplateVars(map[string]interface{}{"Name": ""})
+	})
+	require.PanicsWithError(t, "template variable Data has unsupported type []uint8", func() {
+		newTemplateVars(map[string]interface{}{"Data": []byte("x")})
+	})
+}
@@ -0,0 +1,81 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package copyist
+
+import (
+	"database/sql/driver"
+	"time"
+)
+
+// timeTravel is set by SetTimeTravel.
+var timeTravel bool
+
+// SetTimeTravel determines whether the time values in recordings are shifted
+// during playback by the time that has passed since the recording was made.
+// This keeps tests that compare recorded times to the current time, such as by
+// checking that a row was "created within the last hour", passing as their
+// recordings age. Every time.Time value returned by a recorded call, including
+// the values of rows, is shifted. Times in recordings made before copyist
+// recorded their creation time are not shifted. It is off by default, since
+// it also shifts times that the test itself inserted, which changes them.
+func SetTimeTravel(enable bool) {
+	timeTravel = enable
+}
+
+// recordingAge returns the time that has passed since the recording was made,
+// according to its creation time metadata, or zero if it is not known.
+func recordingAge(metadata map[string]string) time.Duration {
+	created, err := time.Parse(time.RFC3339, metadata[createdMetadataKey])
+	if err != nil {
+		return 0
+	}
+	return time.Since(created)
+}
+
+// shiftTimes returns a copy of the given recording, in which every non-zero
+// time.Time value is shifted forward by the given delta.
+func shiftTimes(rec recording, delta time.Duration) recording {
+	shifted := make(recording, len(rec))
+	for i, r := range rec {
+		newArgs := make(recordArgs, len(r.Args))
+		for j, arg := range r.Args {
+			switch t := arg.(type) {
+			case time.Time:
+				newArgs[j] = shiftTime(t, delta)
+			case []driver.Value:
+				vals := make([]driver.Value, len(t))
+				for k, val := range t {
+					vals[k] = shiftTime(val, delta)
+				}
+				newArgs[j] = vals
+			default:
+				newArgs[j] = arg
+			}
+		}
+		shifted[i] = &record{Typ: r.Typ, Args: newArgs}
+	}
+	return shifted
+}
+
+// shiftTime shifts the given value forward by the given delta if it is a
+// non-zero time.Time, or else returns it unchanged. Zero times are left alone,
+// since they are usually placeholders (e.g. of volatile columns) rather than
+// real times.
+func shiftTime(val driver.Value, delta time.Duration) driver.Value {
+	if t, ok := val.(time.Time); ok && !t.IsZero() {
+		return t.Add(delta)
+	}
+	return val
+}
@@ -0,0 +1,76 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package copyist
+
+import (
+	"database/sql/driver"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestTimeTravel tests that recorded times are shifted by the age of the
+// recording during playback when SetTimeTravel is enabled.
+func TestTimeTravel(t *testing.T) {
+	*recordFlag = true
+	visitedRecording = true
+	defer func() { *recordFlag = false }()
+
+	// The row was created a minute before the recording was made, a day ago.
+	recorded := time.Now().UTC().Add(-24*time.Hour - time.Minute).Truncate(time.Second)
+	source := &memorySource{}
+	s := newSession(source, "TestTimeTravel")
+	c := &proxyConn{driver: &proxyDriver{driverName: "fake"}, session: s}
+	s.AddRecord(c, &record{Typ: DriverOpen, Args: recordArgs{nil}})
+	s.AddRecord(c, &record{Typ: RowsNext,
+		Args: recordArgs{[]driver.Value{recorded, time.Time{}, "x"}, nil}})
+	s.Close()
+
+	// Age the recording by a day.
+	file, err := ReadRecordingFile(source)
+	require.NoError(t, err)
+	metadata := file.Metadata("TestTimeTravel")
+	created, err := time.Parse(time.RFC3339, metadata[createdMetadataKey])
+	require.NoError(t, err)
+	metadata[createdMetadataKey] = created.Add(-24 * time.Hour).Format(time.RFC3339)
+	file.SetMetadata("TestTimeTravel", metadata)
+	require.NoError(t, file.Write())
+
+	playBack := func() []driver.Value {
+		*recordFlag = false
+		s := newSession(source, "TestTimeTravel")
+		s.OnDriverOpen(c.driver)
+		c := &proxyConn{driver: c.driver, session: s}
+		_, err := s.VerifyRecord(c, DriverOpen)
+		require.NoError(t, err)
+		rec, err := s.VerifyRecord(c, RowsNext)
+		require.NoError(t, err)
+		return rec.Args[0].([]driver.Value)
+	}
+
+	// Times are not shifted by default.
+	vals := playBack()
+	require.True(t, recorded.Equal(vals[0].(time.Time)))
+
+	SetTimeTravel(true)
+	defer SetTimeTravel(false)
+	vals = playBack()
+	shifted := vals[0].(time.Time)
+	require.True(t, shifted.After(time.Now().Add(-2*time.Minute)))
+	require.True(t, shifted.Before(time.Now()))
+	require.True(t, vals[1].(time.Time).IsZero())
+	require.Equal(t, "x", vals[2])
+}
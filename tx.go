@@ -21,37 +21,44 @@ type proxyTx struct {
 	// Tx is a transaction.
 	driver.Tx
 
+	// conn is the connection on which this transaction was started.
+	conn *proxyConn
+
 	tx driver.Tx
 }
 
 // Commit commits the transaction.
 func (t *proxyTx) Commit() error {
 	if IsRecording() {
+		defer t.conn.session.SerializeCall(t.conn)()
 		err := t.tx.Commit()
-		currentSession.AddRecord(&record{Typ: TxCommit, Args: recordArgs{err}})
-		return err
+		t.conn.session.AddRecord(t.conn,
+			&record{Typ: TxCommit, Args: recordArgs{err}})
+		return t.conn.markBad(err)
 	}
 
-	record, err := currentSession.VerifyRecord(TxCommit)
+	record, err := t.conn.session.VerifyRecord(t.conn, TxCommit)
 	if err != nil {
 		return err
 	}
 	err, _ = record.Args[0].(error)
-	return err
+	return t.conn.markBad(err)
 }
 
 // Rollback aborts the transaction.
 func (t *proxyTx) Rollback() error {
 	if IsRecording() {
+		defer t.conn.session.SerializeCall(t.conn)()
 		err := t.tx.Rollback()
-		currentSession.AddRecord(&record{Typ: TxRollback, Args: recordArgs{err}})
-		return err
+		t.conn.session.AddRecord(t.conn,
+			&record{Typ: TxRollback, Args: recordArgs{err}})
+		return t.conn.markBad(err)
 	}
 
-	record, err := currentSession.VerifyRecord(TxRollback)
+	record, err := t.conn.session.VerifyRecord(t.conn, TxRollback)
 	if err != nil {
 		return err
 	}
 	err, _ = record.Args[0].(error)
-	return err
+	return t.conn.markBad(err)
 }
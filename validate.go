@@ -0,0 +1,76 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package copyist
+
+import (
+	"io/fs"
+	"path/filepath"
+	"strings"
+)
+
+// ValidationError describes a problem found by ValidateDir in a recording file.
+type ValidationError struct {
+	// FileName is the path of the recording file that has the problem.
+	FileName string
+
+	// Err describes the problem.
+	Err error
+}
+
+// Error returns the problem, prefixed with the name of the file that has it.
+func (e *ValidationError) Error() string {
+	return e.FileName + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying problem.
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// ValidateDir parses every recording file in the given directory and its
+// subdirectories, and returns a *ValidationError for each problem that it finds
+// (see RecordingFile.Validate). This allows a project to guarantee, with a
+// single unit test, that its committed recordings can always be loaded:
+//
+//	func TestRecordings(t *testing.T) {
+//	  for _, err := range copyist.ValidateDir("testdata") {
+//	    t.Error(err)
+//	  }
+//	}
+func ValidateDir(dirName string) []error {
+	var errs []error
+	err := filepath.WalkDir(dirName, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(path, ".copyist") {
+			return nil
+		}
+
+		file, err := ReadRecordingFile(NewFileSource(path))
+		if err != nil {
+			errs = append(errs, &ValidationError{FileName: path, Err: err})
+			return nil
+		}
+		for _, err := range file.Validate() {
+			errs = append(errs, &ValidationError{FileName: path, Err: err})
+		}
+		return nil
+	})
+	if err != nil {
+		errs = append(errs, &ValidationError{FileName: dirName, Err: err})
+	}
+	return errs
+}
@@ -0,0 +1,65 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package copyist
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestValidateDir tests that ValidateDir reports the problems in every
+// recording file in a directory tree.
+func TestValidateDir(t *testing.T) {
+	dirName := t.TempDir()
+	write := func(name, data string) {
+		pathName := filepath.Join(dirName, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(pathName), 0777))
+		require.NoError(t, os.WriteFile(pathName, []byte(data), 0666))
+	}
+
+	write("good.copyist", `
+1=DriverOpen	1:nil
+
+"TestGood"=1
+`)
+	write("notes.txt", "not a recording file")
+	require.Empty(t, ValidateDir(dirName))
+
+	write("sub/bad.copyist", `
+1=DriverOpen	1:nil
+2=ConnQuery	2:"SELECT 1"	9:oops
+
+"TestBad"=1,2,3
+`)
+	errs := ValidateDir(dirName)
+	require.Len(t, errs, 2)
+	badName := filepath.Join(dirName, "sub", "bad.copyist")
+	for _, err := range errs {
+		var validationErr *ValidationError
+		require.True(t, errors.As(err, &validationErr))
+		require.Equal(t, badName, validationErr.FileName)
+	}
+	require.Contains(t, errs[0].Error(), badName+": record 2: ")
+	require.EqualError(t, errs[1],
+		badName+`: recording "TestBad": record with number 3 does not exist`)
+
+	errs = ValidateDir(filepath.Join(dirName, "missing"))
+	require.Len(t, errs, 1)
+	require.True(t, errors.Is(errs[0], os.ErrNotExist))
+}
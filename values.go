@@ -21,14 +21,11 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
+	"reflect"
 	"strconv"
 	"strings"
-	"text/scanner"
 	"time"
-
-	"github.com/jackc/pgconn"
-	"github.com/jackc/pgproto3/v2"
-	"github.com/lib/pq"
 )
 
 // valueType is an enumeration of all types that can be round-tripped to and
@@ -39,11 +36,15 @@ import (
 //   1. Add enumeration value below. Use an explicit numeric value so that its
 //      easier to look up a type by number. For a new driver, leave plenty of
 //      space between numeric runs so that previous drivers can add more types.
-//   2. Add a case to the formatValueWithType switch.
+//   2. Add a case to the appendValueWithType switch.
 //   3. Add a case to the parseValueWithType switch.
 //   4. Add a case to the deepCopyValue switch if the value's content might be
 //      mutated across calls to the driver.
 //
+// Types that are defined by driver packages are instead handled by a ValueCodec
+// that is registered by a copyist subpackage, so that the core copyist package
+// does not depend on any driver.
+//
 type valueType int
 
 const (
@@ -59,14 +60,118 @@ const (
 	stringSliceType valueType = 9
 	byteSliceType   valueType = 10
 	valueSliceType  valueType = 11
-
-	// Custom pq types.
+	sidecarRefType  valueType = 12
+	volatileType    valueType = 13
+	uint64Type      valueType = 14
+	int8Type        valueType = 15
+	int16Type       valueType = 16
+	int32Type       valueType = 17
+	uint8Type       valueType = 18
+	uint16Type      valueType = 19
+	uint32Type      valueType = 20
+	float32Type     valueType = 21
+	ipType          valueType = 22
+	ifaceSliceType  valueType = 23
+	typedSliceType  valueType = 24
+
+	// Results defined by the driver package.
+	rowsAffectedType valueType = 25
+	resultNoRowsType valueType = 26
+
+	// Custom pq types, handled by the copyistpq package.
 	pqErrorType valueType = 100
 
-	// Custom pgx types.
+	// Custom pgx types, handled by the copyistpgx package.
 	pgConnErrorType valueType = 200
+
+	// Custom go-mssqldb types, handled by the copyistmssql package.
+	mssqlErrorType valueType = 300
+
+	// minCustomType is the smallest value type that can be handled by a
+	// ValueCodec.
+	minCustomType valueType = 100
 )
 
+// ValueCodec converts values of a type that is defined by a driver package, such
+// as the errors that it returns, to and from strings, so that they are recorded
+// with all of their fields and are played back as the same type. The core
+// copyist package does not depend on any driver, so the copyist subpackages for
+// drivers register codecs when they are imported. See RegisterValueCodec.
+type ValueCodec struct {
+	// Format returns the given value as a string, and true, if it has the type
+	// that is handled by the codec. Otherwise, it returns false.
+	Format func(val interface{}) (string, bool)
+
+	// Parse returns the value that was formatted as the given string by Format.
+	Parse func(s string) (interface{}, error)
+}
+
+// valueCodec is a ValueCodec, along with the value type that identifies the
+// values it formats in recording files.
+type valueCodec struct {
+	typ valueType
+	ValueCodec
+}
+
+// valueCodecs are the codecs that have been registered by RegisterValueCodec.
+var valueCodecs []valueCodec
+
+// RegisterValueCodec registers a codec for a type that is defined by a driver
+// package. typ is the number that identifies values formatted by the codec in
+// recording files, and must be at least 100. These numbers are used by the
+// copyist subpackages:
+//
+//	100: lib/pq errors, by the copyistpq package
+//	200: pgx errors, by the copyistpgx package
+//	300: go-mssqldb errors, by the copyistmssql package
+//
+// RegisterValueCodec is typically called in an init() method. It panics if a
+// codec has already been registered for typ.
+func RegisterValueCodec(typ int, codec ValueCodec) {
+	if valueType(typ) < minCustomType {
+		panic(fmt.Errorf("value type %d is reserved by copyist", typ))
+	}
+	if findValueCodec(valueType(typ)) != nil {
+		panic(fmt.Errorf("RegisterValueCodec called twice for value type %d", typ))
+	}
+	valueCodecs = append(valueCodecs, valueCodec{typ: valueType(typ), ValueCodec: codec})
+}
+
+// findValueCodec returns the codec that was registered for the given value
+// type, or nil if there is none.
+func findValueCodec(typ valueType) *valueCodec {
+	for i := range valueCodecs {
+		if valueCodecs[i].typ == typ {
+			return &valueCodecs[i]
+		}
+	}
+	return nil
+}
+
+// codecPackages describes the types that are handled by the codecs of the
+// copyist subpackages. It is used to explain which package needs to be imported
+// when a value of one of these types is recorded or played back without its
+// codec. Types are identified by name, since the core copyist package does not
+// import the drivers that define them.
+var codecPackages = map[valueType]struct{ typeName, pkg string }{
+	pqErrorType:     {"*pq.Error", "github.com/cockroachdb/copyist/copyistpq"},
+	pgConnErrorType: {"*pgconn.PgError", "github.com/cockroachdb/copyist/copyistpgx"},
+	mssqlErrorType:  {"mssql.Error", "github.com/cockroachdb/copyist/copyistmssql"},
+}
+
+// checkCodecRegistered panics if the given value has a type that is handled by
+// the codec of a copyist subpackage, but that codec has not been registered,
+// so that the value cannot be recorded without losing information.
+func checkCodecRegistered(val interface{}) {
+	typeName := reflect.TypeOf(val).String()
+	for typ, info := range codecPackages {
+		if info.typeName == typeName && findValueCodec(typ) == nil {
+			panic(fmt.Errorf("cannot record a %s value without losing its fields; "+
+				"import the %s package", typeName, info.pkg))
+		}
+	}
+}
+
 // formatValueWithType converts the given value into a formatted string suitable
 // for inclusion in a copyist recording file. The format is as follows:
 //
@@ -87,133 +192,202 @@ const (
 // data types that do not (e.g. string) need to perform escaping in order to
 // ensure their formatted representation never contains disallowed characters.
 func formatValueWithType(val interface{}) string {
+	return string(appendValueWithType(nil, val))
+}
+
+// appendValueWithType is like formatValueWithType, except that it appends the
+// formatted value to the given byte slice and returns the extended slice. This
+// avoids allocating intermediate strings when formatting many values.
+func appendValueWithType(b []byte, val interface{}) []byte {
 	if val == nil {
-		return fmt.Sprintf("%d:nil", nilType)
+		return append(appendType(b, nilType), "nil"...)
+	}
+
+	// Types defined by driver packages, which are handled by codecs.
+	for i := range valueCodecs {
+		if s, ok := valueCodecs[i].Format(val); ok {
+			return strconv.AppendQuote(appendType(b, valueCodecs[i].typ), s)
+		}
+	}
+
+	// driver.ResultNoRows has an unexported type, so compare it directly.
+	if val == driver.ResultNoRows {
+		return append(appendType(b, resultNoRowsType), "ResultNoRows"...)
 	}
 
 	switch t := val.(type) {
-	// Custom pq types.
-	case *pq.Error:
-		return fmt.Sprintf("%d:%s", pqErrorType, formatPqError(t))
+	// References to sidecar files.
+	case sidecarRef:
+		return append(appendType(b, sidecarRefType), t...)
+
+	// Results defined by the driver package.
+	case driver.RowsAffected:
+		return strconv.AppendInt(appendType(b, rowsAffectedType), int64(t), 10)
 
-	// Custom pgx types.
-	case *pgconn.PgError:
-		return fmt.Sprintf("%d:%s", pgConnErrorType, formatPgConnError(t))
+	// Placeholders for the values of volatile columns.
+	case volatilePlaceholder:
+		return strconv.AppendInt(appendType(b, volatileType), int64(t), 10)
 
 	// Built-in Go types.
 	case string:
-		return fmt.Sprintf("%d:%s", stringType, strconv.Quote(t))
+		return strconv.AppendQuote(appendType(b, stringType), t)
 	case int:
-		return fmt.Sprintf("%d:%d", intType, val)
+		return strconv.AppendInt(appendType(b, intType), int64(t), 10)
 	case int64:
-		return fmt.Sprintf("%d:%d", int64Type, val)
+		return strconv.AppendInt(appendType(b, int64Type), t, 10)
+	case uint64:
+		return strconv.AppendUint(appendType(b, uint64Type), t, 10)
+	case int8:
+		return strconv.AppendInt(appendType(b, int8Type), int64(t), 10)
+	case int16:
+		return strconv.AppendInt(appendType(b, int16Type), int64(t), 10)
+	case int32:
+		return strconv.AppendInt(appendType(b, int32Type), int64(t), 10)
+	case uint8:
+		return strconv.AppendUint(appendType(b, uint8Type), uint64(t), 10)
+	case uint16:
+		return strconv.AppendUint(appendType(b, uint16Type), uint64(t), 10)
+	case uint32:
+		return strconv.AppendUint(appendType(b, uint32Type), uint64(t), 10)
+	case float32:
+		return strconv.AppendFloat(appendType(b, float32Type), float64(t), 'g', -1, 32)
 	case float64:
-		return fmt.Sprintf("%d:%g", float64Type, t)
+		return strconv.AppendFloat(appendType(b, float64Type), t, 'g', -1, 64)
 	case bool:
-		return fmt.Sprintf("%d:%v", boolType, t)
+		return strconv.AppendBool(appendType(b, boolType), t)
 	case error:
-		return fmt.Sprintf("%d:%s", errorType, strconv.Quote(t.Error()))
+		checkCodecRegistered(t)
+
+		// The `sql` package retries calls that fail with driver.ErrBadConn, so
+		// record it in a way that playback can return the same error object.
+		if errors.Is(t, driver.ErrBadConn) {
+			t = driver.ErrBadConn
+		}
+		return strconv.AppendQuote(appendType(b, errorType), scrubDSN(t.Error()))
 	case time.Time:
 		// time.Format normalizes the +00:00 UTC timezone into "Z". This causes
 		// the recorded output to differ from the "real" driver output. Use a
 		// format that's round-trippable by parseValueWithType.
-		s := t.Format(time.RFC3339Nano)
-		if strings.HasSuffix(s, "Z") && t.Location() != time.UTC {
-			s = s[:len(s)-1] + "+00:00"
+		b = t.AppendFormat(appendType(b, timeType), time.RFC3339Nano)
+		if b[len(b)-1] == 'Z' && t.Location() != time.UTC {
+			b = append(b[:len(b)-1], "+00:00"...)
 		}
-		return fmt.Sprintf("%d:%s", timeType, s)
+		return b
 	case []string:
-		var buf bytes.Buffer
-		buf.WriteByte('[')
+		b = append(appendType(b, stringSliceType), '[')
 		for i, s := range t {
 			if i != 0 {
-				buf.WriteByte(',')
+				b = append(b, ',')
 			}
-			buf.WriteString(strconv.Quote(s))
+			b = strconv.AppendQuote(b, s)
 		}
-		buf.WriteByte(']')
-		return fmt.Sprintf("%d:%s", stringSliceType, buf.String())
+		return append(b, ']')
 	case []byte:
-		s := base64.RawStdEncoding.EncodeToString(t)
-		return fmt.Sprintf("%d:%s", byteSliceType, s)
+		b = appendType(b, byteSliceType)
+		n := len(b)
+		b = append(b, make([]byte, base64.RawStdEncoding.EncodedLen(len(t)))...)
+		base64.RawStdEncoding.Encode(b[n:], t)
+		return b
 	case []driver.Value:
-		var buf bytes.Buffer
-		buf.WriteByte('[')
+		b = append(appendType(b, valueSliceType), '[')
 		for i, v := range t {
 			if i != 0 {
-				buf.WriteByte(',')
+				b = append(b, ',')
 			}
-			buf.WriteString(formatValueWithType(v))
+			b = appendValueWithType(b, v)
 		}
-		buf.WriteByte(']')
-		return fmt.Sprintf("%d:%s", valueSliceType, buf.String())
+		return append(b, ']')
+
+	// Types returned by drivers that do not convert values to the types that
+	// driver.Value allows, such as ClickHouse's driver.
+	case net.IP:
+		// Keep the 16-byte form of IPv4 addresses, which String drops.
+		if len(t) == net.IPv6len && t.To4() != nil {
+			b = append(appendType(b, ipType), "::ffff:"...)
+			return append(b, t.To4().String()...)
+		}
+		return append(appendType(b, ipType), t.String()...)
+	case []interface{}:
+		b = append(appendType(b, ifaceSliceType), '[')
+		for i, v := range t {
+			if i != 0 {
+				b = append(b, ',')
+			}
+			b = appendValueWithType(b, v)
+		}
+		return append(b, ']')
 	default:
+		// Slices of other types, like []int32, are formatted as the type of
+		// their elements, followed by their untyped elements:
+		//
+		//   24:17[1,2,3]
+		//
+		if rv := reflect.ValueOf(val); rv.Kind() == reflect.Slice {
+			if elemTyp, ok := sliceElemValueTypes[rv.Type().Elem()]; ok {
+				b = strconv.AppendInt(appendType(b, typedSliceType), int64(elemTyp), 10)
+				b = append(b, '[')
+				for i := 0; i < rv.Len(); i++ {
+					if i != 0 {
+						b = append(b, ',')
+					}
+					n := len(b)
+					b = appendValueWithType(b, rv.Index(i).Interface())
+					prefix := bytes.IndexByte(b[n:], ':') + 1
+					b = append(b[:n], b[n+prefix:]...)
+				}
+				return append(b, ']')
+			}
+		}
+		checkCodecRegistered(t)
 		panic(fmt.Errorf("unsupported type: %T", t))
 	}
 }
 
-// formatPqError returns a lib/pq error as a string that is suitable for
-// inclusion in a copyist recording file. It does this by using the pgproto3
-// library to format the error using the Postgres wire protocol, and then
-// returns it as a quoted string.
-func formatPqError(pqErr *pq.Error) string {
-	resp := pgproto3.ErrorResponse{
-		Severity:         pqErr.Severity,
-		Code:             string(pqErr.Code),
-		Message:          pqErr.Message,
-		Detail:           pqErr.Detail,
-		Hint:             pqErr.Hint,
-		Position:         stringToInt32OrZero(pqErr.Position),
-		InternalPosition: stringToInt32OrZero(pqErr.InternalPosition),
-		InternalQuery:    pqErr.InternalQuery,
-		Where:            pqErr.Where,
-		SchemaName:       pqErr.Schema,
-		TableName:        pqErr.Table,
-		ColumnName:       pqErr.Column,
-		DataTypeName:     pqErr.DataTypeName,
-		ConstraintName:   pqErr.Constraint,
-		File:             pqErr.File,
-		Line:             stringToInt32OrZero(pqErr.Line),
-		Routine:          pqErr.Routine,
+// sliceElemTypes maps the value types that can be elements of typedSliceType
+// slices to their Go types, and sliceElemValueTypes is the reverse mapping.
+// Slices of uint8 are not included, since they are formatted as byteSliceType.
+var (
+	sliceElemTypes = map[valueType]reflect.Type{
+		stringType:  reflect.TypeOf(""),
+		intType:     reflect.TypeOf(int(0)),
+		int64Type:   reflect.TypeOf(int64(0)),
+		float64Type: reflect.TypeOf(float64(0)),
+		boolType:    reflect.TypeOf(false),
+		timeType:    reflect.TypeOf(time.Time{}),
+		uint64Type:  reflect.TypeOf(uint64(0)),
+		int8Type:    reflect.TypeOf(int8(0)),
+		int16Type:   reflect.TypeOf(int16(0)),
+		int32Type:   reflect.TypeOf(int32(0)),
+		uint16Type:  reflect.TypeOf(uint16(0)),
+		uint32Type:  reflect.TypeOf(uint32(0)),
+		float32Type: reflect.TypeOf(float32(0)),
+		ipType:      reflect.TypeOf(net.IP(nil)),
 	}
+	sliceElemValueTypes = make(map[reflect.Type]valueType)
+)
 
-	// Encode using the pgproto3 library and skip the Error header bytes.
-	encoded := resp.Encode(nil)
-	encoded = encoded[5:]
-
-	return strconv.Quote(string(encoded))
+func init() {
+	for typ, goTyp := range sliceElemTypes {
+		sliceElemValueTypes[goTyp] = typ
+	}
 }
 
-// formatPgConnError returns a lib/pq error as a string that is suitable for
-// inclusion in a copyist recording file. It does this by using the pgproto3
-// library to format the error using the Postgres wire protocol, and then
-// returns it as a quoted string.
-func formatPgConnError(pgxError *pgconn.PgError) string {
-	resp := pgproto3.ErrorResponse{
-		Severity:         pgxError.Severity,
-		Code:             pgxError.Code,
-		Message:          pgxError.Message,
-		Detail:           pgxError.Detail,
-		Hint:             pgxError.Hint,
-		Position:         pgxError.Position,
-		InternalPosition: pgxError.InternalPosition,
-		InternalQuery:    pgxError.InternalQuery,
-		Where:            pgxError.Where,
-		SchemaName:       pgxError.SchemaName,
-		TableName:        pgxError.TableName,
-		ColumnName:       pgxError.ColumnName,
-		DataTypeName:     pgxError.DataTypeName,
-		ConstraintName:   pgxError.ConstraintName,
-		File:             pgxError.File,
-		Line:             pgxError.Line,
-		Routine:          pgxError.Routine,
+// isRecordableSlice returns true if the given slice can be formatted in the
+// recording file format, either as one of the slice types that copyist knows
+// about, or as a typedSliceType slice.
+func isRecordableSlice(val interface{}) bool {
+	switch val.(type) {
+	case []string, []byte, []driver.Value, []interface{}:
+		return true
 	}
+	_, ok := sliceElemValueTypes[reflect.TypeOf(val).Elem()]
+	return ok
+}
 
-	// Encode using the pgproto3 library and skip the Error header bytes.
-	encoded := resp.Encode(nil)
-	encoded = encoded[5:]
-
-	return strconv.Quote(string(encoded))
+// appendType appends the "<dataType>:" prefix of a formatted value to the
+// given byte slice and returns the extended slice.
+func appendType(b []byte, typ valueType) []byte {
+	return append(strconv.AppendInt(b, int64(typ), 10), ':')
 }
 
 // parseValueWithType parses a value from the copyist recording file, in the
@@ -234,14 +408,46 @@ func parseValueWithType(valWithTyp string) (interface{}, error) {
 	typ := valueType(num)
 	val := valWithTyp[index+1:]
 
+	// Types defined by driver packages, which can only be played back by their
+	// codecs.
+	if typ >= minCustomType {
+		s, err := strconv.Unquote(val)
+		if err != nil {
+			return nil, err
+		}
+		codec := findValueCodec(typ)
+		if codec == nil {
+			if info, ok := codecPackages[typ]; ok {
+				return nil, fmt.Errorf("cannot play back a %s value; import the %s package",
+					info.typeName, info.pkg)
+			}
+			return nil, fmt.Errorf("unsupported type: %v", typ)
+		}
+		return codec.Parse(s)
+	}
+
 	switch typ {
-	// Custom pq types.
-	case pqErrorType:
-		return parsePqError(val)
+	// References to sidecar files.
+	case sidecarRefType:
+		return sidecarRef(val), nil
+
+	// Results defined by the driver package.
+	case rowsAffectedType:
+		n, err := strconv.ParseInt(val, 10, 64)
+		return driver.RowsAffected(n), err
+	case resultNoRowsType:
+		if val != "ResultNoRows" {
+			return nil, errors.New("expected ResultNoRows")
+		}
+		return driver.ResultNoRows, nil
 
-	// Custom pgx types.
-	case pgConnErrorType:
-		return parsePgConnError(val)
+	// Placeholders for the values of volatile columns.
+	case volatileType:
+		num, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, err
+		}
+		return volatilePlaceholder(num), nil
 
 	// Built-in Go types.
 	case nilType:
@@ -255,6 +461,29 @@ func parseValueWithType(valWithTyp string) (interface{}, error) {
 		return strconv.Atoi(val)
 	case int64Type:
 		return strconv.ParseInt(val, 10, 64)
+	case uint64Type:
+		return strconv.ParseUint(val, 10, 64)
+	case int8Type:
+		n, err := strconv.ParseInt(val, 10, 8)
+		return int8(n), err
+	case int16Type:
+		n, err := strconv.ParseInt(val, 10, 16)
+		return int16(n), err
+	case int32Type:
+		n, err := strconv.ParseInt(val, 10, 32)
+		return int32(n), err
+	case uint8Type:
+		n, err := strconv.ParseUint(val, 10, 8)
+		return uint8(n), err
+	case uint16Type:
+		n, err := strconv.ParseUint(val, 10, 16)
+		return uint16(n), err
+	case uint32Type:
+		n, err := strconv.ParseUint(val, 10, 32)
+		return uint32(n), err
+	case float32Type:
+		f, err := strconv.ParseFloat(val, 32)
+		return float32(f), err
 	case float64Type:
 		return strconv.ParseFloat(val, 64)
 	case boolType:
@@ -272,6 +501,9 @@ func parseValueWithType(valWithTyp string) (interface{}, error) {
 		if s == driver.ErrSkip.Error() {
 			return driver.ErrSkip, nil
 		}
+		if s == driver.ErrBadConn.Error() {
+			return driver.ErrBadConn, nil
+		}
 		if s == io.EOF.Error() {
 			// Return reference to singleton object so that callers can compare
 			// by reference.
@@ -307,63 +539,59 @@ func parseValueWithType(valWithTyp string) (interface{}, error) {
 			}
 		}
 		return valueSlice, nil
+	case ipType:
+		ip := net.ParseIP(val)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address: %s", val)
+		}
+		if !strings.Contains(val, ":") {
+			ip = ip.To4()
+		}
+		return ip, nil
+	case ifaceSliceType:
+		slice, err := parseSlice(val)
+		if err != nil {
+			return nil, err
+		}
+		ifaceSlice := make([]interface{}, len(slice))
+		for i := range slice {
+			ifaceSlice[i], err = parseValueWithType(slice[i])
+			if err != nil {
+				return nil, err
+			}
+		}
+		return ifaceSlice, nil
+	case typedSliceType:
+		index := strings.IndexByte(val, '[')
+		if index == -1 {
+			return nil, errors.New("expected bracket")
+		}
+		elemTyp, err := strconv.Atoi(val[:index])
+		if err != nil {
+			return nil, err
+		}
+		goTyp, ok := sliceElemTypes[valueType(elemTyp)]
+		if !ok {
+			return nil, fmt.Errorf("unsupported slice element type: %d", elemTyp)
+		}
+		slice, err := parseSlice(val[index:])
+		if err != nil {
+			return nil, err
+		}
+		typedSlice := reflect.MakeSlice(reflect.SliceOf(goTyp), len(slice), len(slice))
+		for i := range slice {
+			elem, err := parseValueWithType(val[:index] + ":" + slice[i])
+			if err != nil {
+				return nil, err
+			}
+			typedSlice.Index(i).Set(reflect.ValueOf(elem))
+		}
+		return typedSlice.Interface(), nil
 	default:
-		panic(fmt.Errorf("unsupported type: %v", typ))
+		return nil, fmt.Errorf("unsupported type: %v", typ)
 	}
 }
 
-// parsePqError parses a string value that was formatted by formatPqError. This
-// is expected to be Postgres wire protocol bytes that encode a Postgres error,
-// as a quoted string.
-func parsePqError(val string) (interface{}, error) {
-	unquoted, err := strconv.Unquote(val)
-	if err != nil {
-		return nil, err
-	}
-
-	var resp pgproto3.ErrorResponse
-	if err = resp.Decode([]byte(unquoted)); err != nil {
-		return nil, err
-	}
-
-	return &pq.Error{
-		Severity:         resp.Severity,
-		Code:             pq.ErrorCode(resp.Code),
-		Message:          resp.Message,
-		Detail:           resp.Detail,
-		Hint:             resp.Hint,
-		Position:         strconv.Itoa(int(resp.Position)),
-		InternalPosition: strconv.Itoa(int(resp.InternalPosition)),
-		InternalQuery:    resp.InternalQuery,
-		Where:            resp.Where,
-		Schema:           resp.SchemaName,
-		Table:            resp.TableName,
-		Column:           resp.ColumnName,
-		DataTypeName:     resp.DataTypeName,
-		Constraint:       resp.ConstraintName,
-		File:             resp.File,
-		Line:             strconv.Itoa(int(resp.Line)),
-		Routine:          resp.Routine,
-	}, nil
-}
-
-// parsePgConnError parses a string value that was formatted by
-// formatPgConnError. This is expected to be Postgres wire protocol bytes that
-// encode a Postgres error, as a quoted string.
-func parsePgConnError(val string) (interface{}, error) {
-	unquoted, err := strconv.Unquote(val)
-	if err != nil {
-		return nil, err
-	}
-
-	var resp pgproto3.ErrorResponse
-	if err = resp.Decode([]byte(unquoted)); err != nil {
-		return nil, err
-	}
-
-	return pgconn.ErrorResponseToPgError(&resp), nil
-}
-
 // deepCopyValue makes a deep copy of the given value. It is used to ensure that
 // recorded values are immutable, and will never be updated by the application
 // or driver. One case where this can happen is with driver.Rows.Next, where the
@@ -380,7 +608,22 @@ func deepCopyValue(val interface{}) interface{} {
 			newValues[i] = deepCopyValue(t[i])
 		}
 		return newValues
+	case net.IP:
+		return append(net.IP{}, t...)
+	case []interface{}:
+		newValues := make([]interface{}, len(t))
+		for i := range t {
+			newValues[i] = deepCopyValue(t[i])
+		}
+		return newValues
 	default:
+		// Copy slices of other types, like []int32.
+		if rv := reflect.ValueOf(val); rv.Kind() == reflect.Slice && !rv.IsNil() {
+			newSlice := reflect.MakeSlice(rv.Type(), rv.Len(), rv.Len())
+			reflect.Copy(newSlice, rv)
+			return newSlice.Interface()
+		}
+
 		// Most types don't need special handling.
 		return t
 	}
@@ -399,14 +642,16 @@ func splitString(s, sep string) []string {
 // parseSlice is a simple parser that handles nested slice declarations of the
 // form:
 //
-//   ["foo", ["bar", 55], "baz"]
+//	["foo", ["bar", 55], "baz"]
 //
 // It returns a slice of strings representing the "top-level" strings in the
 // slice, equivalent to this:
 //
-//   []string{"foo", `["bar", 55]`, "baz"}
+//	[]string{"foo", `["bar", 55]`, "baz"}
 //
-// Tokenization of the input string is done according to Golang rules.
+// Commas and brackets inside of double-quoted Go string literals are ignored.
+// The returned strings are slices of the input string, so that parsing does not
+// need to copy them.
 func parseSlice(s string) ([]string, error) {
 	// Trim leading and trailing brackets.
 	if len(s) < 2 || s[0] != '[' || s[len(s)-1] != ']' {
@@ -418,22 +663,26 @@ func parseSlice(s string) ([]string, error) {
 		return []string{}, nil
 	}
 
-	// Tokenize comma-delimited list.
-	var buf bytes.Buffer
-	var tokens []string
-	var scan scanner.Scanner
-	scan.Init(strings.NewReader(s))
-	scan.Mode = scanner.ScanStrings
+	// Count the commas in the list in order to pre-size the tokens slice. This
+	// may over-count if there are nested slices or strings containing commas.
+	tokens := make([]string, 0, strings.Count(s, ",")+1)
 
+	// Tokenize comma-delimited list.
 	nesting := 0
-	for {
-		tok := scan.Scan()
-		switch tok {
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			// Skip past the string literal.
+			n := quotedPrefixLen(s[i:])
+			if n == -1 {
+				return nil, fmt.Errorf("unterminated string: %s", s)
+			}
+			i += n - 1
 		case ',':
 			if nesting == 0 {
-				tokens = append(tokens, buf.String())
-				buf.Reset()
-				continue
+				tokens = append(tokens, strings.TrimSpace(s[start:i]))
+				start = i + 1
 			}
 		case '[':
 			nesting++
@@ -442,24 +691,10 @@ func parseSlice(s string) ([]string, error) {
 				return nil, fmt.Errorf("mismatched brackets: %s", s)
 			}
 			nesting--
-		case scanner.EOF:
-			if nesting != 0 {
-				return nil, fmt.Errorf("mismatched brackets: %s", s)
-			}
-			tokens = append(tokens, buf.String())
-			return tokens, nil
 		}
-
-		buf.WriteString(scan.TokenText())
 	}
-}
-
-// stringToInt32OrZero converts the given string into an int32 value, or returns
-// zero if it cannot (typically when string is empty).
-func stringToInt32OrZero(val string) int32 {
-	pos, err := strconv.ParseInt(val, 10, 32)
-	if err != nil {
-		return 0
+	if nesting != 0 {
+		return nil, fmt.Errorf("mismatched brackets: %s", s)
 	}
-	return int32(pos)
+	return append(tokens, strings.TrimSpace(s[start:])), nil
 }
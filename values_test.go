@@ -17,12 +17,14 @@ package copyist
 import (
 	"database/sql/driver"
 	"errors"
-	"github.com/jackc/pgconn"
 	"io"
 	"math"
+	"net"
+	"strconv"
 	"testing"
 	"time"
 
+	"github.com/jackc/pgconn"
 	"github.com/lib/pq"
 	"github.com/stretchr/testify/require"
 )
@@ -36,11 +38,13 @@ func TestRoundtrip(t *testing.T) {
 		{"format string value", "foo\n\t ][,"},
 		{"format int value", int(-100)},
 		{"format int64 value", math.MaxInt64},
+		{"format uint64 value", uint64(math.MaxUint64)},
 		{"format float64 value", math.MaxFloat64},
 		{"format Inf float64 value", math.Inf(+1)},
 		{"format bool value", bool(true)},
 		{"format error value", errors.New("some error\nmore stuff")},
 		{"format EOF error value", io.EOF},
+		{"format ErrBadConn error value", driver.ErrBadConn},
 		{"format UTC time value", parseTime("2000-01-01T1:00:00Z")},
 		{"format +0:00 time value", parseTime("2000-01-01T1:00:00.123456+00:00")},
 		{"format timezone time value", parseTime("2000-01-01T1:00:00.123456789-07:00")},
@@ -49,50 +53,31 @@ func TestRoundtrip(t *testing.T) {
 		{"format driver.Value value", []driver.Value{0, []string{"foo", "bar"}, io.EOF}},
 		{"format nested values", []driver.Value{[]driver.Value{0, nil}, "foo"}},
 		{"format empty values", []driver.Value{"", []driver.Value{}, []string{}}},
+		{"format volatile placeholder", []driver.Value{volatilePlaceholder(timeType), "foo"}},
 		{"format slices with interesting tokens", []driver.Value{
 			",][*// //* \"string\" range }{ `a string\n`",
 			parseTime("2020-08-06T15:20:25.831116+00:00"),
 			[]driver.Value{8, parseTime("2020-08-06T15:20:25.831116+00:00"), -8},
 			"\n\t",
 		}},
-		{"format pq.Error value", &pq.Error{
-			Severity:         pq.Efatal,
-			Code:             pq.ErrorCode("53200"),
-			Message:          "out of memory",
-			Detail:           "some detail",
-			Hint:             "some hint",
-			Position:         "123",
-			InternalPosition: "456",
-			InternalQuery:    "some query",
-			Where:            "somewhere",
-			Schema:           "some schema",
-			Table:            "some table",
-			Column:           "some column",
-			DataTypeName:     "some datatype",
-			Constraint:       "some constraint",
-			File:             "some file",
-			Line:             "789",
-			Routine:          "some routine",
-		}},
-		{"format pgconn.PgError value", &pgconn.PgError{
-			Severity:         pq.Efatal,
-			Code:             "53200",
-			Message:          "out of memory",
-			Detail:           "some detail",
-			Hint:             "some hint",
-			Position:         123,
-			InternalPosition: 456,
-			InternalQuery:    "some query",
-			Where:            "somewhere",
-			SchemaName:       "some schema",
-			TableName:        "some table",
-			ColumnName:       "some column",
-			DataTypeName:     "some datatype",
-			ConstraintName:   "some constraint",
-			File:             "some file",
-			Line:             789,
-			Routine:          "some routine",
-		}},
+		{"format int8 value", int8(math.MinInt8)},
+		{"format int16 value", int16(math.MinInt16)},
+		{"format int32 value", int32(math.MinInt32)},
+		{"format uint8 value", uint8(math.MaxUint8)},
+		{"format uint16 value", uint16(math.MaxUint16)},
+		{"format uint32 value", uint32(math.MaxUint32)},
+		{"format float32 value", float32(1.1)},
+		{"format IPv4 value", net.IPv4(10, 0, 0, 1).To4()},
+		{"format 16-byte IPv4 value", net.IPv4(10, 0, 0, 1)},
+		{"format IPv6 value", net.ParseIP("2001:db8::1")},
+		{"format tuple value", []interface{}{uint8(1), "a,]", []interface{}{}, nil}},
+		{"format int32 array value", []int32{1, -2, 3}},
+		{"format uint64 array value", []uint64{math.MaxUint64}},
+		{"format empty float32 array value", []float32{}},
+		{"format IP array value", []net.IP{net.ParseIP("::1"), net.IPv4(1, 2, 3, 4).To4()}},
+		{"format time array value", []time.Time{parseTime("2000-01-01T1:00:00Z")}},
+		{"format driver.RowsAffected value", driver.RowsAffected(3)},
+		{"format driver.ResultNoRows value", driver.ResultNoRows},
 	}
 
 	for _, cas := range cases {
@@ -105,6 +90,21 @@ func TestRoundtrip(t *testing.T) {
 	}
 }
 
+func TestParseSlice(t *testing.T) {
+	tokens, err := parseSlice(`["foo", [ "bar",55 ] ,"[,\"]"]`)
+	require.NoError(t, err)
+	require.Equal(t, []string{`"foo"`, `[ "bar",55 ]`, `"[,\"]"`}, tokens)
+
+	_, err = parseSlice(`[1,"foo]`)
+	require.EqualError(t, err, `unterminated string: 1,"foo`)
+	_, err = parseSlice(`[1,[2]`)
+	require.EqualError(t, err, `mismatched brackets: 1,[2`)
+	_, err = parseSlice(`[1],[2]`)
+	require.EqualError(t, err, `mismatched brackets: 1],[2`)
+	_, err = parseSlice(`1`)
+	require.EqualError(t, err, `invalid slice format: 1`)
+}
+
 func parseTime(s string) time.Time {
 	t, err := time.Parse(time.RFC3339Nano, s)
 	if err != nil {
@@ -112,3 +112,98 @@ func parseTime(s string) time.Time {
 	}
 	return t
 }
+
+// benchmarkRow is a typical row of values returned by RowsNext.
+var benchmarkRow = []driver.Value{
+	int64(12345),
+	"some customer name",
+	3.14159,
+	true,
+	parseTime("2020-08-06T15:20:25.831116+00:00"),
+	[]byte("some bytes"),
+	nil,
+}
+
+func BenchmarkFormatValueWithType(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		formatValueWithType(benchmarkRow)
+	}
+}
+
+func BenchmarkParseValueWithType(b *testing.B) {
+	s := formatValueWithType(benchmarkRow)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := parseValueWithType(s); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// fakeDriverError is a fake error type defined by a driver.
+type fakeDriverError struct {
+	Number int
+}
+
+func (e fakeDriverError) Error() string {
+	return "fake: error " + strconv.Itoa(e.Number)
+}
+
+// TestValueCodec tests recording and playing back values using a codec that is
+// registered by RegisterValueCodec.
+func TestValueCodec(t *testing.T) {
+	// Recorded values cannot be played back without their codec.
+	_, err := parseValueWithType(`1000:"208"`)
+	require.EqualError(t, err, "unsupported type: 1000")
+
+	RegisterValueCodec(1000, ValueCodec{
+		Format: func(val interface{}) (string, bool) {
+			fakeErr, ok := val.(fakeDriverError)
+			if !ok {
+				return "", false
+			}
+			return strconv.Itoa(fakeErr.Number), true
+		},
+		Parse: func(s string) (interface{}, error) {
+			num, err := strconv.Atoi(s)
+			if err != nil {
+				return nil, err
+			}
+			return fakeDriverError{Number: num}, nil
+		},
+	})
+	defer func() { valueCodecs = nil }()
+
+	s := formatValueWithType(fakeDriverError{Number: 208})
+	require.Equal(t, `1000:"208"`, s)
+	val, err := parseValueWithType(s)
+	require.NoError(t, err)
+	require.Equal(t, fakeDriverError{Number: 208}, val)
+
+	// Other values are not formatted by the codec.
+	require.Equal(t, `7:"some error"`, formatValueWithType(errors.New("some error")))
+
+	// Built-in value types and registered value types cannot be reused.
+	require.Panics(t, func() { RegisterValueCodec(int(errorType), ValueCodec{}) })
+	require.Panics(t, func() { RegisterValueCodec(1000, ValueCodec{}) })
+}
+
+// TestDriverErrorWithoutCodec tests that errors of the drivers that have copyist
+// subpackages cannot be recorded or played back unless the subpackage has been
+// imported. The copyistpq package tests that they can be once it is.
+func TestDriverErrorWithoutCodec(t *testing.T) {
+	require.PanicsWithError(t, "cannot record a *pq.Error value without losing its fields; "+
+		"import the github.com/cockroachdb/copyist/copyistpq package", func() {
+		formatValueWithType(&pq.Error{Code: "40001", Message: "restart transaction"})
+	})
+	require.PanicsWithError(t, "cannot record a *pgconn.PgError value without losing its "+
+		"fields; import the github.com/cockroachdb/copyist/copyistpgx package", func() {
+		formatValueWithType(&pgconn.PgError{Code: "40001", Message: "restart transaction"})
+	})
+
+	_, err := parseValueWithType(`100:"SERROR\x00C40001\x00Mrestart transaction\x00\x00"`)
+	require.EqualError(t, err, "cannot play back a *pq.Error value; "+
+		"import the github.com/cockroachdb/copyist/copyistpq package")
+}
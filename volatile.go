@@ -0,0 +1,80 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package copyist
+
+import (
+	"database/sql/driver"
+	"time"
+)
+
+// volatilePlaceholder replaces the value of a volatile column in a recording.
+// It records the type of the value, but not the value itself, so that
+// recordings do not change each time they are regenerated. See
+// SetVolatileColumns.
+type volatilePlaceholder valueType
+
+// volatileIndexes returns the indexes of the given columns that are volatile,
+// or nil if none are.
+func volatileIndexes(cols []string) []int {
+	var indexes []int
+	for i, col := range cols {
+		if volatileColumns[col] {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes
+}
+
+// stampVolatile returns a placeholder for the given value of a volatile
+// column, which records only the type of the value.
+func stampVolatile(val driver.Value) volatilePlaceholder {
+	switch val.(type) {
+	case string:
+		return volatilePlaceholder(stringType)
+	case int64:
+		return volatilePlaceholder(int64Type)
+	case float64:
+		return volatilePlaceholder(float64Type)
+	case bool:
+		return volatilePlaceholder(boolType)
+	case time.Time:
+		return volatilePlaceholder(timeType)
+	case []byte:
+		return volatilePlaceholder(byteSliceType)
+	default:
+		return volatilePlaceholder(nilType)
+	}
+}
+
+// Value returns the value that is played back in place of the volatile value,
+// which is the zero value of its type.
+func (p volatilePlaceholder) Value() driver.Value {
+	switch valueType(p) {
+	case stringType:
+		return ""
+	case int64Type:
+		return int64(0)
+	case float64Type:
+		return float64(0)
+	case boolType:
+		return false
+	case timeType:
+		return time.Time{}
+	case byteSliceType:
+		return []byte{}
+	default:
+		return nil
+	}
+}
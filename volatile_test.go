@@ -0,0 +1,82 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package copyist
+
+import (
+	"database/sql/driver"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRows is a driver.Rows that returns a fixed set of rows.
+type fakeRows struct {
+	cols []string
+	rows [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.cols }
+func (r *fakeRows) Close() error      { return nil }
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+// TestVolatileColumns tests that the values of volatile columns are returned
+// as-is when recording, but are stored as placeholders that play back as zero
+// values.
+func TestVolatileColumns(t *testing.T) {
+	SetVolatileColumns("now", "session_id")
+	defer SetVolatileColumns()
+
+	now := time.Now()
+	s := newSession(&memorySource{}, "TestVolatileColumns")
+	c := &proxyConn{driver: &proxyDriver{driverName: "fake"}, session: s}
+
+	// Record the rows.
+	*recordFlag = true
+	visitedRecording = true
+	defer func() { *recordFlag = false }()
+
+	rows := &proxyRows{conn: c, rows: &fakeRows{
+		cols: []string{"id", "now", "session_id"},
+		rows: [][]driver.Value{{int64(1), now, "abc"}},
+	}}
+	dest := make([]driver.Value, 3)
+	require.NoError(t, rows.Next(dest))
+	require.Equal(t, []driver.Value{int64(1), now, "abc"}, dest)
+	require.Equal(t, io.EOF, rows.Next(dest))
+
+	require.Len(t, s.recording, 2)
+	vals := s.recording[0].Args[0].([]driver.Value)
+	require.Equal(t, "11:[4:1,13:8,13:2]", formatValueWithType(vals))
+
+	// Play back the rows.
+	*recordFlag = false
+	parsed, err := parseValueWithType("11:[4:1,13:8,13:2]")
+	require.NoError(t, err)
+	s.recording = recording{{Typ: RowsNext, Args: recordArgs{parsed, nil}}}
+	s.streams = map[streamKey]*recordStream{{}: {records: s.recording}}
+
+	rows = &proxyRows{conn: c}
+	require.NoError(t, rows.Next(dest))
+	require.Equal(t, []driver.Value{int64(1), time.Time{}, ""}, dest)
+}